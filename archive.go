@@ -0,0 +1,106 @@
+package spicy
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+)
+
+// archiveSuffixes are the extensions of the archives a RAW include may name
+// a member of, as in "assets.zip:level1.bin".
+var archiveSuffixes = []string{".zip", ".tar", ".tar.gz", ".tgz"}
+
+// splitArchiveMember splits include into the archive and the member it
+// names, if it names one. A file that exists under the whole name is always
+// taken as itself, so that paths which happen to contain a colon still work.
+func splitArchiveMember(include string) (archive string, member string, ok bool) {
+	if _, err := os.Stat(include); err == nil {
+		return "", "", false
+	}
+	for i := 0; i < len(include); i++ {
+		if include[i] != ':' {
+			continue
+		}
+		for _, suffix := range archiveSuffixes {
+			if strings.HasSuffix(include[:i], suffix) && i+1 < len(include) {
+				return include[:i], include[i+1:], true
+			}
+		}
+	}
+	return "", "", false
+}
+
+// includeFile returns the file on disk that include is read from: the
+// archive, for a member of one, or else include itself.
+func includeFile(include string) string {
+	if archive, _, ok := splitArchiveMember(include); ok {
+		return archive
+	}
+	return include
+}
+
+// readArchiveMember returns the data of member in the zip or tar archive at
+// archive. Tar archives may be gzip-compressed.
+func readArchiveMember(archive string, member string) ([]byte, error) {
+	member = path.Clean(member)
+	if strings.HasSuffix(archive, ".zip") {
+		zr, err := zip.OpenReader(archive)
+		if err != nil {
+			return nil, err
+		}
+		defer zr.Close()
+		for _, f := range zr.File {
+			if path.Clean(f.Name) != member {
+				continue
+			}
+			r, err := f.Open()
+			if err != nil {
+				return nil, fmt.Errorf("could not read %s from %s: %v", member, archive, err)
+			}
+			defer r.Close()
+			b, err := ioutil.ReadAll(r)
+			if err != nil {
+				return nil, fmt.Errorf("could not read %s from %s: %v", member, archive, err)
+			}
+			return b, nil
+		}
+		return nil, fmt.Errorf("%s has no member %s", archive, member)
+	}
+	f, err := os.Open(archive)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var r io.Reader = f
+	if !strings.HasSuffix(archive, ".tar") {
+		zr, err := gzip.NewReader(f)
+		if err != nil {
+			return nil, fmt.Errorf("could not decompress %s: %v", archive, err)
+		}
+		r = zr
+	}
+	tr := tar.NewReader(r)
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			return nil, fmt.Errorf("%s has no member %s", archive, member)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("could not read %s: %v", archive, err)
+		}
+		if path.Clean(h.Name) != member || h.Typeflag == tar.TypeDir {
+			continue
+		}
+		b, err := ioutil.ReadAll(tr)
+		if err != nil {
+			return nil, fmt.Errorf("could not read %s from %s: %v", member, archive, err)
+		}
+		return b, nil
+	}
+}
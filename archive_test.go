@@ -0,0 +1,86 @@
+package spicy
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"debug/elf"
+	"io/ioutil"
+	"os/exec"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRawIncludeFromZipMember(t *testing.T) {
+	assert := assert.New(t)
+	if _, err := exec.LookPath("ld"); err != nil {
+		t.Skip("ld not available")
+	}
+	chdirTemp(t)
+	level := bytes.Repeat([]byte{5, 6, 7, 8}, 32)
+	archive := &bytes.Buffer{}
+	zw := zip.NewWriter(archive)
+	for name, data := range map[string][]byte{"level0.bin": {1, 2, 3}, "level1.bin": level} {
+		w, err := zw.Create(name)
+		assert.Nil(err)
+		_, err = w.Write(data)
+		assert.Nil(err)
+	}
+	assert.Nil(zw.Close())
+	assert.Nil(ioutil.WriteFile("assets.zip", archive.Bytes(), 0644))
+	spec, err := ParseSpec(strings.NewReader(`
+beginseg
+  name "level"
+  flags RAW
+  include "assets.zip:level1.bin"
+endseg
+beginwave
+  name "game"
+  include "level"
+endwave
+`))
+	assert.Nil(err)
+	seg := spec.Waves[0].RawSegments[0]
+	size, err := rawSegmentSize(seg, true)
+	assert.Nil(err)
+	assert.Equal(uint64(len(level)), size)
+	assert.Equal([]string{"assets.zip"}, spec.InputFiles()[len(spec.Sources):])
+
+	_, err = PrepareRawSegments(spec.Waves[0], NewRunner("ld"), BuildOptions{})
+	assert.Nil(err)
+	f, err := elf.Open(rawWrapperName("assets.zip:level1.bin", 0))
+	assert.Nil(err)
+	defer f.Close()
+	b, err := f.Section(".data").Data()
+	assert.Nil(err)
+	assert.Equal(level, b)
+
+	_, err = readRawInclude("assets.zip:level2.bin")
+	assert.EqualError(err, "assets.zip has no member level2.bin")
+}
+
+func TestReadGzippedTarMember(t *testing.T) {
+	assert := assert.New(t)
+	chdirTemp(t)
+	archive := &bytes.Buffer{}
+	zw := gzip.NewWriter(archive)
+	tw := tar.NewWriter(zw)
+	assert.Nil(tw.WriteHeader(&tar.Header{Name: "maps/", Typeflag: tar.TypeDir, Mode: 0755}))
+	assert.Nil(tw.WriteHeader(&tar.Header{Name: "maps/town.bin", Mode: 0644, Size: 4}))
+	_, err := tw.Write([]byte{9, 8, 7, 6})
+	assert.Nil(err)
+	assert.Nil(tw.Close())
+	assert.Nil(zw.Close())
+	assert.Nil(ioutil.WriteFile("assets.tar.gz", archive.Bytes(), 0644))
+
+	b, err := readRawInclude("assets.tar.gz:maps/town.bin")
+	assert.Nil(err)
+	assert.Equal([]byte{9, 8, 7, 6}, b)
+	size, err := rawIncludeSize("assets.tar.gz:maps/town.bin")
+	assert.Nil(err)
+	assert.Equal(uint64(4), size)
+	assert.False(strings.Contains(strings.TrimPrefix(rawWrapperName("assets.tar.gz:maps/town.bin", 0), "assets.tar.gz"), "/"))
+}
@@ -0,0 +1,177 @@
+package spicy
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// maxResponseDepth bounds how deeply response files may include each other.
+const maxResponseDepth = 16
+
+// ExpandResponseFiles replaces each @file argument with the arguments read
+// from file, following gcc's convention: arguments are separated by
+// whitespace, may be quoted with single or double quotes, and a backslash
+// escapes the next character. Response files may themselves contain @file
+// arguments. An @file that cannot be read is left as it is.
+func ExpandResponseFiles(args []string) ([]string, error) {
+	return expandResponseFiles(args, 0)
+}
+
+func expandResponseFiles(args []string, depth int) ([]string, error) {
+	var out []string
+	for _, arg := range args {
+		if !strings.HasPrefix(arg, "@") || len(arg) == 1 {
+			out = append(out, arg)
+			continue
+		}
+		b, err := ioutil.ReadFile(arg[1:])
+		if err != nil {
+			out = append(out, arg)
+			continue
+		}
+		if depth >= maxResponseDepth {
+			return nil, fmt.Errorf("response file %s nested too deeply", arg[1:])
+		}
+		fileArgs, err := splitResponseFile(string(b))
+		if err != nil {
+			return nil, fmt.Errorf("response file %s: %v", arg[1:], err)
+		}
+		expanded, err := expandResponseFiles(fileArgs, depth+1)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, expanded...)
+	}
+	return out, nil
+}
+
+func splitResponseFile(s string) ([]string, error) {
+	var args []string
+	var cur strings.Builder
+	inArg := false
+	var quote rune
+	escaped := false
+	for _, c := range s {
+		switch {
+		case escaped:
+			cur.WriteRune(c)
+			escaped = false
+		case c == '\\':
+			escaped = true
+			inArg = true
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			} else {
+				cur.WriteRune(c)
+			}
+		case c == '\'' || c == '"':
+			quote = c
+			inArg = true
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == '\v' || c == '\f':
+			if inArg {
+				args = append(args, cur.String())
+				cur.Reset()
+				inArg = false
+			}
+		default:
+			cur.WriteRune(c)
+			inArg = true
+		}
+	}
+	if quote != 0 {
+		return nil, fmt.Errorf("unterminated %c quote", quote)
+	}
+	if inArg {
+		args = append(args, cur.String())
+	}
+	return args, nil
+}
+
+// ConfigFileName is the config file loaded from the directory of the spec
+// when no other is given.
+const ConfigFileName = ".spicy.json"
+
+// ConfigFlag is a flag a config file sets, with each of the values it gives
+// it, as they would be written on the command line.
+type ConfigFlag struct {
+	Name   string
+	Values []string
+}
+
+// ReadConfig reads the config file at path, a JSON object mapping long flag
+// names to their value, or to an array of values for flags that may be
+// repeated:
+//
+//	{"toolchain-prefix": "mips64-elf-", "include": ["include"], "strict": true}
+//
+// The flags are returned sorted by name. Which names are flags, and what
+// values they take, is left to the command line that applies them.
+func ReadConfig(path string) ([]ConfigFlag, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("could not read config: %v", err)
+	}
+	var config map[string]interface{}
+	if err := json.Unmarshal(b, &config); err != nil {
+		return nil, NewUsageError("config %s is not a JSON object: %v", path, err)
+	}
+	var names []string
+	for name := range config {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var flags []ConfigFlag
+	for _, name := range names {
+		values, ok := config[name].([]interface{})
+		if !ok {
+			values = []interface{}{config[name]}
+		}
+		f := ConfigFlag{Name: name}
+		for _, v := range values {
+			switch v := v.(type) {
+			case string:
+				f.Values = append(f.Values, v)
+			case bool:
+				f.Values = append(f.Values, strconv.FormatBool(v))
+			case float64:
+				f.Values = append(f.Values, strconv.FormatFloat(v, 'f', -1, 64))
+			default:
+				return nil, NewUsageError("config %s gives flag %s a value that is not a string, number or boolean", path, name)
+			}
+		}
+		flags = append(flags, f)
+	}
+	return flags, nil
+}
+
+// sizeSuffixes maps the unit suffixes ParseNumber accepts to their sizes.
+var sizeSuffixes = map[byte]int64{
+	'K': 1 << 10,
+	'M': 1 << 20,
+	'G': 1 << 30,
+}
+
+// ParseNumber parses a byte count given in decimal, in hex with a 0x prefix
+// or in octal with a 0 prefix, optionally followed by K, M or G for KiB, MiB
+// or GiB.
+func ParseNumber(s string) (int64, error) {
+	digits, unit := s, int64(1)
+	if n := len(s); n > 0 {
+		if size, ok := sizeSuffixes[strings.ToUpper(s[n-1:])[0]]; ok {
+			digits, unit = s[:n-1], size
+		}
+	}
+	v, err := strconv.ParseInt(digits, 0, 64)
+	if err != nil || v < 0 {
+		return 0, fmt.Errorf("invalid number %q", s)
+	}
+	if v > (1<<63-1)/unit {
+		return 0, fmt.Errorf("number %q is too large", s)
+	}
+	return v * unit, nil
+}
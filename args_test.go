@@ -0,0 +1,89 @@
+package spicy
+
+import (
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	flag "github.com/spf13/pflag"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestResponseFileIncludesReachCpp(t *testing.T) {
+	assert := assert.New(t)
+	dir := t.TempDir()
+	nested := filepath.Join(dir, "nested.rsp")
+	assert.Nil(ioutil.WriteFile(nested, []byte("-DNESTED\n"), 0644))
+	rsp := filepath.Join(dir, "flags.rsp")
+	assert.Nil(ioutil.WriteFile(rsp, []byte("-I include/one\n-I 'include/with space' @"+nested+"\n"), 0644))
+
+	args, err := ExpandResponseFiles([]string{"@" + rsp, "-Ulegacy", "spec", "@missing.rsp"})
+	assert.Nil(err)
+	assert.Equal([]string{"-I", "include/one", "-I", "include/with space", "-DNESTED", "-Ulegacy", "spec", "@missing.rsp"}, args)
+
+	flags := flag.NewFlagSet("spicy", flag.ContinueOnError)
+	includes := flags.StringArrayP("include", "I", nil, "")
+	defines := flags.StringArrayP("define", "D", nil, "")
+	undefines := flags.StringArrayP("undefine", "U", nil, "")
+	assert.Nil(flags.Parse(args))
+	cpp := &echoRunner{}
+	_, err = PreprocessSpec(strings.NewReader(""), cpp, *includes, *defines, *undefines)
+	assert.Nil(err)
+	assert.Contains(cpp.calls[0], "-Iinclude/one")
+	assert.Contains(cpp.calls[0], "-Iinclude/with space")
+	assert.Contains(cpp.calls[0], "-DNESTED")
+	assert.Contains(cpp.calls[0], "-Ulegacy")
+
+	_, err = splitResponseFile("-I 'unterminated")
+	assert.NotNil(err)
+}
+
+func TestParseNumber(t *testing.T) {
+	assert := assert.New(t)
+	for s, want := range map[string]int64{
+		"4096":     4096,
+		"0x800000": 0x800000,
+		"8M":       8 << 20,
+		"16k":      16 << 10,
+		"0x10K":    0x10 << 10,
+		"1G":       1 << 30,
+	} {
+		v, err := ParseNumber(s)
+		assert.Nil(err, s)
+		assert.Equal(want, v, s)
+	}
+	for _, s := range []string{"", "M", "8MB", "-1", "lots", "9999999999G"} {
+		_, err := ParseNumber(s)
+		assert.NotNil(err, s)
+	}
+}
+
+func TestReadConfigGivesEachFlagsValues(t *testing.T) {
+	assert := assert.New(t)
+	config := filepath.Join(t.TempDir(), ConfigFileName)
+	assert.Nil(ioutil.WriteFile(config, []byte(`{
+		"toolchain-prefix": "mips64-elf-",
+		"include": ["include/one", "include/two"],
+		"strict": true,
+		"jobs": 4
+	}`), 0644))
+
+	flags, err := ReadConfig(config)
+	assert.Nil(err)
+	assert.Equal([]ConfigFlag{
+		{Name: "include", Values: []string{"include/one", "include/two"}},
+		{Name: "jobs", Values: []string{"4"}},
+		{Name: "strict", Values: []string{"true"}},
+		{Name: "toolchain-prefix", Values: []string{"mips64-elf-"}},
+	}, flags)
+
+	var usage *UsageError
+	assert.Nil(ioutil.WriteFile(config, []byte(`{"jobs": {"n": 4}}`), 0644))
+	_, err = ReadConfig(config)
+	assert.True(errors.As(err, &usage))
+	assert.Nil(ioutil.WriteFile(config, []byte(`["jobs"]`), 0644))
+	_, err = ReadConfig(config)
+	assert.True(errors.As(err, &usage))
+}
@@ -0,0 +1,1178 @@
+package spicy
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"debug/elf"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/trhodeos/n64rom"
+)
+
+// SegmentTransform rewrites the binary data of the named segment before it is
+// written to the ROM. The returned data must be the same length as the input.
+type SegmentTransform func(name string, data []byte) ([]byte, error)
+
+// BuildOptions controls optional behaviour when turning a parsed spec into a ROM.
+type BuildOptions struct {
+	// AutoSplit splits RAW segments larger than their maxsize into numbered
+	// sub-segments. Without it they are left whole, as maxsize has never
+	// been enforced for RAW segments.
+	AutoSplit bool
+	// DedupeRaw stores byte-identical RAW segments only once, pointing the
+	// later segments' symbols at the first copy.
+	DedupeRaw bool
+	// DisableOverlapCheck skips checking that the direct-mapped segments of
+	// each wave do not overlap in physical memory.
+	DisableOverlapCheck bool
+	// AllowHeaderOverlap permits segments to be placed over the header and
+	// bootcode before n64rom.CodeStart.
+	AllowHeaderOverlap bool
+	// CodeAlign, if set, is the alignment every object segment's VRAM start
+	// must have.
+	CodeAlign uint64
+	// Cache, if set, holds toolchain outputs reused across builds.
+	Cache *Cache
+	// Strict turns warnings about suspicious inputs into errors.
+	Strict bool
+	// FillByte is used for any gaps in the ROM image.
+	FillByte byte
+	// Header, if set, is a HeaderSize-byte header copied over the ROM's own.
+	// The checksum words are still computed when the ROM is saved.
+	Header []byte
+	// Bootcode, if set, is written after the header, up to
+	// n64rom.CodeStart. Segments may not be placed over it, even with
+	// AllowHeaderOverlap.
+	Bootcode []byte
+	// BaseRom, if set, is an existing image the waves are written over
+	// instead of starting from a blank ROM.
+	BaseRom io.Reader
+	// SegmentTransform, if set, is applied to every segment of each wave
+	// after it has been binarized.
+	SegmentTransform SegmentTransform
+	// Version, if set, is written NUL-terminated into the ROM at
+	// VersionOffset, or after the last wave if VersionOffset is zero.
+	Version       string
+	VersionOffset int64
+	// RomSize, if set, is the size in bytes the ROM is padded up to.
+	RomSize int64
+	// SaveEntryAsm, if set, is where the generated entry stub source, in
+	// whichever EntryLang, is written before it is assembled. Each wave
+	// overwrites the last.
+	SaveEntryAsm string
+	// SegmentCrc embeds a table of each segment's CRC32 after the last
+	// segment, for runtime code to check its DMA transfers against.
+	SegmentCrc bool
+	// RoundPow2 pads the ROM up to the next power-of-two size in Mbit, after
+	// any padding to RomSize.
+	RoundPow2 bool
+	// AllowEmpty lets a spec that places no data in the ROM build anyway.
+	AllowEmpty bool
+	// PiConfig, if set, replaces the header's first word, which holds the PI
+	// BSD domain 1 timings.
+	PiConfig *uint32
+	// KeepDebug keeps debug sections in the linked objects, which are
+	// otherwise stripped.
+	KeepDebug bool
+	// Sysroot, if set, is passed to cpp and ld as --sysroot, for cross
+	// toolchains installed outside their default prefix.
+	Sysroot string
+	// OrphanHandling, if set, is passed to ld as --orphan-handling, and
+	// sections the linker script does not place are left to it rather than
+	// discarded. It must be one of OrphanHandlingModes.
+	OrphanHandling string
+	// AllowExternalEntry skips checking that the header's initial PC is
+	// within the entry stub or a loaded code segment.
+	AllowExternalEntry bool
+	// MaxRomSize, if set, is the largest ROM in bytes a build may produce,
+	// so that a misplaced segment fails the build rather than filling the
+	// disk. It is checked before each wave is binarized.
+	MaxRomSize int64
+	// FooterMagic, if set, is written at the very end of the ROM, after any
+	// padding, followed by a CRC32 of every byte before it. A ROM padded to
+	// a size keeps that size, with the footer in its last bytes.
+	FooterMagic []byte
+	// EntryLang is the language the entry stub is generated in, one of
+	// EntryLangs; assembly if it is not set. A C stub is compiled with
+	// EntryCc, which must be gcc, and is larger than ComputeLayout allows
+	// for the assembly one.
+	EntryLang string
+	EntryCc   Runner
+	// StrictSizes requires the includes of every RAW segment that declares
+	// a maxsize to add up to exactly that size, for asset pipelines whose
+	// sizes are fixed.
+	StrictSizes bool
+	// Jobs, if above one, is how many waves are built at once. Waves are
+	// still written to the ROM in the order the spec declares them, so the
+	// image does not depend on which finishes first. Preparing RAW segments,
+	// the entry stub and the link still run one wave at a time, as they
+	// write files of fixed names to the working directory; only the checks
+	// and binarizing after the link run in parallel.
+	Jobs int
+	// Defsyms are symbol definitions passed to ld with --defsym, each given
+	// as NAME=value, where value may be any expression ld accepts.
+	Defsyms []string
+	// NoGaps fails the build if any bytes are left between segments in the
+	// ROM, or between the entry stub and the first of them, by alignment,
+	// romoffset or otherwise.
+	NoGaps bool
+	// TempFiles, if set, tracks the temporary files the build writes while
+	// they exist, so that an interrupt handler can remove them. Whether or
+	// not it is set, the build removes its temporary files when it returns.
+	TempFiles *Cleanup
+	// Tracer, if set, records every stage, command and file of the build.
+	Tracer *Tracer
+}
+
+// traceRunners wraps ld, as and objcopy to record each command they run in
+// t. It must come before trackTempFiles, whose middleware has to stay the
+// outermost.
+func traceRunners(t *Tracer, ld, as, objcopy *Runner) {
+	*ld = WithTrace(t, "ld")(*ld)
+	*as = WithTrace(t, "as")(*as)
+	*objcopy = WithTrace(t, "objcopy")(*objcopy)
+}
+
+// trackTempFiles gives opts a TempFiles list if it has none, and wraps each
+// of runners to track the temporary files written for it there. It returns
+// a function removing them all, for the build to call when it returns.
+func trackTempFiles(opts *BuildOptions, runners ...*Runner) func() {
+	if opts.TempFiles == nil {
+		opts.TempFiles = &Cleanup{}
+	}
+	for _, r := range runners {
+		*r = WithTempFiles(opts.TempFiles)(*r)
+	}
+	return opts.TempFiles.Remove
+}
+
+// ErrEmptyRom is returned when a build would write no segment data to the
+// ROM, unless BuildOptions.AllowEmpty is set.
+var ErrEmptyRom = errors.New("no loadable data produced; resulting ROM would be empty")
+
+// checkLoadable returns ErrEmptyRom if none of waves has a segment that
+// takes up space in the ROM. Segments that turn out to be empty are caught
+// by checkNotEmpty once the ROM is built.
+func checkLoadable(waves []*Wave, opts BuildOptions) error {
+	if opts.AllowEmpty {
+		return nil
+	}
+	for _, w := range waves {
+		if len(w.RawSegments) > 0 {
+			return nil
+		}
+		for _, seg := range w.ObjectSegments {
+			if !seg.Flags.NoLoad {
+				return nil
+			}
+		}
+	}
+	return ErrEmptyRom
+}
+
+// SegmentTableEntry describes one piece of segment data placed in the ROM.
+type SegmentTableEntry struct {
+	// Name of the segment as it appears in the generated linker symbols.
+	Name string
+	// Source is the name of the spec segment the data came from.
+	Source string
+	// Offset of this piece's data within the source segment.
+	Offset uint64
+	Size   uint64
+	// AliasOf names an earlier entry whose identical data this entry shares.
+	AliasOf string
+}
+
+type SegmentTable []SegmentTableEntry
+
+// WaveSegmentTable is the segment table of a wave's RAW segments.
+type WaveSegmentTable struct {
+	Wave  string
+	Table SegmentTable
+}
+
+// Lookup returns the entry with the given name, or nil if there is none.
+func (t SegmentTable) Lookup(name string) *SegmentTableEntry {
+	for i := range t {
+		if t[i].Name == name {
+			return &t[i]
+		}
+	}
+	return nil
+}
+
+// rawSegmentSize returns the total size of seg's includes. Empty includes
+// usually mean an asset failed to build, so they are warned about, or
+// rejected under strict.
+func rawSegmentSize(seg *Segment, strict bool) (uint64, error) {
+	var size uint64
+	for _, include := range seg.Includes {
+		includeSize, err := rawIncludeSize(include)
+		if err != nil {
+			return 0, fmt.Errorf("could not read include %s of segment %s: %v", include, seg.Name, err)
+		}
+		if includeSize == 0 {
+			if strict {
+				return 0, fmt.Errorf("include %s of segment %s is empty", include, seg.Name)
+			}
+			log.Warnf("Include %s of segment \"%s\" is empty.", include, seg.Name)
+		}
+		size += includeSize
+	}
+	return size, nil
+}
+
+// CheckRawSizes returns an error listing every RAW segment of waves that
+// declares a maxsize its includes do not add up to exactly. Segments
+// without a maxsize are not checked.
+func CheckRawSizes(waves []*Wave) error {
+	var offenders []string
+	checked := map[string]bool{}
+	for _, w := range waves {
+		for _, seg := range w.RawSegments {
+			if seg.MaxSize == 0 || checked[seg.Name] {
+				continue
+			}
+			checked[seg.Name] = true
+			size, err := rawSegmentSize(seg, false)
+			if err != nil {
+				return err
+			}
+			switch {
+			case size > seg.MaxSize:
+				offenders = append(offenders, fmt.Sprintf("segment %s (%s) is 0x%x bytes, 0x%x more than its size of 0x%x", seg.Name, strings.Join(seg.Includes, ", "), size, size-seg.MaxSize, seg.MaxSize))
+			case size < seg.MaxSize:
+				offenders = append(offenders, fmt.Sprintf("segment %s (%s) is 0x%x bytes, 0x%x less than its size of 0x%x", seg.Name, strings.Join(seg.Includes, ", "), size, seg.MaxSize-size, seg.MaxSize))
+			}
+		}
+	}
+	if len(offenders) == 0 {
+		return nil
+	}
+	return fmt.Errorf("%d RAW segments are not the size they declare:\n  %s", len(offenders), strings.Join(offenders, "\n  "))
+}
+
+// checkRawSizes runs CheckRawSizes on waves if opts.StrictSizes is set.
+func checkRawSizes(waves []*Wave, opts BuildOptions) error {
+	if !opts.StrictSizes {
+		return nil
+	}
+	if err := CheckRawSizes(waves); err != nil {
+		return &StageError{Stage: "raw", Err: err}
+	}
+	return nil
+}
+
+// gzipMagic starts every gzip stream.
+var gzipMagic = []byte{0x1f, 0x8b}
+
+// isGzipped reports whether the RAW include named include, whose data
+// starts with head, is gzip-compressed: its name must end in .gz and its
+// data start with gzipMagic, so that a blob which happens to begin with the
+// magic bytes is still included as it is.
+func isGzipped(include string, head []byte) bool {
+	return strings.HasSuffix(include, ".gz") && bytes.HasPrefix(head, gzipMagic)
+}
+
+// readRawInclude returns the data of a RAW include, which may be a member
+// of a zip or tar archive. Gzip-compressed data, as isGzipped recognises
+// it, is decompressed, so that large blobs can be stored compressed.
+func readRawInclude(include string) ([]byte, error) {
+	var b []byte
+	var err error
+	if archive, member, ok := splitArchiveMember(include); ok {
+		b, err = readArchiveMember(archive, member)
+	} else {
+		b, err = ioutil.ReadFile(include)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if !isGzipped(include, b) {
+		return b, nil
+	}
+	zr, err := gzip.NewReader(bytes.NewReader(b))
+	if err != nil {
+		return nil, fmt.Errorf("could not decompress %s: %v", include, err)
+	}
+	data, err := ioutil.ReadAll(zr)
+	if err != nil {
+		return nil, fmt.Errorf("could not decompress %s: %v", include, err)
+	}
+	return data, nil
+}
+
+// rawIncludeSize returns the size of a RAW include's data, after any
+// decompression. A compressed file is decompressed and counted as it is
+// read, rather than held in memory.
+func rawIncludeSize(include string) (uint64, error) {
+	if _, _, ok := splitArchiveMember(include); ok {
+		b, err := readRawInclude(include)
+		if err != nil {
+			return 0, err
+		}
+		return uint64(len(b)), nil
+	}
+	f, err := os.Open(include)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return 0, err
+	}
+	magic := make([]byte, len(gzipMagic))
+	n, _ := io.ReadFull(f, magic)
+	if !isGzipped(include, magic[:n]) {
+		return uint64(info.Size()), nil
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return 0, err
+	}
+	zr, err := gzip.NewReader(f)
+	if err != nil {
+		return 0, fmt.Errorf("could not decompress %s: %v", include, err)
+	}
+	size, err := io.Copy(ioutil.Discard, zr)
+	if err != nil {
+		return 0, fmt.Errorf("could not decompress %s: %v", include, err)
+	}
+	return uint64(size), nil
+}
+
+func readRawSegment(seg *Segment) ([]byte, error) {
+	var data []byte
+	for _, include := range seg.Includes {
+		b, err := readRawInclude(include)
+		if err != nil {
+			return nil, err
+		}
+		data = append(data, b...)
+	}
+	return data, nil
+}
+
+// splitRawSegment breaks seg's data into pieces of at most seg.MaxSize bytes,
+// each written to its own temporary include file, which is tracked in temps.
+func splitRawSegment(seg *Segment, temps *Cleanup, tracer *Tracer) ([]*Segment, SegmentTable, error) {
+	data, err := readRawSegment(seg)
+	if err != nil {
+		return nil, nil, err
+	}
+	var pieces []*Segment
+	var table SegmentTable
+	count := int((uint64(len(data)) + seg.MaxSize - 1) / seg.MaxSize)
+	for offset := uint64(0); offset < uint64(len(data)); offset += seg.MaxSize {
+		end := offset + seg.MaxSize
+		if end > uint64(len(data)) {
+			end = uint64(len(data))
+		}
+		path := TempFileName(".bin")
+		err := ioutil.WriteFile(path, data[offset:end], 0644)
+		temps.Add(path)
+		if err != nil {
+			return nil, nil, err
+		}
+		tracer.File(path)
+		piece := *seg
+		piece.Name = fmt.Sprintf("%s_%d", seg.Name, len(pieces))
+		piece.Includes = []string{path}
+		piece.Split = &SegmentSplit{Source: seg, Index: len(pieces), Count: count}
+		pieces = append(pieces, &piece)
+		table = append(table, SegmentTableEntry{Name: piece.Name, Source: seg.Name, Offset: offset, Size: end - offset})
+	}
+	log.Infof("Split segment \"%s\" into %d pieces.", seg.Name, len(pieces))
+	return pieces, table, nil
+}
+
+// dedupeRawSegments marks each RAW segment whose data is identical to an
+// earlier one of w as an alias of it, in both the wave and the table. Pieces of
+// split segments are kept, as the symbols of the segment they were split
+// from assume they follow one another.
+func dedupeRawSegments(w *Wave, table SegmentTable) error {
+	firstByHash := map[[sha256.Size]byte]string{}
+	for _, seg := range w.RawSegments {
+		if seg.Split != nil {
+			continue
+		}
+		data, err := readRawSegment(seg)
+		if err != nil {
+			return err
+		}
+		hash := sha256.Sum256(data)
+		first, ok := firstByHash[hash]
+		if !ok {
+			firstByHash[hash] = seg.Name
+			continue
+		}
+		log.Infof("Segment \"%s\" is identical to \"%s\"; storing it once.", seg.Name, first)
+		w.rawAliases[seg.Name] = first
+		if entry := table.Lookup(seg.Name); entry != nil {
+			entry.AliasOf = first
+		}
+	}
+	return nil
+}
+
+// PrepareRawSegments splits each RAW segment larger than its maxsize if
+// requested, and wraps every include as a linkable object.
+func PrepareRawSegments(w *Wave, ld Runner, opts BuildOptions) (SegmentTable, error) {
+	var segments []*Segment
+	var table SegmentTable
+	for _, seg := range w.RawSegments {
+		size, err := rawSegmentSize(seg, opts.Strict)
+		if err != nil {
+			return nil, err
+		}
+		if seg.MaxSize == 0 || size <= seg.MaxSize {
+			segments = append(segments, seg)
+			table = append(table, SegmentTableEntry{Name: seg.Name, Source: seg.Name, Size: size})
+			continue
+		}
+		if !opts.AutoSplit {
+			log.Warnf("Segment %s is 0x%x bytes, exceeding its maxsize of 0x%x; use --auto-split to split it.", seg.Name, size, seg.MaxSize)
+			segments = append(segments, seg)
+			table = append(table, SegmentTableEntry{Name: seg.Name, Source: seg.Name, Size: size})
+			continue
+		}
+		pieces, pieceTable, err := splitRawSegment(seg, opts.TempFiles, opts.Tracer)
+		if err != nil {
+			return nil, err
+		}
+		segments = append(segments, pieces...)
+		table = append(table, pieceTable...)
+	}
+	w.RawSegments = segments
+
+	w.rawAliases = map[string]string{}
+	if opts.DedupeRaw {
+		if err := dedupeRawSegments(w, table); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, seg := range w.RawSegments {
+		if w.aliasOf(seg.Name) != "" {
+			continue
+		}
+		for _, include := range seg.Includes {
+			if err := wrapRawInclude(include, seg.IncludeAlign[include], ld, opts); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return table, nil
+}
+
+// rawWrapperName returns the name of the object wrapping include with the
+// given alignment. It is suffixed with a hash of include's absolute path and
+// the alignment, so that the same file included differently, or by two
+// paths that look alike, never shares a wrapper. The wrapper of an archive
+// member sits beside the archive.
+func rawWrapperName(include string, align uint64) string {
+	path, err := filepath.Abs(include)
+	if err != nil {
+		path = include
+	}
+	sum := sha256.Sum256([]byte(fmt.Sprintf("%s\x00%d", path, align)))
+	name := include
+	if archive, member, ok := splitArchiveMember(include); ok {
+		name = archive + "." + strings.NewReplacer("/", "_", ":", "_").Replace(member)
+	}
+	return fmt.Sprintf("%s.%x.o", name, sum[:4])
+}
+
+// wrapRawInclude writes rawWrapperName(include, align), an object holding
+// include's data aligned to align, reusing a cached copy when include has
+// not changed, in opts.Cache.
+func wrapRawInclude(include string, align uint64, ld Runner, opts BuildOptions) error {
+	cache := opts.Cache
+	b, err := readRawInclude(include)
+	if err != nil {
+		return fmt.Errorf("could not open include: %v", err)
+	}
+	output := rawWrapperName(include, align)
+	args, script := rawObjectWrapperArgs(output, align)
+	key := cache.Key("raw-wrapper", b, []byte(strings.Join(args, "\x00")), []byte(script))
+	if cached, ok := cache.Get(key); ok {
+		stageDebugf("raw", "Using cached wrapper for %s", include)
+		if err := ioutil.WriteFile(output, cached, 0644); err != nil {
+			return err
+		}
+		opts.Tracer.File(output)
+		return nil
+	}
+	stageDebugf("raw", "Wrapping %d bytes of %s in %s", len(b), include, output)
+	wrapper, err := createRawObjectWrapper(bytes.NewReader(b), output, ld, align)
+	if err != nil {
+		return err
+	}
+	wrapped, err := ioutil.ReadAll(wrapper)
+	if err != nil {
+		return err
+	}
+	opts.Tracer.File(output)
+	if err := cache.Put(key, wrapped); err != nil {
+		log.Warnf("Could not cache wrapper for %s: %v", include, err)
+	}
+	return nil
+}
+
+// SegmentLayout is where a segment ended up in the ROM and in memory.
+type SegmentLayout struct {
+	Wave      string
+	Name      string
+	RomStart  uint64
+	RomEnd    uint64
+	VramStart uint64
+	VramEnd   uint64
+}
+
+// readSymbols returns the value of every symbol in the linked object.
+func readSymbols(linked []byte) (map[string]uint64, error) {
+	f, err := elf.NewFile(bytes.NewReader(linked))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	symbols, err := f.Symbols()
+	if err != nil {
+		return nil, err
+	}
+	values := map[string]uint64{}
+	for _, sym := range symbols {
+		values[sym.Name] = sym.Value
+	}
+	return values, nil
+}
+
+// CheckEntrySymbols returns an error if an entry or stack symbol named by
+// one of w's segments is missing from symbols or is zero, as the entry stub
+// would then jump or set its stack to address 0. Stacks given as numbers
+// rather than symbols are not checked.
+func CheckEntrySymbols(w *Wave, symbols map[string]uint64) error {
+	check := func(seg *Segment, kind string, name string) error {
+		if value, ok := symbols[name]; !ok {
+			return fmt.Errorf("%s symbol %s of segment %s is not defined by any of its includes", kind, name, seg.Name)
+		} else if value == 0 {
+			return fmt.Errorf("%s symbol %s of segment %s is at address 0", kind, name, seg.Name)
+		}
+		return nil
+	}
+	for _, seg := range w.ObjectSegments {
+		for _, e := range seg.Entries {
+			if err := check(seg, "entry", e.Entry); err != nil {
+				return err
+			}
+			if _, err := strconv.ParseUint(e.Stack.Start, 0, 64); err == nil {
+				continue
+			}
+			if err := check(seg, "stack", e.Stack.Start); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// readSegmentLayout looks up the boundary symbols the linker script defines
+// for each segment of w in the linked object. RAW segments have no BSS, so
+// their data symbols give their place in memory.
+func readSegmentLayout(linked []byte, w *Wave) ([]SegmentLayout, error) {
+	values, err := readSymbols(linked)
+	if err != nil {
+		return nil, err
+	}
+	var layout []SegmentLayout
+	add := func(seg *Segment, vramStart, vramEnd string) error {
+		start, ok := values[seg.BoundarySymbol("RomStart")]
+		if !ok {
+			return fmt.Errorf("linked object has no ROM start symbol for segment %s", seg.Name)
+		}
+		end, ok := values[seg.BoundarySymbol("RomEnd")]
+		if !ok {
+			return fmt.Errorf("linked object has no ROM end symbol for segment %s", seg.Name)
+		}
+		layout = append(layout, SegmentLayout{
+			Wave:      w.Name,
+			Name:      seg.Name,
+			RomStart:  start,
+			RomEnd:    end,
+			VramStart: values[seg.BoundarySymbol(vramStart)],
+			VramEnd:   values[seg.BoundarySymbol(vramEnd)],
+		})
+		return nil
+	}
+	for _, seg := range w.ObjectSegments {
+		if err := add(seg, "Start", "End"); err != nil {
+			return nil, err
+		}
+	}
+	for _, seg := range w.RawSegments {
+		if err := add(seg, "DataStart", "DataEnd"); err != nil {
+			return nil, err
+		}
+	}
+	return layout, nil
+}
+
+// imageBase returns the ROM offset a binarized wave begins at: the start of
+// its first segment, or n64rom.CodeStart where the entry stub lives.
+func imageBase(layout []SegmentLayout) uint64 {
+	base := uint64(n64rom.CodeStart)
+	for _, l := range layout {
+		if l.RomEnd > l.RomStart && l.RomStart < base {
+			base = l.RomStart
+		}
+	}
+	return base
+}
+
+// applySegmentTransform runs transform over each segment's slice of bin, a
+// binarized wave which begins at base in the ROM.
+func applySegmentTransform(bin []byte, base uint64, w *Wave, layout []SegmentLayout, transform SegmentTransform) error {
+	aliases := map[string]bool{}
+	for _, seg := range w.RawSegments {
+		aliases[seg.Name] = w.aliasOf(seg.Name) != ""
+	}
+	for _, l := range layout {
+		if aliases[l.Name] {
+			// The data has already been transformed under its first name.
+			continue
+		}
+		if l.RomStart < base || l.RomEnd < l.RomStart || l.RomEnd-base > uint64(len(bin)) {
+			return fmt.Errorf("segment %s occupies 0x%x-0x%x, outside of the binarized wave", l.Name, l.RomStart, l.RomEnd)
+		}
+		data := bin[l.RomStart-base : l.RomEnd-base]
+		transformed, err := transform(l.Name, append([]byte{}, data...))
+		if err != nil {
+			return fmt.Errorf("transforming segment %s: %v", l.Name, err)
+		}
+		if len(transformed) != len(data) {
+			return fmt.Errorf("transforming segment %s changed its size from 0x%x to 0x%x bytes", l.Name, len(data), len(transformed))
+		}
+		copy(data, transformed)
+	}
+	return nil
+}
+
+// StageTiming records how long one stage of a build took.
+type StageTiming struct {
+	Stage    string
+	Wave     string
+	Duration time.Duration
+}
+
+// stageTimer accumulates stage timings, and records each stage in tracer;
+// a nil stageTimer discards them.
+type stageTimer struct {
+	timings []StageTiming
+	tracer  *Tracer
+}
+
+func (t *stageTimer) track(stage string, wave string, start time.Time) {
+	if t == nil {
+		return
+	}
+	timing := StageTiming{Stage: stage, Wave: wave, Duration: time.Since(start)}
+	t.tracer.event(TraceEvent{Event: "stage", Stage: stage, Wave: wave, Duration: timing.Duration})
+	t.timings = append(t.timings, timing)
+}
+
+// workdirFiles is held by a wave from preparing its RAW segments until it
+// is linked, as those stages write files of fixed names to the working
+// directory: wrappers that waves including the same file share, and the
+// entry object the linker script reads as a.out.
+var workdirFiles sync.Mutex
+
+// waveBuild is a wave linked and binarized, ready to be written to a ROM.
+type waveBuild struct {
+	layout []SegmentLayout
+	// stub is where the wave's entry stub was linked, if the linked object
+	// says.
+	stub   *AddressRange
+	linked []byte
+	image  []byte
+	base   uint64
+	// segments is the table of the wave's RAW segments, including the
+	// pieces of split segments.
+	segments SegmentTable
+	timer    *stageTimer
+}
+
+// linkWave prepares the RAW segments, relocation tables and entry stub of w
+// and links it, returning the linked object, the relocation tables and the
+// table of RAW segments.
+func linkWave(w *Wave, ld, as Runner, opts BuildOptions, timer *stageTimer) ([]byte, RelocTables, SegmentTable, error) {
+	workdirFiles.Lock()
+	defer workdirFiles.Unlock()
+	start := time.Now()
+	segments, err := PrepareRawSegments(w, ld, opts)
+	if err != nil {
+		return nil, nil, nil, &StageError{Stage: "raw", Err: fmt.Errorf("spicy.PrepareRawSegments: %w", err)}
+	}
+	tables, err := PrepareRelocTables(w, ld, opts)
+	if err != nil {
+		return nil, nil, nil, &StageError{Stage: "reloc", Err: fmt.Errorf("spicy.PrepareRelocTables: %w", err)}
+	}
+	timer.track("raw", w.Name, start)
+	start = time.Now()
+	entry, err := createEntryBinary(w, as, opts)
+	if err != nil {
+		return nil, nil, nil, &StageError{Stage: "entry", Err: fmt.Errorf("spicy.CreateEntryBinary: %w", err)}
+	}
+	timer.track("entry", w.Name, start)
+	start = time.Now()
+	linkedObject, err := linkSpec(w, ld, entry, opts)
+	if err != nil {
+		return nil, nil, nil, &StageError{Stage: "link", Err: fmt.Errorf("spicy.LinkSpec: %w", err)}
+	}
+	linkedBytes, err := ioutil.ReadAll(linkedObject)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("could not read linked object: %v", err)
+	}
+	timer.track("link", w.Name, start)
+	return linkedBytes, tables, segments, nil
+}
+
+// buildWave links and binarizes w, returning its image along with where
+// each of its segments was placed and the linked object.
+func buildWave(w *Wave, ld, as, objcopy Runner, opts BuildOptions, timer *stageTimer) (*waveBuild, error) {
+	linkedBytes, tables, segments, err := linkWave(w, ld, as, opts, timer)
+	if err != nil {
+		return nil, err
+	}
+	layout, err := readSegmentLayout(linkedBytes, w)
+	if err != nil {
+		return nil, &StageError{Stage: "link", Err: err}
+	}
+	symbols, err := readSymbols(linkedBytes)
+	if err != nil {
+		return nil, &StageError{Stage: "link", Err: err}
+	}
+	if err := CheckEntrySymbols(w, symbols); err != nil {
+		return nil, &StageError{Stage: "link", Err: err}
+	}
+	if err := CheckRelocTables(w, tables, symbols); err != nil {
+		return nil, &StageError{Stage: "reloc", Err: err}
+	}
+	if err := CheckRomOverlaps(romAddressRanges(w, layout)); err != nil {
+		return nil, &StageError{Stage: "overlap", Err: err}
+	}
+	if !opts.AllowHeaderOverlap {
+		if err := CheckHeaderOverlap(layout); err != nil {
+			return nil, &StageError{Stage: "overlap", Err: err}
+		}
+	} else if opts.Bootcode != nil {
+		if err := CheckBootcodeOverlap(layout, len(opts.Bootcode)); err != nil {
+			return nil, &StageError{Stage: "overlap", Err: err}
+		}
+	}
+	if err := CheckCodeAlignment(w, layout, opts.CodeAlign); err != nil {
+		return nil, &StageError{Stage: "align", Err: err}
+	}
+	if err := CheckRomSize(layout, opts.MaxRomSize); err != nil {
+		return nil, &StageError{Stage: "size", Err: err}
+	}
+	if !opts.DisableOverlapCheck {
+		if err := CheckOverlaps(memoryAddressRanges(w, layout)); err != nil {
+			return nil, &StageError{Stage: "overlap", Err: err}
+		}
+	}
+	start := time.Now()
+	fill := opts.FillByte
+	if w.Fill != nil {
+		fill = *w.Fill
+	}
+	binarizedObject, err := BinarizeObject(bytes.NewReader(linkedBytes), objcopy, fill)
+	if err != nil {
+		return nil, &StageError{Stage: "binarize", Err: fmt.Errorf("spicy.BinarizeObject: %w", err)}
+	}
+	binarizedObjectBytes, err := ioutil.ReadAll(binarizedObject)
+	if err != nil {
+		return nil, fmt.Errorf("could not read binarized object: %v", err)
+	}
+	stageDebugf("binarize", "Binarized wave %s: %d bytes at 0x%x", w.Name, len(binarizedObjectBytes), imageBase(layout))
+	if opts.SegmentTransform != nil {
+		if err := applySegmentTransform(binarizedObjectBytes, imageBase(layout), w, layout, opts.SegmentTransform); err != nil {
+			return nil, err
+		}
+	}
+	timer.track("binarize", w.Name, start)
+	build := &waveBuild{layout: layout, linked: linkedBytes, image: binarizedObjectBytes, base: imageBase(layout), segments: segments, timer: timer}
+	if stub, ok := entryStubRange(symbols); ok {
+		build.stub = &stub
+	}
+	return build, nil
+}
+
+// buildWaves builds each of waves, up to opts.Jobs at a time, and returns
+// them in the order of waves, however the builds interleave. Once a wave
+// fails no more are started, and the error of the first failed wave in
+// declaration order is returned. reverse starts the waves from the last, so
+// that a second build finishes them in a different order. The timings of
+// each wave are added to timer in declaration order.
+func buildWaves(waves []*Wave, ld, as, objcopy Runner, opts BuildOptions, timer *stageTimer, reverse bool) ([]*waveBuild, error) {
+	jobs := opts.Jobs
+	if jobs < 1 {
+		jobs = 1
+	}
+	builds := make([]*waveBuild, len(waves))
+	errs := make([]error, len(waves))
+	slots := make(chan struct{}, jobs)
+	var failed int32
+	var wg sync.WaitGroup
+	for n := range waves {
+		i := n
+		if reverse {
+			i = len(waves) - 1 - n
+		}
+		slots <- struct{}{}
+		if atomic.LoadInt32(&failed) != 0 {
+			break
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() { <-slots }()
+			builds[i], errs[i] = buildWave(waves[i], ld, as, objcopy, opts, &stageTimer{tracer: opts.Tracer})
+			if errs[i] != nil {
+				atomic.StoreInt32(&failed, 1)
+			}
+		}()
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			return nil, err
+		}
+	}
+	if timer != nil {
+		for _, b := range builds {
+			timer.timings = append(timer.timings, b.timer.timings...)
+		}
+	}
+	return builds, nil
+}
+
+// assembleRom writes builds into a new ROM started from base, in the order
+// given, which is the spec's, so that where waves overlap the later one wins
+// however the builds finished. The ROM is then finished and its entry PC
+// checked against waves.
+func assembleRom(base []byte, waves []*Wave, builds []*waveBuild, opts BuildOptions) (*Rom, []SegmentLayout, error) {
+	rom, err := newRom(base, opts)
+	if err != nil {
+		return nil, nil, err
+	}
+	var layout []SegmentLayout
+	var stubs []AddressRange
+	for _, b := range builds {
+		if err := rom.WriteAt(b.image, int64(b.base)); err != nil {
+			return nil, nil, fmt.Errorf("could not write ROM: %v", err)
+		}
+		layout = append(layout, b.layout...)
+		if b.stub != nil {
+			stubs = append(stubs, *b.stub)
+		}
+	}
+	if err := checkNotEmpty(rom, layout, stubs, opts); err != nil {
+		return nil, nil, err
+	}
+	if err := checkNoGaps(layout, stubs, opts); err != nil {
+		return nil, nil, err
+	}
+	if err := finishRom(rom, layout, opts); err != nil {
+		return nil, nil, err
+	}
+	if err := checkEntryPc(rom, stubs, waves, layout, opts); err != nil {
+		return nil, nil, err
+	}
+	return rom, layout, nil
+}
+
+// finishRom applies the options that act on the whole ROM once every wave
+// has been written to it.
+func finishRom(rom *Rom, layout []SegmentLayout, opts BuildOptions) error {
+	if err := embedVersion(rom, layout, opts); err != nil {
+		return err
+	}
+	if err := embedSegmentCrcs(rom, layout, opts); err != nil {
+		return err
+	}
+	log.Infof("ROM uses 0x%x bytes", rom.UsedSize())
+	return padRom(rom, opts)
+}
+
+// padRom pads rom to opts.RomSize and then to a power of two, as opts asks,
+// and adds its footer.
+func padRom(rom *Rom, opts BuildOptions) error {
+	if opts.RomSize > 0 {
+		if err := CheckPaddedRomSize(opts.RomSize, opts.MaxRomSize); err != nil {
+			return err
+		}
+		rom.Pad(opts.RomSize)
+	}
+	if opts.RoundPow2 {
+		mbits := PowerOfTwoMbitSize(rom.Size())
+		if err := CheckPaddedRomSize(MbitBytes(mbits), opts.MaxRomSize); err != nil {
+			return err
+		}
+		log.Infof("Padding ROM to %d Mbit", mbits)
+		rom.Pad(MbitBytes(mbits))
+	}
+	return addFooter(rom, opts)
+}
+
+// addFooter sets opts.FooterMagic as the footer of rom: in the last bytes
+// of a padded ROM, as long as no data is there, or after the end of the ROM
+// otherwise. The footer must also come after the bytes the header checksum
+// covers, so a ROM rounded to a power of two is rounded up further until
+// there is room, and an unpadded ROM is filled up to the end of the
+// checksum.
+func addFooter(rom *Rom, opts BuildOptions) error {
+	if opts.FooterMagic == nil {
+		return nil
+	}
+	size := int64(len(opts.FooterMagic)) + 4
+	start := rom.UsedSize()
+	if start < checksumStart+checksumLength {
+		start = checksumStart + checksumLength
+	}
+	offset := rom.Size()
+	switch {
+	case opts.RoundPow2:
+		mbits := PowerOfTwoMbitSize(rom.Size())
+		for MbitBytes(mbits)-size < start {
+			mbits *= 2
+		}
+		if MbitBytes(mbits) > rom.Size() {
+			if err := CheckPaddedRomSize(MbitBytes(mbits), opts.MaxRomSize); err != nil {
+				return fmt.Errorf("no room for the 0x%x-byte footer: %v", size, err)
+			}
+			log.Infof("Padding ROM to %d Mbit to make room for the footer", mbits)
+			rom.Pad(MbitBytes(mbits))
+		}
+		offset = rom.Size() - size
+	case opts.RomSize > 0:
+		offset -= size
+		if offset < rom.UsedSize() {
+			return fmt.Errorf("no room for the 0x%x-byte footer at the end of the padded ROM, whose data runs to 0x%x", size, rom.UsedSize())
+		}
+	default:
+		if offset < start {
+			offset = start
+		}
+		if err := CheckPaddedRomSize(offset+size, opts.MaxRomSize); err != nil {
+			return err
+		}
+		rom.Pad(offset)
+	}
+	if err := rom.SetFooter(opts.FooterMagic, offset); err != nil {
+		return fmt.Errorf("could not add footer: %v", err)
+	}
+	log.Infof("Added footer at 0x%x", offset)
+	return nil
+}
+
+// stubsEnd returns where the largest of stubs ends in the ROM, or
+// n64rom.CodeStart if there are none, as every wave's entry stub is linked
+// there.
+func stubsEnd(stubs []AddressRange) uint64 {
+	end := uint64(n64rom.CodeStart)
+	for _, stub := range stubs {
+		if e := uint64(n64rom.CodeStart) + uint64(stub.End-stub.Start); e > end {
+			end = e
+		}
+	}
+	return end
+}
+
+// checkNotEmpty returns ErrEmptyRom, unless opts.AllowEmpty is set, if no
+// segment of layout takes up space in rom and nothing was written to it past
+// its header, bootcode and entry stubs, so that the ROM holds no bytes for
+// the stubs to load.
+func checkNotEmpty(rom *Rom, layout []SegmentLayout, stubs []AddressRange, opts BuildOptions) error {
+	if opts.AllowEmpty {
+		return nil
+	}
+	for _, l := range layout {
+		if l.RomEnd > l.RomStart {
+			return nil
+		}
+	}
+	if uint64(rom.UsedSize()) > stubsEnd(stubs) {
+		return nil
+	}
+	return ErrEmptyRom
+}
+
+// checkNoGaps runs CheckNoGaps on layout if opts.NoGaps is set. The first
+// segment may begin where the entry stubs end.
+func checkNoGaps(layout []SegmentLayout, stubs []AddressRange, opts BuildOptions) error {
+	if !opts.NoGaps {
+		return nil
+	}
+	if err := CheckNoGaps(layout, stubsEnd(stubs)); err != nil {
+		return &StageError{Stage: "gaps", Err: err}
+	}
+	return nil
+}
+
+// checkEntryPc runs CheckEntryPc on the finished rom, for the CIC its
+// bootcode was written for, unless opts.AllowExternalEntry is set.
+func checkEntryPc(rom *Rom, stubs []AddressRange, waves []*Wave, layout []SegmentLayout, opts BuildOptions) error {
+	if opts.AllowExternalEntry {
+		return nil
+	}
+	cic := DetectCIC(rom.Bytes())
+	pc := rom.EntryPc()
+	if err := CheckEntryPc(EntryTarget(pc, cic), stubs, waves, layout); err != nil {
+		if target := EntryTarget(pc, cic); target != pc {
+			err = fmt.Errorf("%v; CIC-%d jumps to 0x%08x for header PC 0x%08x", err, cic, target, pc)
+		}
+		return &StageError{Stage: "entry", Err: err}
+	}
+	return nil
+}
+
+// embedVersion writes opts.Version into rom, refusing to cover any segment
+// in layout.
+func embedVersion(rom *Rom, layout []SegmentLayout, opts BuildOptions) error {
+	if opts.Version == "" {
+		return nil
+	}
+	offset, err := rom.EmbedString(opts.Version, opts.VersionOffset)
+	if err != nil {
+		return fmt.Errorf("could not embed version: %v", err)
+	}
+	end := uint64(offset) + uint64(len(opts.Version)) + 1
+	for _, l := range layout {
+		if uint64(offset) < l.RomEnd && l.RomStart < end {
+			return fmt.Errorf("version string at 0x%x overlaps segment %s at 0x%x-0x%x", offset, l.Name, l.RomStart, l.RomEnd)
+		}
+	}
+	log.Infof("Embedded version %q at 0x%x", opts.Version, offset)
+	return nil
+}
+
+// embedSegmentCrcs writes the segment CRC table just past the end of the
+// ROM, aligned to 16 bytes, when opts.SegmentCrc is set.
+func embedSegmentCrcs(rom *Rom, layout []SegmentLayout, opts BuildOptions) error {
+	if !opts.SegmentCrc {
+		return nil
+	}
+	crcs, err := SegmentCrcs(rom, layout)
+	if err != nil {
+		return fmt.Errorf("could not compute segment CRCs: %v", err)
+	}
+	offset := (rom.Size() + 0xf) &^ 0xf
+	if err := rom.WriteAt(EncodeSegmentCrcTable(crcs), offset); err != nil {
+		return fmt.Errorf("could not embed segment CRCs: %v", err)
+	}
+	log.Infof("Embedded CRCs of %d segments at 0x%x", len(crcs), offset)
+	return nil
+}
+
+// newRom starts a ROM from base if given, or from a blank image otherwise,
+// then applies opts.Header, opts.PiConfig and opts.Bootcode.
+func newRom(base []byte, opts BuildOptions) (*Rom, error) {
+	var rom *Rom
+	var err error
+	if base != nil {
+		rom, err = LoadRom(bytes.NewReader(base), opts.FillByte)
+	} else {
+		rom, err = NewBlankRom(opts.FillByte)
+	}
+	if err != nil {
+		return nil, err
+	}
+	rom.AllowHeaderWrites(opts.AllowHeaderOverlap)
+	if opts.Header != nil {
+		if err := rom.SetHeader(opts.Header); err != nil {
+			return nil, err
+		}
+	}
+	if opts.PiConfig != nil {
+		rom.SetPiConfig(*opts.PiConfig)
+	}
+	if opts.Bootcode != nil {
+		if err := rom.SetBootcode(opts.Bootcode); err != nil {
+			return nil, err
+		}
+	}
+	return rom, nil
+}
+
+func readBaseRom(opts BuildOptions) ([]byte, error) {
+	if opts.BaseRom == nil {
+		return nil, nil
+	}
+	return ioutil.ReadAll(opts.BaseRom)
+}
+
+// BuildRom links each wave of spec and writes the binarized result into a
+// new ROM image, or over opts.BaseRom if given.
+func BuildRom(spec *Spec, ld, as, objcopy Runner, opts BuildOptions) (*Rom, error) {
+	traceRunners(opts.Tracer, &ld, &as, &objcopy)
+	defer trackTempFiles(&opts, &ld, &as, &objcopy)()
+	if err := checkLoadable(spec.Waves, opts); err != nil {
+		return nil, err
+	}
+	if err := checkRawSizes(spec.Waves, opts); err != nil {
+		return nil, err
+	}
+	base, err := readBaseRom(opts)
+	if err != nil {
+		return nil, err
+	}
+	builds, err := buildWaves(spec.Waves, ld, as, objcopy, opts, nil, false)
+	if err != nil {
+		return nil, err
+	}
+	rom, _, err := assembleRom(base, spec.Waves, builds, opts)
+	return rom, err
+}
+
+// BuildWaveRoms is like BuildRom, but builds each wave into its own ROM.
+func BuildWaveRoms(spec *Spec, ld, as, objcopy Runner, opts BuildOptions) ([]*Rom, error) {
+	traceRunners(opts.Tracer, &ld, &as, &objcopy)
+	defer trackTempFiles(&opts, &ld, &as, &objcopy)()
+	base, err := readBaseRom(opts)
+	if err != nil {
+		return nil, err
+	}
+	for _, w := range spec.Waves {
+		if err := checkLoadable([]*Wave{w}, opts); err != nil {
+			return nil, fmt.Errorf("wave %s: %w", w.Name, err)
+		}
+	}
+	if err := checkRawSizes(spec.Waves, opts); err != nil {
+		return nil, err
+	}
+	builds, err := buildWaves(spec.Waves, ld, as, objcopy, opts, nil, false)
+	if err != nil {
+		return nil, err
+	}
+	var roms []*Rom
+	for i, w := range spec.Waves {
+		rom, _, err := assembleRom(base, []*Wave{w}, builds[i:i+1], opts)
+		if err != nil {
+			return nil, err
+		}
+		roms = append(roms, rom)
+	}
+	return roms, nil
+}
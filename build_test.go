@@ -0,0 +1,482 @@
+package spicy
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/trhodeos/n64rom"
+)
+
+func TestAutoSplitOversizedRawSegment(t *testing.T) {
+	assert := assert.New(t)
+	data := make([]byte, 0x20)
+	for i := range data {
+		data[i] = byte(i)
+	}
+	include := filepath.Join(t.TempDir(), "data.bin")
+	assert.Nil(ioutil.WriteFile(include, data, 0644))
+	w := &Wave{
+		Name:        "wave",
+		RawSegments: []*Segment{{Name: "data", Includes: []string{include}, MaxSize: 0x10, Flags: Flags{Raw: true}}},
+	}
+
+	// Without --auto-split the segment is left whole, as it always was.
+	table, err := PrepareRawSegments(w, &fakeRunner{}, BuildOptions{})
+	assert.Nil(err)
+	assert.Equal(SegmentTable{{Name: "data", Source: "data", Size: 0x20}}, table)
+	assert.Equal(1, len(w.RawSegments))
+
+	table, err = PrepareRawSegments(w, &fakeRunner{}, BuildOptions{AutoSplit: true})
+	assert.Nil(err)
+	assert.Equal(2, len(w.RawSegments))
+	assert.Equal(SegmentTable{
+		{Name: "data_0", Source: "data", Offset: 0, Size: 0x10},
+		{Name: "data_1", Source: "data", Offset: 0x10, Size: 0x10},
+	}, table)
+	for i, seg := range w.RawSegments {
+		assert.Equal(table[i].Name, seg.Name)
+		b, err := ioutil.ReadFile(seg.Includes[0])
+		assert.Nil(err)
+		assert.Equal(data[table[i].Offset:table[i].Offset+table[i].Size], b)
+	}
+
+	// The segment's own symbols span both pieces.
+	script, err := createLdScript(w)
+	assert.Nil(err)
+	text, err := ioutil.ReadAll(script)
+	assert.Nil(err)
+	assert.Regexp(`_dataSegmentRomStart = _RomSize;\s+_data_0SegmentRomStart = _RomSize;`, string(text))
+	assert.Regexp(`_data_1SegmentRomEnd = _RomSize;\s+_dataSegmentRomEnd = _RomSize;\s+_dataSegmentDataEnd = _data_1SegmentDataEnd;`, string(text))
+	assert.Contains(string(text), "_dataSegmentDataStart = _data_0SegmentDataStart;")
+}
+
+func TestSegmentTransformIsAppliedToRom(t *testing.T) {
+	assert := assert.New(t)
+	chdirTemp(t)
+	spec, err := ParseSpec(strings.NewReader(`
+beginseg
+  name "code"
+  flags BOOT OBJECT
+  entry boot
+  stack bootStack + 0x1000
+  include "code.o"
+endseg
+beginseg
+  name "data"
+  flags OBJECT
+  after "code"
+  include "data.o"
+endseg
+beginwave
+  name "game"
+  include "code"
+  include "data"
+endwave
+`))
+	assert.Nil(err)
+	image := []byte{0, 1, 2, 3, 4, 5, 6, 7}
+	ld := &fakeRunner{output: testElf(entrySymbols(map[string]uint64{
+		"_codeSegmentRomStart": 0x1000,
+		"_codeSegmentRomEnd":   0x1004,
+		"_dataSegmentRomStart": 0x1004,
+		"_dataSegmentRomEnd":   0x1008,
+		"_codeSegmentStart":    0x80000450,
+		"_codeSegmentEnd":      0x80000454,
+		"_dataSegmentStart":    0x80000454,
+		"_dataSegmentEnd":      0x80000458,
+	}))}
+	as := &fakeRunner{output: []byte{}, outputFile: "a.out"}
+	objcopy := &fakeRunner{output: image}
+	xor := func(name string, data []byte) ([]byte, error) {
+		if name == "data" {
+			for i := range data {
+				data[i] ^= 0xff
+			}
+		}
+		return data, nil
+	}
+
+	rom, err := BuildRom(spec, ld, as, objcopy, BuildOptions{SegmentTransform: xor})
+	assert.Nil(err)
+	romBytes := readRom(t, rom)
+	assert.Equal([]byte{0, 1, 2, 3, 0xfb, 0xfa, 0xf9, 0xf8}, romBytes[n64rom.CodeStart:n64rom.CodeStart+8])
+}
+
+func TestDedupeIdenticalRawSegments(t *testing.T) {
+	assert := assert.New(t)
+	dir := t.TempDir()
+	blob := []byte("identical payload")
+	var segments []*Segment
+	for _, name := range []string{"first", "second"} {
+		include := filepath.Join(dir, name+".bin")
+		assert.Nil(ioutil.WriteFile(include, blob, 0644))
+		segments = append(segments, &Segment{Name: name, Includes: []string{include}, Flags: Flags{Raw: true}})
+	}
+	w := &Wave{Name: "wave", RawSegments: segments}
+
+	ld := &fakeRunner{}
+	table, err := PrepareRawSegments(w, ld, BuildOptions{DedupeRaw: true})
+	assert.Nil(err)
+	assert.Equal(1, len(ld.calls))
+	assert.Equal("", table.Lookup("first").AliasOf)
+	assert.Equal("first", table.Lookup("second").AliasOf)
+
+	script, err := createLdScript(w)
+	assert.Nil(err)
+	b, err := ioutil.ReadAll(script)
+	assert.Nil(err)
+	assert.Equal(1, strings.Count(string(b), ".bin."))
+	assert.Contains(string(b), "_secondSegmentRomStart = _firstSegmentRomStart;")
+	assert.Contains(string(b), "_secondSegmentRomEnd = _firstSegmentRomEnd;")
+}
+
+func TestDedupeIsKeptToEachWave(t *testing.T) {
+	assert := assert.New(t)
+	chdirTemp(t)
+	blob := []byte("identical payload")
+	assert.Nil(ioutil.WriteFile("first.bin", blob, 0644))
+	assert.Nil(ioutil.WriteFile("second.bin", blob, 0644))
+	spec, err := ParseSpec(strings.NewReader(`
+beginseg
+  name "first"
+  flags RAW
+  include "first.bin"
+endseg
+beginseg
+  name "second"
+  flags RAW
+  include "second.bin"
+endseg
+beginwave
+  name "both"
+  include "first"
+  include "second"
+endwave
+beginwave
+  name "one"
+  include "second"
+endwave
+`))
+	assert.Nil(err)
+	both, one := spec.Waves[0], spec.Waves[1]
+	assert.Same(both.RawSegments[1], one.RawSegments[0])
+
+	_, err = PrepareRawSegments(both, &fakeRunner{}, BuildOptions{DedupeRaw: true})
+	assert.Nil(err)
+	assert.Equal("first", both.aliasOf("second"))
+	// The wave that does not include first still stores and wraps second.
+	ld := &fakeRunner{}
+	table, err := PrepareRawSegments(one, ld, BuildOptions{DedupeRaw: true})
+	assert.Nil(err)
+	assert.Equal(1, len(ld.calls))
+	assert.Equal("", table.Lookup("second").AliasOf)
+	script, err := createLdScript(one)
+	assert.Nil(err)
+	b, err := ioutil.ReadAll(script)
+	assert.Nil(err)
+	assert.NotContains(string(b), "_firstSegment")
+	assert.Equal("first", both.aliasOf("second"))
+}
+
+func TestBuildWaveRomsWritesOneRomPerWave(t *testing.T) {
+	assert := assert.New(t)
+	chdirTemp(t)
+	spec, err := ParseSpec(strings.NewReader(`
+beginseg
+  name "first"
+  flags BOOT OBJECT
+  entry boot
+  stack bootStack
+  include "first.o"
+endseg
+beginseg
+  name "second"
+  flags BOOT OBJECT
+  entry boot
+  stack bootStack
+  include "second.o"
+endseg
+beginwave
+  name "one"
+  include "first"
+endwave
+beginwave
+  name "two"
+  include "second"
+endwave
+`))
+	assert.Nil(err)
+	symbols := segmentSymbols(map[string]uint64{}, "first", 0x1000, 0x80000450, 4)
+	symbols = segmentSymbols(symbols, "second", 0x1000, 0x80000450, 4)
+	ld := &fakeRunner{output: testElf(entrySymbols(symbols))}
+	as := &fakeRunner{output: []byte{}, outputFile: "a.out"}
+	objcopy := &fakeRunner{output: []byte{1, 2, 3, 4}}
+
+	roms, err := BuildWaveRoms(spec, ld, as, objcopy, BuildOptions{})
+	assert.Nil(err)
+	assert.Equal(2, len(roms))
+	for _, rom := range roms {
+		b := readRom(t, rom)
+		assert.Equal([]byte{0x80, 0x37, 0x12, 0x40}, b[:4])
+		crc1, crc2 := ComputeChecksum(b)
+		assert.Equal(crc1, binary.BigEndian.Uint32(b[ChecksumOffset:]))
+		assert.Equal(crc2, binary.BigEndian.Uint32(b[ChecksumOffset+4:]))
+		assert.Equal([]byte{1, 2, 3, 4}, b[n64rom.CodeStart:])
+	}
+}
+
+func TestEmptyRawIncludeWarns(t *testing.T) {
+	assert := assert.New(t)
+	logs := captureLogs(t, log.WarnLevel)
+	include := filepath.Join(t.TempDir(), "empty.bin")
+	assert.Nil(ioutil.WriteFile(include, nil, 0644))
+	newWave := func() *Wave {
+		return &Wave{Name: "wave", RawSegments: []*Segment{{Name: "empty", Includes: []string{include}, Flags: Flags{Raw: true}}}}
+	}
+
+	_, err := PrepareRawSegments(newWave(), &fakeRunner{}, BuildOptions{})
+	assert.Nil(err)
+	assert.Contains(logs.String(), "empty.bin of segment \\\"empty\\\" is empty")
+
+	_, err = PrepareRawSegments(newWave(), &fakeRunner{}, BuildOptions{Strict: true})
+	assert.NotNil(err)
+}
+
+func TestMissingRawIncludeNamesSegment(t *testing.T) {
+	chdirTemp(t)
+	w := &Wave{Name: "wave", RawSegments: []*Segment{{Name: "level", Includes: []string{"missing.bin"}, Flags: Flags{Raw: true}}}}
+	_, err := PrepareRawSegments(w, &fakeRunner{}, BuildOptions{})
+	assert.EqualError(t, err, "could not read include missing.bin of segment level: open missing.bin: no such file or directory")
+}
+
+func TestAllNoLoadSpecIsEmpty(t *testing.T) {
+	assert := assert.New(t)
+	chdirTemp(t)
+	spec, err := ParseSpec(strings.NewReader(`
+beginseg
+  name "bss"
+  flags OBJECT NOLOAD
+  include "bss.o"
+endseg
+beginwave
+  name "game"
+  include "bss"
+endwave
+`))
+	assert.Nil(err)
+	_, err = BuildRom(spec, &fakeRunner{}, &fakeRunner{}, &fakeRunner{}, BuildOptions{})
+	assert.Equal(ErrEmptyRom, err)
+	assert.Equal("no loadable data produced; resulting ROM would be empty", err.Error())
+
+	// Once built, a ROM whose segments are all empty and that holds nothing
+	// past its entry stub is empty too, but one with data after the stub is
+	// not, whatever its layout says.
+	stubs := []AddressRange{{Name: "entry stub", Start: 0x80000400, End: 0x80000450}}
+	layout := []SegmentLayout{{Name: "empty", RomStart: 0x1050, RomEnd: 0x1050}}
+	rom, err := NewBlankRom(0)
+	assert.Nil(err)
+	assert.Nil(rom.WriteAt(make([]byte, 0x50), n64rom.CodeStart))
+	assert.Equal(ErrEmptyRom, checkNotEmpty(rom, layout, stubs, BuildOptions{}))
+	assert.Nil(checkNotEmpty(rom, layout, stubs, BuildOptions{AllowEmpty: true}))
+	assert.Nil(rom.WriteAt([]byte{1}, n64rom.CodeStart+0x50))
+	assert.Nil(checkNotEmpty(rom, nil, stubs, BuildOptions{}))
+}
+
+// gapFillRunner stands in for objcopy -O binary, writing two bytes of
+// segment data either side of a four-byte gap filled as --gap-fill asks.
+type gapFillRunner struct{}
+
+func (gapFillRunner) Run(r io.Reader, args []string) (io.Reader, error) {
+	var fill byte
+	for _, arg := range args {
+		var v uint
+		if _, err := fmt.Sscanf(arg, "--gap-fill=0x%x", &v); err == nil {
+			fill = byte(v)
+		}
+	}
+	b := []byte{1, 2, fill, fill, fill, fill, 3, 4}
+	return &bytes.Buffer{}, ioutil.WriteFile(args[len(args)-1], b, 0644)
+}
+
+func TestWaveFillOverridesRomFill(t *testing.T) {
+	assert := assert.New(t)
+	chdirTemp(t)
+	spec, err := ParseSpec(strings.NewReader(`
+beginseg
+  name "code"
+  flags BOOT OBJECT
+  entry boot
+  stack bootStack
+  include "code.o"
+endseg
+beginseg
+  name "audio"
+  flags BOOT OBJECT
+  entry boot
+  stack bootStack
+  include "audio.o"
+endseg
+beginwave
+  name "game"
+  include "code"
+endwave
+beginwave
+  name "sound"
+  fill 0xaa
+  include "audio"
+endwave
+`))
+	assert.Nil(err)
+	assert.Nil(spec.Waves[0].Fill)
+	assert.Equal(byte(0xaa), *spec.Waves[1].Fill)
+	symbols := segmentSymbols(map[string]uint64{}, "code", 0x1000, 0x80000450, 8)
+	symbols = segmentSymbols(symbols, "audio", 0x1000, 0x80000450, 8)
+	ld := &fakeRunner{output: testElf(entrySymbols(symbols))}
+	as := &fakeRunner{output: []byte{}, outputFile: "a.out"}
+
+	roms, err := BuildWaveRoms(spec, ld, as, gapFillRunner{}, BuildOptions{FillByte: 0xff})
+	assert.Nil(err)
+	assert.Equal([]byte{1, 2, 0xff, 0xff, 0xff, 0xff, 3, 4}, readRom(t, roms[0])[n64rom.CodeStart:])
+	assert.Equal([]byte{1, 2, 0xaa, 0xaa, 0xaa, 0xaa, 3, 4}, readRom(t, roms[1])[n64rom.CodeStart:])
+}
+
+func TestMissingEntrySymbolIsReported(t *testing.T) {
+	assert := assert.New(t)
+	chdirTemp(t)
+	spec, err := ParseSpec(strings.NewReader(pipelineTestSpec))
+	assert.Nil(err)
+	build := func(symbols map[string]uint64) error {
+		ld := &fakeRunner{output: testElf(segmentSymbols(symbols, "code", 0x1000, 0x80000450, 8))}
+		as := &fakeRunner{output: []byte{}, outputFile: "a.out"}
+		_, err := BuildRom(spec, ld, as, &fakeRunner{output: make([]byte, 8)}, BuildOptions{})
+		return err
+	}
+
+	err = build(map[string]uint64{"bootStack": 0x80010000})
+	assert.EqualError(err, "entry symbol boot of segment code is not defined by any of its includes")
+	err = build(map[string]uint64{"boot": 0x80000450, "bootStack": 0})
+	assert.EqualError(err, "stack symbol bootStack of segment code is at address 0")
+	assert.Nil(build(entrySymbols(map[string]uint64{})))
+}
+
+func TestRawWrappersAreUniquePerPath(t *testing.T) {
+	assert := assert.New(t)
+	dir := chdirTemp(t)
+	for _, sub := range []string{"a", "b"} {
+		assert.Nil(os.Mkdir(sub, 0755))
+		assert.Nil(ioutil.WriteFile(filepath.Join(sub, "data.bin"), []byte(sub), 0644))
+	}
+	w := &Wave{Name: "wave", RawSegments: []*Segment{
+		{Name: "first", Includes: []string{"a/data.bin"}, Flags: Flags{Raw: true}},
+		{Name: "second", Includes: []string{filepath.Join(dir, "b", "data.bin")}, Flags: Flags{Raw: true}},
+		{Name: "aligned", Includes: []string{"a/data.bin"}, Flags: Flags{Raw: true}, IncludeAlign: map[string]uint64{"a/data.bin": 16}},
+	}}
+	ld := &fakeRunner{}
+	_, err := PrepareRawSegments(w, ld, BuildOptions{})
+	assert.Nil(err)
+	assert.Equal(3, len(ld.calls))
+
+	names := map[string]bool{}
+	for _, seg := range w.RawSegments {
+		include := seg.Includes[0]
+		name := rawWrapperName(include, seg.IncludeAlign[include])
+		assert.True(strings.HasPrefix(name, include+"."), name)
+		_, err := os.Stat(name)
+		assert.Nil(err, name)
+		names[name] = true
+	}
+	assert.Equal(3, len(names))
+
+	script, err := createLdScript(w)
+	assert.Nil(err)
+	b, err := ioutil.ReadAll(script)
+	assert.Nil(err)
+	for name := range names {
+		assert.Contains(string(b), "\""+name+"\"")
+	}
+}
+
+func TestStrictSizesReportsEveryMismatch(t *testing.T) {
+	assert := assert.New(t)
+	chdirTemp(t)
+	for name, size := range map[string]int{"big.bin": 0x24, "small.bin": 0x10, "exact.bin": 0x20} {
+		assert.Nil(ioutil.WriteFile(name, make([]byte, size), 0644))
+	}
+	waves := []*Wave{{Name: "wave", RawSegments: []*Segment{
+		{Name: "big", Includes: []string{"big.bin"}, MaxSize: 0x20, Flags: Flags{Raw: true}},
+		{Name: "exact", Includes: []string{"exact.bin"}, MaxSize: 0x20, Flags: Flags{Raw: true}},
+		{Name: "small", Includes: []string{"small.bin"}, MaxSize: 0x20, Flags: Flags{Raw: true}},
+		{Name: "unsized", Includes: []string{"small.bin"}, Flags: Flags{Raw: true}},
+	}}}
+	assert.EqualError(CheckRawSizes(waves), "2 RAW segments are not the size they declare:\n"+
+		"  segment big (big.bin) is 0x24 bytes, 0x4 more than its size of 0x20\n"+
+		"  segment small (small.bin) is 0x10 bytes, 0x10 less than its size of 0x20")
+	assert.Nil(checkRawSizes(waves, BuildOptions{}))
+	var stageErr *StageError
+	assert.True(errors.As(checkRawSizes(waves, BuildOptions{StrictSizes: true}), &stageErr))
+	assert.Equal("raw", stageErr.Stage)
+}
+
+func TestFooterEndsPaddedRom(t *testing.T) {
+	assert := assert.New(t)
+	rom, err := NewBlankRom(0xff)
+	assert.Nil(err)
+	assert.Nil(rom.WriteAt([]byte{1, 2, 3, 4}, n64rom.CodeStart))
+	layout := []SegmentLayout{{Name: "code", RomStart: n64rom.CodeStart, RomEnd: n64rom.CodeStart + 4}}
+	opts := BuildOptions{RomSize: MbitBytes(16), FooterMagic: []byte("FOOT")}
+	assert.Nil(finishRom(rom, layout, opts))
+	b := rom.Bytes()
+	assert.Equal(MbitBytes(16), int64(len(b)))
+	footer := b[len(b)-8:]
+	assert.Equal([]byte("FOOT"), footer[:4])
+	assert.Equal(crc32.ChecksumIEEE(b[:len(b)-8]), binary.BigEndian.Uint32(footer[4:]))
+	crc1, crc2 := ComputeChecksum(b)
+	assert.Equal(crc1, binary.BigEndian.Uint32(b[ChecksumOffset:]))
+	assert.Equal(crc2, binary.BigEndian.Uint32(b[ChecksumOffset+4:]))
+
+	// A small unpadded ROM is filled up to the end of the header checksum,
+	// or the footer would fall within it.
+	rom, err = NewBlankRom(0xff)
+	assert.Nil(err)
+	assert.Nil(rom.WriteAt([]byte{1, 2, 3, 4}, n64rom.CodeStart))
+	assert.Nil(finishRom(rom, layout, BuildOptions{FooterMagic: []byte("FOOT")}))
+	b = rom.Bytes()
+	assert.Equal(checksumStart+checksumLength+8, len(b))
+	assert.Equal([]byte{1, 2, 3, 4, 0xff}, b[n64rom.CodeStart:n64rom.CodeStart+5])
+	assert.Equal([]byte("FOOT"), b[len(b)-8:len(b)-4])
+	assert.Equal(crc32.ChecksumIEEE(b[:len(b)-8]), binary.BigEndian.Uint32(b[len(b)-4:]))
+
+	// Rounded to a power of two, a small ROM is rounded past the checksum,
+	// and one whose data fills it is rounded to the next power.
+	rom, err = NewBlankRom(0xff)
+	assert.Nil(err)
+	assert.Nil(rom.WriteAt([]byte{1, 2, 3, 4}, n64rom.CodeStart))
+	assert.Nil(finishRom(rom, layout, BuildOptions{RoundPow2: true, FooterMagic: []byte("FOOT")}))
+	assert.Equal(MbitBytes(16), rom.Size())
+	rom, err = NewBlankRom(0xff)
+	assert.Nil(err)
+	assert.Nil(rom.WriteAt(make([]byte, MbitBytes(16)-n64rom.CodeStart-4), n64rom.CodeStart))
+	assert.Nil(finishRom(rom, layout, BuildOptions{RoundPow2: true, FooterMagic: []byte("FOOT")}))
+	assert.Equal(MbitBytes(32), rom.Size())
+	assert.Equal([]byte("FOOT"), rom.Bytes()[MbitBytes(32)-8:MbitBytes(32)-4])
+	rom, err = NewBlankRom(0xff)
+	assert.Nil(err)
+	assert.Nil(rom.WriteAt(make([]byte, MbitBytes(16)-n64rom.CodeStart-4), n64rom.CodeStart))
+	assert.NotNil(finishRom(rom, layout, BuildOptions{RoundPow2: true, MaxRomSize: MbitBytes(16), FooterMagic: []byte("FOOT")}))
+
+	rom, err = NewBlankRom(0xff)
+	assert.Nil(err)
+	assert.Nil(rom.WriteAt(make([]byte, MbitBytes(16)-n64rom.CodeStart-4), n64rom.CodeStart))
+	assert.EqualError(finishRom(rom, layout, opts), fmt.Sprintf("no room for the 0x8-byte footer at the end of the padded ROM, whose data runs to 0x%x", MbitBytes(16)-4))
+}
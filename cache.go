@@ -0,0 +1,90 @@
+package spicy
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Cache stores toolchain outputs on disk, keyed by a hash of their inputs,
+// so that unchanged inputs need not be processed again.
+type Cache struct {
+	Dir string
+	// Toolchain identifies the toolchain producing the outputs, as
+	// Toolchain.Identity gives it, and is part of every key.
+	Toolchain string
+}
+
+// DefaultCacheDir returns the per-user directory spicy caches outputs in.
+func DefaultCacheDir() (string, error) {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "spicy"), nil
+}
+
+// Key hashes kind and the inputs of a step, which should include its
+// arguments, into a key for c.
+func (c *Cache) Key(kind string, inputs ...[]byte) string {
+	h := sha256.New()
+	if c != nil {
+		h.Write([]byte(c.Toolchain))
+		h.Write([]byte{0})
+	}
+	h.Write([]byte(kind))
+	for _, input := range inputs {
+		h.Write([]byte{0})
+		h.Write(input)
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// Get returns the data stored under key, if any. A nil Cache is always empty.
+func (c *Cache) Get(key string) ([]byte, bool) {
+	if c == nil {
+		return nil, false
+	}
+	b, err := ioutil.ReadFile(filepath.Join(c.Dir, key))
+	if err != nil {
+		return nil, false
+	}
+	log.Debugf("Cache hit for %s", key)
+	return b, true
+}
+
+// Put stores data under key. A nil Cache stores nothing.
+func (c *Cache) Put(key string, data []byte) error {
+	if c == nil {
+		return nil
+	}
+	if err := os.MkdirAll(c.Dir, 0755); err != nil {
+		return err
+	}
+	// Write to a temporary name first so a concurrent build never reads a
+	// partial entry.
+	tmp, err := ioutil.TempFile(c.Dir, key+".tmp")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), filepath.Join(c.Dir, key))
+}
+
+// Clean removes the cache directory and everything in it.
+func (c *Cache) Clean() error {
+	log.Infof("Removing cache %s", c.Dir)
+	return os.RemoveAll(c.Dir)
+}
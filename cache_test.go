@@ -0,0 +1,50 @@
+package spicy
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCachedRawWrapperSkipsToolchain(t *testing.T) {
+	assert := assert.New(t)
+	dir := t.TempDir()
+	include := filepath.Join(dir, "data.bin")
+	assert.Nil(ioutil.WriteFile(include, []byte("payload"), 0644))
+	newWave := func() *Wave {
+		return &Wave{Name: "wave", RawSegments: []*Segment{{Name: "data", Includes: []string{include}, Flags: Flags{Raw: true}}}}
+	}
+	cache := &Cache{Dir: filepath.Join(dir, "cache")}
+
+	ld := &fakeRunner{output: []byte("wrapped")}
+	_, err := PrepareRawSegments(newWave(), ld, BuildOptions{Cache: cache})
+	assert.Nil(err)
+	assert.Equal(1, len(ld.calls))
+	assert.Nil(os.Remove(rawWrapperName(include, 0)))
+
+	_, err = PrepareRawSegments(newWave(), ld, BuildOptions{Cache: cache})
+	assert.Nil(err)
+	assert.Equal(1, len(ld.calls))
+	b, err := ioutil.ReadFile(rawWrapperName(include, 0))
+	assert.Nil(err)
+	assert.Equal("wrapped", string(b))
+
+	// Without a cache, as without --cache, the toolchain runs again even
+	// though a valid entry exists.
+	_, err = PrepareRawSegments(newWave(), ld, BuildOptions{})
+	assert.Nil(err)
+	assert.Equal(2, len(ld.calls))
+
+	// Another toolchain's outputs are never reused.
+	other := &Cache{Dir: cache.Dir, Toolchain: "other-ld"}
+	_, err = PrepareRawSegments(newWave(), ld, BuildOptions{Cache: other})
+	assert.Nil(err)
+	assert.Equal(3, len(ld.calls))
+
+	assert.Nil(cache.Clean())
+	_, err = os.Stat(cache.Dir)
+	assert.True(os.IsNotExist(err))
+}
@@ -0,0 +1,65 @@
+package spicy
+
+import (
+	"fmt"
+	"io"
+)
+
+// objectSegmentSymbols and rawSegmentSymbols are the kinds of boundary
+// symbol the linker script defines for each segment. RELOC segments also
+// have symbols bounding their relocation table.
+var (
+	objectSegmentSymbols = []string{"RomStart", "RomEnd", "Start", "TextStart", "TextEnd", "DataStart", "DataEnd", "BssStart", "BssEnd", "BssSize", "End"}
+	rawSegmentSymbols    = []string{"RomStart", "RomEnd", "DataStart", "DataEnd"}
+	relocSegmentSymbols  = append(append([]string{}, objectSegmentSymbols...), "RelocStart", "RelocEnd")
+)
+
+// WriteSegmentHeader writes a C header declaring the boundary symbols of
+// every segment in spec, such as
+//
+//	extern unsigned char _codeSegmentRomStart[];
+//
+// unsigned char is what libultra's u8 is, so the declarations agree with
+// any the game makes itself, without the header needing ultratypes.h.
+// Symbols are declared as arrays so that they decay to their address, which
+// is all a linker symbol has; the value of the BSS size symbol is its
+// address too. Segments included in several waves are declared once.
+func WriteSegmentHeader(w io.Writer, spec *Spec) error {
+	if _, err := fmt.Fprint(w, "/* Generated by spicy. Do not edit. */\n#ifndef SPICY_SEGMENTS_H\n#define SPICY_SEGMENTS_H\n"); err != nil {
+		return err
+	}
+	declared := map[string]bool{}
+	declare := func(seg *Segment, symbols []string) error {
+		if declared[seg.Name] {
+			return nil
+		}
+		declared[seg.Name] = true
+		if _, err := fmt.Fprintf(w, "\n/* %s */\n", seg.Name); err != nil {
+			return err
+		}
+		for _, s := range symbols {
+			if _, err := fmt.Fprintf(w, "extern unsigned char %s[];\n", seg.BoundarySymbol(s)); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	for _, wave := range spec.Waves {
+		for _, seg := range wave.ObjectSegments {
+			symbols := objectSegmentSymbols
+			if seg.Flags.Reloc {
+				symbols = relocSegmentSymbols
+			}
+			if err := declare(seg, symbols); err != nil {
+				return err
+			}
+		}
+		for _, seg := range wave.RawSegments {
+			if err := declare(seg, rawSegmentSymbols); err != nil {
+				return err
+			}
+		}
+	}
+	_, err := fmt.Fprint(w, "\n#endif\n")
+	return err
+}
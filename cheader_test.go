@@ -0,0 +1,63 @@
+package spicy
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os/exec"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWriteSegmentHeaderDeclaresSymbols(t *testing.T) {
+	assert := assert.New(t)
+	spec, err := ParseSpec(strings.NewReader(`
+beginseg
+  name "code"
+  flags BOOT OBJECT
+  entry boot
+  stack bootStack
+  include "code.o"
+endseg
+beginseg
+  name "level"
+  flags RAW
+  include "level.bin"
+endseg
+beginwave
+  name "game"
+  include "code"
+  include "level"
+endwave
+beginwave
+  name "demo"
+  include "code"
+endwave
+`))
+	assert.Nil(err)
+	b := &bytes.Buffer{}
+	assert.Nil(WriteSegmentHeader(b, spec))
+	header := b.String()
+	for _, s := range []string{"RomStart", "RomEnd", "TextStart", "DataEnd", "BssStart", "BssEnd", "BssSize"} {
+		assert.Contains(header, "extern unsigned char _codeSegment"+s+"[];\n")
+	}
+	assert.Contains(header, "extern unsigned char _levelSegmentRomStart[];\n")
+	assert.Contains(header, "extern unsigned char _levelSegmentRomEnd[];\n")
+	assert.NotContains(header, "_levelSegmentBssStart")
+	assert.Equal(1, strings.Count(header, "_codeSegmentRomStart"))
+
+	if _, err := exec.LookPath("gcc"); err != nil {
+		t.Skip("gcc not available")
+	}
+	chdirTemp(t)
+	assert.Nil(ioutil.WriteFile("segments.h", b.Bytes(), 0644))
+	assert.Nil(ioutil.WriteFile("use.c", []byte(`#include "segments.h"
+#include "segments.h"
+typedef unsigned char u8;
+extern u8 _codeSegmentRomStart[];
+unsigned long levelSize(void) { return _levelSegmentRomEnd - _levelSegmentRomStart; }
+`), 0644))
+	out, err := exec.Command("gcc", "-std=c89", "-pedantic-errors", "-fsyntax-only", "use.c").CombinedOutput()
+	assert.Nil(err, string(out))
+}
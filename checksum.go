@@ -0,0 +1,136 @@
+package spicy
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"math/bits"
+	"os"
+)
+
+const (
+	// ChecksumOffset is where the two checksum words live in the ROM header.
+	ChecksumOffset = 0x10
+	checksumStart  = 0x1000
+	checksumLength = 0x100000
+	bootcodeStart  = 0x40
+)
+
+// CIC identifies the lockout chip a ROM's bootcode was written for, which
+// selects the checksum variant.
+type CIC int
+
+const (
+	CIC6101 CIC = 6101
+	CIC6102 CIC = 6102
+	CIC6103 CIC = 6103
+	CIC6105 CIC = 6105
+	CIC6106 CIC = 6106
+)
+
+var cicSeeds = map[CIC]uint32{
+	CIC6101: 0xF8CA4DDC,
+	CIC6102: 0xF8CA4DDC,
+	CIC6103: 0xA3886759,
+	CIC6105: 0xDF26F436,
+	CIC6106: 0x1FEA617A,
+}
+
+// CRC32s of the retail bootcodes, used to recognise them.
+var bootcodeCics = map[uint32]CIC{
+	0x6170A4A1: CIC6101,
+	0x90BB6CB5: CIC6102,
+	0x0B050EE0: CIC6103,
+	0x98BC2C86: CIC6105,
+	0xACC8580A: CIC6106,
+}
+
+// DetectCIC guesses the CIC from the ROM's bootcode, defaulting to 6102.
+func DetectCIC(rom []byte) CIC {
+	if len(rom) >= checksumStart {
+		if cic, ok := bootcodeCics[crc32.ChecksumIEEE(rom[bootcodeStart:checksumStart])]; ok {
+			return cic
+		}
+	}
+	return CIC6102
+}
+
+func romWord(rom []byte, i int) uint32 {
+	if i+4 > len(rom) {
+		// Treat anything past the end of a short ROM as zero.
+		var word [4]byte
+		if i < len(rom) {
+			copy(word[:], rom[i:])
+		}
+		return binary.BigEndian.Uint32(word[:])
+	}
+	return binary.BigEndian.Uint32(rom[i:])
+}
+
+// ComputeChecksum calculates the two header checksum words that the CIC
+// verifies at boot, over the first megabyte of code following the header.
+func ComputeChecksum(rom []byte) (uint32, uint32) {
+	cic := DetectCIC(rom)
+	seed := cicSeeds[cic]
+	t1, t2, t3, t4, t5, t6 := seed, seed, seed, seed, seed, seed
+	for i := checksumStart; i < checksumStart+checksumLength; i += 4 {
+		d := romWord(rom, i)
+		if t6+d < t6 {
+			t4++
+		}
+		t6 += d
+		t3 ^= d
+		r := bits.RotateLeft32(d, int(d&0x1F))
+		t5 += r
+		if t2 > d {
+			t2 ^= r
+		} else {
+			t2 ^= t6 ^ d
+		}
+		if cic == CIC6105 {
+			t1 += romWord(rom, bootcodeStart+0x0710+(i&0xFF)) ^ d
+		} else {
+			t1 += t5 ^ d
+		}
+	}
+	switch cic {
+	case CIC6103:
+		return (t6 ^ t4) + t3, (t5 ^ t2) + t1
+	case CIC6106:
+		return (t6 * t4) + t3, (t5 * t2) + t1
+	default:
+		return t6 ^ t4 ^ t3, t5 ^ t2 ^ t1
+	}
+}
+
+// FixChecksumFile recomputes the checksum of the ROM at path and rewrites
+// the header checksum words in place, leaving the rest of the file untouched.
+func FixChecksumFile(path string) error {
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	if info.Size() < checksumStart {
+		f.Close()
+		return fmt.Errorf("%s is too small to be a ROM: 0x%x bytes", path, info.Size())
+	}
+	rom := make([]byte, info.Size())
+	if _, err := f.ReadAt(rom, 0); err != nil {
+		f.Close()
+		return err
+	}
+	crc1, crc2 := ComputeChecksum(rom)
+	words := make([]byte, 8)
+	binary.BigEndian.PutUint32(words[0:], crc1)
+	binary.BigEndian.PutUint32(words[4:], crc2)
+	if _, err := f.WriteAt(words, ChecksumOffset); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
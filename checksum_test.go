@@ -0,0 +1,38 @@
+package spicy
+
+import (
+	"encoding/binary"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestComputeChecksumOfBlankRom(t *testing.T) {
+	assert := assert.New(t)
+	crc1, crc2 := ComputeChecksum(make([]byte, 0x101000))
+	assert.Equal(uint32(0xF8CA4DDC), crc1)
+	assert.Equal(uint32(0x303A4DDC), crc2)
+}
+
+func TestFixChecksumFileAfterPatching(t *testing.T) {
+	assert := assert.New(t)
+	rom := make([]byte, 0x101010)
+	rom[0x101008] = 0xab // Outside the checksummed region.
+	path := filepath.Join(t.TempDir(), "rom.n64")
+	assert.Nil(ioutil.WriteFile(path, rom, 0644))
+	assert.Nil(FixChecksumFile(path))
+
+	patched, err := ioutil.ReadFile(path)
+	assert.Nil(err)
+	patched[0x1234] = 0x5a
+	assert.Nil(ioutil.WriteFile(path, patched, 0644))
+	assert.Nil(FixChecksumFile(path))
+
+	fixed, err := ioutil.ReadFile(path)
+	assert.Nil(err)
+	assert.Equal(uint32(0x08CA4DDD), binary.BigEndian.Uint32(fixed[ChecksumOffset:]))
+	assert.Equal(uint32(0xA43A4DDC), binary.BigEndian.Uint32(fixed[ChecksumOffset+4:]))
+	assert.Equal(patched[ChecksumOffset+8:], fixed[ChecksumOffset+8:])
+}
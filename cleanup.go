@@ -0,0 +1,125 @@
+package spicy
+
+import (
+	"os"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Cleanup tracks files that should be removed if a build is interrupted,
+// such as temporary files and a partially written ROM. A nil Cleanup tracks
+// nothing.
+type Cleanup struct {
+	mu    sync.Mutex
+	paths []string
+}
+
+// Add records path for removal.
+func (c *Cleanup) Add(path string) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.paths = append(c.paths, path)
+}
+
+// Forget stops tracking path, for files that were completed and should be
+// kept.
+func (c *Cleanup) Forget(path string) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for i, p := range c.paths {
+		if p == path {
+			c.paths = append(c.paths[:i], c.paths[i+1:]...)
+			return
+		}
+	}
+}
+
+// Remove deletes every tracked file that still exists.
+func (c *Cleanup) Remove() {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, path := range c.paths {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			log.Warnf("Could not remove %s: %v", path, err)
+		}
+	}
+	c.paths = nil
+}
+
+// Finishers holds functions that finish outputs written over a whole run,
+// such as a CPU profile or a trace, so that an interrupt completes them
+// rather than cutting them short. A nil Finishers holds nothing.
+type Finishers struct {
+	mu    sync.Mutex
+	funcs []*finisher
+}
+
+type finisher struct {
+	once sync.Once
+	fn   func()
+}
+
+// Add records fn and returns a function running it, for the caller to defer.
+// Whichever of that function and Run comes first runs fn; fn never runs
+// twice.
+func (f *Finishers) Add(fn func()) func() {
+	fin := &finisher{fn: fn}
+	if f != nil {
+		f.mu.Lock()
+		f.funcs = append(f.funcs, fin)
+		f.mu.Unlock()
+	}
+	return func() { fin.once.Do(fin.fn) }
+}
+
+// Run runs each recorded function that has not run yet, the last added
+// first.
+func (f *Finishers) Run() {
+	if f == nil {
+		return
+	}
+	f.mu.Lock()
+	funcs := f.funcs
+	f.funcs = nil
+	f.mu.Unlock()
+	for i := len(funcs) - 1; i >= 0; i-- {
+		funcs[i].once.Do(funcs[i].fn)
+	}
+}
+
+// removeTempFiles deletes paths, which are no longer needed, and stops
+// tracking them in c.
+func removeTempFiles(c *Cleanup, paths []string) {
+	for _, path := range paths {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			log.Warnf("Could not remove %s: %v", path, err)
+		}
+		c.Forget(path)
+	}
+}
+
+// HandleInterrupt waits for a signal on signals, then runs finishers,
+// removes the files tracked by each of cleanups, such as a build's
+// BuildOptions.TempFiles, and calls exit with a non-zero status.
+func HandleInterrupt(signals <-chan os.Signal, exit func(int), finishers *Finishers, cleanups ...*Cleanup) {
+	sig, ok := <-signals
+	if !ok {
+		return
+	}
+	log.Warnf("Interrupted by %v, cleaning up.", sig)
+	finishers.Run()
+	for _, c := range cleanups {
+		c.Remove()
+	}
+	exit(130)
+}
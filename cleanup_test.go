@@ -0,0 +1,79 @@
+package spicy
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestInterruptRemovesPartialOutputs(t *testing.T) {
+	assert := assert.New(t)
+	dir := t.TempDir()
+	partial := filepath.Join(dir, "rom.n64")
+	finished := filepath.Join(dir, "rom.wave0.n64")
+	assert.Nil(ioutil.WriteFile(partial, []byte("half a ROM"), 0644))
+	assert.Nil(ioutil.WriteFile(finished, []byte("a whole ROM"), 0644))
+	c := &Cleanup{}
+	c.Add(finished)
+	c.Add(partial)
+	c.Forget(finished)
+	temps := &Cleanup{}
+	temp, err := writeTempFile(strings.NewReader("temp"), "input", temps)
+	assert.Nil(err)
+
+	var ran []string
+	finishers := &Finishers{}
+	finishers.Add(func() { ran = append(ran, "profile") })
+	closeTrace := finishers.Add(func() { ran = append(ran, "trace") })
+
+	signals := make(chan os.Signal, 1)
+	signals <- os.Interrupt
+	status := 0
+	HandleInterrupt(signals, func(code int) { status = code }, finishers, c, temps)
+
+	assert.NotEqual(0, status)
+	assert.Equal([]string{"trace", "profile"}, ran)
+	// The deferred call of a finisher that already ran does nothing.
+	closeTrace()
+	assert.Equal([]string{"trace", "profile"}, ran)
+	_, err = os.Stat(partial)
+	assert.True(os.IsNotExist(err))
+	_, err = os.Stat(temp)
+	assert.True(os.IsNotExist(err))
+	_, err = os.Stat(finished)
+	assert.Nil(err)
+}
+
+// runnerFunc runs itself.
+type runnerFunc func(r io.Reader, args []string) (io.Reader, error)
+
+func (f runnerFunc) Run(r io.Reader, args []string) (io.Reader, error) {
+	return f(r, args)
+}
+
+func TestMappedFileRunnerTracksInputsWhileTheyExist(t *testing.T) {
+	assert := assert.New(t)
+	temps := &Cleanup{}
+	output := filepath.Join(t.TempDir(), "out")
+	var inputs []string
+	ld := WithTempFiles(temps)(runnerFunc(func(r io.Reader, args []string) (io.Reader, error) {
+		inputs = append([]string{}, temps.paths...)
+		for _, path := range inputs {
+			_, err := os.Stat(path)
+			assert.Nil(err)
+		}
+		return &bytes.Buffer{}, ioutil.WriteFile(output, nil, 0644)
+	}))
+	_, err := NewMappedFileRunner(ld, map[string]io.Reader{"script": strings.NewReader("script")}, output).Run(nil, []string{"-T", "script"})
+	assert.Nil(err)
+	assert.Equal(1, len(inputs))
+	assert.Empty(temps.paths)
+	_, err = os.Stat(inputs[0])
+	assert.True(os.IsNotExist(err))
+}
@@ -1,29 +1,37 @@
 package main
 
 import (
-	"errors"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
 	"io/ioutil"
 	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
 
 	log "github.com/sirupsen/logrus"
 	flag "github.com/spf13/pflag"
 
 	"github.com/TheEssem/spicy"
-	"github.com/trhodeos/n64rom"
 )
 
 var (
 	verbose                        = flag.BoolP("verbose", "d", false, "print verbose information")
+	showCommands                   = flag.Bool("show-commands", false, "print each toolchain command line without the rest of the verbose output")
 	linkEditorVerbose              = flag.BoolP("verbose_linking", "m", false, "print verbose information when link editing")
 	disableOverlappingSectionCheck = flag.BoolP("disable_overlapping_section_checks", "o", false, "disable checks for overlapping sections")
-	romsizeMbits                   = flag.IntP("romsize", "s", -1, "ROM size (Mbit)")
+	romsizeMbits                   = flag.IntP("romsize", "s", -1, "ROM size (Mbit, of 2^20 bits each)")
 	filldata                       = flag.IntP("filldata_byte", "f", 0x0, "fill byte for data in the ROM image")
-	bootstrapFilename              = flag.StringP("bootstrap_file", "b", "Boot", "bootstrap file (not currently used)")
+	bootstrapFilename              = flag.StringP("bootstrap_file", "b", "Boot", "bootcode file written between the header and the code at 0x1000")
 	headerFilename                 = flag.StringP("romheader_file", "h", "romheader", "header file (not currently used)")
 	pifBootstrapFilename           = flag.StringP("pif2boot_file", "p", "pif2Boot", "PIF bootstrap file (not currently used)")
 	romImageFile                   = flag.StringP("rom_name", "r", "rom.n64", "output ROM image filename")
-	elfFile                        = flag.StringP("rom_elf_name", "e", "rom.out", "output ROM image filename")
+	splitWaves                     = flag.Bool("split-waves", false, "write each wave to its own ROM image, named <rom>.wave<N>.n64")
+	baseRom                        = flag.String("base-rom", "", "existing ROM image to write the spec's waves over")
+	elfFile                        = flag.StringP("rom_elf_name", "e", "rom.out", "output ELF filename, written with --split-debug")
 	defineFlags                    = flag.StringArrayP("define", "D", nil, "macro definition for preprocessor")
 	includeFlags                   = flag.StringArrayP("include", "I", nil, "header search path for preprocessor")
 	undefineFlags                  = flag.StringArrayP("undefine", "U", nil, "macros to undefine in preprocessor")
@@ -35,6 +43,70 @@ var (
 	cppCommand      = flag.String("cpp_command", "", "cpp command to use")
 	objcopyCommand  = flag.String("objcopy_command", "", "objcopy command to use")
 	fontFilename    = flag.String("font_filename", "font", "Font filename")
+	failFast        = flag.Bool("fail-fast", false, "stop at the first error in the spec's segments and waves instead of reporting all of them; a syntax error always stops parsing")
+	strict          = flag.Bool("strict", false, "reject unknown spec keywords and treat suspicious inputs as errors")
+	strictEnv       = flag.Bool("strict-env", false, "error if a spec include references an unset environment variable")
+	outputFormat    = flag.String("output-format", "binary", "format of the output ROM image: binary, ihex or srec")
+	autoSplit       = flag.Bool("auto-split", false, "split RAW segments exceeding their maxsize into numbered sub-segments")
+	dedupeRaw       = flag.Bool("dedupe-raw", false, "store byte-identical RAW segments in the ROM only once")
+	segmentFilters  = flag.StringArray("segment-filter", nil, "pipe a segment's binary through an external command, given as name=cmd")
+	embedVersion    = flag.String("embed-version", "", "write this NUL-terminated version string into the ROM")
+	versionOffset   = flag.Int64("version-offset", 0, "ROM offset for --embed-version; defaults to just after the last segment")
+	saveEntryAsm    = flag.String("save-entry-asm", "", "write the generated entry stub assembly to this path")
+	mkdir           = flag.Bool("mkdir", false, "create the output ROM's directory if it does not exist")
+	headerTemplate  = flag.String("header-template", "", "64-byte file to use as the ROM header, with the checksum recomputed")
+	combinedElf     = flag.String("combined-elf", "", "also write one ELF holding the sections of every wave, for debuggers")
+	gzipRom         = flag.Bool("gzip", false, "also write a gzip-compressed copy of the ROM, named <rom>.gz")
+	gzipOnly        = flag.Bool("gzip-only", false, "write only the gzip-compressed ROM")
+	printToolchain  = flag.Bool("print-toolchain", false, "print the full path of each toolchain command and exit")
+	useCache        = flag.Bool("cache", false, "reuse toolchain outputs cached by earlier builds with the same inputs, arguments and toolchain")
+	noCache         = flag.Bool("no-cache", false, "neither read nor write the cache, even with --cache, so every toolchain step runs again")
+	cleanCache      = flag.Bool("clean-cache", false, "remove the cache of toolchain outputs before building, or alone, without a spec")
+	allowHeader     = flag.Bool("allow-header-overlap", false, "allow segments to be placed over the header and bootcode")
+	codeAlign       = flag.Uint64("code-align", 0, "required VRAM alignment of code segments, or 0 to not check")
+	segmentCrc      = flag.Bool("segment-crc", false, "embed a table of each segment's CRC32 after the last segment")
+	roundPow2       = flag.Bool("round-pow2", false, "pad the ROM up to the next power-of-two size in Mbit")
+	allowEmpty      = flag.Bool("allow-empty", false, "write the ROM even if the spec places no data in it")
+	piConfig        = flag.Uint32("pi-config", spicy.DefaultPiConfig, "PI BSD domain 1 configuration word at the start of the header")
+	noPreprocess    = flag.Bool("no-preprocess", false, "parse the spec as it is, without running cpp over it")
+	maxProcs        = flag.Int("max-procs", 0, "maximum number of toolchain processes to run at once, or 0 for no limit")
+	debuggerMaps    = flag.StringArray("debugger-map", nil, "write the linked symbols for an emulator debugger, given as format:path; formats are ares and generic")
+	splitDebug      = flag.Bool("split-debug", false, "write the linked ELF without debug sections to the -e file, and its debug sections to <elf>.debug")
+	sysroot         = flag.String("sysroot", "", "sysroot passed to cpp and ld with --sysroot")
+	errorsJSON      = flag.Bool("errors-json", false, "report errors to stderr as a JSON array of {file, line, col, stage, message}")
+	cpuProfile      = flag.String("cpuprofile", "", "write a pprof CPU profile of the run to this file")
+	memProfile      = flag.String("memprofile", "", "write a pprof heap profile at the end of the run to this file")
+	quiet           = flag.BoolP("quiet", "q", false, "print nothing but errors")
+	ifNewer         = flag.Bool("if-newer", false, "skip the build if the ROM is newer than the spec and everything it includes")
+	romBytes        = flag.String("rom-bytes", "", "ROM size in bytes, such as 8M or 0x800000; cannot be used with -s")
+	logStages       = flag.StringSlice("log-stage", nil, "print debug output for only these comma-separated stages: "+strings.Join(spicy.PipelineStages, ", "))
+	iquoteFlags     = flag.StringArray("iquote", nil, "header search path for quoted includes only, searched before -I paths")
+	isystemFlags    = flag.StringArray("isystem", nil, "system header search path, searched after -I paths")
+	cppArgs         = flag.StringArray("cpp-arg", nil, "extra argument to pass to the preprocessor as it is, such as -nostdinc")
+	expectSha256    = flag.String("expect-sha256", "", "fail if the SHA-256 of the built ROM image is not this hex digest")
+	defaultStack    = flag.String("default-stack-size", "", "allocate a NOLOAD stack of this size, such as 8K, for entry points declared without a stack")
+	entryOnly       = flag.String("entry-only", "", "only assemble the entry stub, writing the object to this path, without linking or writing a ROM")
+	orphanHandling  = flag.String("orphan-handling", "warn", "what ld does with sections the linker script does not place: "+strings.Join(spicy.OrphanHandlingModes, ", "))
+	maxRomSize      = flag.String("max-rom-size", "64M", "fail the build if the ROM image would be larger than this, such as 32M, or 0 for no limit")
+	cHeader         = flag.String("c-header", "", "write a C header declaring every segment's boundary symbols to this file")
+	explainCpp      = flag.Bool("explain-preprocess", false, "on a syntax error, show the failing line of the spec both as written and as cpp expanded it")
+	traceFile       = flag.String("trace", "", "write every stage, command and file of the build to this file, as one JSON object per line")
+	symbolFormat    = flag.String("symbol-format", "", "name segment boundary symbols after this format instead of _%sSegmentRomStart, such as %s_ROM_START")
+	splitCodeData   = flag.Bool("split-code-data", false, "write the RAW segments to <rom>.data.bin rather than the ROM, which keeps only the header and code, and the layout of each to <rom>.code.json and <rom>.data.json; code finds a segment in the data image at its RomStart less _DataRomStart")
+	externalEntry   = flag.Bool("allow-external-entry", false, "allow the header's initial PC to point outside the entry stub and every loaded code segment")
+	jobs            = flag.Int("jobs", 1, "number of waves to build at once; the ROM is still assembled in spec order. Waves are only linked one at a time, as linking writes fixed file names to the working directory, so this speeds up the checks and binarizing after it")
+	canonicalOrder  = flag.Bool("canonical-order", false, "build the spec a second time with its waves started in the opposite order, and fail if the ROMs differ")
+	configFile      = flag.String("config", "", "seed flags from this JSON config file instead of "+spicy.ConfigFileName+" in the spec's directory")
+	strictSizes     = flag.Bool("strict-sizes", false, "fail the build if any RAW segment with a maxsize is not exactly that size")
+	footerMagic     = flag.String("footer-magic", "", "end the ROM, after any padding, with these hex bytes and a CRC32 of everything before them")
+	dumpLayout      = flag.String("dump-layout", "", "print where every segment would be placed, worked out without linking, in this format and exit; the only format is json")
+	entryLang       = flag.String("entry-lang", "asm", "language to generate the entry stub in: "+strings.Join(spicy.EntryLangs, ", ")+"; C is compiled with the cpp command, which must be gcc")
+	depsTree        = flag.Bool("deps-tree", false, "print the spec's headers, waves, segments and includes as an indented tree with their sizes and exit")
+	werror          = flag.Bool("Werror", false, "fail the build if a toolchain command prints warnings, even though it succeeds; cpp preprocessing the spec is not checked")
+	defsyms         = flag.StringArray("defsym", nil, "define a symbol for the link, given as NAME=value, as ld's --defsym does")
+	memmap          = flag.String("memmap", "", "draw where every segment would be placed in the ROM and VRAM, worked out without linking, in this format and exit: "+strings.Join(spicy.MemoryMapFormats, ", "))
+	noGaps          = flag.Bool("no-gaps", false, "fail the build if any gap is left between segments in the ROM, or before the first of them, listing where each is")
+	padReport       = flag.Bool("pad-report", false, "print each gap left between segments in the ROM and the total bytes wasted")
 )
 
 /*
@@ -53,103 +125,908 @@ Uname Is passed to cpp(1) for use during its invocation.
 -B 0 An option that concerns only games supported by 64DD. Using this option creates a startup game. For information on startup games, please see Section 15.1, "Restarting," in the N64 Disk Drive Programming Manual.
 */
 
-func getCommand(flag, def string) string {
-	if flag != "" {
-		return flag
+// toolchain returns the toolchain given by --toolchain-prefix, with any
+// commands overridden by their own flags.
+func toolchain() spicy.Toolchain {
+	tc := spicy.NewToolchain(*toolchainPrefix)
+	for _, override := range []struct{ flag, command *string }{
+		{cppCommand, &tc.Cpp},
+		{ldCommand, &tc.Ld},
+		{asCommand, &tc.As},
+		{objcopyCommand, &tc.Objcopy},
+	} {
+		if *override.flag != "" {
+			*override.command = *override.flag
+		}
 	}
-	return *toolchainPrefix + def
+	return tc
 }
 
-func mainE() error {
-	flag.Parse()
-	if flag.NArg() != 1 {
+// toolchainRunner returns the runner for one of the toolchain's commands,
+// which waits for a slot in limit before each call. With --Werror it fails
+// the command if it prints warnings. The spec is preprocessed with a plain
+// runner, as its warnings are the spec's, not the toolchain's.
+func toolchainRunner(command string, limit *spicy.ProcessLimit) spicy.Runner {
+	if *werror {
+		return spicy.Chain(spicy.NewWarningsAsErrorsRunner(command), spicy.WithProcessLimit(limit))
+	}
+	return spicy.Chain(spicy.NewRunner(command), spicy.WithProcessLimit(limit))
+}
+
+// segmentFilterTransform builds a transform which pipes each named segment
+// through its external command, given as name=cmd, within limit.
+func segmentFilterTransform(filters []string, limit *spicy.ProcessLimit) (spicy.SegmentTransform, error) {
+	if len(filters) == 0 {
+		return nil, nil
+	}
+	commands := map[string][]string{}
+	for _, filter := range filters {
+		parts := strings.SplitN(filter, "=", 2)
+		if len(parts) != 2 || parts[0] == "" || len(strings.Fields(parts[1])) == 0 {
+			return nil, spicy.NewUsageError("invalid segment filter %q: expected name=cmd", filter)
+		}
+		commands[parts[0]] = strings.Fields(parts[1])
+	}
+	return func(name string, data []byte) ([]byte, error) {
+		command, ok := commands[name]
+		if !ok {
+			return data, nil
+		}
+		out, err := spicy.Chain(spicy.NewRunner(command[0]), spicy.WithProcessLimit(limit)).Run(bytes.NewReader(data), command[1:])
+		if err != nil {
+			return nil, err
+		}
+		return ioutil.ReadAll(out)
+	}, nil
+}
+
+// newCache returns the cache of tc's outputs in the default directory, or
+// nil if there is no such directory on this system.
+func newCache(tc spicy.Toolchain) *spicy.Cache {
+	dir, err := spicy.DefaultCacheDir()
+	if err != nil {
+		log.Debugf("Not caching: %v", err)
+		return nil
+	}
+	return &spicy.Cache{Dir: dir, Toolchain: tc.Identity()}
+}
+
+// buildCache returns the cache a build with tc reads and writes: the default
+// one with --cache, or nil without it or with --no-cache, which wins so that
+// it can override a config file.
+func buildCache(tc spicy.Toolchain) *spicy.Cache {
+	if !*useCache || *noCache {
+		return nil
+	}
+	return newCache(tc)
+}
+
+// applyConfig seeds the flags not given on the command line from --config,
+// or from the config file next to the first spec if there is one.
+func applyConfig() error {
+	path := *configFile
+	if path == "" {
 		if flag.NArg() == 0 {
-			return errors.New("missing argument: <spec>")
+			return nil
+		}
+		path = filepath.Join(filepath.Dir(flag.Arg(0)), spicy.ConfigFileName)
+		if _, err := os.Stat(path); os.IsNotExist(err) {
+			return nil
+		}
+	}
+	return applyConfigFile(flag.CommandLine, path)
+}
+
+// applyConfigFile seeds flags from the config file at path, which
+// spicy.ReadConfig reads. Flags already set on the command line are left
+// alone, so they override the config; a repeatable flag given there
+// replaces the config's values rather than adding to them.
+func applyConfigFile(flags *flag.FlagSet, path string) error {
+	config, err := spicy.ReadConfig(path)
+	if err != nil {
+		return err
+	}
+	for _, c := range config {
+		f := flags.Lookup(c.Name)
+		if f == nil || c.Name == "config" {
+			return spicy.NewUsageError("config %s sets unknown flag %q", path, c.Name)
+		}
+		if f.Changed {
+			continue
+		}
+		for _, v := range c.Values {
+			if err := flags.Set(c.Name, v); err != nil {
+				return spicy.NewUsageError("config %s: invalid value %q for flag %s: %v", path, v, c.Name, err)
+			}
+		}
+	}
+	return nil
+}
+
+// parseFlags parses args into flags, returning a usage error if they are
+// not valid, or flag.ErrHelp as it is if they asked for help.
+func parseFlags(flags *flag.FlagSet, args []string) error {
+	err := flags.Parse(args)
+	if err != nil && err != flag.ErrHelp {
+		return spicy.NewUsageError("%v", err)
+	}
+	return err
+}
+
+// romSize returns the size in bytes to pad the ROM of spec to, from
+// --rom-bytes or -s if either is given and from the spec's romsize
+// otherwise, or 0 to leave it unpadded.
+func romSize(spec *spicy.Spec) (int64, error) {
+	if *romBytes != "" {
+		if flag.CommandLine.Changed("romsize") {
+			return 0, spicy.NewUsageError("--rom-bytes cannot be used with -s")
 		}
-		return fmt.Errorf("invalid usage: got %d arguments, expected exactly 1", flag.NArg())
+		size, err := spicy.ParseNumber(*romBytes)
+		if err != nil {
+			return 0, spicy.NewUsageError("invalid --rom-bytes: %v", err)
+		}
+		return size, nil
+	}
+	if *romsizeMbits > 0 {
+		return spicy.MbitBytes(*romsizeMbits), nil
+	}
+	if spec.RomSize > 0 {
+		return spicy.MbitBytes(spec.RomSize), nil
 	}
-	if *verbose {
+	return 0, nil
+}
+
+// setVerbosity sets the level of the standard logger: debug output when
+// verbose, only errors when quiet, and warnings and errors otherwise.
+func setVerbosity(verbose bool, quiet bool) error {
+	switch {
+	case verbose && quiet:
+		return spicy.NewUsageError("--quiet cannot be used with --verbose")
+	case verbose:
 		log.SetLevel(log.DebugLevel)
-	} else {
+	case quiet:
+		log.SetLevel(log.ErrorLevel)
+	default:
 		log.SetLevel(log.WarnLevel)
 	}
-	f, err := os.Open(flag.Arg(0))
+	return nil
+}
+
+func mainE() error {
+	args, err := spicy.ExpandResponseFiles(os.Args[1:])
 	if err != nil {
-		return fmt.Errorf("could not open spec: %v", err)
+		return err
 	}
-	defer f.Close()
-
-	gcc := spicy.NewRunner(getCommand(*cppCommand, "gcc"))
-	ld := spicy.NewRunner(getCommand(*ldCommand, "ld"))
-	as := spicy.NewRunner(getCommand(*asCommand, "as"))
-	objcopy := spicy.NewRunner(getCommand(*objcopyCommand, "objcopy"))
-	preprocessed, err := spicy.PreprocessSpec(f, gcc, *includeFlags, *defineFlags, *undefineFlags)
+	flag.CommandLine.Init(os.Args[0], flag.ContinueOnError)
+	if err := parseFlags(flag.CommandLine, args); err != nil {
+		return err
+	}
+	if err := applyConfig(); err != nil {
+		return err
+	}
+	if err := setVerbosity(*verbose, *quiet); err != nil {
+		return err
+	}
+	if err := spicy.LogStages(*logStages); err != nil {
+		return err
+	}
+	if *traceFile != "" {
+		f, err := os.Create(*traceFile)
+		if err != nil {
+			return fmt.Errorf("could not create trace: %v", err)
+		}
+		tracer = spicy.NewTracer(f)
+		// The trace is closed through t, as an interrupt may close it while
+		// tracer is being reset.
+		t := tracer
+		closeTrace := finishers.Add(func() {
+			t.Stop()
+			if err := f.Close(); err != nil {
+				log.Errorln("Error: could not write trace:", err)
+			}
+		})
+		defer func() {
+			tracer = nil
+			closeTrace()
+		}()
+	}
+	profiler, err := spicy.StartProfiling(*cpuProfile, *memProfile)
 	if err != nil {
-		return fmt.Errorf("could not preprocess spec: %v", err)
+		return err
 	}
-	spec, err := spicy.ParseSpec(preprocessed)
+	defer finishers.Add(func() {
+		if err := profiler.Stop(); err != nil {
+			log.Errorln("Error:", err)
+		}
+	})()
+	tc := toolchain()
+	if *printToolchain {
+		return tc.Print(os.Stdout)
+	}
+	if flag.NArg() == 0 && !*cleanCache {
+		return spicy.NewUsageError("missing argument: <spec>")
+	}
+	spicy.ShowCommands(*showCommands)
+	// One limit is shared by every runner, however many waves --jobs builds
+	// at once.
+	limit := spicy.NewProcessLimit(*maxProcs)
+	transform, err := segmentFilterTransform(*segmentFilters, limit)
+	if err != nil {
+		return err
+	}
+	maps, err := parseDebuggerMaps(*debuggerMaps)
 	if err != nil {
-		return fmt.Errorf("could not parse spec: %v", err)
+		return err
+	}
+	knownOrphanHandling := false
+	for _, mode := range spicy.OrphanHandlingModes {
+		knownOrphanHandling = knownOrphanHandling || mode == *orphanHandling
+	}
+	if !knownOrphanHandling {
+		return spicy.NewUsageError("unknown --orphan-handling %q: expected one of %s", *orphanHandling, strings.Join(spicy.OrphanHandlingModes, ", "))
+	}
+	knownEntryLang := false
+	for _, lang := range spicy.EntryLangs {
+		knownEntryLang = knownEntryLang || lang == *entryLang
 	}
+	if !knownEntryLang {
+		return spicy.NewUsageError("unknown --entry-lang %q: expected one of %s", *entryLang, strings.Join(spicy.EntryLangs, ", "))
+	}
+	if *expectSha256 != "" {
+		if b, err := hex.DecodeString(*expectSha256); err != nil || len(b) != sha256.Size {
+			return spicy.NewUsageError("invalid --expect-sha256 %q: expected %d hex digits", *expectSha256, 2*sha256.Size)
+		}
+	}
+	if _, ok := spicy.OutputFormatExtensions[*outputFormat]; !ok {
+		return spicy.NewUsageError("unknown output format %q", *outputFormat)
+	}
+	if err := spicy.CheckOutputPath(*romImageFile, *mkdir); err != nil {
+		return err
+	}
+	if *cleanCache {
+		if cache := newCache(tc); cache != nil {
+			if err := cache.Clean(); err != nil {
+				return fmt.Errorf("could not clean cache: %v", err)
+			}
+		}
+	}
+	if flag.NArg() == 0 {
+		return nil
+	}
+	p := &spicy.Pipeline{
+		Cpp:           spicy.Chain(spicy.NewRunner(tc.Cpp), spicy.WithProcessLimit(limit)),
+		Ld:            toolchainRunner(tc.Ld, limit),
+		As:            toolchainRunner(tc.As, limit),
+		Objcopy:       toolchainRunner(tc.Objcopy, limit),
+		IncludeFlags:  *includeFlags,
+		DefineFlags:   *defineFlags,
+		UndefineFlags: *undefineFlags,
+		CppArgs:       *cppArgs,
+		NoPreprocess:  *noPreprocess,
 
-	rom, err := n64rom.NewBlankRomFile(byte(*filldata))
+		QuoteIncludeFlags:  *iquoteFlags,
+		SystemIncludeFlags: *isystemFlags,
+		BuildOptions: spicy.BuildOptions{
+			TempFiles:           tempFiles,
+			Tracer:              tracer,
+			AutoSplit:           *autoSplit,
+			DedupeRaw:           *dedupeRaw,
+			DisableOverlapCheck: *disableOverlappingSectionCheck,
+			CodeAlign:           *codeAlign,
+			AllowHeaderOverlap:  *allowHeader,
+			Cache:               buildCache(tc),
+			FillByte:            byte(*filldata),
+			SegmentTransform:    transform,
+			Strict:              *strict,
+			Version:             *embedVersion,
+			VersionOffset:       *versionOffset,
+			SaveEntryAsm:        *saveEntryAsm,
+			SegmentCrc:          *segmentCrc,
+			RoundPow2:           *roundPow2,
+			AllowEmpty:          *allowEmpty,
+			KeepDebug:           *splitDebug,
+			Sysroot:             *sysroot,
+			OrphanHandling:      *orphanHandling,
+			AllowExternalEntry:  *externalEntry,
+			Jobs:                *jobs,
+			StrictSizes:         *strictSizes,
+			EntryLang:           *entryLang,
+			EntryCc:             toolchainRunner(tc.Cpp, limit),
+			Defsyms:             *defsyms,
+			NoGaps:              *noGaps,
+		},
+		CanonicalOrder: *canonicalOrder,
+	}
+	if *jobs < 1 {
+		return spicy.NewUsageError("invalid --jobs %d: at least one wave must be built at a time", *jobs)
+	}
+	for _, def := range *defsyms {
+		if err := spicy.CheckDefsym(def); err != nil {
+			return spicy.NewUsageError("invalid --defsym: %v", err)
+		}
+	}
+	if !*failFast {
+		p.ParseOptions = append(p.ParseOptions, spicy.AggregateErrors())
+	}
+	if *strict {
+		p.ParseOptions = append(p.ParseOptions, spicy.Strict())
+	}
+	if *strictEnv {
+		p.ParseOptions = append(p.ParseOptions, spicy.StrictEnv())
+	}
+	if *allowHeader {
+		p.ParseOptions = append(p.ParseOptions, spicy.AllowHeaderOverlap())
+	}
+	if *symbolFormat != "" {
+		if err := spicy.CheckSymbolFormat(*symbolFormat); err != nil {
+			return spicy.NewUsageError("invalid --symbol-format: %v", err)
+		}
+		p.ParseOptions = append(p.ParseOptions, spicy.SymbolFormat(*symbolFormat))
+	}
+	if *explainCpp {
+		p.ParseOptions = append(p.ParseOptions, spicy.ExplainPreprocess())
+	}
+	if *defaultStack != "" {
+		size, err := spicy.ParseNumber(*defaultStack)
+		if err != nil {
+			return spicy.NewUsageError("invalid --default-stack-size: %v", err)
+		}
+		p.ParseOptions = append(p.ParseOptions, spicy.DefaultStackSize(uint64(size)))
+	}
+	if *footerMagic != "" {
+		magic, err := hex.DecodeString(*footerMagic)
+		if err != nil {
+			return spicy.NewUsageError("invalid --footer-magic %q: %v", *footerMagic, err)
+		}
+		p.BuildOptions.FooterMagic = magic
+	}
+	maxSize, err := spicy.ParseNumber(*maxRomSize)
 	if err != nil {
-		return fmt.Errorf("n64rom.NewBlankRomFile: %v", err)
+		return spicy.NewUsageError("invalid --max-rom-size: %v", err)
 	}
-	for _, w := range spec.Waves {
-		for _, seg := range w.RawSegments {
-			for _, include := range seg.Includes {
-				f, err := os.Open(include)
-				if err != nil {
-					return fmt.Errorf("could not open include: %v", err)
-				}
-				spicy.CreateRawObjectWrapper(f, include+".o", ld)
+	p.BuildOptions.MaxRomSize = maxSize
+	if flag.CommandLine.Changed("bootstrap_file") {
+		bootcode, err := ioutil.ReadFile(*bootstrapFilename)
+		if err != nil {
+			return fmt.Errorf("could not read bootstrap file: %v", err)
+		}
+		if len(bootcode) > spicy.BootcodeSize {
+			return spicy.NewUsageError("bootstrap file %s must be at most %d bytes, got %d", *bootstrapFilename, spicy.BootcodeSize, len(bootcode))
+		}
+		p.BuildOptions.Bootcode = bootcode
+	}
+	if *headerTemplate != "" {
+		header, err := ioutil.ReadFile(*headerTemplate)
+		if err != nil {
+			return fmt.Errorf("could not read header template: %v", err)
+		}
+		if len(header) != spicy.HeaderSize {
+			return spicy.NewUsageError("header template %s must be exactly %d bytes, got %d", *headerTemplate, spicy.HeaderSize, len(header))
+		}
+		p.BuildOptions.Header = header
+	}
+	// Only an explicit --pi-config overrides the word in a header template or
+	// base ROM.
+	if flag.CommandLine.Changed("pi-config") {
+		p.BuildOptions.PiConfig = piConfig
+	}
+	if *baseRom != "" {
+		base, err := os.Open(*baseRom)
+		if err != nil {
+			return fmt.Errorf("could not open base ROM: %v", err)
+		}
+		defer base.Close()
+		p.BuildOptions.BaseRom = base
+	}
+
+	if *dumpLayout != "" && *dumpLayout != "json" {
+		return spicy.NewUsageError("unknown --dump-layout format %q; the only format is json", *dumpLayout)
+	}
+	knownMemmap := *memmap == ""
+	for _, format := range spicy.MemoryMapFormats {
+		knownMemmap = knownMemmap || format == *memmap
+	}
+	if !knownMemmap {
+		return spicy.NewUsageError("unknown --memmap format %q: expected one of %s", *memmap, strings.Join(spicy.MemoryMapFormats, ", "))
+	}
+	if *dumpLayout != "" && *memmap != "" {
+		return spicy.NewUsageError("--dump-layout and --memmap cannot be used together")
+	}
+
+	if *depsTree {
+		trees, err := p.DependencyTree(flag.Args()...)
+		if err != nil {
+			return err
+		}
+		for _, tree := range trees {
+			if err := tree.Write(os.Stdout); err != nil {
+				return err
 			}
 		}
-		entry, err := spicy.CreateEntryBinary(w, as)
+		return nil
+	}
+
+	spec, err := p.ParseFiles(flag.Args()...)
+	if err != nil {
+		return err
+	}
+	if *entryOnly != "" {
+		return writeEntryObjects(spec, spicy.Chain(p.As, spicy.WithTrace(tracer, "as")), spicy.Chain(p.BuildOptions.EntryCc, spicy.WithTrace(tracer, "cc")))
+	}
+	if *dumpLayout != "" || *memmap != "" {
+		layout, err := spicy.ComputeLayout(spec, p.LayoutOptions())
+		if err != nil {
+			return &spicy.PipelineError{Code: spicy.ExitBuild, Err: fmt.Errorf("could not compute layout: %w", err)}
+		}
+		if *memmap != "" {
+			return spicy.WriteMemoryMap(os.Stdout, layout, *memmap)
+		}
+		return spicy.WriteLayoutJSON(os.Stdout, spec, layout)
+	}
+	if *cHeader != "" {
+		if err := writeCHeader(spec, *cHeader); err != nil {
+			return err
+		}
+	}
+	if *ifNewer {
+		if *splitWaves {
+			return spicy.NewUsageError("--if-newer cannot be used with --split-waves")
+		}
+		target := romOutputPath(*romImageFile)
+		if *gzipOnly {
+			target += ".gz"
+		}
+		upToDate, err := spicy.UpToDate(target, spec.InputFiles())
 		if err != nil {
-			return fmt.Errorf("spicy.CreateEntryBinary: %v", err)
+			return fmt.Errorf("could not check %s: %v", target, err)
+		}
+		if upToDate {
+			log.Infof("%s is up to date.", target)
+			return nil
+		}
+	}
+	// Settings from the spec apply unless overridden on the command line.
+	if spec.Fill != nil && !flag.CommandLine.Changed("filldata_byte") {
+		p.BuildOptions.FillByte = *spec.Fill
+	}
+	if p.BuildOptions.RomSize, err = romSize(spec); err != nil {
+		return err
+	}
+	// The outputs are converted and split outside the build, so their
+	// objcopy commands are traced here.
+	objcopy := spicy.Chain(p.Objcopy, spicy.WithTrace(tracer, "objcopy"))
+
+	if *splitWaves {
+		if *combinedElf != "" {
+			return spicy.NewUsageError("--combined-elf cannot be used with --split-waves")
+		}
+		if len(maps) > 0 {
+			return spicy.NewUsageError("--debugger-map cannot be used with --split-waves")
+		}
+		if *splitDebug {
+			return spicy.NewUsageError("--split-debug cannot be used with --split-waves")
+		}
+		if *padReport {
+			return spicy.NewUsageError("--pad-report cannot be used with --split-waves")
 		}
-		linkedObject, err := spicy.LinkSpec(w, ld, entry)
+		if *expectSha256 != "" {
+			return spicy.NewUsageError("--expect-sha256 cannot be used with --split-waves")
+		}
+		if *splitCodeData {
+			return spicy.NewUsageError("--split-code-data cannot be used with --split-waves")
+		}
+		if *canonicalOrder {
+			return spicy.NewUsageError("--canonical-order cannot be used with --split-waves")
+		}
+		roms, err := spicy.BuildWaveRoms(spec, p.Ld, p.As, p.Objcopy, p.BuildOptions)
 		if err != nil {
-			return fmt.Errorf("spicy.LinkSpec: %v", err)
+			return &spicy.PipelineError{Code: spicy.ExitBuild, Err: err}
 		}
-		binarizedObject, err := spicy.BinarizeObject(linkedObject, objcopy)
+		ext := filepath.Ext(*romImageFile)
+		for i, rom := range roms {
+			path := fmt.Sprintf("%s.wave%d%s", strings.TrimSuffix(*romImageFile, ext), i, ext)
+			if err := writeRom(rom, path, objcopy); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	result, err := p.Build(spec)
+	if err != nil {
+		return err
+	}
+	for _, timing := range result.Timings {
+		log.Debugf("Stage %s %s took %v", timing.Stage, timing.Wave, timing.Duration)
+	}
+	if *combinedElf != "" {
+		spicy.ReportWaveConflicts(result.Layout)
+		if _, err := spicy.CombineObjects(result.Objects, objcopy, *combinedElf); err != nil {
+			return fmt.Errorf("spicy.CombineObjects: %v", err)
+		}
+	}
+	for _, m := range maps {
+		if err := writeDebuggerMap(m, result.Objects); err != nil {
+			return err
+		}
+	}
+	if *splitDebug {
+		if err := writeSplitDebug(result.Objects, objcopy); err != nil {
+			return err
+		}
+	}
+	if *padReport {
+		if err := spicy.WritePadReport(os.Stdout, result.Layout); err != nil {
+			return err
+		}
+	}
+	rom := result.Rom
+	if *splitCodeData {
+		split, err := spicy.SplitCodeData(result, p.BuildOptions)
 		if err != nil {
-			return fmt.Errorf("spicy.BinarizeObject: %v", err)
+			return &spicy.PipelineError{Code: spicy.ExitBuild, Err: err}
 		}
+		base := strings.TrimSuffix(*romImageFile, filepath.Ext(*romImageFile))
+		if err := ioutil.WriteFile(base+".data.bin", split.Data, 0644); err != nil {
+			return fmt.Errorf("could not write data image: %v", err)
+		}
+		tracer.File(base + ".data.bin")
+		if err := writeLayout(base+".code.json", spec, split.CodeLayout); err != nil {
+			return err
+		}
+		if err := writeLayout(base+".data.json", spec, split.DataLayout); err != nil {
+			return err
+		}
+		rom = split.Code
+	}
+	if err := writeRom(rom, *romImageFile, objcopy); err != nil {
+		return err
+	}
+	if *expectSha256 != "" {
+		// The ROM is still written, so that it can be compared with the
+		// expected one.
+		return spicy.CheckSha256(rom.Bytes(), *expectSha256)
+	}
+	return nil
+}
 
-		binarizedObjectBytes, err := ioutil.ReadAll(binarizedObject)
+// writeLayout writes layout, a layout of spec, to path as JSON.
+func writeLayout(path string, spec *spicy.Spec, layout []spicy.SegmentLayout) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return fmt.Errorf("could not create layout: %v", err)
+	}
+	defer f.Close()
+	if err := spicy.WriteLayoutJSON(f, spec, layout); err != nil {
+		return fmt.Errorf("could not write layout: %v", err)
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	tracer.File(path)
+	return nil
+}
+
+// writeCHeader writes the segment symbol declarations of spec to path.
+func writeCHeader(spec *spicy.Spec, path string) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return fmt.Errorf("could not create C header: %v", err)
+	}
+	defer f.Close()
+	if err := spicy.WriteSegmentHeader(f, spec); err != nil {
+		return fmt.Errorf("could not write C header: %v", err)
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	tracer.File(path)
+	return nil
+}
+
+// writeEntryObjects writes the entry object of each wave with a boot
+// segment to --entry-only. With several, each file name gets the wave's name
+// before its extension.
+func writeEntryObjects(spec *spicy.Spec, as spicy.Runner, cc spicy.Runner) error {
+	var waves []*spicy.Wave
+	for _, w := range spec.Waves {
+		if w.GetBootSegment() != nil {
+			waves = append(waves, w)
+		}
+	}
+	if len(waves) == 0 {
+		return fmt.Errorf("no wave has a boot segment to create an entry point for")
+	}
+	ext := filepath.Ext(*entryOnly)
+	for _, w := range waves {
+		path := *entryOnly
+		if len(waves) > 1 {
+			path = fmt.Sprintf("%s.%s%s", strings.TrimSuffix(*entryOnly, ext), w.Name, ext)
+		}
+		var err error
+		if *entryLang == "c" {
+			err = spicy.WriteCEntryObject(w, cc, path)
+		} else {
+			err = spicy.WriteEntryObject(w, as, path)
+		}
 		if err != nil {
-			return fmt.Errorf("could not read binarized object: %v", err)
+			return &spicy.PipelineError{Code: spicy.ExitBuild, Err: &spicy.StageError{Stage: "entry", Err: err}}
+		}
+		tracer.File(path)
+	}
+	return nil
+}
+
+// writeSplitDebug writes each wave's stripped ELF and debug companion. With
+// several waves, each file name gets the wave's name before its extension.
+func writeSplitDebug(objects []spicy.WaveObject, objcopy spicy.Runner) error {
+	ext := filepath.Ext(*elfFile)
+	base := strings.TrimSuffix(*elfFile, ext)
+	for _, obj := range objects {
+		stripped, debug := *elfFile, base+".debug"
+		if len(objects) > 1 {
+			stripped = fmt.Sprintf("%s.%s%s", base, obj.Wave, ext)
+			debug = fmt.Sprintf("%s.%s.debug", base, obj.Wave)
+		}
+		if err := spicy.SplitDebug(bytes.NewReader(obj.Linked), objcopy, stripped, debug); err != nil {
+			return fmt.Errorf("spicy.SplitDebug: %v", err)
+		}
+	}
+	return nil
+}
+
+// debuggerMap is one --debugger-map output.
+type debuggerMap struct {
+	format string
+	path   string
+}
+
+func parseDebuggerMaps(values []string) ([]debuggerMap, error) {
+	var maps []debuggerMap
+	for _, value := range values {
+		i := strings.Index(value, ":")
+		if i < 0 {
+			return nil, spicy.NewUsageError("invalid debugger map %q: expected format:path", value)
+		}
+		m := debuggerMap{format: value[:i], path: value[i+1:]}
+		known := false
+		for _, format := range spicy.DebuggerMapFormats {
+			known = known || format == m.format
 		}
-		rom.WriteAt(binarizedObjectBytes, n64rom.CodeStart)
+		if !known {
+			return nil, spicy.NewUsageError("unknown debugger map format %q", m.format)
+		}
+		maps = append(maps, m)
+	}
+	return maps, nil
+}
+
+func writeDebuggerMap(m debuggerMap, objects []spicy.WaveObject) error {
+	f, err := os.Create(m.path)
+	if err != nil {
+		return fmt.Errorf("could not write debugger map: %v", err)
+	}
+	if err := spicy.WriteDebuggerMap(f, m.format, objects); err != nil {
+		f.Close()
+		return fmt.Errorf("could not write debugger map: %v", err)
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	tracer.File(m.path)
+	return nil
+}
+
+// partialOutputs holds the output files being written, and tempFiles the
+// temporary files of the build in progress, which are removed if the build
+// is interrupted. finishers completes the profiles and trace of a run that
+// is interrupted. tracer records the build for --trace.
+var (
+	partialOutputs = &spicy.Cleanup{}
+	tempFiles      = &spicy.Cleanup{}
+	finishers      = &spicy.Finishers{}
+	tracer         *spicy.Tracer
+)
+
+// writeRom saves rom to path in the output format, replacing path's
+// extension for formats other than binary.
+func writeRom(rom *spicy.Rom, path string, objcopy spicy.Runner) error {
+	image := &bytes.Buffer{}
+	if _, err := rom.Save(image); err != nil {
+		return fmt.Errorf("could not write ROM: %v", err)
+	}
+	path = romOutputPath(path)
+	// With --gzip-only nothing is written to path, so a ROM already there is
+	// not removed if the build is interrupted.
+	if !*gzipOnly {
+		partialOutputs.Add(path)
+		defer partialOutputs.Forget(path)
+	}
+	output := image.Bytes()
+	if *outputFormat == "binary" {
+		if !*gzipOnly {
+			if err := ioutil.WriteFile(path, output, 0644); err != nil {
+				return fmt.Errorf("could not write ROM: %v", err)
+			}
+			tracer.File(path)
+		}
+	} else {
+		convertedPath := path
+		if *gzipOnly {
+			convertedPath = ""
+		}
+		converted, err := spicy.ConvertImage(image, objcopy, *outputFormat, convertedPath)
 		if err != nil {
-			return fmt.Errorf("could not write ROM: %v", err)
+			return fmt.Errorf("spicy.ConvertImage: %v", err)
+		}
+		if output, err = ioutil.ReadAll(converted); err != nil {
+			return fmt.Errorf("spicy.ConvertImage: %v", err)
 		}
+		if !*gzipOnly {
+			tracer.File(path)
+		}
+	}
+	if *gzipRom || *gzipOnly {
+		return writeGzip(output, path)
+	}
+	return nil
+}
+
+// romOutputPath returns the path writeRom saves a ROM named path to.
+func romOutputPath(path string) string {
+	if *outputFormat != "binary" {
+		return strings.TrimSuffix(path, filepath.Ext(path)) + spicy.OutputFormatExtensions[*outputFormat]
 	}
-	out, err := os.Create(*romImageFile)
+	return path
+}
+
+// writeGzip writes output compressed to path.gz.
+func writeGzip(output []byte, path string) error {
+	gzPath := path + ".gz"
+	partialOutputs.Add(gzPath)
+	defer partialOutputs.Forget(gzPath)
+	f, err := os.Create(gzPath)
 	if err != nil {
-		return fmt.Errorf("could not create ROM: %v", err)
+		return fmt.Errorf("could not write compressed ROM: %v", err)
 	}
-	// Pad the rom if necessary.
-	if *romsizeMbits > 0 {
-		minSize := int64(1000000 * *romsizeMbits / 8)
-		_, err := out.WriteAt([]byte{0}, minSize)
+	if err := spicy.WriteGzip(f, output, filepath.Base(path)); err != nil {
+		f.Close()
+		return fmt.Errorf("could not write compressed ROM: %v", err)
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	tracer.File(gzPath)
+	return nil
+}
+
+// fixCrcE implements "spicy fixcrc <rom>".
+func fixCrcE(args []string) error {
+	if len(args) != 1 {
+		return spicy.NewUsageError("invalid usage: expected spicy fixcrc <rom>")
+	}
+	return spicy.FixChecksumFile(args[0])
+}
+
+// diffFlags are the flags of the build that "spicy diff" takes too, for
+// building its specs.
+var diffFlags = []string{
+	"define", "include", "undefine", "iquote", "isystem", "cpp-arg",
+	"toolchain-prefix", "ld_command", "as_command", "cpp_command", "objcopy_command",
+}
+
+// diffE implements "spicy diff <a> <b> [spec...]". Given specs, it builds
+// them to find where each segment lies.
+func diffE(args []string) error {
+	flags := flag.NewFlagSet("diff", flag.ContinueOnError)
+	for _, name := range diffFlags {
+		flags.AddFlag(flag.CommandLine.Lookup(name))
+	}
+	if err := parseFlags(flags, args); err != nil {
+		return err
+	}
+	if flags.NArg() < 2 {
+		return spicy.NewUsageError("invalid usage: expected spicy diff <rom> <rom> [spec...]")
+	}
+	a, err := os.Open(flags.Arg(0))
+	if err != nil {
+		return fmt.Errorf("could not open ROM: %v", err)
+	}
+	defer a.Close()
+	b, err := os.Open(flags.Arg(1))
+	if err != nil {
+		return fmt.Errorf("could not open ROM: %v", err)
+	}
+	defer b.Close()
+	ranges, err := spicy.DiffROMs(a, b)
+	if err != nil {
+		return err
+	}
+	var layout []spicy.SegmentLayout
+	if flags.NArg() > 2 {
+		tc := toolchain()
+		p := &spicy.Pipeline{
+			Cpp:           spicy.NewRunner(tc.Cpp),
+			Ld:            spicy.NewRunner(tc.Ld),
+			As:            spicy.NewRunner(tc.As),
+			Objcopy:       spicy.NewRunner(tc.Objcopy),
+			IncludeFlags:  *includeFlags,
+			DefineFlags:   *defineFlags,
+			UndefineFlags: *undefineFlags,
+			CppArgs:       *cppArgs,
+
+			QuoteIncludeFlags:  *iquoteFlags,
+			SystemIncludeFlags: *isystemFlags,
+		}
+		spec, err := p.ParseFiles(flags.Args()[2:]...)
 		if err != nil {
 			return err
 		}
+		result, err := p.Build(spec)
+		if err != nil {
+			return err
+		}
+		layout = result.Layout
+	}
+	for _, r := range ranges {
+		fmt.Printf("0x%08x-0x%08x\t%d bytes\t%s\n", r.Start, r.End, r.End-r.Start, strings.Join(spicy.DiffRegions(r, layout), ", "))
+	}
+	return nil
+}
+
+// stubE implements "spicy stub --out <rom> [--bootcode <file>]".
+func stubE(args []string) error {
+	flags := flag.NewFlagSet("stub", flag.ContinueOnError)
+	out := flags.String("out", "", "path to write the stub ROM to; its code only loops, doing none of the setup real hardware needs, so it is meant for emulators and header checks")
+	bootcode := flags.String("bootcode", "", "file to copy into the bootcode region; without an IPL3 here, which spicy does not ship, real hardware will not boot the stub at all")
+	fill := flags.Int("filldata_byte", 0x0, "fill byte for the ROM image")
+	if err := flags.Parse(args); err != nil {
+		return spicy.NewUsageError("%v", err)
+	}
+	if *out == "" || flags.NArg() != 0 {
+		return spicy.NewUsageError("invalid usage: expected spicy stub --out <rom> [--bootcode <file>]")
+	}
+	var code []byte
+	if *bootcode != "" {
+		b, err := ioutil.ReadFile(*bootcode)
+		if err != nil {
+			return fmt.Errorf("could not read bootcode: %v", err)
+		}
+		code = b
 	}
-	_, err = rom.Save(out)
+	rom, err := spicy.NewStubRom(code, byte(*fill))
 	if err != nil {
+		return err
+	}
+	image := &bytes.Buffer{}
+	if _, err := rom.Save(image); err != nil {
+		return fmt.Errorf("could not write ROM: %v", err)
+	}
+	if err := ioutil.WriteFile(*out, image.Bytes(), 0644); err != nil {
 		return fmt.Errorf("could not write ROM: %v", err)
 	}
-	return out.Close()
+	return nil
 }
 
 func main() {
-	if err := mainE(); err != nil {
-		log.Errorln("Error:", err)
-		os.Exit(1)
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go spicy.HandleInterrupt(signals, os.Exit, finishers, partialOutputs, tempFiles)
+	var err error
+	if len(os.Args) > 1 && os.Args[1] == "fixcrc" {
+		err = fixCrcE(os.Args[2:])
+	} else if len(os.Args) > 1 && os.Args[1] == "diff" {
+		err = diffE(os.Args[2:])
+	} else if len(os.Args) > 1 && os.Args[1] == "stub" {
+		err = stubE(os.Args[2:])
+	} else {
+		err = mainE()
+	}
+	if err != nil && err != flag.ErrHelp {
+		if *errorsJSON {
+			spicy.WriteErrorsJSON(os.Stderr, err)
+		} else {
+			log.Errorln("Error:", err)
+		}
+		os.Exit(spicy.ExitCode(err))
 	}
 }
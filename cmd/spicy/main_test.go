@@ -0,0 +1,176 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	log "github.com/sirupsen/logrus"
+	flag "github.com/spf13/pflag"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/TheEssem/spicy"
+)
+
+func TestQuietSuppressesWarnings(t *testing.T) {
+	assert := assert.New(t)
+	logs := &bytes.Buffer{}
+	oldLevel := log.GetLevel()
+	log.SetOutput(logs)
+	defer func() {
+		log.SetOutput(os.Stderr)
+		log.SetLevel(oldLevel)
+	}()
+	assert.Nil(setVerbosity(false, true))
+	log.Warnln("segment is empty")
+	log.Errorln("build failed")
+	assert.NotContains(logs.String(), "segment is empty")
+	assert.Contains(logs.String(), "build failed")
+
+	assert.Nil(setVerbosity(false, false))
+	log.Warnln("segment is empty")
+	assert.Contains(logs.String(), "segment is empty")
+
+	assert.Equal(spicy.ExitUsage, spicy.ExitCode(setVerbosity(true, true)))
+}
+
+func TestConfigSeedsFlagsTheCommandLineDoesNotSet(t *testing.T) {
+	assert := assert.New(t)
+	config := filepath.Join(t.TempDir(), spicy.ConfigFileName)
+	assert.Nil(ioutil.WriteFile(config, []byte(`{
+		"toolchain-prefix": "mips64-elf-",
+		"include": ["include/one", "include/two"],
+		"strict": true,
+		"jobs": 4
+	}`), 0644))
+
+	flags := flag.NewFlagSet("spicy", flag.ContinueOnError)
+	prefix := flags.String("toolchain-prefix", "mips-linux-gnu-", "")
+	includes := flags.StringArrayP("include", "I", nil, "")
+	strict := flags.Bool("strict", false, "")
+	jobs := flags.Int("jobs", 1, "")
+	assert.Nil(flags.Parse([]string{"-I", "include/cli", "spec"}))
+	assert.Nil(applyConfigFile(flags, config))
+	assert.Equal("mips64-elf-", *prefix)
+	assert.Equal([]string{"include/cli"}, *includes)
+	assert.True(*strict)
+	assert.Equal(4, *jobs)
+
+	assert.Nil(ioutil.WriteFile(config, []byte(`{"toolchian-prefix": "mips64-elf-"}`), 0644))
+	var usage *spicy.UsageError
+	assert.True(errors.As(applyConfigFile(flags, config), &usage))
+	assert.Nil(ioutil.WriteFile(config, []byte(`{"jobs": "many"}`), 0644))
+	flags = flag.NewFlagSet("spicy", flag.ContinueOnError)
+	flags.Int("jobs", 1, "")
+	assert.True(errors.As(applyConfigFile(flags, config), &usage))
+}
+
+func TestRomBytesSetsRomSize(t *testing.T) {
+	assert := assert.New(t)
+	defer func() {
+		for _, name := range []string{"rom-bytes", "romsize"} {
+			f := flag.CommandLine.Lookup(name)
+			f.Value.Set(f.DefValue)
+			f.Changed = false
+		}
+	}()
+	spec := &spicy.Spec{RomSize: 32}
+	assert.Nil(parseFlags(flag.CommandLine, []string{"--rom-bytes", "8M", "game.spec"}))
+	size, err := romSize(spec)
+	assert.Nil(err)
+	assert.Equal(int64(8<<20), size)
+
+	assert.Nil(parseFlags(flag.CommandLine, []string{"-s", "16", "--rom-bytes", "8M", "game.spec"}))
+	_, err = romSize(spec)
+	assert.Equal(spicy.ExitUsage, spicy.ExitCode(err))
+}
+
+// countingLd counts its calls and writes a fixed object to the path after -o,
+// as ld does.
+type countingLd struct{ calls int }
+
+func (r *countingLd) Run(in io.Reader, args []string) (io.Reader, error) {
+	r.calls++
+	for i, arg := range args {
+		if arg == "-o" && i+1 < len(args) {
+			if err := ioutil.WriteFile(args[i+1], []byte("wrapped"), 0644); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return &bytes.Buffer{}, nil
+}
+
+func TestNoCacheReinvokesToolchainDespiteCacheEntry(t *testing.T) {
+	assert := assert.New(t)
+	oldCacheHome, hadCacheHome := os.LookupEnv("XDG_CACHE_HOME")
+	defer func() {
+		if hadCacheHome {
+			os.Setenv("XDG_CACHE_HOME", oldCacheHome)
+		} else {
+			os.Unsetenv("XDG_CACHE_HOME")
+		}
+		for _, name := range []string{"cache", "no-cache"} {
+			f := flag.CommandLine.Lookup(name)
+			f.Value.Set(f.DefValue)
+			f.Changed = false
+		}
+	}()
+	dir := t.TempDir()
+	os.Setenv("XDG_CACHE_HOME", filepath.Join(dir, "cache"))
+	include := filepath.Join(dir, "data.bin")
+	assert.Nil(ioutil.WriteFile(include, []byte("payload"), 0644))
+	newWave := func() *spicy.Wave {
+		return &spicy.Wave{Name: "wave", RawSegments: []*spicy.Segment{{Name: "data", Includes: []string{include}, Flags: spicy.Flags{Raw: true}}}}
+	}
+	build := func(ld spicy.Runner, args ...string) {
+		assert.Nil(parseFlags(flag.CommandLine, append(args, "game.spec")))
+		_, err := spicy.PrepareRawSegments(newWave(), ld, spicy.BuildOptions{Cache: buildCache(spicy.Toolchain{})})
+		assert.Nil(err)
+	}
+
+	ld := &countingLd{}
+	build(ld, "--cache")
+	assert.Equal(1, ld.calls)
+	build(ld, "--cache")
+	assert.Equal(1, ld.calls, "the cache entry should be valid")
+
+	build(ld, "--cache", "--no-cache")
+	assert.Equal(2, ld.calls)
+}
+
+func TestInterruptedGzipOnlyKeepsExistingRom(t *testing.T) {
+	assert := assert.New(t)
+	defer func() {
+		for _, name := range []string{"gzip-only", "output-format"} {
+			f := flag.CommandLine.Lookup(name)
+			f.Value.Set(f.DefValue)
+			f.Changed = false
+		}
+	}()
+	path := filepath.Join(t.TempDir(), "rom.hex")
+	assert.Nil(ioutil.WriteFile(path, []byte("an earlier ROM"), 0644))
+	rom, err := spicy.NewBlankRom(0xff)
+	assert.Nil(err)
+	assert.Nil(parseFlags(flag.CommandLine, []string{"--gzip-only", "--output-format", "ihex", "game.spec"}))
+	// objcopy is interrupted while it converts the image.
+	objcopy := runnerFunc(func(in io.Reader, args []string) (io.Reader, error) {
+		partialOutputs.Remove()
+		return &bytes.Buffer{}, ioutil.WriteFile(args[len(args)-1], []byte(":00000001FF\n"), 0644)
+	})
+	assert.Nil(writeRom(rom, path, objcopy))
+	b, err := ioutil.ReadFile(path)
+	assert.Nil(err)
+	assert.Equal("an earlier ROM", string(b))
+}
+
+// runnerFunc runs itself.
+type runnerFunc func(r io.Reader, args []string) (io.Reader, error)
+
+func (f runnerFunc) Run(r io.Reader, args []string) (io.Reader, error) {
+	return f(r, args)
+}
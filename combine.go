@@ -0,0 +1,144 @@
+package spicy
+
+import (
+	"bytes"
+	"debug/elf"
+	"fmt"
+	"io"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// WaveObject is the linked ELF object of one wave.
+type WaveObject struct {
+	Wave   string
+	Linked []byte
+}
+
+// CombineObjects merges the linked objects of several waves into a single
+// ELF at outputPath, for debuggers that want every segment in one file. Each
+// wave's sections are prefixed with its name, so that the same segment in
+// two waves is kept twice rather than merged, and the symbols defined in
+// those sections are carried over. Absolute symbols and sections without
+// contents, such as .bss, are only kept from the first wave.
+func CombineObjects(objects []WaveObject, objcopy Runner, outputPath string) (io.Reader, error) {
+	if len(objects) == 0 {
+		return nil, fmt.Errorf("no objects to combine")
+	}
+	prefixed, err := prefixSections(objects[0], objcopy)
+	if err != nil {
+		return nil, fmt.Errorf("could not rename sections of wave %s: %v", objects[0].Wave, err)
+	}
+	temps := tempFilesOf(objcopy)
+	var sections []string
+	defer func() { removeTempFiles(temps, sections) }()
+	var args []string
+	for _, obj := range objects[1:] {
+		waveArgs, err := addSectionArgs(obj, temps, &sections)
+		if err != nil {
+			return nil, fmt.Errorf("could not read object of wave %s: %v", obj.Wave, err)
+		}
+		args = append(args, waveArgs...)
+	}
+	mappedInputs := map[string]io.Reader{
+		"objFile": prefixed,
+	}
+	return NewMappedFileRunner(objcopy, mappedInputs, outputPath).Run( /* stdin=*/ nil, append(args, "objFile", outputPath))
+}
+
+func prefixSections(obj WaveObject, objcopy Runner) (io.Reader, error) {
+	output := TempFileName(".o")
+	mappedInputs := map[string]io.Reader{
+		"objFile": bytes.NewReader(obj.Linked),
+	}
+	defer removeTempFiles(nil, []string{output})
+	return NewMappedFileRunner(objcopy, mappedInputs, output).Run( /* stdin=*/ nil, []string{"--prefix-alloc-sections=." + obj.Wave, "objFile", output})
+}
+
+// addSectionArgs returns the objcopy arguments adding obj's loaded sections
+// and their symbols to another object. The files the sections are written
+// to are tracked in temps and added to written.
+func addSectionArgs(obj WaveObject, temps *Cleanup, written *[]string) ([]string, error) {
+	f, err := elf.NewFile(bytes.NewReader(obj.Linked))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var args []string
+	added := map[int]string{}
+	for i, sec := range f.Sections {
+		if sec.Flags&elf.SHF_ALLOC == 0 || sec.Type != elf.SHT_PROGBITS || sec.Size == 0 {
+			continue
+		}
+		data, err := sec.Data()
+		if err != nil {
+			return nil, err
+		}
+		path, err := writeTempFile(bytes.NewReader(data), "section", temps)
+		if err != nil {
+			return nil, err
+		}
+		*written = append(*written, path)
+		name := "." + obj.Wave + sec.Name
+		flags := "alloc,load,contents,data"
+		if sec.Flags&elf.SHF_EXECINSTR != 0 {
+			flags = "alloc,load,contents,code"
+		}
+		args = append(args,
+			"--add-section", fmt.Sprintf("%s=%s", name, path),
+			"--set-section-flags", fmt.Sprintf("%s=%s", name, flags),
+			"--change-section-address", fmt.Sprintf("%s=0x%x", name, sec.Addr))
+		added[i] = name
+	}
+	symbols, err := f.Symbols()
+	if err != nil && err != elf.ErrNoSymbols {
+		return nil, err
+	}
+	for _, sym := range symbols {
+		name, ok := added[int(sym.Section)]
+		if !ok || sym.Name == "" {
+			continue
+		}
+		kind := elf.ST_TYPE(sym.Info)
+		if kind == elf.STT_SECTION || kind == elf.STT_FILE {
+			continue
+		}
+		flags := "global"
+		if elf.ST_BIND(sym.Info) == elf.STB_LOCAL {
+			flags = "local"
+		}
+		switch kind {
+		case elf.STT_FUNC:
+			flags += ",function"
+		case elf.STT_OBJECT:
+			flags += ",object"
+		}
+		offset := sym.Value - f.Sections[sym.Section].Addr
+		args = append(args, "--add-symbol", fmt.Sprintf("%s=%s:0x%x,%s", sym.Name, name, offset, flags))
+	}
+	return args, nil
+}
+
+// ReportWaveConflicts logs a warning for each pair of segments from
+// different waves that occupy overlapping VRAM, as a debugger can only show
+// one of them at a given address. A segment shared by both waves at the same
+// place is not a conflict. The number of conflicts is returned.
+func ReportWaveConflicts(layout []SegmentLayout) int {
+	conflicts := 0
+	for i, a := range layout {
+		for _, b := range layout[i+1:] {
+			if a.Wave == b.Wave || a.VramEnd <= a.VramStart || b.VramEnd <= b.VramStart {
+				continue
+			}
+			if a.Name == b.Name && a.VramStart == b.VramStart && a.VramEnd == b.VramEnd {
+				continue
+			}
+			if a.VramStart < b.VramEnd && b.VramStart < a.VramEnd {
+				log.Warnf("Segment %s of wave %s (0x%x-0x%x) overlaps segment %s of wave %s (0x%x-0x%x) in the combined ELF.",
+					a.Name, a.Wave, a.VramStart, a.VramEnd, b.Name, b.Wave, b.VramStart, b.VramEnd)
+				conflicts++
+			}
+		}
+	}
+	return conflicts
+}
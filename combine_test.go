@@ -0,0 +1,63 @@
+package spicy
+
+import (
+	"debug/elf"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCombineObjectsKeepsSectionsOfEveryWave(t *testing.T) {
+	assert := assert.New(t)
+	for _, tool := range []string{"objcopy"} {
+		if _, err := exec.LookPath(tool); err != nil {
+			t.Skip(tool + " not available")
+		}
+	}
+	var objects []WaveObject
+	for _, name := range []string{"one", "two"} {
+		w := &Wave{Name: name, ObjectSegments: []*Segment{{
+			Name:        "code",
+			Includes:    []string{"code.o"},
+			Flags:       Flags{Object: true},
+			Positioning: Positioning{Address: 0x80000450},
+		}}}
+		linked := linkWithHostTools(t, w, map[string]string{
+			"code.o": "int " + name + "(void) { return 1; }\n",
+		})
+		objects = append(objects, WaveObject{Wave: name, Linked: linked})
+	}
+	output := filepath.Join(t.TempDir(), "combined.elf")
+	_, err := CombineObjects(objects, NewRunner("objcopy"), output)
+	assert.Nil(err)
+
+	f, err := elf.Open(output)
+	assert.Nil(err)
+	defer f.Close()
+	assert.NotNil(f.Section(".one..code"))
+	assert.NotNil(f.Section(".two..code"))
+	symbols, err := f.Symbols()
+	assert.Nil(err)
+	var names []string
+	for _, s := range symbols {
+		names = append(names, s.Name)
+	}
+	assert.Contains(names, "one")
+	assert.Contains(names, "two")
+}
+
+func TestReportWaveConflicts(t *testing.T) {
+	assert := assert.New(t)
+	logs := captureLogs(t, log.WarnLevel)
+	layout := []SegmentLayout{
+		{Wave: "one", Name: "code", VramStart: 0x80000450, VramEnd: 0x80001000},
+		{Wave: "two", Name: "code", VramStart: 0x80000450, VramEnd: 0x80001000},
+		{Wave: "one", Name: "level1", VramStart: 0x80100000, VramEnd: 0x80110000},
+		{Wave: "two", Name: "level2", VramStart: 0x80108000, VramEnd: 0x80118000},
+	}
+	assert.Equal(1, ReportWaveConflicts(layout))
+	assert.Contains(logs.String(), "Segment level1 of wave one")
+}
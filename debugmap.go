@@ -0,0 +1,83 @@
+package spicy
+
+import (
+	"bufio"
+	"bytes"
+	"debug/elf"
+	"fmt"
+	"io"
+	"sort"
+)
+
+// DebuggerMapFormats lists the symbol map formats WriteDebuggerMap can write:
+// "ares" is the [labels] file the ares debugger loads, and "generic" is one
+// "0xaddress symbol" line per symbol.
+var DebuggerMapFormats = []string{"ares", "generic"}
+
+type debuggerSymbol struct {
+	Name    string
+	Address uint64
+}
+
+// debuggerSymbols returns the named symbols the objects define in their
+// sections, sorted by address. Absolute symbols are left out, as the ones
+// spicy defines are mostly ROM offsets rather than addresses.
+func debuggerSymbols(objects []WaveObject) ([]debuggerSymbol, error) {
+	seen := map[debuggerSymbol]bool{}
+	var symbols []debuggerSymbol
+	for _, obj := range objects {
+		f, err := elf.NewFile(bytes.NewReader(obj.Linked))
+		if err != nil {
+			return nil, fmt.Errorf("could not read object of wave %s: %v", obj.Wave, err)
+		}
+		syms, err := f.Symbols()
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("could not read symbols of wave %s: %v", obj.Wave, err)
+		}
+		for _, sym := range syms {
+			typ := elf.ST_TYPE(sym.Info)
+			if sym.Name == "" || sym.Section == elf.SHN_ABS || sym.Section == elf.SHN_UNDEF || typ == elf.STT_SECTION || typ == elf.STT_FILE {
+				continue
+			}
+			s := debuggerSymbol{Name: sym.Name, Address: sym.Value}
+			if !seen[s] {
+				seen[s] = true
+				symbols = append(symbols, s)
+			}
+		}
+	}
+	sort.SliceStable(symbols, func(i, j int) bool {
+		if symbols[i].Address != symbols[j].Address {
+			return symbols[i].Address < symbols[j].Address
+		}
+		return symbols[i].Name < symbols[j].Name
+	})
+	return symbols, nil
+}
+
+// WriteDebuggerMap writes the symbols of the linked objects to w in one of
+// DebuggerMapFormats.
+func WriteDebuggerMap(w io.Writer, format string, objects []WaveObject) error {
+	var line string
+	switch format {
+	case "ares":
+		line = "%08x %s\n"
+	case "generic":
+		line = "0x%08x %s\n"
+	default:
+		return fmt.Errorf("unknown debugger map format %q", format)
+	}
+	symbols, err := debuggerSymbols(objects)
+	if err != nil {
+		return err
+	}
+	out := bufio.NewWriter(w)
+	if format == "ares" {
+		fmt.Fprintln(out, "[labels]")
+	}
+	for _, s := range symbols {
+		fmt.Fprintf(out, line, s.Address, s.Name)
+	}
+	return out.Flush()
+}
@@ -0,0 +1,42 @@
+package spicy
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAresDebuggerMap(t *testing.T) {
+	assert := assert.New(t)
+	spec, err := ParseSpec(strings.NewReader(`
+beginseg
+  name "code"
+  flags BOOT OBJECT
+  entry boot
+  stack bootStack
+  include "code.o"
+endseg
+beginwave
+  name "game"
+  include "code"
+endwave
+`))
+	assert.Nil(err)
+	linked := linkWithHostTools(t, spec.Waves[0], map[string]string{"code.o": "void boot(void) {}\n"})
+	objects := []WaveObject{{Wave: "game", Linked: linked}}
+
+	b := &bytes.Buffer{}
+	assert.Nil(WriteDebuggerMap(b, "ares", objects))
+	lines := strings.Split(b.String(), "\n")
+	assert.Equal("[labels]", lines[0])
+	assert.Contains(lines, "80000450 boot")
+	assert.NotContains(b.String(), "_codeSegmentRomStart")
+
+	b.Reset()
+	assert.Nil(WriteDebuggerMap(b, "generic", objects))
+	assert.Contains(strings.Split(b.String(), "\n"), "0x80000450 boot")
+
+	assert.NotNil(WriteDebuggerMap(b, "nemu", objects))
+}
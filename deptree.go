@@ -0,0 +1,122 @@
+package spicy
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// DependencyNode is one entry of the tree --deps-tree prints: a spec file,
+// a header it includes, a wave, a segment or one of its includes.
+type DependencyNode struct {
+	Name string
+	// Size is the size in bytes of the node's file, or of everything
+	// under it for waves and segments. It is -1 for a missing file, and
+	// for anything with a missing file under it.
+	Size     int64
+	Children []*DependencyNode
+}
+
+// fileNode returns the node for the file at path, sized from the file
+// itself.
+func fileNode(path string) *DependencyNode {
+	info, err := os.Stat(path)
+	if err != nil {
+		return &DependencyNode{Name: path, Size: -1}
+	}
+	return &DependencyNode{Name: path, Size: info.Size()}
+}
+
+// add appends child to n, adding its size to n's unless either is unknown.
+func (n *DependencyNode) add(child *DependencyNode) {
+	n.Children = append(n.Children, child)
+	if n.Size >= 0 {
+		if child.Size < 0 {
+			n.Size = -1
+		} else {
+			n.Size += child.Size
+		}
+	}
+}
+
+// Write prints the tree under n to w, indenting each level by two spaces.
+func (n *DependencyNode) Write(w io.Writer) error {
+	return n.write(w, 0)
+}
+
+func (n *DependencyNode) write(w io.Writer, depth int) error {
+	size := fmt.Sprintf("0x%x bytes", n.Size)
+	if n.Size < 0 && len(n.Children) > 0 {
+		size = "size unknown"
+	} else if n.Size < 0 {
+		size = "missing"
+	}
+	if _, err := fmt.Fprintf(w, "%s%s (%s)\n", strings.Repeat("  ", depth), n.Name, size); err != nil {
+		return err
+	}
+	for _, child := range n.Children {
+		if err := child.write(w, depth+1); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// DependencyTree returns a tree for each of paths, holding the headers cpp
+// finds the spec including and then the waves the spec defines there, each
+// with its segments and their includes. The headers are found with cpp -MM,
+// unless p.NoPreprocess is set.
+func (p *Pipeline) DependencyTree(paths ...string) ([]*DependencyNode, error) {
+	spec, err := p.ParseFiles(paths...)
+	if err != nil {
+		return nil, err
+	}
+	var roots []*DependencyNode
+	byPath := map[string]*DependencyNode{}
+	for _, path := range paths {
+		root := fileNode(path)
+		if !p.NoPreprocess {
+			headers, err := p.headerDependencies(path)
+			if err != nil {
+				return nil, &PipelineError{Code: ExitParse, Err: err}
+			}
+			for _, header := range headers {
+				root.Children = append(root.Children, fileNode(header))
+			}
+		}
+		roots = append(roots, root)
+		byPath[path] = root
+	}
+	for _, w := range spec.Waves {
+		root, ok := byPath[w.Span.Filename]
+		if !ok {
+			root = roots[0]
+		}
+		wave := &DependencyNode{Name: "wave " + w.Name}
+		for _, seg := range append(append([]*Segment{}, w.ObjectSegments...), w.RawSegments...) {
+			segment := &DependencyNode{Name: "segment " + seg.Name}
+			for _, include := range seg.Includes {
+				segment.add(fileNode(includeFile(include)))
+			}
+			wave.add(segment)
+		}
+		root.Children = append(root.Children, wave)
+	}
+	return roots, nil
+}
+
+// headerDependencies returns the headers the spec at path includes, found
+// as preprocessFile would find them.
+func (p *Pipeline) headerDependencies(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("could not open spec: %w", err)
+	}
+	defer f.Close()
+	headers, err := dependencies(f, p.Cpp, p.cppFlags(path))
+	if err != nil {
+		return nil, fmt.Errorf("could not find headers of spec %s: %w", path, err)
+	}
+	return headers, nil
+}
@@ -0,0 +1,82 @@
+package spicy
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os/exec"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDependencyTreeNestsSpecContents(t *testing.T) {
+	if _, err := exec.LookPath("gcc"); err != nil {
+		t.Skip("gcc not available")
+	}
+	assert := assert.New(t)
+	chdirTemp(t)
+	assert.Nil(ioutil.WriteFile("segments.h", []byte("#define BLOB \"blob.bin\"\n"), 0644))
+	assert.Nil(ioutil.WriteFile("code.o", make([]byte, 0x100), 0644))
+	assert.Nil(ioutil.WriteFile("blob.bin", make([]byte, 0x20), 0644))
+	spec := []byte(`#include "segments.h"
+beginseg
+  name "code"
+  flags BOOT OBJECT
+  entry boot
+  stack bootStack
+  include "code.o"
+  include "missing.o"
+endseg
+beginseg
+  name "blob"
+  flags RAW
+  include BLOB
+endseg
+beginwave
+  name "game"
+  include "code"
+  include "blob"
+endwave
+`)
+	assert.Nil(ioutil.WriteFile("game.spec", spec, 0644))
+	p := &Pipeline{Cpp: NewRunner("gcc")}
+	trees, err := p.DependencyTree("game.spec")
+	assert.Nil(err)
+	b := &bytes.Buffer{}
+	for _, tree := range trees {
+		assert.Nil(tree.Write(b))
+	}
+	assert.Equal(fmt.Sprintf("game.spec (0x%x bytes)\n", len(spec))+`  segments.h (0x18 bytes)
+  wave game (size unknown)
+    segment code (size unknown)
+      code.o (0x100 bytes)
+      missing.o (missing)
+    segment blob (0x20 bytes)
+      blob.bin (0x20 bytes)
+`, b.String())
+}
+
+func TestHeaderDependenciesUsePreprocessingFlags(t *testing.T) {
+	assert := assert.New(t)
+	chdirTemp(t)
+	assert.Nil(ioutil.WriteFile("game.spec", []byte("beginwave\n  name \"game\"\nendwave\n"), 0644))
+	cpp := &echoRunner{}
+	p := &Pipeline{
+		Cpp:                cpp,
+		IncludeFlags:       []string{"include"},
+		QuoteIncludeFlags:  []string{"quoted"},
+		SystemIncludeFlags: []string{"system"},
+		DefineFlags:        []string{"DEBUG"},
+		UndefineFlags:      []string{"RELEASE"},
+		CppArgs:            []string{"-nostdinc"},
+		BuildOptions:       BuildOptions{Sysroot: "/opt/n64"},
+	}
+	_, err := p.headerDependencies("game.spec")
+	assert.Nil(err)
+	_, err = p.ParseFiles("game.spec")
+	assert.Nil(err)
+	assert.Equal([]string{"-E", "-MM", "-U_LANGUAGE_C", "-D_LANGUAGE_MAKEROM", "-"}, cpp.calls[0][:5])
+	assert.Equal(cpp.calls[1][4:], cpp.calls[0][5:])
+	assert.Equal([]string{"-Iinclude", "-I.", "-iquote", "quoted", "-isystem", "system", "-DDEBUG", "-URELEASE", "--sysroot=/opt/n64", "-nostdinc"}, cpp.calls[0][5:])
+}
@@ -0,0 +1,107 @@
+package spicy
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/trhodeos/n64rom"
+)
+
+// DiffRange is a run of bytes, from Start up to End, that differs between
+// two ROMs.
+type DiffRange struct {
+	Start int64
+	End   int64
+}
+
+const diffChunkSize = 0x10000
+
+// readChunk reads up to len(buf) bytes of r at off, treating the end of r
+// as a short read.
+func readChunk(r io.ReaderAt, buf []byte, off int64) (int, error) {
+	n, err := r.ReadAt(buf, off)
+	if err == io.EOF {
+		err = nil
+	}
+	return n, err
+}
+
+// DiffROMs returns every run of bytes that differs between a and b, in
+// order. Bytes past the end of the shorter ROM count as differing.
+func DiffROMs(a, b io.ReaderAt) ([]DiffRange, error) {
+	var ranges []DiffRange
+	bufA := make([]byte, diffChunkSize)
+	bufB := make([]byte, diffChunkSize)
+	for off := int64(0); ; off += diffChunkSize {
+		nA, err := readChunk(a, bufA, off)
+		if err != nil {
+			return nil, fmt.Errorf("could not read first ROM: %v", err)
+		}
+		nB, err := readChunk(b, bufB, off)
+		if err != nil {
+			return nil, fmt.Errorf("could not read second ROM: %v", err)
+		}
+		n := nA
+		if nB > n {
+			n = nB
+		}
+		for i := 0; i < n; i++ {
+			if i < nA && i < nB && bufA[i] == bufB[i] {
+				continue
+			}
+			pos := off + int64(i)
+			if len(ranges) > 0 && ranges[len(ranges)-1].End == pos {
+				ranges[len(ranges)-1].End++
+			} else {
+				ranges = append(ranges, DiffRange{Start: pos, End: pos + 1})
+			}
+		}
+		if n < diffChunkSize {
+			return ranges, nil
+		}
+	}
+}
+
+// DiffRegions names the parts of the ROM that r touches: "header",
+// "bootcode", and then each segment of layout it overlaps, or "padding" for
+// bytes outside all of them. Without a layout, everything from
+// n64rom.CodeStart on is "code".
+func DiffRegions(r DiffRange, layout []SegmentLayout) []string {
+	var regions []string
+	if r.Start < HeaderSize {
+		regions = append(regions, "header")
+	}
+	if r.Start < n64rom.CodeStart && r.End > HeaderSize {
+		regions = append(regions, "bootcode")
+	}
+	if r.End <= n64rom.CodeStart {
+		return regions
+	}
+	if layout == nil {
+		return append(regions, "code")
+	}
+	start := r.Start
+	if start < n64rom.CodeStart {
+		start = n64rom.CodeStart
+	}
+	covered := int64(0)
+	for _, l := range layout {
+		lo, hi := int64(l.RomStart), int64(l.RomEnd)
+		if lo < r.End && start < hi {
+			regions = append(regions, "segment "+l.Name)
+			if lo < start {
+				lo = start
+			}
+			if hi > r.End {
+				hi = r.End
+			}
+			covered += hi - lo
+		}
+	}
+	// Overlapping segments can only make covered too large, never too small,
+	// so a shortfall always means some bytes are in no segment.
+	if covered < r.End-start {
+		regions = append(regions, "padding")
+	}
+	return regions
+}
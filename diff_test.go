@@ -0,0 +1,33 @@
+package spicy
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDiffROMsGroupsRuns(t *testing.T) {
+	assert := assert.New(t)
+	a := make([]byte, 0x2000)
+	b := make([]byte, 0x2010)
+	copy(b, a)
+	for i := 0x1004; i < 0x1008; i++ {
+		b[i] = 0xff
+	}
+	b[0x10] = 1
+
+	ranges, err := DiffROMs(bytes.NewReader(a), bytes.NewReader(b))
+	assert.Nil(err)
+	assert.Equal([]DiffRange{{0x10, 0x11}, {0x1004, 0x1008}, {0x2000, 0x2010}}, ranges)
+
+	layout := []SegmentLayout{{Name: "code", RomStart: 0x1000, RomEnd: 0x1010}}
+	assert.Equal([]string{"header"}, DiffRegions(ranges[0], layout))
+	assert.Equal([]string{"segment code"}, DiffRegions(ranges[1], layout))
+	assert.Equal([]string{"padding"}, DiffRegions(ranges[2], layout))
+	assert.Equal([]string{"code"}, DiffRegions(ranges[1], nil))
+
+	ranges, err = DiffROMs(bytes.NewReader(a), bytes.NewReader(a))
+	assert.Nil(err)
+	assert.Empty(ranges)
+}
@@ -2,7 +2,11 @@ package spicy
 
 import (
 	"bytes"
+	"debug/elf"
+	"fmt"
 	"io"
+	"io/ioutil"
+	"strings"
 	"text/template"
 
 	log "github.com/sirupsen/logrus"
@@ -10,39 +14,241 @@ import (
 
 var compileArgs = []string{"-march=vr4300", "-mtune=vr4300", "-mgp32", "-mfp32", "-non_shared"}
 
+// cEntryArgs compile a C entry stub with gcc. It is optimised so that the
+// stub needs no stack frame, and freestanding with a volatile store so that
+// clearing the BSS is not turned into a call to memset.
+var cEntryArgs = []string{"-march=vr4300", "-mtune=vr4300", "-mgp32", "-mfp32", "-mno-abicalls", "-fno-pic", "-G", "0", "-O2", "-ffreestanding", "-fno-toplevel-reorder", "-c", "-x", "c"}
+
+// EntryLangs lists the languages the entry stub can be generated in.
+var EntryLangs = []string{"asm", "c"}
+
+// createEntrySource returns the assembly of the entry stub of bootSegment.
+// _start, where the bootcode jumps, starts the first entry point; each other
+// entry point gets a _start_<entry> the program can jump to instead, say to
+// restart into it. Every one of them loads its entry point and stack, then
+// clears the boot segment's BSS and jumps to the entry point.
 func createEntrySource(bootSegment *Segment) (io.Reader, error) {
 	t := `
 	.text
 	.global	_start
 _start:
-	la	$8,_{{.Name}}SegmentBssStart
-	la	$9,_{{.Name}}SegmentBssSize
+	la	$10, {{.Entry}} + 0
+	la	$29,{{.StackInfo.Start}} + {{.StackInfo.Offset}}
+.Lclear_bss:
+	la	$8,{{.BoundarySymbol "BssStart"}}
+	la	$9,{{.BoundarySymbol "BssSize"}}
 1:
 	sw	$0, 0($8)
 	sw	$0, 4($8)
 	addi	$8, 8
 	addi	$9, 0xfff8
 	bne	$9, $0, 1b
-	la	$10, {{.Entry}} + 0
-	la	$29,{{.StackInfo.Start}} + {{.StackInfo.Offset}}
 	jr	$10
-`
+{{range (slice .Entries 1)}}
+	.global	_start_{{.Entry}}
+_start_{{.Entry}}:
+	la	$10, {{.Entry}} + 0
+	la	$29,{{.Stack.Start}} + {{.Stack.Offset}}
+	b	.Lclear_bss
+{{end}}`
 	tmpl, err := template.New("test").Parse(t)
 	if err != nil {
 		return nil, err
 	}
 	b := &bytes.Buffer{}
 	err = tmpl.Execute(b, bootSegment)
-	log.Debugf("Created entry script:\n%s", b.String())
+	stageDebugf("entry", "Created entry script:\n%s", b.String())
+	return b, err
+}
+
+// createCEntrySource is createEntrySource for a C stub. Each stub clears
+// the boot segment's BSS on the stack it was started on, then moves to its
+// entry point's stack and jumps to it, which C cannot do without a little
+// assembly.
+func createCEntrySource(bootSegment *Segment) (io.Reader, error) {
+	t := `/* Entry stub generated by spicy. */
+extern unsigned char {{.BoundarySymbol "BssStart"}}[];
+extern unsigned char {{.BoundarySymbol "BssSize"}}[];
+
+static inline __attribute__((always_inline)) void clear_bss(void)
+{
+	volatile unsigned int *bss = (volatile unsigned int *){{.BoundarySymbol "BssStart"}};
+	volatile unsigned int *end = (volatile unsigned int *)({{.BoundarySymbol "BssStart"}} + (unsigned long){{.BoundarySymbol "BssSize"}});
+
+	while (bss < end) {
+		*bss++ = 0;
+	}
+}
+
+void _start(void)
+{
+	clear_bss();
+	__asm__ volatile(".set push\n\t.set reorder\n\t.set macro\n\t"
+		"la $29, {{.StackInfo.Start}} + {{.StackInfo.Offset}}\n\t"
+		"la $10, {{.Entry}}\n\t"
+		"jr $10\n\t"
+		".set pop");
+	__builtin_unreachable();
+}
+{{range (slice .Entries 1)}}
+void _start_{{.Entry}}(void)
+{
+	clear_bss();
+	__asm__ volatile(".set push\n\t.set reorder\n\t.set macro\n\t"
+		"la $29, {{.Stack.Start}} + {{.Stack.Offset}}\n\t"
+		"la $10, {{.Entry}}\n\t"
+		"jr $10\n\t"
+		".set pop");
+	__builtin_unreachable();
+}
+{{end}}`
+	tmpl, err := template.New("entry").Parse(t)
+	if err != nil {
+		return nil, err
+	}
+	b := &bytes.Buffer{}
+	err = tmpl.Execute(b, bootSegment)
+	stageDebugf("entry", "Created C entry:\n%s", b.String())
 	return b, err
 }
 
 func CreateEntryBinary(w *Wave, as Runner) (io.Reader, error) {
+	return createEntryBinary(w, as, BuildOptions{})
+}
+
+// CreateCEntryBinary is like CreateEntryBinary, but generates the entry
+// stub as C and compiles it with cc, which must be gcc.
+func CreateCEntryBinary(w *Wave, cc Runner) (io.Reader, error) {
+	return createEntryBinary(w, nil, BuildOptions{EntryLang: "c", EntryCc: cc})
+}
+
+// WriteEntryObject assembles the entry stub of w and writes the object to
+// path, without linking it, so the startup code can be inspected. The
+// object must define _start.
+func WriteEntryObject(w *Wave, as Runner, path string) error {
+	obj, err := CreateEntryBinary(w, as)
+	if err != nil {
+		return err
+	}
+	return writeEntryObject(w, obj, path)
+}
+
+// WriteCEntryObject is like WriteEntryObject, but generates the entry stub
+// as C and compiles it with cc.
+func WriteCEntryObject(w *Wave, cc Runner, path string) error {
+	obj, err := CreateCEntryBinary(w, cc)
+	if err != nil {
+		return err
+	}
+	return writeEntryObject(w, obj, path)
+}
+
+func writeEntryObject(w *Wave, obj io.Reader, path string) error {
+	b, err := ioutil.ReadAll(obj)
+	if err != nil {
+		return err
+	}
+	f, err := elf.NewFile(bytes.NewReader(b))
+	if err != nil {
+		return fmt.Errorf("entry object of wave %s is not an ELF object: %v", w.Name, err)
+	}
+	symbols, err := f.Symbols()
+	f.Close()
+	if err != nil {
+		return fmt.Errorf("entry object of wave %s has no symbols: %v", w.Name, err)
+	}
+	found := false
+	for _, sym := range symbols {
+		found = found || sym.Name == "_start"
+	}
+	if !found {
+		return fmt.Errorf("entry object of wave %s does not define _start", w.Name)
+	}
+	if err := ioutil.WriteFile(path, b, 0644); err != nil {
+		return err
+	}
+	return nil
+}
+
+// entryStubSize returns the size of an entry stub object with sections, as
+// the linker script places it: its .text, then .bss, then .data.
+func entryStubSize(sections []InputSection) uint64 {
+	var dot uint64
+	for _, name := range []string{".text", ".bss", ".data"} {
+		for _, s := range sections {
+			if s.Name == name {
+				dot = alignUp(dot, s.Align) + s.Size
+			}
+		}
+	}
+	return dot
+}
+
+// MeasureEntryStub builds the entry stub of w as a build with opts would,
+// assembling it with as or compiling it with opts.EntryCc, and returns its
+// size as the linker script places it.
+func MeasureEntryStub(w *Wave, as Runner, opts BuildOptions) (uint64, error) {
+	obj, err := createEntryBinary(w, as, opts)
+	if err != nil {
+		return 0, err
+	}
+	b, err := ioutil.ReadAll(obj)
+	if err != nil {
+		return 0, err
+	}
+	f, err := elf.NewFile(bytes.NewReader(b))
+	if err != nil {
+		return 0, fmt.Errorf("entry object of wave %s is not an ELF object: %v", w.Name, err)
+	}
+	defer f.Close()
+	var sections []InputSection
+	for _, s := range f.Sections {
+		if s.Flags&elf.SHF_ALLOC != 0 {
+			sections = append(sections, InputSection{Name: s.Name, Size: s.Size, Align: s.Addralign})
+		}
+	}
+	return entryStubSize(sections), nil
+}
+
+// createEntryBinary assembles the entry stub of w, or compiles it with
+// opts.EntryCc if opts.EntryLang is "c", first saving its source to
+// opts.SaveEntryAsm if that is set.
+func createEntryBinary(w *Wave, as Runner, opts BuildOptions) (io.Reader, error) {
 	name := w.Name
 	log.Infof("Creating entry for \"%s\".", name)
-	entrySource, err := createEntrySource(w.GetBootSegment())
+	boot := w.GetBootSegment()
+	if boot == nil || len(boot.Entries) == 0 {
+		return nil, fmt.Errorf("wave %s has no entry point", name)
+	}
+	var entrySource io.Reader
+	var err error
+	switch opts.EntryLang {
+	case "", "asm":
+		entrySource, err = createEntrySource(boot)
+	case "c":
+		if opts.EntryCc == nil {
+			return nil, fmt.Errorf("no C compiler given for the entry stub")
+		}
+		entrySource, err = createCEntrySource(boot)
+	default:
+		return nil, fmt.Errorf("unknown entry language %q: expected one of %s", opts.EntryLang, strings.Join(EntryLangs, ", "))
+	}
 	if err != nil {
 		return nil, err
 	}
+	if saveAsm := opts.SaveEntryAsm; saveAsm != "" {
+		b, err := ioutil.ReadAll(entrySource)
+		if err != nil {
+			return nil, err
+		}
+		if err := ioutil.WriteFile(saveAsm, b, 0644); err != nil {
+			return nil, fmt.Errorf("could not save entry assembly: %v", err)
+		}
+		opts.Tracer.File(saveAsm)
+		entrySource = bytes.NewReader(b)
+	}
+	if opts.EntryLang == "c" {
+		return NewOutputFileRunner(WithTrace(opts.Tracer, "cc")(opts.EntryCc), "a.out").Run(entrySource, append(cEntryArgs, "-o", "a.out", "-"))
+	}
 	return NewOutputFileRunner(as, "a.out").Run(entrySource, append(compileArgs, "-"))
 }
@@ -0,0 +1,231 @@
+package spicy
+
+import (
+	"bytes"
+	"debug/elf"
+	"io/ioutil"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEntryStubForEachEntryPoint(t *testing.T) {
+	assert := assert.New(t)
+	spec, err := ParseSpec(strings.NewReader(`
+beginseg
+  name "code"
+  flags BOOT OBJECT
+  entry boot
+  stack bootStack + 0x1000
+  entry idle
+  stack idleStack + 0x400
+  include "code.o"
+endseg
+beginwave
+  name "game"
+  include "code"
+endwave
+`))
+	assert.Nil(err)
+	boot := spec.Waves[0].GetBootSegment()
+	assert.Equal([]EntryPoint{
+		{Entry: "boot", Stack: &StackInfo{Start: "bootStack", Offset: 0x1000}},
+		{Entry: "idle", Stack: &StackInfo{Start: "idleStack", Offset: 0x400}},
+	}, boot.Entries)
+	assert.Equal("boot", *boot.Entry)
+
+	source, err := createEntrySource(boot)
+	assert.Nil(err)
+	b, err := ioutil.ReadAll(source)
+	assert.Nil(err)
+	assert.Contains(string(b), "_start:")
+	assert.Contains(string(b), "la\t$10, boot + 0")
+	assert.Contains(string(b), ".global\t_start_idle")
+	assert.Contains(string(b), "la\t$10, idle + 0")
+	assert.Contains(string(b), "la\t$29,idleStack + 1024")
+	// The other entry point clears the BSS too, with _start's loop.
+	assert.Contains(string(b), "_start_idle:\n\tla\t$10, idle + 0\n\tla\t$29,idleStack + 1024\n\tb\t.Lclear_bss\n")
+
+	_, err = CreateEntryBinary(&Wave{Name: "empty"}, &fakeRunner{})
+	assert.NotNil(err)
+}
+
+func TestEntryPointWithoutStack(t *testing.T) {
+	_, err := ParseSpec(strings.NewReader(`
+beginseg
+  name "code"
+  flags BOOT OBJECT
+  entry boot
+  stack bootStack
+  entry idle
+  include "code.o"
+endseg
+beginwave
+  name "game"
+  include "code"
+endwave
+`))
+	assert.NotNil(t, err)
+}
+
+func TestSaveEntryAssembly(t *testing.T) {
+	assert := assert.New(t)
+	w := &Wave{Name: "game", ObjectSegments: []*Segment{{
+		Name:    "code",
+		Flags:   Flags{Boot: true, Object: true},
+		Entries: []EntryPoint{{Entry: "boot", Stack: &StackInfo{Start: "bootStack"}}},
+	}}}
+	w.ObjectSegments[0].Entry = &w.ObjectSegments[0].Entries[0].Entry
+	w.ObjectSegments[0].StackInfo = w.ObjectSegments[0].Entries[0].Stack
+	dir := chdirTemp(t)
+	path := filepath.Join(dir, "entry.s")
+
+	as := &fakeRunner{output: []byte{}, outputFile: "a.out"}
+	_, err := createEntryBinary(w, as, BuildOptions{SaveEntryAsm: path})
+	assert.Nil(err)
+	b, err := ioutil.ReadFile(path)
+	assert.Nil(err)
+	assert.Contains(string(b), ".global\t_start\n")
+	assert.Contains(string(b), "la\t$10, boot + 0")
+}
+
+func TestWriteEntryObjectChecksForStart(t *testing.T) {
+	assert := assert.New(t)
+	chdirTemp(t)
+	spec, err := ParseSpec(strings.NewReader(pipelineTestSpec))
+	assert.Nil(err)
+	w := spec.Waves[0]
+
+	obj := testElf(map[string]uint64{"_start": 0})
+	assert.Nil(WriteEntryObject(w, &fakeRunner{output: obj, outputFile: "a.out"}, "entry.o"))
+	b, err := ioutil.ReadFile("entry.o")
+	assert.Nil(err)
+	assert.Equal(obj, b)
+
+	err = WriteEntryObject(w, &fakeRunner{output: testElf(map[string]uint64{"boot": 0}), outputFile: "a.out"}, "missing.o")
+	assert.NotNil(err)
+	assert.Contains(err.Error(), "does not define _start")
+	err = WriteEntryObject(w, &fakeRunner{output: []byte("not an object"), outputFile: "a.out"}, "garbage.o")
+	assert.NotNil(err)
+	assert.Contains(err.Error(), "not an ELF object")
+}
+
+func TestWriteEntryObjectWithMipsAssembler(t *testing.T) {
+	assert := assert.New(t)
+	as, err := exec.LookPath("mips64-elf-as")
+	if err != nil {
+		t.Skip("mips64-elf-as not available")
+	}
+	chdirTemp(t)
+	spec, err := ParseSpec(strings.NewReader(pipelineTestSpec))
+	assert.Nil(err)
+	assert.Nil(WriteEntryObject(spec.Waves[0], NewRunner(as), "entry.o"))
+	f, err := elf.Open("entry.o")
+	assert.Nil(err)
+	defer f.Close()
+	assert.Equal(elf.EM_MIPS, f.Machine)
+	symbols, err := f.Symbols()
+	assert.Nil(err)
+	var names []string
+	for _, sym := range symbols {
+		names = append(names, sym.Name)
+	}
+	assert.Contains(names, "_start")
+
+	size, err := MeasureEntryStub(spec.Waves[0], NewRunner(as), BuildOptions{})
+	assert.Nil(err)
+	assert.Equal(f.Section(".text").Size, size)
+}
+
+func TestEntryStubSizeFollowsLinkerScript(t *testing.T) {
+	assert := assert.New(t)
+	// The script places .text, then .bss, then .data, each aligned.
+	assert.Equal(uint64(0x50), entryStubSize([]InputSection{
+		{Name: ".data", Size: 0x8, Align: 8},
+		{Name: ".text", Size: 0x44, Align: 4},
+		{Name: ".bss", Size: 0x4, Align: 4},
+		{Name: ".rodata", Size: 0x100, Align: 4},
+	}))
+}
+
+func TestCEntryStubSetsStackAndJumpsToEntry(t *testing.T) {
+	assert := assert.New(t)
+	dir := chdirTemp(t)
+	spec, err := ParseSpec(strings.NewReader(`
+beginseg
+  name "code"
+  flags BOOT OBJECT
+  entry boot
+  stack bootStack
+  entry other
+  stack otherStack + 0x100
+  include "code.o"
+endseg
+beginwave
+  name "game"
+  include "code"
+endwave
+`))
+	assert.Nil(err)
+	path := filepath.Join(dir, "entry.c")
+	cc := &fakeRunner{output: []byte{}}
+	_, err = createEntryBinary(spec.Waves[0], nil, BuildOptions{EntryLang: "c", EntryCc: cc, SaveEntryAsm: path})
+	assert.Nil(err)
+	assert.Equal([]string{"-c", "-x", "c", "-o", "a.out", "-"}, cc.calls[0][len(cc.calls[0])-6:])
+	b, err := ioutil.ReadFile(path)
+	assert.Nil(err)
+	source := string(b)
+	assert.Contains(source, "void _start(void)\n")
+	assert.Contains(source, "(volatile unsigned int *)_codeSegmentBssStart;")
+	assert.Contains(source, `"la $29, bootStack + 0\n\t"`)
+	assert.Contains(source, `"la $10, boot\n\t"`)
+	assert.Contains(source, "void _start_other(void)\n{\n\tclear_bss();\n")
+	assert.Contains(source, `"la $29, otherStack + 256\n\t"`)
+
+	_, err = createEntryBinary(spec.Waves[0], nil, BuildOptions{EntryLang: "fortran"})
+	assert.EqualError(err, `unknown entry language "fortran": expected one of asm, c`)
+
+	if _, err := exec.LookPath("gcc"); err == nil {
+		_, err := NewRunner("gcc").Run(bytes.NewReader(b), []string{"-fsyntax-only", "-Wall", "-Werror", "-x", "c", "-"})
+		assert.Nil(err)
+	}
+}
+
+func TestWriteCEntryObjectWithMipsCompiler(t *testing.T) {
+	assert := assert.New(t)
+	cc, err := exec.LookPath("mips64-elf-gcc")
+	if err != nil {
+		t.Skip("mips64-elf-gcc not available")
+	}
+	chdirTemp(t)
+	spec, err := ParseSpec(strings.NewReader(pipelineTestSpec))
+	assert.Nil(err)
+	assert.Nil(WriteCEntryObject(spec.Waves[0], NewRunner(cc), "entry.o"))
+	f, err := elf.Open("entry.o")
+	assert.Nil(err)
+	defer f.Close()
+	assert.Equal(elf.EM_MIPS, f.Machine)
+	symbols, err := f.Symbols()
+	assert.Nil(err)
+	undefined := map[string]bool{}
+	var names []string
+	for _, sym := range symbols {
+		names = append(names, sym.Name)
+		undefined[sym.Name] = sym.Section == elf.SHN_UNDEF
+	}
+	assert.Contains(names, "_start")
+	assert.True(undefined["boot"], "boot should be referenced")
+	assert.True(undefined["bootStack"], "bootStack should be referenced")
+
+	// The compiled stub is laid out at its own size, which must leave room
+	// for the boot segment at its default address.
+	size, err := MeasureEntryStub(spec.Waves[0], nil, BuildOptions{EntryLang: "c", EntryCc: NewRunner(cc)})
+	assert.Nil(err)
+	text := f.Section(".text")
+	assert.NotNil(text)
+	assert.True(size >= text.Size, "stub is 0x%x bytes but its text 0x%x", size, text.Size)
+	assert.True(size <= 0x50, "stub is 0x%x bytes", size)
+}
@@ -0,0 +1,157 @@
+package spicy
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os/exec"
+)
+
+// Exit codes for each category of failure, so scripts can tell them apart.
+const (
+	ExitFailure      = 1
+	ExitUsage        = 2
+	ExitParse        = 3
+	ExitToolNotFound = 4
+	ExitBuild        = 5
+	ExitMismatch     = 6
+)
+
+// UsageError is an error in how spicy was invoked.
+type UsageError struct {
+	msg string
+}
+
+// NewUsageError formats a UsageError.
+func NewUsageError(format string, args ...interface{}) error {
+	return &UsageError{msg: fmt.Sprintf(format, args...)}
+}
+
+func (e *UsageError) Error() string {
+	return e.msg
+}
+
+// PipelineError is a failure in one stage of a Pipeline.
+type PipelineError struct {
+	// Code is the exit code for the failure, ExitParse or ExitBuild.
+	Code int
+	Err  error
+}
+
+func (e *PipelineError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *PipelineError) Unwrap() error {
+	return e.Err
+}
+
+// StageError is a failure in a named step of building a wave, such as
+// "link" or "overlap".
+type StageError struct {
+	Stage string
+	Err   error
+}
+
+func (e *StageError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *StageError) Unwrap() error {
+	return e.Err
+}
+
+// MismatchError is a ROM that was built successfully but is not the one
+// expected.
+type MismatchError struct {
+	Expected string
+	Actual   string
+	Size     int
+}
+
+func (e *MismatchError) Error() string {
+	return fmt.Sprintf("ROM does not match: sha256 is %s, expected %s (0x%x bytes); compare it with the expected ROM using spicy diff", e.Actual, e.Expected, e.Size)
+}
+
+// ErrorRecord is one error as --errors-json reports it. File, Line and Col
+// are only set for errors at a place in a spec.
+type ErrorRecord struct {
+	File    string `json:"file"`
+	Line    int    `json:"line"`
+	Col     int    `json:"col"`
+	Stage   string `json:"stage"`
+	Message string `json:"message"`
+}
+
+// errorStage names the step err came from, as precisely as it is known.
+func errorStage(err error) string {
+	var usage *UsageError
+	var stage *StageError
+	var pipeline *PipelineError
+	switch {
+	case errors.As(err, &usage):
+		return "usage"
+	case errors.Is(err, exec.ErrNotFound):
+		return "toolchain"
+	case errors.As(err, &stage):
+		return stage.Stage
+	case errors.As(err, &pipeline) && pipeline.Code == ExitParse:
+		return "parse"
+	case errors.As(err, &pipeline):
+		return "build"
+	default:
+		return ""
+	}
+}
+
+// ErrorRecords breaks err down into one record per error, so that each
+// error of a ParseErrorList gets its own.
+func ErrorRecords(err error) []ErrorRecord {
+	stage := errorStage(err)
+	errs := []error{err}
+	var list ParseErrorList
+	if errors.As(err, &list) {
+		errs = list
+	}
+	var records []ErrorRecord
+	for _, e := range errs {
+		record := ErrorRecord{Stage: stage, Message: e.Error()}
+		var specErr *SpecError
+		if errors.As(e, &specErr) {
+			record.File = specErr.Filename
+			record.Line = specErr.Line
+			record.Col = specErr.Column
+			record.Message = specErr.Message
+		}
+		records = append(records, record)
+	}
+	return records
+}
+
+// WriteErrorsJSON writes the records of err to w as a JSON array.
+func WriteErrorsJSON(w io.Writer, err error) error {
+	return json.NewEncoder(w).Encode(ErrorRecords(err))
+}
+
+// ExitCode returns the exit code for err. A missing toolchain command is
+// reported as such whichever stage it was needed for.
+func ExitCode(err error) int {
+	var usage *UsageError
+	var pipeline *PipelineError
+	var mismatch *MismatchError
+	switch {
+	case err == nil:
+		return 0
+	case errors.As(err, &usage):
+		return ExitUsage
+	case errors.As(err, &mismatch):
+		return ExitMismatch
+	case errors.Is(err, exec.ErrNotFound):
+		return ExitToolNotFound
+	case errors.As(err, &pipeline):
+		return pipeline.Code
+	default:
+		return ExitFailure
+	}
+}
@@ -0,0 +1,56 @@
+package spicy
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestExitCodes(t *testing.T) {
+	assert := assert.New(t)
+	chdirTemp(t)
+	assert.Equal(0, ExitCode(nil))
+	assert.Equal(ExitFailure, ExitCode(errors.New("something else")))
+	assert.Equal(ExitUsage, ExitCode(NewUsageError("missing argument: <spec>")))
+
+	p := newTestPipeline()
+	_, err := p.Run(strings.NewReader("beginseg\n  nme \"code\"\nendseg\n"))
+	assert.Equal(ExitParse, ExitCode(err))
+
+	p = newTestPipeline()
+	p.Ld = NewRunner("spicy-test-no-such-ld")
+	_, err = p.Run(strings.NewReader(pipelineTestSpec))
+	assert.Equal(ExitToolNotFound, ExitCode(err))
+
+	p = newTestPipeline()
+	p.Ld = &fakeRunner{output: testElf(map[string]uint64{})}
+	_, err = p.Run(strings.NewReader(pipelineTestSpec))
+	assert.Contains(err.Error(), "no ROM start symbol")
+	assert.Equal(ExitBuild, ExitCode(err))
+}
+
+func TestErrorsJSON(t *testing.T) {
+	assert := assert.New(t)
+	p := newTestPipeline()
+	p.ParseOptions = []ParseOption{Filename("game.spec")}
+	_, err := p.Parse(strings.NewReader("beginseg\n  nme \"code\"\nendseg\n"))
+	assert.NotNil(err)
+
+	b := &bytes.Buffer{}
+	assert.Nil(WriteErrorsJSON(b, err))
+	var records []map[string]interface{}
+	assert.Nil(json.Unmarshal(b.Bytes(), &records))
+	assert.Equal(1, len(records))
+	assert.Equal("game.spec", records[0]["file"])
+	assert.Equal(float64(2), records[0]["line"])
+	assert.Equal(float64(3), records[0]["col"])
+	assert.Equal("parse", records[0]["stage"])
+	assert.NotEmpty(records[0]["message"])
+
+	overlap := &PipelineError{Code: ExitBuild, Err: &StageError{Stage: "overlap", Err: errors.New("segments a and b overlap")}}
+	assert.Equal([]ErrorRecord{{Stage: "overlap", Message: "segments a and b overlap"}}, ErrorRecords(overlap))
+}
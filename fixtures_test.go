@@ -0,0 +1,176 @@
+package spicy
+
+import (
+	"bytes"
+	"debug/elf"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"testing"
+)
+
+// fakeRunner records its invocations and writes output to the file a real
+// tool would have produced: outputFile if set, else the argument after "-o",
+// else the last argument. If output is nil, the last argument's contents are
+// copied instead.
+type fakeRunner struct {
+	calls      [][]string
+	output     []byte
+	outputFile string
+}
+
+func (f *fakeRunner) Run(r io.Reader, args []string) (io.Reader, error) {
+	f.calls = append(f.calls, args)
+	if len(args) == 0 {
+		return &bytes.Buffer{}, nil
+	}
+	path := f.outputFile
+	for i, arg := range args {
+		if path == "" && arg == "-o" && i+1 < len(args) {
+			path = args[i+1]
+		}
+	}
+	if path == "" {
+		path = args[len(args)-1]
+	}
+	b := f.output
+	if b == nil {
+		b, _ = ioutil.ReadFile(args[len(args)-1])
+	}
+	if err := ioutil.WriteFile(path, b, 0644); err != nil {
+		return nil, err
+	}
+	return &bytes.Buffer{}, nil
+}
+
+// testElf returns a minimal big-endian ELF32 object with a symbol table
+// holding the given absolute symbols.
+func testElf(symbols map[string]uint64) []byte {
+	var names []string
+	for name := range symbols {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	strtab := []byte{0}
+	syms := []elf.Sym32{{}}
+	for _, name := range names {
+		syms = append(syms, elf.Sym32{
+			Name:  uint32(len(strtab)),
+			Value: uint32(symbols[name]),
+			Info:  elf.ST_INFO(elf.STB_GLOBAL, elf.STT_NOTYPE),
+			Shndx: uint16(elf.SHN_ABS),
+		})
+		strtab = append(append(strtab, name...), 0)
+	}
+	shstrtab := []byte("\x00.shstrtab\x00.strtab\x00.symtab\x00")
+	symtab := &bytes.Buffer{}
+	binary.Write(symtab, binary.BigEndian, syms)
+
+	const headerSize = 52
+	shstrtabOff := uint32(headerSize)
+	strtabOff := shstrtabOff + uint32(len(shstrtab))
+	symtabOff := strtabOff + uint32(len(strtab))
+	shOff := symtabOff + uint32(symtab.Len())
+	out := &bytes.Buffer{}
+	header := elf.Header32{
+		Type:      uint16(elf.ET_REL),
+		Machine:   uint16(elf.EM_MIPS),
+		Version:   uint32(elf.EV_CURRENT),
+		Shoff:     shOff,
+		Ehsize:    headerSize,
+		Shentsize: 40,
+		Shnum:     4,
+		Shstrndx:  1,
+	}
+	copy(header.Ident[:], elf.ELFMAG)
+	header.Ident[elf.EI_CLASS] = byte(elf.ELFCLASS32)
+	header.Ident[elf.EI_DATA] = byte(elf.ELFDATA2MSB)
+	header.Ident[elf.EI_VERSION] = byte(elf.EV_CURRENT)
+	binary.Write(out, binary.BigEndian, header)
+	out.Write(shstrtab)
+	out.Write(strtab)
+	out.Write(symtab.Bytes())
+	binary.Write(out, binary.BigEndian, []elf.Section32{
+		{},
+		{Name: 1, Type: uint32(elf.SHT_STRTAB), Off: shstrtabOff, Size: uint32(len(shstrtab)), Addralign: 1},
+		{Name: 11, Type: uint32(elf.SHT_STRTAB), Off: strtabOff, Size: uint32(len(strtab)), Addralign: 1},
+		{Name: 19, Type: uint32(elf.SHT_SYMTAB), Off: symtabOff, Size: uint32(symtab.Len()), Link: 2, Info: 1, Addralign: 4, Entsize: 16},
+	})
+	return out.Bytes()
+}
+
+// chdirTemp moves the test into a fresh directory, as the toolchain steps
+// write some of their outputs to the working directory.
+func chdirTemp(t *testing.T) string {
+	dir := t.TempDir()
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chdir(wd) })
+	return dir
+}
+
+// readRom returns the bytes rom.Save writes.
+func readRom(t *testing.T, rom *Rom) []byte {
+	b := &bytes.Buffer{}
+	if _, err := rom.Save(b); err != nil {
+		t.Fatal(err)
+	}
+	return b.Bytes()
+}
+
+// segmentSymbols returns the boundary symbols the linker script would define
+// for a segment occupying size bytes at romStart and vramStart.
+func segmentSymbols(symbols map[string]uint64, name string, romStart, vramStart, size uint64) map[string]uint64 {
+	symbols["_"+name+"SegmentRomStart"] = romStart
+	symbols["_"+name+"SegmentRomEnd"] = romStart + size
+	symbols["_"+name+"SegmentStart"] = vramStart
+	symbols["_"+name+"SegmentEnd"] = vramStart + size
+	return symbols
+}
+
+// entrySymbols adds the entry and stack symbols the test specs' boot
+// segments name.
+func entrySymbols(symbols map[string]uint64) map[string]uint64 {
+	symbols["boot"] = 0x80000450
+	symbols["bootStack"] = 0x80010000
+	symbols[entryStubStartSymbol] = 0x80000400
+	symbols[entryStubEndSymbol] = 0x80000440
+	return symbols
+}
+
+// echoRunner stands in for cpp, returning its input unchanged.
+type echoRunner struct {
+	calls [][]string
+}
+
+func (e *echoRunner) Run(r io.Reader, args []string) (io.Reader, error) {
+	e.calls = append(e.calls, args)
+	b, err := ioutil.ReadAll(r)
+	return bytes.NewBuffer(b), err
+}
+
+// newFakePipeline returns a Pipeline whose cpp passes the spec through,
+// whose ld writes an object defining symbols, with the entry symbols added,
+// and whose objcopy writes image as each wave's binary.
+func newFakePipeline(symbols map[string]uint64, image []byte) *Pipeline {
+	return &Pipeline{
+		Cpp:     &echoRunner{},
+		Ld:      &fakeRunner{output: testElf(entrySymbols(symbols))},
+		As:      &fakeRunner{output: []byte{}, outputFile: "a.out"},
+		Objcopy: &fakeRunner{output: image},
+	}
+}
+
+// newTestPipeline returns a fake Pipeline for pipelineTestSpec, whose one
+// segment, code, is 8 bytes long.
+func newTestPipeline() *Pipeline {
+	symbols := segmentSymbols(map[string]uint64{}, "code", 0x1000, 0x80000450, 8)
+	return newFakePipeline(symbols, []byte{1, 2, 3, 4, 5, 6, 7, 8})
+}
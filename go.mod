@@ -3,10 +3,11 @@ module github.com/TheEssem/spicy
 go 1.16
 
 require (
-	github.com/alecthomas/participle v0.7.1 // indirect
-	github.com/depp/shellquote v1.0.0 // indirect
-	github.com/sirupsen/logrus v1.8.1 // indirect
-	github.com/spf13/pflag v1.0.5 // indirect
+	github.com/alecthomas/participle v0.7.1
+	github.com/depp/shellquote v1.0.0
+	github.com/sirupsen/logrus v1.8.1
+	github.com/spf13/pflag v1.0.5
+	github.com/stretchr/testify v1.4.0
 	github.com/trhodeos/ecoff v0.0.0-20180301004534-e54570a0fac2 // indirect
-	github.com/trhodeos/n64rom v0.0.0-20180318220953-504dba7b4d46 // indirect
+	github.com/trhodeos/n64rom v0.0.0-20180318220953-504dba7b4d46
 )
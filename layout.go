@@ -0,0 +1,362 @@
+package spicy
+
+import (
+	"debug/elf"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/trhodeos/n64rom"
+)
+
+// InputSection is a section of an include, as the linker script places it.
+// COMMON symbols of an object are given as sections named "COMMON", and
+// small COMMON symbols as sections named ".scommon".
+type InputSection struct {
+	Name  string
+	Size  uint64
+	Align uint64
+	// Index is the index of the section in the object, by which its
+	// relocation section refers to it. It is 0 for COMMON symbols.
+	Index int
+}
+
+// LayoutOptions configures ComputeLayout.
+type LayoutOptions struct {
+	// ReadSections returns the sections of an object include. If it is not
+	// set, they are read from the object file itself.
+	ReadSections func(include string) ([]InputSection, error)
+	// RawSize returns the size of a RAW include. If it is not set, the size
+	// of the file's data is used, after any decompression.
+	RawSize func(include string) (uint64, error)
+	// EntryStubSize returns the size of the entry stub of a wave, as the
+	// linker script places it. If it is not set, the stub is the a.out the
+	// script links, read with ReadSections.
+	EntryStubSize func(w *Wave) (uint64, error)
+}
+
+func (o LayoutOptions) readSections(include string) ([]InputSection, error) {
+	if o.ReadSections != nil {
+		return o.ReadSections(include)
+	}
+	return readObjectSections(include)
+}
+
+func (o LayoutOptions) entryStubSize(w *Wave) (uint64, error) {
+	if o.EntryStubSize != nil {
+		return o.EntryStubSize(w)
+	}
+	sections, err := o.readSections("a.out")
+	if err != nil {
+		return 0, fmt.Errorf("could not read sections of the entry stub: %w", err)
+	}
+	return entryStubSize(sections), nil
+}
+
+func (o LayoutOptions) rawSize(include string) (uint64, error) {
+	if o.RawSize != nil {
+		return o.RawSize(include)
+	}
+	return rawIncludeSize(include)
+}
+
+// shnMipsScommon is the section index MIPS objects give small COMMON
+// symbols, which the linker script places with .scommon.
+const shnMipsScommon = elf.SectionIndex(0xff03)
+
+// readObjectSections reads the allocated sections and COMMON symbols of the
+// object at path.
+func readObjectSections(path string) ([]InputSection, error) {
+	f, err := elf.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return objectSections(f)
+}
+
+// objectSections returns the allocated sections and COMMON symbols of f.
+func objectSections(f *elf.File) ([]InputSection, error) {
+	var sections []InputSection
+	for i, s := range f.Sections {
+		if s.Flags&elf.SHF_ALLOC == 0 {
+			continue
+		}
+		sections = append(sections, InputSection{Name: s.Name, Size: s.Size, Align: s.Addralign, Index: i})
+	}
+	symbols, err := f.Symbols()
+	if err != nil && err != elf.ErrNoSymbols {
+		return nil, err
+	}
+	for _, sym := range symbols {
+		// The value of a COMMON symbol is its alignment.
+		switch sym.Section {
+		case elf.SHN_COMMON:
+			sections = append(sections, InputSection{Name: "COMMON", Size: sym.Size, Align: sym.Value})
+		case shnMipsScommon:
+			sections = append(sections, InputSection{Name: ".scommon", Size: sym.Size, Align: sym.Value})
+		}
+	}
+	return sections, nil
+}
+
+// ComputeLayout works out where each segment of spec would be placed in the
+// ROM and in VRAM, following the rules of the generated linker script but
+// without running ld. Sizes come from the includes themselves, so objects
+// must already be built; this makes it cheap enough for editors and other
+// tools to call as a spec is changed. Identical RAW segments are not stored
+// once as they are with DedupeRaw.
+func ComputeLayout(spec *Spec, opts LayoutOptions) ([]SegmentLayout, error) {
+	var layout []SegmentLayout
+	for _, w := range spec.Waves {
+		waveLayout, err := computeWaveLayout(w, opts)
+		if err != nil {
+			return nil, fmt.Errorf("wave %s: %w", w.Name, err)
+		}
+		layout = append(layout, waveLayout...)
+	}
+	return layout, nil
+}
+
+// LayoutRecord is a segment as --dump-layout json reports it: what the spec
+// declares for it, and where it was placed.
+type LayoutRecord struct {
+	Wave      string   `json:"wave"`
+	Name      string   `json:"name"`
+	Flags     []string `json:"flags"`
+	Includes  []string `json:"includes"`
+	RomStart  uint64   `json:"rom_start"`
+	RomEnd    uint64   `json:"rom_end"`
+	RomSize   uint64   `json:"rom_size"`
+	VramStart uint64   `json:"vram_start"`
+	VramEnd   uint64   `json:"vram_end"`
+	VramSize  uint64   `json:"vram_size"`
+}
+
+// flagNames returns the spec keywords of the flags set in f.
+func flagNames(f Flags) []string {
+	names := []string{}
+	for _, flag := range []struct {
+		set  bool
+		name string
+	}{{f.Boot, "BOOT"}, {f.Object, "OBJECT"}, {f.Raw, "RAW"}, {f.NoLoad, "NOLOAD"}, {f.Reloc, "RELOC"}} {
+		if flag.set {
+			names = append(names, flag.name)
+		}
+	}
+	return names
+}
+
+// LayoutRecords pairs each entry of layout, as ComputeLayout or a build
+// returns it, with the segment of spec it places.
+func LayoutRecords(spec *Spec, layout []SegmentLayout) []LayoutRecord {
+	segments := map[string]*Segment{}
+	for _, w := range spec.Waves {
+		for _, seg := range append(append([]*Segment{}, w.ObjectSegments...), w.RawSegments...) {
+			segments[w.Name+"\x00"+seg.Name] = seg
+		}
+	}
+	records := []LayoutRecord{}
+	for _, l := range layout {
+		r := LayoutRecord{
+			Wave:      l.Wave,
+			Name:      l.Name,
+			Flags:     []string{},
+			Includes:  []string{},
+			RomStart:  l.RomStart,
+			RomEnd:    l.RomEnd,
+			RomSize:   l.RomEnd - l.RomStart,
+			VramStart: l.VramStart,
+			VramEnd:   l.VramEnd,
+			VramSize:  l.VramEnd - l.VramStart,
+		}
+		if seg, ok := segments[l.Wave+"\x00"+l.Name]; ok {
+			r.Flags = flagNames(seg.Flags)
+			r.Includes = append(r.Includes, seg.Includes...)
+		}
+		records = append(records, r)
+	}
+	return records
+}
+
+// WriteLayoutJSON writes the LayoutRecords of spec and layout to w as a JSON
+// array.
+func WriteLayoutJSON(w io.Writer, spec *Spec, layout []SegmentLayout) error {
+	return json.NewEncoder(w).Encode(LayoutRecords(spec, layout))
+}
+
+func alignUp(v uint64, align uint64) uint64 {
+	if align <= 1 {
+		return v
+	}
+	return (v + align - 1) / align * align
+}
+
+// matchesSection reports whether name is matched by the script's
+// "<base> <base>.*" input section pattern.
+func matchesSection(name string, base string) bool {
+	return name == base || strings.HasPrefix(name, base+".")
+}
+
+// The input sections of an OBJECT segment, in the order the linker script
+// places them: its text, then its data, then, in the segment's .bss, its
+// BSS.
+var (
+	objectTextSections = []string{".text"}
+	objectDataSections = []string{".data", ".rodata", ".sdata"}
+	objectBssSections  = []string{".sbss", ".scommon", ".bss", "COMMON"}
+)
+
+// sectionPlacer places the input sections of a segment's includes from
+// dot, as the linker script does.
+type sectionPlacer struct {
+	dot      uint64
+	includes []string
+	sections map[string][]InputSection
+}
+
+// place places the sections matched by each of names in turn, include by
+// include, as the script's line for each does. If placed is not nil, it is
+// called with the name that matched each section, the index of its include
+// and where the section starts.
+func (p *sectionPlacer) place(placed func(name string, include int, s InputSection, start uint64), names ...string) {
+	for _, name := range names {
+		for i, include := range p.includes {
+			for _, s := range p.sections[include] {
+				if !matchesSection(s.Name, name) {
+					continue
+				}
+				p.dot = alignUp(p.dot, s.Align)
+				if placed != nil {
+					placed(name, i, s, p.dot)
+				}
+				p.dot += s.Size
+			}
+		}
+	}
+}
+
+func computeWaveLayout(w *Wave, opts LayoutOptions) ([]SegmentLayout, error) {
+	var layout []SegmentLayout
+	romSize := uint64(n64rom.CodeStart)
+	dot := uint64(0x80000400)
+	if boot := w.GetBootSegment(); boot != nil && len(boot.Entries) > 0 {
+		size, err := opts.entryStubSize(w)
+		if err != nil {
+			return nil, err
+		}
+		dot += size
+	}
+	ends := map[string]uint64{}
+	endOf := func(name string) (uint64, error) {
+		end, ok := ends[name]
+		if !ok {
+			return 0, fmt.Errorf("segment %s must come before the segments placed after it", name)
+		}
+		return end, nil
+	}
+	for _, seg := range w.ObjectSegments {
+		if seg.RomOffset != 0 {
+			romSize = seg.RomOffset
+		} else if seg.Positioning.Address > 0x80000400 {
+			romSize = seg.Positioning.Address - 0x80000400 + n64rom.CodeStart
+		}
+		romSize = alignUp(romSize, seg.Align)
+		romStart := romSize
+
+		p := seg.Positioning
+		switch {
+		case p.AfterSegment != "":
+			end, err := endOf(p.AfterSegment)
+			if err != nil {
+				return nil, err
+			}
+			dot = end
+		case p.AfterMinSegment[0] != "" || p.AfterMaxSegment[0] != "":
+			pair, useMax := p.AfterMinSegment, false
+			if p.AfterMaxSegment[0] != "" {
+				pair, useMax = p.AfterMaxSegment, true
+			}
+			a, err := endOf(pair[0])
+			if err != nil {
+				return nil, err
+			}
+			b, err := endOf(pair[1])
+			if err != nil {
+				return nil, err
+			}
+			if (b > a) == useMax {
+				a = b
+			}
+			dot = a
+		case p.Address != 0:
+			dot = p.Address
+		}
+
+		sections := map[string][]InputSection{}
+		for _, include := range seg.Includes {
+			s, err := opts.readSections(include)
+			if err != nil {
+				return nil, fmt.Errorf("could not read sections of %s: %w", include, err)
+			}
+			sections[include] = s
+		}
+		vramStart := dot
+		placer := &sectionPlacer{dot: alignUp(dot, 0x10), includes: seg.Includes, sections: sections}
+		textStart := placer.dot
+		placer.place(nil, objectTextSections...)
+		placer.place(nil, objectDataSections...)
+		if seg.Flags.Reloc {
+			table, err := computeRelocTable(seg, sections)
+			if err != nil {
+				return nil, err
+			}
+			placer.dot = alignUp(placer.dot, 0x10) + uint64(len(table.Bytes()))
+		}
+		placer.dot = alignUp(placer.dot, 0x10)
+		if !seg.Flags.NoLoad {
+			romSize += placer.dot - textStart
+		}
+		placer.dot = alignUp(placer.dot, 0x10)
+		placer.place(nil, objectBssSections...)
+		dot = alignUp(placer.dot+seg.Reserve, 0x10)
+		ends[seg.Name] = dot
+		layout = append(layout, SegmentLayout{
+			Wave:      w.Name,
+			Name:      seg.Name,
+			RomStart:  romStart,
+			RomEnd:    romSize,
+			VramStart: vramStart,
+			VramEnd:   dot,
+		})
+	}
+	for _, seg := range w.RawSegments {
+		if seg.RomOffset != 0 {
+			romSize = seg.RomOffset
+		}
+		romSize = alignUp(romSize, seg.Align)
+		romStart := romSize
+		sectionStart := dot
+		dot = alignUp(dot, 0x10)
+		dataStart := dot
+		for _, include := range seg.Includes {
+			size, err := opts.rawSize(include)
+			if err != nil {
+				return nil, fmt.Errorf("could not read size of %s: %w", include, err)
+			}
+			dot = alignUp(dot, seg.IncludeAlign[include]) + size
+		}
+		dot = alignUp(dot, 0x10)
+		romSize += dot - sectionStart
+		layout = append(layout, SegmentLayout{
+			Wave:      w.Name,
+			Name:      seg.Name,
+			RomStart:  romStart,
+			RomEnd:    romSize,
+			VramStart: dataStart,
+			VramEnd:   dot,
+		})
+	}
+	return layout, nil
+}
@@ -0,0 +1,164 @@
+package spicy
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const mixedPlacementSpec = `
+beginseg
+  name "code"
+  flags BOOT OBJECT
+  entry boot
+  stack bootStack
+  include "code.o"
+endseg
+beginseg
+  name "overlay"
+  flags OBJECT
+  after "code"
+  align 0x100
+  include "overlay.o"
+endseg
+beginseg
+  name "fixed"
+  flags OBJECT
+  address 0x80200000
+  romoffset 0x40000
+  include "fixed.o"
+endseg
+beginseg
+  name "blob"
+  flags RAW
+  include "blob.bin"
+endseg
+beginwave
+  name "game"
+  include "code"
+  include "overlay"
+  include "fixed"
+  include "blob"
+endwave
+`
+
+// mixedPlacementOptions gives the includes of mixedPlacementSpec sizes
+// without them existing.
+func mixedPlacementOptions() LayoutOptions {
+	sections := map[string][]InputSection{
+		"code.o": {
+			{Name: ".text", Size: 0x123, Align: 4},
+			{Name: ".rodata.str1.4", Size: 0x10, Align: 4},
+			{Name: ".bss", Size: 0x40, Align: 8},
+		},
+		"overlay.o": {
+			{Name: ".text", Size: 0x80, Align: 4},
+			{Name: ".data", Size: 0x8, Align: 4},
+			{Name: "COMMON", Size: 0x20, Align: 16},
+		},
+		"fixed.o": {
+			{Name: ".text", Size: 0x30, Align: 4},
+		},
+	}
+	return LayoutOptions{
+		ReadSections: func(include string) ([]InputSection, error) { return sections[include], nil },
+		RawSize:      func(include string) (uint64, error) { return 0x1234, nil },
+	}
+}
+
+func TestComputeLayoutOfMixedPlacements(t *testing.T) {
+	assert := assert.New(t)
+	spec, err := ParseSpec(strings.NewReader(mixedPlacementSpec))
+	assert.Nil(err)
+	layout, err := ComputeLayout(spec, mixedPlacementOptions())
+	assert.Nil(err)
+	assert.Equal([]SegmentLayout{
+		// Text and rodata end at 0x80000584, rounded up to 0x10.
+		{Wave: "game", Name: "code", RomStart: 0x1050, RomEnd: 0x1190, VramStart: 0x80000450, VramEnd: 0x800005d0},
+		// Aligned in the ROM only; in VRAM it follows code's BSS.
+		{Wave: "game", Name: "overlay", RomStart: 0x1200, RomEnd: 0x1290, VramStart: 0x800005d0, VramEnd: 0x80000680},
+		{Wave: "game", Name: "fixed", RomStart: 0x40000, RomEnd: 0x40030, VramStart: 0x80200000, VramEnd: 0x80200030},
+		{Wave: "game", Name: "blob", RomStart: 0x40030, RomEnd: 0x41270, VramStart: 0x80200030, VramEnd: 0x80201270},
+	}, layout)
+}
+
+func TestComputeLayoutMatchesLinker(t *testing.T) {
+	assert := assert.New(t)
+	spec, err := ParseSpec(strings.NewReader(mixedPlacementSpec))
+	assert.Nil(err)
+	w := spec.Waves[0]
+	// Raw segments are linked from their wrapped objects, so are left out
+	// here; TestComputeLayoutOfMixedPlacements covers them.
+	w.RawSegments = nil
+
+	linked := linkWithHostTools(t, w, map[string]string{
+		"code.o":    "int counter; const char msg[] = \"hello\"; int boot(void) { return 1; }\n",
+		"overlay.o": "int table[3] = {1, 2, 3}; char scratch[0x20]; int overlay(void) { return 2; }\n",
+		"fixed.o":   "int fixed(int x) { return x * 3; }\n",
+	})
+	want, err := readSegmentLayout(linked, w)
+	assert.Nil(err)
+	// ComputeLayout reads the host's a.out as the entry stub, as the link
+	// did, so the whole layout must match.
+	got, err := ComputeLayout(spec, LayoutOptions{})
+	assert.Nil(err)
+	assert.Equal(want, got)
+}
+
+func TestComputeLayoutFollowsEntryStub(t *testing.T) {
+	assert := assert.New(t)
+	spec, err := ParseSpec(strings.NewReader(`
+beginseg
+  name "lib"
+  flags OBJECT
+  include "lib.o"
+endseg
+beginseg
+  name "code"
+  flags BOOT OBJECT
+  entry boot
+  stack bootStack
+  include "code.o"
+endseg
+beginwave
+  name "game"
+  include "lib"
+  include "code"
+endwave
+`))
+	assert.Nil(err)
+	opts := mixedPlacementOptions()
+	opts.ReadSections = func(include string) ([]InputSection, error) {
+		return []InputSection{{Name: ".text", Size: 0x10, Align: 4}}, nil
+	}
+	opts.EntryStubSize = func(w *Wave) (uint64, error) { return 0x34, nil }
+	layout, err := ComputeLayout(spec, opts)
+	assert.Nil(err)
+	// lib starts right after the stub; only its text is aligned to 0x10.
+	assert.Equal(uint64(0x80000434), layout[0].VramStart)
+	assert.Equal(uint64(0x80000450), layout[1].VramStart)
+}
+
+func TestLayoutJSONHasResolvedAddresses(t *testing.T) {
+	assert := assert.New(t)
+	spec, err := ParseSpec(strings.NewReader(mixedPlacementSpec))
+	assert.Nil(err)
+	layout, err := ComputeLayout(spec, mixedPlacementOptions())
+	assert.Nil(err)
+	b := &bytes.Buffer{}
+	assert.Nil(WriteLayoutJSON(b, spec, layout))
+	assert.Contains(b.String(), `{"wave":"game","name":"overlay","flags":["OBJECT"],"includes":["overlay.o"],"rom_start":4608,"rom_end":4752,"rom_size":144,"vram_start":2147485136,"vram_end":2147485312,"vram_size":176}`)
+	var records []LayoutRecord
+	assert.Nil(json.Unmarshal(b.Bytes(), &records))
+	assert.Equal(4, len(records))
+	assert.Equal(LayoutRecord{
+		Wave: "game", Name: "code", Flags: []string{"BOOT", "OBJECT"}, Includes: []string{"code.o"},
+		RomStart: 0x1050, RomEnd: 0x1190, RomSize: 0x140,
+		VramStart: 0x80000450, VramEnd: 0x800005d0, VramSize: 0x180,
+	}, records[0])
+	assert.Equal(uint64(0x40000), records[2].RomStart)
+	assert.Equal([]string{"RAW"}, records[3].Flags)
+}
@@ -5,9 +5,11 @@ import (
 	"encoding/hex"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"math/rand"
 	"os"
 	"path/filepath"
+	"strings"
 	"text/template"
 
 	log "github.com/sirupsen/logrus"
@@ -15,7 +17,18 @@ import (
 
 var ldArgs = []string{"-G 0", "-S", "-nostartfiles", "-nodefaultlibs", "-nostdinc", "-M"}
 
+// OrphanHandlingModes lists the --orphan-handling modes of ld that
+// BuildOptions.OrphanHandling may be set to.
+var OrphanHandlingModes = []string{"warn", "error", "place"}
+
 func createLdScript(w *Wave) (io.Reader, error) {
+	return createLdScriptWithOrphans(w, "")
+}
+
+// createLdScriptWithOrphans is createLdScript, leaving sections the script
+// does not place to ld's orphan handling if orphanHandling is set, rather
+// than discarding them.
+func createLdScriptWithOrphans(w *Wave, orphanHandling string) (io.Reader, error) {
 	t := `
 ENTRY(_start)
 MEMORY {
@@ -27,39 +40,46 @@ SECTIONS {
     _RomSize = _RomStart;
     ..generatedStartEntry 0x80000400 : AT(_RomSize)
     {
+      _spicyEntryStubStart = .;
       a.out (.text)
       a.out (.bss)
       a.out (.data)
+      _spicyEntryStubEnd = .;
     } > ram
     {{range .ObjectSegments -}}
-      {{if (gt .Positioning.Address 0x80000400)}}
+      {{if .RomOffset}}
+        _RomSize = {{.RomOffset}};
+      {{else if (gt .Positioning.Address 0x80000400)}}
         _RomSize = ({{.Positioning.Address}} - 0x80000400) + _RomStart;
       {{end}}
-    _{{.Name}}SegmentRomStart = _RomSize;
-    ..{{.Name}}
+      {{if .Align}}
+        _RomSize = ALIGN(_RomSize, {{.Align}});
+      {{end}}
+    {{.BoundarySymbol "RomStart"}} = _RomSize;
+    ..{{.LinkName}}
     {{if ne .Positioning.AfterSegment ""}}
-        ADDR(..{{.Positioning.AfterSegment}}.bss) + SIZEOF(..{{.Positioning.AfterSegment}}.bss)
+        ADDR(..{{linkName .Positioning.AfterSegment}}.bss) + SIZEOF(..{{linkName .Positioning.AfterSegment}}.bss)
     {{else if ne (index .Positioning.AfterMinSegment 0) ""}}
         MIN(
-          ADDR(..{{index .Positioning.AfterMinSegment 0}}.bss) + SIZEOF(..{{index .Positioning.AfterMinSegment 0}}.bss),
-          ADDR(..{{index .Positioning.AfterMinSegment 1}}.bss) + SIZEOF(..{{index .Positioning.AfterMinSegment 1}}.bss))
+          ADDR(..{{linkName (index .Positioning.AfterMinSegment 0)}}.bss) + SIZEOF(..{{linkName (index .Positioning.AfterMinSegment 0)}}.bss),
+          ADDR(..{{linkName (index .Positioning.AfterMinSegment 1)}}.bss) + SIZEOF(..{{linkName (index .Positioning.AfterMinSegment 1)}}.bss))
     {{else if ne (index .Positioning.AfterMaxSegment 0) ""}}
         MAX(
-          ADDR(..{{index .Positioning.AfterMaxSegment 0}}.bss) + SIZEOF(..{{index .Positioning.AfterMaxSegment 0}}.bss),
-          ADDR(..{{index .Positioning.AfterMaxSegment 1}}.bss) + SIZEOF(..{{index .Positioning.AfterMaxSegment 1}}.bss))
+          ADDR(..{{linkName (index .Positioning.AfterMaxSegment 0)}}.bss) + SIZEOF(..{{linkName (index .Positioning.AfterMaxSegment 0)}}.bss),
+          ADDR(..{{linkName (index .Positioning.AfterMaxSegment 1)}}.bss) + SIZEOF(..{{linkName (index .Positioning.AfterMaxSegment 1)}}.bss))
     {{else if not (eq .Positioning.Address 0)}}
       {{.Positioning.Address}}
     {{end}}
-    : AT(_RomSize)
+    {{if .Flags.NoLoad}} (NOLOAD) {{end}}: AT(_RomSize)
     {
-      _{{.Name}}SegmentStart = .;
+      {{.BoundarySymbol "Start"}} = .;
       . = ALIGN(0x10);
-      _{{.Name}}SegmentTextStart = .;
+      {{.BoundarySymbol "TextStart"}} = .;
       {{range .Includes -}}
         {{.}} (.text .text.*)
       {{end}}
-      _{{.Name}}SegmentTextEnd = .;
-      _{{.Name}}SegmentDataStart = .;
+      {{.BoundarySymbol "TextEnd"}} = .;
+      {{.BoundarySymbol "DataStart"}} = .;
       {{range .Includes -}}
         {{.}} (.data .data.*)
       {{end}}
@@ -69,16 +89,24 @@ SECTIONS {
       {{range .Includes -}}
         {{.}} (.sdata .sdata.*)
       {{end}}
+      {{if .Flags.Reloc}}
+      . = ALIGN(0x10);
+      {{.BoundarySymbol "RelocStart"}} = .;
+      "{{relocTableName .}}" (.data)
+      {{.BoundarySymbol "RelocEnd"}} = .;
+      {{end}}
       . = ALIGN(0x10);
-      _{{.Name}}SegmentDataEnd = .;
+      {{.BoundarySymbol "DataEnd"}} = .;
     } {{if (gt .Positioning.Address 0x80000400)}} > ram {{end}}
-    _RomSize += (_{{.Name}}SegmentDataEnd - _{{.Name}}SegmentTextStart);
-    _{{.Name}}SegmentRomEnd = _RomSize;
+    {{if not .Flags.NoLoad -}}
+    _RomSize += ({{.BoundarySymbol "DataEnd"}} - {{.BoundarySymbol "TextStart"}});
+    {{end -}}
+    {{.BoundarySymbol "RomEnd"}} = _RomSize;
 
-    ..{{.Name}}.bss ADDR(..{{.Name}}) + SIZEOF(..{{.Name}}) (NOLOAD) :
+    ..{{.LinkName}}.bss ADDR(..{{.LinkName}}) + SIZEOF(..{{.LinkName}}) (NOLOAD) :
     {
       . = ALIGN(0x10);
-      _{{.Name}}SegmentBssStart = .;
+      {{.BoundarySymbol "BssStart"}} = .;
       {{range .Includes -}}
         {{.}} (.sbss .sbss.*)
       {{end}}
@@ -91,51 +119,146 @@ SECTIONS {
       {{range .Includes -}}
         {{.}} (COMMON)
       {{end}}
+      {{if .Reserve}}
+      . += {{.Reserve}};
+      {{end}}
       . = ALIGN(0x10);
-      _{{.Name}}SegmentBssEnd = .;
-      _{{.Name}}SegmentEnd = .;
+      {{.BoundarySymbol "BssEnd"}} = .;
+      {{.BoundarySymbol "End"}} = .;
     } {{if (gt .Positioning.Address 0x80000400)}} > ram.bss {{end}}
-    _{{.Name}}SegmentBssSize =  _{{.Name}}SegmentBssEnd - _{{.Name}}SegmentBssStart;
+    {{.BoundarySymbol "BssSize"}} =  {{.BoundarySymbol "BssEnd"}} - {{.BoundarySymbol "BssStart"}};
   {{ end }}
+  /* Where the data image of --split-code-data starts in the ROM. */
+  _DataRomStart = _RomSize;
   {{range .RawSegments -}}
-    _{{.Name}}SegmentRomStart = _RomSize;
-    ..{{.Name}} : AT(_RomSize)
+    {{$alias := aliasOf .Name}}
+    {{if $alias}}
+    {{.BoundarySymbol "RomStart"}} = {{(segment $alias).BoundarySymbol "RomStart"}};
+    {{.BoundarySymbol "RomEnd"}} = {{(segment $alias).BoundarySymbol "RomEnd"}};
+    {{.BoundarySymbol "DataStart"}} = {{(segment $alias).BoundarySymbol "DataStart"}};
+    {{.BoundarySymbol "DataEnd"}} = {{(segment $alias).BoundarySymbol "DataEnd"}};
+    {{else}}
+    {{if .RomOffset}}
+    _RomSize = {{.RomOffset}};
+    {{end}}
+    {{if .Align}}
+    _RomSize = ALIGN(_RomSize, {{.Align}});
+    {{end}}
+    {{if and .Split .Split.First}}
+    {{.Split.Source.BoundarySymbol "RomStart"}} = _RomSize;
+    {{end}}
+    {{.BoundarySymbol "RomStart"}} = _RomSize;
+    ..{{.LinkName}} : AT(_RomSize)
     {
       . = ALIGN(0x10);
-      _{{.Name}}SegmentDataStart = .;
+      {{.BoundarySymbol "DataStart"}} = .;
+      {{$seg := .}}
       {{range .Includes -}}
-      "{{.}}.o"
+      "{{rawWrapperName . (index $seg.IncludeAlign .)}}"
       {{end}}
       . = ALIGN(0x10);
-      _{{.Name}}SegmentDataEnd = .;
+      {{.BoundarySymbol "DataEnd"}} = .;
     } > ram
-    _RomSize += SIZEOF(..{{.Name}});
-    _{{.Name}}SegmentRomEnd = _RomSize;
+    _RomSize += SIZEOF(..{{.LinkName}});
+    {{.BoundarySymbol "RomEnd"}} = _RomSize;
+    {{if and .Split .Split.First}}
+    {{.Split.Source.BoundarySymbol "DataStart"}} = {{.BoundarySymbol "DataStart"}};
+    {{end}}
+    {{if and .Split .Split.Last}}
+    {{.Split.Source.BoundarySymbol "RomEnd"}} = _RomSize;
+    {{.Split.Source.BoundarySymbol "DataEnd"}} = {{.BoundarySymbol "DataEnd"}};
+    {{end}}
+    {{end}}
   {{ end }}
+  /* Debug sections take no space in the ROM, so are kept for --split-debug. */
+  .debug_info 0 : { *(.debug_info .gnu.linkonce.wi.*) }
+  .debug_abbrev 0 : { *(.debug_abbrev) }
+  .debug_line 0 : { *(.debug_line .debug_line.*) }
+  .debug_str 0 : { *(.debug_str) }
+  .debug_aranges 0 : { *(.debug_aranges) }
+  .debug_frame 0 : { *(.debug_frame) }
+  .debug_loc 0 : { *(.debug_loc) }
+  .debug_ranges 0 : { *(.debug_ranges) }
+  .debug_line_str 0 : { *(.debug_line_str) }
+  .debug_loclists 0 : { *(.debug_loclists) }
+  .debug_rnglists 0 : { *(.debug_rnglists) }
   /DISCARD/ :
   {
+    /* Sections the toolchain always emits, which are never wanted. */
+    *(.comment .note .note.* .eh_frame .eh_frame_hdr .gcc_except_table .pdr .mdebug.* .gnu.attributes .reginfo .MIPS.* .gptab.* .options .debug_*)
+    /* Nothing is loaded dynamically, so linker-made tables are not either. */
+    *(.rel.* .rela.* .got .got.plt .igot.plt .plt .iplt .interp .dynamic .dynsym .dynstr .hash .gnu.hash)
+    {{if discardOrphans -}}
     /* Discard everything we haven't explicitly used. */
     *(*)
+    {{- end}}
   }
   _RomEnd = _RomSize;
 }
 `
-	tmpl, err := template.New("test").Parse(t)
+	// Segments referred to by name, from after statements and aliases, may
+	// be named differently in the script.
+	lookup := func(name string) *Segment {
+		for _, seg := range append(append([]*Segment{}, w.ObjectSegments...), w.RawSegments...) {
+			if seg.Name == name {
+				return seg
+			}
+		}
+		return &Segment{Name: name}
+	}
+	funcs := template.FuncMap{
+		"linkName":       func(name string) string { return lookup(name).LinkName() },
+		"segment":        lookup,
+		"aliasOf":        w.aliasOf,
+		"rawWrapperName": rawWrapperName,
+		"relocTableName": relocTableName,
+		"discardOrphans": func() bool { return orphanHandling == "" },
+	}
+	tmpl, err := template.New("test").Funcs(funcs).Parse(t)
 	if err != nil {
 		return nil, err
 	}
 	b := &bytes.Buffer{}
 	err = tmpl.Execute(b, w)
 	if err == nil {
-		log.Debugln("Ld script generated:\n", b.String())
+		stageDebugf("link", "Ld script generated:\n%s", b.String())
 	}
 	return b, err
 }
 
 func LinkSpec(w *Wave, ld Runner, entry io.Reader) (io.Reader, error) {
+	return linkSpec(w, ld, entry, BuildOptions{})
+}
+
+// CheckDefsym returns an error unless def defines a symbol as --defsym
+// expects, as NAME=value. NAME must be a C symbol, so that the game can
+// refer to it, and value must not be empty.
+func CheckDefsym(def string) error {
+	parts := strings.SplitN(def, "=", 2)
+	if len(parts) != 2 || strings.TrimSpace(parts[1]) == "" {
+		return fmt.Errorf("symbol definition %q must be given as NAME=value", def)
+	}
+	if !isSymbolPrefix(parts[0]) {
+		return fmt.Errorf("symbol definition %q must name a symbol, such as FOO", def)
+	}
+	return nil
+}
+
+// linkSpec is LinkSpec, applying opts.KeepDebug, opts.Sysroot,
+// opts.OrphanHandling and opts.Defsyms.
+func linkSpec(w *Wave, ld Runner, entry io.Reader, opts BuildOptions) (io.Reader, error) {
 	name := w.Name
 	log.Infof("Linking spec \"%s\".", name)
-	ldscript, err := createLdScript(w)
+	if opts.OrphanHandling != "" {
+		known := false
+		for _, mode := range OrphanHandlingModes {
+			known = known || mode == opts.OrphanHandling
+		}
+		if !known {
+			return nil, fmt.Errorf("unknown orphan handling %q", opts.OrphanHandling)
+		}
+	}
+	ldscript, err := createLdScriptWithOrphans(w, opts.OrphanHandling)
 	if err != nil {
 		return nil, err
 	}
@@ -143,25 +266,116 @@ func LinkSpec(w *Wave, ld Runner, entry io.Reader) (io.Reader, error) {
 	mappedInputs := map[string]io.Reader{
 		"ld-script": ldscript,
 	}
-	return NewMappedFileRunner(ld, mappedInputs, outputPath).Run( /* stdin=*/ nil, append(ldArgs, "-dT", "ld-script", "-o", outputPath))
+	var args []string
+	for _, arg := range ldArgs {
+		if arg != "-S" || !opts.KeepDebug {
+			args = append(args, arg)
+		}
+	}
+	if opts.Sysroot != "" {
+		args = append(args, "--sysroot="+opts.Sysroot)
+	}
+	if opts.OrphanHandling != "" {
+		args = append(args, "--orphan-handling="+opts.OrphanHandling)
+	}
+	for _, def := range opts.Defsyms {
+		if err := CheckDefsym(def); err != nil {
+			return nil, err
+		}
+		args = append(args, "--defsym", def)
+	}
+	return NewMappedFileRunner(ld, mappedInputs, outputPath).Run( /* stdin=*/ nil, append(args, "-dT", "ld-script", "-o", outputPath))
+}
+
+// SplitDebug writes the linked object to strippedPath without its debug
+// sections, and the debug sections alone to debugPath, which the stripped
+// object points debuggers at with a .gnu_debuglink section.
+func SplitDebug(linked io.Reader, objcopy Runner, strippedPath string, debugPath string) error {
+	b, err := ioutil.ReadAll(linked)
+	if err != nil {
+		return err
+	}
+	mappedInputs := map[string]io.Reader{
+		"objFile": bytes.NewReader(b),
+	}
+	if _, err := NewMappedFileRunner(objcopy, mappedInputs, debugPath).Run( /* stdin=*/ nil, []string{"--only-keep-debug", "objFile", debugPath}); err != nil {
+		return err
+	}
+	mappedInputs["objFile"] = bytes.NewReader(b)
+	_, err = NewMappedFileRunner(objcopy, mappedInputs, strippedPath).Run( /* stdin=*/ nil, []string{"--strip-debug", "--add-gnu-debuglink=" + debugPath, "objFile", strippedPath})
+	return err
 }
+
+// TempFileName returns a path for a new temporary file with suffix. Nothing
+// is created; whoever creates the file should track it in a Cleanup from
+// then on.
 func TempFileName(suffix string) string {
 	randBytes := make([]byte, 16)
 	rand.Read(randBytes)
 	return filepath.Join(os.TempDir(), hex.EncodeToString(randBytes)+suffix)
 }
 
-func BinarizeObject(obj io.Reader, objcopy Runner) (io.Reader, error) {
+// BinarizeObject converts a linked object into a flat binary. Gaps between
+// its sections are filled with fill, as the rest of the ROM is.
+func BinarizeObject(obj io.Reader, objcopy Runner, fill byte) (io.Reader, error) {
 	outputBin := TempFileName(".bin")
 	mappedInputs := map[string]io.Reader{
 		"objFile": obj,
 	}
-	return NewMappedFileRunner(objcopy, mappedInputs, outputBin).Run( /* stdin=*/ nil, []string{"-O", "binary", "objFile", outputBin})
+	return NewTempOutputFileRunner(NewMappedFileRunner(objcopy, mappedInputs, outputBin), outputBin).Run( /* stdin=*/ nil, []string{"-O", "binary", fmt.Sprintf("--gap-fill=0x%02x", fill), "objFile", outputBin})
+}
+
+// OutputFormatExtensions maps each objcopy output format spicy supports to
+// the file extension used for images in that format.
+var OutputFormatExtensions = map[string]string{
+	"binary": ".n64",
+	"ihex":   ".hex",
+	"srec":   ".srec",
+}
+
+// ConvertImage uses objcopy to convert a raw binary image into format,
+// writing the result to outputPath. If outputPath is empty, the result is
+// only returned, and the temporary file objcopy writes it to is removed.
+func ConvertImage(image io.Reader, objcopy Runner, format string, outputPath string) (io.Reader, error) {
+	if _, ok := OutputFormatExtensions[format]; !ok {
+		return nil, fmt.Errorf("unknown output format %q", format)
+	}
+	mappedInputs := map[string]io.Reader{
+		"image": image,
+	}
+	if outputPath == "" {
+		outputPath = TempFileName(OutputFormatExtensions[format])
+		return NewTempOutputFileRunner(NewMappedFileRunner(objcopy, mappedInputs, outputPath), outputPath).Run( /* stdin=*/ nil, []string{"-I", "binary", "-O", format, "image", outputPath})
+	}
+	return NewMappedFileRunner(objcopy, mappedInputs, outputPath).Run( /* stdin=*/ nil, []string{"-I", "binary", "-O", format, "image", outputPath})
 }
 
 func CreateRawObjectWrapper(r io.Reader, outputName string, ld Runner) (io.Reader, error) {
+	return createRawObjectWrapper(r, outputName, ld, 0)
+}
+
+// createRawObjectWrapper is CreateRawObjectWrapper, aligning the data to
+// align within the object if it is set.
+func createRawObjectWrapper(r io.Reader, outputName string, ld Runner, align uint64) (io.Reader, error) {
 	mappedInputs := map[string]io.Reader{
 		"input": r,
 	}
-	return NewMappedFileRunner(ld, mappedInputs, outputName).Run( /* stdin=*/ nil, []string{"-r", "-b", "binary", "-o", outputName, "input"})
+	args, script := rawObjectWrapperArgs(outputName, align)
+	if script != "" {
+		mappedInputs["wrapper-script"] = strings.NewReader(script)
+	}
+	return NewMappedFileRunner(ld, mappedInputs, outputName).Run( /* stdin=*/ nil, args)
+}
+
+// rawObjectWrapperArgs returns the arguments ld is run with to wrap data in
+// outputName, aligned to align, and the linker script it also reads as
+// wrapper-script, if one is needed.
+func rawObjectWrapperArgs(outputName string, align uint64) ([]string, string) {
+	args := []string{"-r", "-b", "binary", "-o", outputName, "input"}
+	if align == 0 {
+		return args, ""
+	}
+	// The script must come after "-b default", or ld reads it as binary
+	// data too.
+	return append(args, "-b", "default", "-T", "wrapper-script"), fmt.Sprintf("SECTIONS { .data : SUBALIGN(%d) { *(.data) } }\n", align)
 }
@@ -0,0 +1,724 @@
+package spicy
+
+import (
+	"bytes"
+	"compress/gzip"
+	"debug/elf"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestConvertImageToIhex(t *testing.T) {
+	assert := assert.New(t)
+	outputPath := filepath.Join(t.TempDir(), "rom.hex")
+	fake := &fakeRunner{output: []byte(":00000001FF\n")}
+	_, err := ConvertImage(bytes.NewReader([]byte{1, 2, 3, 4}), fake, "ihex", outputPath)
+	assert.Nil(err)
+	assert.Equal(1, len(fake.calls))
+	assert.Equal([]string{"-I", "binary", "-O", "ihex"}, fake.calls[0][:4])
+
+	_, err = ConvertImage(bytes.NewReader(nil), fake, "elf", outputPath)
+	assert.NotNil(err)
+
+	// Without an output path the converted image is only returned.
+	out, err := ConvertImage(bytes.NewReader([]byte{1, 2, 3, 4}), fake, "ihex", "")
+	assert.Nil(err)
+	b, err := ioutil.ReadAll(out)
+	assert.Nil(err)
+	assert.Equal(":00000001FF\n", string(b))
+	tempPath := fake.calls[1][len(fake.calls[1])-1]
+	assert.Equal(".hex", filepath.Ext(tempPath))
+	_, err = os.Stat(tempPath)
+	assert.True(os.IsNotExist(err))
+
+	if _, err := exec.LookPath("objcopy"); err != nil {
+		t.Skip("objcopy not available")
+	}
+	out, err = ConvertImage(bytes.NewReader([]byte{1, 2, 3, 4}), NewRunner("objcopy"), "ihex", outputPath)
+	assert.Nil(err)
+	b, err = ioutil.ReadAll(out)
+	assert.Nil(err)
+	assert.Equal(byte(':'), b[0])
+}
+
+// linkWithHostTools links w with the host's gcc and ld, compiling each
+// object from the given C source, and returns the linked object. The test is
+// skipped if the tools are not available.
+func linkWithHostTools(t *testing.T, w *Wave, sources map[string]string) []byte {
+	linked, err := linkWithHostOrphanHandling(t, w, sources, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return linked
+}
+
+// linkWithHostOrphanHandling is linkWithHostTools, passing orphanHandling to
+// ld if it is set, along with any extraArgs, and returning any error from ld.
+func linkWithHostOrphanHandling(t *testing.T, w *Wave, sources map[string]string, orphanHandling string, extraArgs ...string) ([]byte, error) {
+	for _, tool := range []string{"gcc", "ld"} {
+		if _, err := exec.LookPath(tool); err != nil {
+			t.Skip(tool + " not available")
+		}
+	}
+	chdirTemp(t)
+	sources["a.out"] = "void _start(void) {}\n"
+	for output, source := range sources {
+		input := output + ".c"
+		if err := ioutil.WriteFile(input, []byte(source), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := NewRunner("gcc").Run(nil, []string{"-c", "-g", "-fno-pic", "-o", output, input}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	script, err := createLdScriptWithOrphans(w, orphanHandling)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := ioutil.ReadAll(script)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile("ld-script", b, 0644); err != nil {
+		t.Fatal(err)
+	}
+	args := []string{"-T", "ld-script", "-o", "linked.out"}
+	if orphanHandling != "" {
+		args = append(args, "--orphan-handling="+orphanHandling)
+	}
+	args = append(args, extraArgs...)
+	if _, err := NewRunner("ld").Run(nil, args); err != nil {
+		return nil, err
+	}
+	linked, err := ioutil.ReadFile("linked.out")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return linked, nil
+}
+
+func TestDedupedRawSegmentIsStoredOnce(t *testing.T) {
+	assert := assert.New(t)
+	for _, tool := range []string{"ld", "objcopy"} {
+		if _, err := exec.LookPath(tool); err != nil {
+			t.Skip(tool + " not available")
+		}
+	}
+	dir := t.TempDir()
+	payload := []byte("a payload stored only once")
+	for _, name := range []string{"first.bin", "second.bin"} {
+		assert.Nil(ioutil.WriteFile(filepath.Join(dir, name), payload, 0644))
+	}
+	spec, err := ParseSpec(strings.NewReader(fmt.Sprintf(`
+beginseg
+  name "code"
+  flags BOOT OBJECT
+  entry boot
+  stack bootStack
+  include "code.o"
+endseg
+beginseg
+  name "first"
+  flags RAW
+  include "%s"
+endseg
+beginseg
+  name "second"
+  flags RAW
+  include "%s"
+endseg
+beginwave
+  name "game"
+  include "code"
+  include "first"
+  include "second"
+endwave
+`, filepath.Join(dir, "first.bin"), filepath.Join(dir, "second.bin"))))
+	assert.Nil(err)
+	w := spec.Waves[0]
+	_, err = PrepareRawSegments(w, NewRunner("ld"), BuildOptions{DedupeRaw: true})
+	assert.Nil(err)
+
+	linked := linkWithHostTools(t, w, map[string]string{
+		"code.o": "int boot(void) { return 1; }\n",
+	})
+	layout, err := readSegmentLayout(linked, w)
+	assert.Nil(err)
+	assert.Equal(layout[1].RomStart, layout[2].RomStart)
+	assert.Equal(layout[1].RomEnd, layout[2].RomEnd)
+	bin, err := BinarizeObject(bytes.NewReader(linked), NewRunner("objcopy"), 0)
+	assert.Nil(err)
+	b, err := ioutil.ReadAll(bin)
+	assert.Nil(err)
+	assert.Equal(1, bytes.Count(b, payload))
+}
+
+func TestNoLoadSegmentTakesNoRomSpace(t *testing.T) {
+	assert := assert.New(t)
+	spec, err := ParseSpec(bytes.NewReader([]byte(`
+beginseg
+  name "code"
+  flags BOOT OBJECT
+  entry boot
+  stack bootStack
+  include "code.o"
+endseg
+beginseg
+  name "buffers"
+  flags OBJECT NOLOAD
+  after "code"
+  include "buffers.o"
+endseg
+beginwave
+  name "game"
+  include "code"
+  include "buffers"
+endwave
+`)))
+	assert.Nil(err)
+	w := spec.Waves[0]
+	assert.True(w.ObjectSegments[1].Flags.NoLoad)
+
+	script, err := createLdScript(w)
+	assert.Nil(err)
+	b, err := ioutil.ReadAll(script)
+	assert.Nil(err)
+	assert.Contains(string(b), "(NOLOAD) : AT(_RomSize)")
+	assert.Equal(1, strings.Count(string(b), "_RomSize += "))
+
+	linked := linkWithHostTools(t, w, map[string]string{
+		"code.o":    "int boot(void) { return 1; }\n",
+		"buffers.o": "char buffer[0x100] = {1};\n",
+	})
+	layout, err := readSegmentLayout(linked, w)
+	assert.Nil(err)
+	assert.Equal(2, len(layout))
+	buffers := layout[1]
+	assert.Equal(buffers.RomStart, buffers.RomEnd)
+	assert.Equal(layout[0].RomEnd, buffers.RomStart)
+	assert.True(buffers.VramEnd-buffers.VramStart >= 0x100)
+	assert.True(buffers.VramStart >= layout[0].VramEnd)
+}
+
+func TestBinarizeObjectFillsGaps(t *testing.T) {
+	assert := assert.New(t)
+	fake := &fakeRunner{output: []byte{}}
+	_, err := BinarizeObject(bytes.NewReader(nil), fake, 0xaa)
+	assert.Nil(err)
+	assert.Contains(fake.calls[0], "--gap-fill=0xaa")
+
+	for _, tool := range []string{"as", "ld", "objcopy"} {
+		if _, err := exec.LookPath(tool); err != nil {
+			t.Skip(tool + " not available")
+		}
+	}
+	dir := chdirTemp(t)
+	source := ".section .first,\"a\"\n.byte 1\n.section .second,\"a\"\n.byte 2\n"
+	_, err = NewRunner("as").Run(strings.NewReader(source), []string{"-o", "sparse.o"})
+	assert.Nil(err)
+	script := "SECTIONS { .first 0x1000 : { *(.first) } .second 0x1008 : { *(.second) } /DISCARD/ : { *(*) } }"
+	assert.Nil(ioutil.WriteFile("sparse.ld", []byte(script), 0644))
+	_, err = NewRunner("ld").Run(nil, []string{"-T", "sparse.ld", "-o", "sparse.out", "sparse.o"})
+	assert.Nil(err)
+	obj, err := ioutil.ReadFile(filepath.Join(dir, "sparse.out"))
+	assert.Nil(err)
+
+	out, err := BinarizeObject(bytes.NewReader(obj), NewRunner("objcopy"), 0xaa)
+	assert.Nil(err)
+	b, err := ioutil.ReadAll(out)
+	assert.Nil(err)
+	assert.Equal([]byte{1, 0xaa, 0xaa, 0xaa, 0xaa, 0xaa, 0xaa, 0xaa, 2}, b)
+}
+
+func TestRomOffsetForcesRomPlacement(t *testing.T) {
+	assert := assert.New(t)
+	spec, err := ParseSpec(bytes.NewReader([]byte(`
+beginseg
+  name "code"
+  flags BOOT OBJECT
+  entry boot
+  stack bootStack
+  include "code.o"
+endseg
+beginseg
+  name "dma"
+  flags OBJECT
+  after "code"
+  romoffset 0x40000
+  include "dma.o"
+endseg
+beginwave
+  name "game"
+  include "code"
+  include "dma"
+endwave
+`)))
+	assert.Nil(err)
+	w := spec.Waves[0]
+	assert.Equal(uint64(0x40000), w.ObjectSegments[1].RomOffset)
+
+	linked := linkWithHostTools(t, w, map[string]string{
+		"code.o": "int boot(void) { return 1; }\n",
+		"dma.o":  "int table[4] = {1, 2, 3, 4};\n",
+	})
+	layout, err := readSegmentLayout(linked, w)
+	assert.Nil(err)
+	assert.Equal(uint64(0x40000), layout[1].RomStart)
+	assert.True(layout[1].RomEnd > layout[1].RomStart)
+	assert.True(layout[1].VramStart >= layout[0].VramEnd)
+}
+
+func TestRomOffsetInsideHeader(t *testing.T) {
+	_, err := ParseSpec(bytes.NewReader([]byte(`
+beginseg
+  name "dma"
+  flags OBJECT
+  romoffset 0x800
+  include "dma.o"
+endseg
+`)))
+	assert.NotNil(t, err)
+}
+
+func TestRomOffsetInsideHeaderWithOverlapAllowed(t *testing.T) {
+	spec, err := ParseSpec(bytes.NewReader([]byte(`
+beginseg
+  name "dma"
+  flags OBJECT
+  romoffset 0x800
+  include "dma.o"
+endseg
+beginwave
+  name "game"
+  include "dma"
+endwave
+`)), AllowHeaderOverlap())
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(0x800), spec.Waves[0].ObjectSegments[0].RomOffset)
+}
+
+func TestAlignAndAlignShiftMatch(t *testing.T) {
+	assert := assert.New(t)
+	specFor := func(align string) string {
+		return `
+beginseg
+  name "code"
+  flags BOOT OBJECT
+  entry boot
+  stack bootStack
+  include "code.o"
+endseg
+beginseg
+  name "data"
+  flags OBJECT
+  after "code"
+  ` + align + `
+  include "data.o"
+endseg
+beginwave
+  name "game"
+  include "code"
+  include "data"
+endwave
+`
+	}
+	var scripts []string
+	var waves []*Wave
+	for _, align := range []string{"align 0x1000", "alignshift 12"} {
+		spec, err := ParseSpec(strings.NewReader(specFor(align)))
+		assert.Nil(err)
+		assert.Equal(uint64(0x1000), spec.Waves[0].ObjectSegments[1].Align)
+		script, err := createLdScript(spec.Waves[0])
+		assert.Nil(err)
+		b, err := ioutil.ReadAll(script)
+		assert.Nil(err)
+		scripts = append(scripts, string(b))
+		waves = append(waves, spec.Waves[0])
+	}
+	assert.Equal(scripts[0], scripts[1])
+
+	_, err := ParseSpec(strings.NewReader(specFor("align 0x1800")))
+	assert.NotNil(err)
+
+	linked := linkWithHostTools(t, waves[0], map[string]string{
+		"code.o": "int boot(void) { return 1; }\n",
+		"data.o": "int table[4] = {1, 2, 3, 4};\n",
+	})
+	layout, err := readSegmentLayout(linked, waves[0])
+	assert.Nil(err)
+	assert.Equal(uint64(0), layout[1].RomStart%0x1000)
+	assert.True(layout[1].RomStart >= layout[0].RomEnd)
+}
+
+func TestSplitDebugSeparatesDebugSections(t *testing.T) {
+	assert := assert.New(t)
+	if _, err := exec.LookPath("objcopy"); err != nil {
+		t.Skip("objcopy not available")
+	}
+	spec, err := ParseSpec(bytes.NewReader([]byte(`
+beginseg
+  name "code"
+  flags BOOT OBJECT
+  entry boot
+  stack bootStack
+  include "code.o"
+endseg
+beginwave
+  name "game"
+  include "code"
+endwave
+`)))
+	assert.Nil(err)
+	linked := linkWithHostTools(t, spec.Waves[0], map[string]string{"code.o": "int counter;\nvoid boot(void) { counter++; }\n"})
+
+	assert.Nil(SplitDebug(bytes.NewReader(linked), NewRunner("objcopy"), "rom.out", "rom.debug"))
+	sections := func(path string) map[string]bool {
+		f, err := elf.Open(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		names := map[string]bool{}
+		for _, s := range f.Sections {
+			names[s.Name] = true
+		}
+		return names
+	}
+	stripped := sections("rom.out")
+	assert.False(stripped[".debug_info"])
+	assert.True(stripped[".gnu_debuglink"])
+	assert.True(sections("rom.debug")[".debug_info"])
+}
+
+func TestIncludeAlignAlignsWrappedBlob(t *testing.T) {
+	assert := assert.New(t)
+	if _, err := exec.LookPath("ld"); err != nil {
+		t.Skip("ld not available")
+	}
+	chdirTemp(t)
+	assert.Nil(ioutil.WriteFile("data.bin", []byte{1, 2, 3, 4, 5}, 0644))
+	spec, err := ParseSpec(strings.NewReader(`
+beginseg
+  name "data"
+  flags RAW
+  include "data.bin" align 16
+  align 32
+endseg
+beginwave
+  name "game"
+  include "data"
+endwave
+`))
+	assert.Nil(err)
+	seg := spec.Waves[0].RawSegments[0]
+	assert.Equal(map[string]uint64{"data.bin": 16}, seg.IncludeAlign)
+	assert.Equal(uint64(32), seg.Align)
+
+	_, err = PrepareRawSegments(spec.Waves[0], NewRunner("ld"), BuildOptions{})
+	assert.Nil(err)
+	f, err := elf.Open(rawWrapperName("data.bin", 16))
+	assert.Nil(err)
+	defer f.Close()
+	data := f.Section(".data")
+	assert.Equal(uint64(16), data.Addralign)
+	assert.Equal(uint64(0), data.Offset%16)
+	b, err := data.Data()
+	assert.Nil(err)
+	assert.Equal([]byte{1, 2, 3, 4, 5}, b)
+
+	_, err = ParseSpec(strings.NewReader("beginseg\n  name \"code\"\n  flags OBJECT\n  include \"code.o\" align 16\nendseg\n"))
+	assert.NotNil(err)
+}
+
+func TestGzipRawIncludeIsDecompressed(t *testing.T) {
+	assert := assert.New(t)
+	if _, err := exec.LookPath("ld"); err != nil {
+		t.Skip("ld not available")
+	}
+	chdirTemp(t)
+	level := bytes.Repeat([]byte{1, 2, 3, 4}, 64)
+	compressed := &bytes.Buffer{}
+	zw := gzip.NewWriter(compressed)
+	_, err := zw.Write(level)
+	assert.Nil(err)
+	assert.Nil(zw.Close())
+	assert.Nil(ioutil.WriteFile("level.bin.gz", compressed.Bytes(), 0644))
+	spec, err := ParseSpec(strings.NewReader(`
+beginseg
+  name "level"
+  flags RAW
+  include "level.bin.gz"
+endseg
+beginwave
+  name "game"
+  include "level"
+endwave
+`))
+	assert.Nil(err)
+	seg := spec.Waves[0].RawSegments[0]
+	size, err := rawSegmentSize(seg, true)
+	assert.Nil(err)
+	assert.Equal(uint64(len(level)), size)
+
+	_, err = PrepareRawSegments(spec.Waves[0], NewRunner("ld"), BuildOptions{})
+	assert.Nil(err)
+	f, err := elf.Open(rawWrapperName("level.bin.gz", 0))
+	assert.Nil(err)
+	defer f.Close()
+	b, err := f.Section(".data").Data()
+	assert.Nil(err)
+	assert.Equal(level, b)
+
+	// Only includes named .gz are decompressed; other data that starts with
+	// the magic bytes is included as it is.
+	assert.Nil(ioutil.WriteFile("level.bin", compressed.Bytes(), 0644))
+	size, err = rawIncludeSize("level.bin")
+	assert.Nil(err)
+	assert.Equal(uint64(compressed.Len()), size)
+	b, err = readRawInclude("level.bin")
+	assert.Nil(err)
+	assert.Equal(compressed.Bytes(), b)
+}
+
+func TestPrefixedSegmentBoundarySymbols(t *testing.T) {
+	assert := assert.New(t)
+	spec, err := ParseSpec(bytes.NewReader([]byte(`
+beginseg
+  name "code"
+  flags BOOT OBJECT
+  entry boot
+  stack bootStack
+  include "code.o"
+endseg
+beginseg
+  name "level"
+  flags OBJECT
+  after "code"
+  prefix game_
+  include "level.o"
+endseg
+beginwave
+  name "game"
+  include "code"
+  include "level"
+endwave
+`)))
+	assert.Nil(err)
+	w := spec.Waves[0]
+	assert.Equal("game_level", w.ObjectSegments[1].SymbolName())
+
+	linked := linkWithHostTools(t, w, map[string]string{
+		"code.o":  "static int state = 1; int boot(void) { return state; }\n",
+		"level.o": "static int state = 2; int level(void) { return state; }\n",
+	})
+	values, err := readSymbols(linked)
+	assert.Nil(err)
+	for _, suffix := range []string{"RomStart", "RomEnd", "TextStart", "DataEnd", "BssStart", "BssSize"} {
+		assert.Contains(values, "_game_levelSegment"+suffix)
+		assert.NotContains(values, "_levelSegment"+suffix)
+	}
+	assert.Contains(values, "_codeSegmentRomStart")
+	layout, err := readSegmentLayout(linked, w)
+	assert.Nil(err)
+	assert.Equal("level", layout[1].Name)
+	assert.Equal(values["_game_levelSegmentRomStart"], layout[1].RomStart)
+}
+
+func TestSymbolFormatNamesBoundarySymbols(t *testing.T) {
+	assert := assert.New(t)
+	spec, err := ParseSpec(bytes.NewReader([]byte(`
+beginseg
+  name "code"
+  flags BOOT OBJECT
+  entry boot
+  include "code.o"
+endseg
+beginwave
+  name "game"
+  include "code"
+endwave
+`)), SymbolFormat("%s_ROM_START"), DefaultStackSize(0x400))
+	assert.Nil(err)
+	w := spec.Waves[0]
+	assert.Equal("codeStack_BSS_END", w.GetBootSegment().StackInfo.Start)
+	entry, err := createEntrySource(w.GetBootSegment())
+	assert.Nil(err)
+	b, err := ioutil.ReadAll(entry)
+	assert.Nil(err)
+	assert.Contains(string(b), "la\t$9,code_BSS_SIZE")
+
+	linked := linkWithHostTools(t, w, map[string]string{
+		"code.o": "static int state = 1; int boot(void) { return state; }\n",
+	})
+	values, err := readSymbols(linked)
+	assert.Nil(err)
+	for _, symbol := range []string{"code_ROM_START", "code_ROM_END", "code_TEXT_START", "code_DATA_END", "code_BSS_START", "code_BSS_SIZE", "codeStack_BSS_END"} {
+		assert.Contains(values, symbol)
+	}
+	assert.NotContains(values, "_codeSegmentRomStart")
+	layout, err := readSegmentLayout(linked, w)
+	assert.Nil(err)
+	assert.Equal(values["code_ROM_START"], layout[0].RomStart)
+	assert.Equal(values["code_ROM_END"], layout[0].RomEnd)
+
+	_, err = ParseSpec(bytes.NewReader(nil), SymbolFormat("%s_START"))
+	assert.NotNil(err)
+}
+
+func TestMangledSegmentNamesLink(t *testing.T) {
+	assert := assert.New(t)
+	spec, err := ParseSpec(bytes.NewReader([]byte(`
+beginseg
+  name "コード"
+  flags BOOT OBJECT
+  entry boot
+  stack bootStack
+  include "code.o"
+endseg
+beginseg
+  name "ステージ"
+  flags OBJECT
+  after "コード"
+  include "level.o"
+endseg
+beginwave
+  name "game"
+  include "コード"
+  include "ステージ"
+endwave
+`)))
+	assert.Nil(err)
+	w := spec.Waves[0]
+
+	linked := linkWithHostTools(t, w, map[string]string{
+		"code.o":  "int boot(void) { return 1; }\n",
+		"level.o": "int level(void) { return 2; }\n",
+	})
+	values, err := readSymbols(linked)
+	assert.Nil(err)
+	assert.Contains(values, "_"+MangleSymbol("ステージ")+"SegmentRomStart")
+	layout, err := readSegmentLayout(linked, w)
+	assert.Nil(err)
+	assert.Equal("ステージ", layout[1].Name)
+	assert.True(layout[1].VramStart >= layout[0].VramEnd)
+}
+
+func TestDefaultStackIsAllocatedForEntryWithoutStack(t *testing.T) {
+	assert := assert.New(t)
+	spec, err := ParseSpec(bytes.NewReader([]byte(`
+beginseg
+  name "code"
+  flags BOOT OBJECT
+  entry boot
+  include "code.o"
+endseg
+beginwave
+  name "game"
+  include "code"
+endwave
+`)), DefaultStackSize(0x2000))
+	assert.Nil(err)
+	w := spec.Waves[0]
+	assert.Equal(2, len(w.ObjectSegments))
+	stackSeg := w.ObjectSegments[1]
+	assert.Equal("codeStack", stackSeg.Name)
+	assert.True(stackSeg.Flags.NoLoad)
+
+	source, err := createEntrySource(w.GetBootSegment())
+	assert.Nil(err)
+	b, err := ioutil.ReadAll(source)
+	assert.Nil(err)
+	assert.Contains(string(b), "la\t$29,_codeStackSegmentBssEnd + 0")
+
+	linked := linkWithHostTools(t, w, map[string]string{
+		"code.o": "char buffer[0x40]; int boot(void) { return 1; }\n",
+	})
+	values, err := readSymbols(linked)
+	assert.Nil(err)
+	assert.Equal(uint64(0x2000), values["_codeStackSegmentBssEnd"]-values["_codeStackSegmentBssStart"])
+	assert.True(values["_codeStackSegmentBssStart"] >= values["_codeSegmentEnd"])
+	layout, err := readSegmentLayout(linked, w)
+	assert.Nil(err)
+	assert.Equal(layout[1].RomStart, layout[1].RomEnd)
+	assert.Equal(values["_codeStackSegmentBssEnd"], layout[1].VramEnd)
+
+	computed, err := ComputeLayout(spec, LayoutOptions{})
+	assert.Nil(err)
+	assert.Equal(layout, computed)
+}
+
+func TestOrphanHandlingErrorFailsOnUnplacedSections(t *testing.T) {
+	assert := assert.New(t)
+	spec, err := ParseSpec(strings.NewReader(pipelineTestSpec))
+	assert.Nil(err)
+	w := spec.Waves[0]
+
+	code := "int boot(void) { return 1; }\nint bootStack[4];\n"
+	_, err = linkWithHostOrphanHandling(t, w, map[string]string{"code.o": code}, "error")
+	assert.Nil(err)
+
+	tagged := code + "__attribute__((section(\".custom\"))) int tagged = 5;\n"
+	_, err = linkWithHostOrphanHandling(t, w, map[string]string{"code.o": tagged}, "error")
+	assert.NotNil(err)
+	assert.Contains(err.Error(), ".custom")
+
+	// Without orphan handling, unplaced sections are discarded as before.
+	_, err = linkWithHostOrphanHandling(t, w, map[string]string{"code.o": tagged}, "")
+	assert.Nil(err)
+}
+
+func TestLinkSpecPassesOrphanHandling(t *testing.T) {
+	assert := assert.New(t)
+	chdirTemp(t)
+	spec, err := ParseSpec(strings.NewReader(pipelineTestSpec))
+	assert.Nil(err)
+	ld := &fakeRunner{output: []byte{}}
+	_, err = linkSpec(spec.Waves[0], ld, nil, BuildOptions{OrphanHandling: "warn"})
+	assert.Nil(err)
+	assert.Contains(ld.calls[0], "--orphan-handling=warn")
+
+	_, err = linkSpec(spec.Waves[0], ld, nil, BuildOptions{OrphanHandling: "ignore"})
+	assert.NotNil(err)
+}
+
+func TestDefsymResolvesReferences(t *testing.T) {
+	assert := assert.New(t)
+	chdirTemp(t)
+	spec, err := ParseSpec(strings.NewReader(pipelineTestSpec))
+	assert.Nil(err)
+	w := spec.Waves[0]
+	ld := &fakeRunner{output: []byte{}}
+	_, err = linkSpec(w, ld, nil, BuildOptions{Defsyms: []string{"FOO=0x10"}})
+	assert.Nil(err)
+	var defsymArgs []string
+	for i, arg := range ld.calls[0] {
+		if arg == "--defsym" && i+1 < len(ld.calls[0]) {
+			defsymArgs = append(defsymArgs, arg, ld.calls[0][i+1])
+		}
+	}
+	assert.Equal([]string{"--defsym", "FOO=0x10"}, defsymArgs)
+
+	// The host link fails on the undefined reference unless the definition
+	// passed to ld resolves it.
+	code := "extern char FOO[]; char *foo = FOO; int boot(void) { return 1; }\nint bootStack[4];\n"
+	_, err = linkWithHostOrphanHandling(t, w, map[string]string{"code.o": code}, "")
+	assert.NotNil(err)
+	linked, err := linkWithHostOrphanHandling(t, w, map[string]string{"code.o": code}, "", defsymArgs...)
+	assert.Nil(err)
+	values, err := readSymbols(linked)
+	assert.Nil(err)
+	assert.Equal(uint64(0x10), values["FOO"])
+
+	for _, def := range []string{"FOO", "FOO=", "=0x10", "1FOO=2"} {
+		assert.NotNil(CheckDefsym(def), def)
+	}
+	_, err = linkSpec(w, ld, nil, BuildOptions{Defsyms: []string{"FOO"}})
+	assert.NotNil(err)
+}
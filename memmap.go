@@ -0,0 +1,191 @@
+package spicy
+
+import (
+	"fmt"
+	"html"
+	"io"
+	"sort"
+	"strings"
+)
+
+// MemoryMapFormats are the formats WriteMemoryMap can draw a map in.
+var MemoryMapFormats = []string{"text", "svg"}
+
+// memoryMapBarWidth is how many characters the bar of the largest segment
+// takes in a text memory map.
+const memoryMapBarWidth = 40
+
+// memoryMapRegion is one address space of a memory map: the ROM, which
+// every wave shares, or the VRAM of a single wave.
+type memoryMapRegion struct {
+	title   string
+	entries []memoryMapEntry
+}
+
+// memoryMapEntry is a segment in a memory map, or the gap before it.
+type memoryMapEntry struct {
+	name  string
+	start uint64
+	end   uint64
+	gap   bool
+}
+
+func (e memoryMapEntry) size() uint64 {
+	return e.end - e.start
+}
+
+// memoryMapEntries sorts the non-empty ranges into address order, with an
+// entry for each gap left between them.
+func memoryMapEntries(ranges []memoryMapEntry) []memoryMapEntry {
+	var nonEmpty []memoryMapEntry
+	for _, r := range ranges {
+		if r.end > r.start {
+			nonEmpty = append(nonEmpty, r)
+		}
+	}
+	sort.SliceStable(nonEmpty, func(i, j int) bool {
+		return nonEmpty[i].start < nonEmpty[j].start
+	})
+	var entries []memoryMapEntry
+	var end uint64
+	for i, r := range nonEmpty {
+		if i > 0 && r.start > end {
+			entries = append(entries, memoryMapEntry{start: end, end: r.start, gap: true})
+		}
+		entries = append(entries, r)
+		if r.end > end {
+			end = r.end
+		}
+	}
+	return entries
+}
+
+// memoryMapRegions splits layout into the ROM and the VRAM of each wave.
+func memoryMapRegions(layout []SegmentLayout) []memoryMapRegion {
+	var waves []string
+	vram := map[string][]memoryMapEntry{}
+	var rom []memoryMapEntry
+	for _, l := range layout {
+		if _, ok := vram[l.Wave]; !ok {
+			waves = append(waves, l.Wave)
+			vram[l.Wave] = nil
+		}
+		vram[l.Wave] = append(vram[l.Wave], memoryMapEntry{name: l.Name, start: l.VramStart, end: l.VramEnd})
+	}
+	for _, l := range layout {
+		name := l.Name
+		if len(waves) > 1 {
+			name = l.Wave + "/" + l.Name
+		}
+		rom = append(rom, memoryMapEntry{name: name, start: l.RomStart, end: l.RomEnd})
+	}
+	regions := []memoryMapRegion{{title: "ROM", entries: memoryMapEntries(rom)}}
+	for _, w := range waves {
+		regions = append(regions, memoryMapRegion{title: "VRAM of wave " + w, entries: memoryMapEntries(vram[w])})
+	}
+	return regions
+}
+
+// largestSegment returns the size of the largest segment among entries.
+func largestSegment(entries []memoryMapEntry) uint64 {
+	var largest uint64
+	for _, e := range entries {
+		if !e.gap && e.size() > largest {
+			largest = e.size()
+		}
+	}
+	return largest
+}
+
+// WriteMemoryMap draws where each segment of layout lies in the ROM and in
+// the VRAM of its wave, in address order, in one of MemoryMapFormats. Each
+// segment's bar is scaled to its size against the largest segment of the
+// same map; gaps are listed with their size but not drawn to scale, as one
+// large gap would shrink every segment to nothing.
+func WriteMemoryMap(w io.Writer, layout []SegmentLayout, format string) error {
+	switch format {
+	case "text":
+		return writeTextMemoryMap(w, memoryMapRegions(layout))
+	case "svg":
+		return writeSVGMemoryMap(w, memoryMapRegions(layout))
+	}
+	return fmt.Errorf("unknown memory map format %q; formats are %s", format, strings.Join(MemoryMapFormats, ", "))
+}
+
+func writeTextMemoryMap(w io.Writer, regions []memoryMapRegion) error {
+	for i, region := range regions {
+		if i > 0 {
+			if _, err := fmt.Fprintln(w); err != nil {
+				return err
+			}
+		}
+		if _, err := fmt.Fprintf(w, "%s\n", region.title); err != nil {
+			return err
+		}
+		nameWidth := 0
+		for _, e := range region.entries {
+			if len(e.name) > nameWidth {
+				nameWidth = len(e.name)
+			}
+		}
+		largest := largestSegment(region.entries)
+		for _, e := range region.entries {
+			var err error
+			if e.gap {
+				_, err = fmt.Fprintf(w, "  0x%08x-0x%08x  %-*s  (0x%x-byte gap)\n", e.start, e.end, nameWidth, "", e.size())
+			} else {
+				bar := int((e.size()*memoryMapBarWidth + largest/2) / largest)
+				if bar < 1 {
+					bar = 1
+				}
+				_, err = fmt.Fprintf(w, "  0x%08x-0x%08x  %-*s  |%-*s| 0x%x bytes\n", e.start, e.end, nameWidth, e.name, memoryMapBarWidth, strings.Repeat("#", bar), e.size())
+			}
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// SVG memory maps draw each region as a column of boxes, the largest
+// segment of each svgMaxHeight high.
+const (
+	svgColumnWidth = 320
+	svgBoxWidth    = 120
+	svgMaxHeight   = 240
+	svgMinHeight   = 14
+	svgGapHeight   = 10
+	svgTop         = 30
+)
+
+func writeSVGMemoryMap(w io.Writer, regions []memoryMapRegion) error {
+	b := &strings.Builder{}
+	height := svgTop
+	for i, region := range regions {
+		x := 10 + i*svgColumnWidth
+		y := svgTop
+		fmt.Fprintf(b, "  <text x=\"%d\" y=\"%d\" font-weight=\"bold\">%s</text>\n", x, svgTop-10, html.EscapeString(region.title))
+		largest := largestSegment(region.entries)
+		for _, e := range region.entries {
+			if e.gap {
+				fmt.Fprintf(b, "  <text x=\"%d\" y=\"%d\" font-size=\"10\" fill=\"#888\">0x%x-byte gap</text>\n", x+svgBoxWidth+8, y+svgGapHeight-1, e.size())
+				y += svgGapHeight
+				continue
+			}
+			h := int(e.size() * svgMaxHeight / largest)
+			if h < svgMinHeight {
+				h = svgMinHeight
+			}
+			fmt.Fprintf(b, "  <rect x=\"%d\" y=\"%d\" width=\"%d\" height=\"%d\" fill=\"#9cf\" stroke=\"#036\"><title>%s: 0x%08x-0x%08x, 0x%x bytes</title></rect>\n", x, y, svgBoxWidth, h, html.EscapeString(e.name), e.start, e.end, e.size())
+			fmt.Fprintf(b, "  <text x=\"%d\" y=\"%d\" font-size=\"11\">%s</text>\n", x+4, y+11, html.EscapeString(e.name))
+			fmt.Fprintf(b, "  <text x=\"%d\" y=\"%d\" font-size=\"10\">0x%08x-0x%08x</text>\n", x+svgBoxWidth+8, y+11, e.start, e.end)
+			y += h
+		}
+		if y > height {
+			height = y
+		}
+	}
+	_, err := fmt.Fprintf(w, "<svg xmlns=\"http://www.w3.org/2000/svg\" width=\"%d\" height=\"%d\" font-family=\"monospace\">\n%s</svg>\n", 20+len(regions)*svgColumnWidth, height+10, b.String())
+	return err
+}
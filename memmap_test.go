@@ -0,0 +1,46 @@
+package spicy
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTextMemoryMapIsInAddressOrder(t *testing.T) {
+	assert := assert.New(t)
+	layout := []SegmentLayout{
+		{Wave: "game", Name: "code", RomStart: 0x1000, RomEnd: 0x1400, VramStart: 0x80000400, VramEnd: 0x80000800},
+		{Wave: "game", Name: "level", RomStart: 0x1800, RomEnd: 0x1a00, VramStart: 0x80400000, VramEnd: 0x80400200},
+		{Wave: "game", Name: "buffers", RomStart: 0x1400, RomEnd: 0x1400, VramStart: 0x80000800, VramEnd: 0x80000900},
+		{Wave: "game", Name: "boot", RomStart: 0x1400, RomEnd: 0x1500, VramStart: 0x80000900, VramEnd: 0x80000a00},
+	}
+	b := &bytes.Buffer{}
+	assert.Nil(WriteMemoryMap(b, layout, "text"))
+	bar := func(n int) string {
+		return "|" + strings.Repeat("#", n) + strings.Repeat(" ", memoryMapBarWidth-n) + "|"
+	}
+	assert.Equal(strings.Join([]string{
+		"ROM",
+		"  0x00001000-0x00001400  code   " + bar(40) + " 0x400 bytes",
+		"  0x00001400-0x00001500  boot   " + bar(10) + " 0x100 bytes",
+		"  0x00001500-0x00001800         (0x300-byte gap)",
+		"  0x00001800-0x00001a00  level  " + bar(20) + " 0x200 bytes",
+		"",
+		"VRAM of wave game",
+		"  0x80000400-0x80000800  code     " + bar(40) + " 0x400 bytes",
+		"  0x80000800-0x80000900  buffers  " + bar(10) + " 0x100 bytes",
+		"  0x80000900-0x80000a00  boot     " + bar(10) + " 0x100 bytes",
+		"  0x80000a00-0x80400000           (0x3ff600-byte gap)",
+		"  0x80400000-0x80400200  level    " + bar(20) + " 0x200 bytes",
+		"",
+	}, "\n"), b.String())
+
+	b.Reset()
+	assert.Nil(WriteMemoryMap(b, layout, "svg"))
+	assert.True(strings.HasPrefix(b.String(), "<svg "))
+	// buffers takes no space in the ROM, so is only drawn in VRAM.
+	assert.Equal(3+4, strings.Count(b.String(), "<rect "))
+	assert.NotNil(WriteMemoryMap(b, layout, "png"))
+}
@@ -0,0 +1,216 @@
+package spicy
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/trhodeos/n64rom"
+)
+
+const (
+	kseg0Start = 0x80000000
+	kseg2Start = 0xC0000000
+)
+
+// AddressRange is the [Start, End) region of memory a segment occupies.
+type AddressRange struct {
+	Name  string
+	Start uint32
+	End   uint32
+}
+
+// PhysicalAddr translates a direct-mapped KSEG0 (cached) or KSEG1 (uncached)
+// address to the physical address it refers to. Other addresses are returned
+// unchanged.
+func PhysicalAddr(vaddr uint32) uint32 {
+	if isDirectMapped(vaddr) {
+		return vaddr & 0x1FFFFFFF
+	}
+	return vaddr
+}
+
+func isDirectMapped(vaddr uint32) bool {
+	return vaddr >= kseg0Start && vaddr < kseg2Start
+}
+
+// CheckOverlaps returns an error if any two direct-mapped ranges share
+// physical memory. TLB-mapped ranges are not checked, as their physical
+// location is only known at runtime.
+func CheckOverlaps(ranges []AddressRange) error {
+	var physical []AddressRange
+	for _, r := range ranges {
+		if r.End <= r.Start || !isDirectMapped(r.Start) {
+			continue
+		}
+		physical = append(physical, AddressRange{Name: r.Name, Start: PhysicalAddr(r.Start), End: PhysicalAddr(r.Start) + (r.End - r.Start)})
+	}
+	if prev, cur, ok := findOverlap(physical); ok {
+		return fmt.Errorf("segments %s and %s overlap in physical memory at 0x%x-0x%x", prev.Name, cur.Name, cur.Start, prev.End)
+	}
+	return nil
+}
+
+// CheckRomOverlaps returns an error if any two non-empty ranges overlap in
+// the ROM.
+func CheckRomOverlaps(ranges []AddressRange) error {
+	var nonEmpty []AddressRange
+	for _, r := range ranges {
+		if r.End > r.Start {
+			nonEmpty = append(nonEmpty, r)
+		}
+	}
+	if prev, cur, ok := findOverlap(nonEmpty); ok {
+		return fmt.Errorf("segments %s and %s overlap in the ROM at 0x%x-0x%x", prev.Name, cur.Name, cur.Start, prev.End)
+	}
+	return nil
+}
+
+// findOverlap sorts ranges and returns the first overlapping pair.
+func findOverlap(ranges []AddressRange) (AddressRange, AddressRange, bool) {
+	sort.SliceStable(ranges, func(i, j int) bool { return ranges[i].Start < ranges[j].Start })
+	for i := 1; i < len(ranges); i++ {
+		if ranges[i].Start < ranges[i-1].End {
+			return ranges[i-1], ranges[i], true
+		}
+	}
+	return AddressRange{}, AddressRange{}, false
+}
+
+// memoryAddressRanges returns the memory occupied by w's object segments
+// and the data of its RAW segments. Aliased RAW segments share their data,
+// so they are left out.
+func memoryAddressRanges(w *Wave, layout []SegmentLayout) []AddressRange {
+	segments := map[string]bool{}
+	for _, seg := range w.ObjectSegments {
+		segments[seg.Name] = true
+	}
+	for _, seg := range w.RawSegments {
+		segments[seg.Name] = w.aliasOf(seg.Name) == ""
+	}
+	var ranges []AddressRange
+	for _, l := range layout {
+		if segments[l.Name] {
+			ranges = append(ranges, AddressRange{Name: l.Name, Start: uint32(l.VramStart), End: uint32(l.VramEnd)})
+		}
+	}
+	return ranges
+}
+
+// romAddressRanges returns the ROM occupied by w's segments. Aliased RAW
+// segments share their data, so they are left out.
+func romAddressRanges(w *Wave, layout []SegmentLayout) []AddressRange {
+	aliases := map[string]bool{}
+	for _, seg := range w.RawSegments {
+		if w.aliasOf(seg.Name) != "" {
+			aliases[seg.Name] = true
+		}
+	}
+	var ranges []AddressRange
+	for _, l := range layout {
+		if !aliases[l.Name] {
+			ranges = append(ranges, AddressRange{Name: l.Name, Start: uint32(l.RomStart), End: uint32(l.RomEnd)})
+		}
+	}
+	return ranges
+}
+
+// CheckCodeAlignment returns an error naming the first object segment of w
+// whose VRAM start is not a multiple of align. An align of zero disables the
+// check.
+func CheckCodeAlignment(w *Wave, layout []SegmentLayout, align uint64) error {
+	if align == 0 {
+		return nil
+	}
+	objects := map[string]bool{}
+	for _, seg := range w.ObjectSegments {
+		objects[seg.Name] = true
+	}
+	for _, l := range layout {
+		if objects[l.Name] && l.VramStart%align != 0 {
+			return fmt.Errorf("code segment %s starts at 0x%x, which is not aligned to 0x%x", l.Name, l.VramStart, align)
+		}
+	}
+	return nil
+}
+
+// CheckBootcodeOverlap returns an error if any segment in layout would be
+// written over the header or the size bytes of bootcode that follow it.
+func CheckBootcodeOverlap(layout []SegmentLayout, size int) error {
+	end := uint64(HeaderSize + size)
+	for _, l := range layout {
+		if l.RomEnd > l.RomStart && l.RomStart < end {
+			return fmt.Errorf("segment %s at 0x%x-0x%x overlaps the header and bootcode before 0x%x", l.Name, l.RomStart, l.RomEnd, end)
+		}
+	}
+	return nil
+}
+
+// CheckHeaderOverlap returns an error if any segment in layout would be
+// written over the header and bootcode before n64rom.CodeStart.
+func CheckHeaderOverlap(layout []SegmentLayout) error {
+	for _, l := range layout {
+		if l.RomEnd > l.RomStart && l.RomStart < n64rom.CodeStart {
+			return fmt.Errorf("segment %s at 0x%x-0x%x overlaps the header and bootcode before 0x%x", l.Name, l.RomStart, l.RomEnd, n64rom.CodeStart)
+		}
+	}
+	return nil
+}
+
+// entryStubSymbols are the symbols the linker script defines around the
+// entry stub.
+const (
+	entryStubStartSymbol = "_spicyEntryStubStart"
+	entryStubEndSymbol   = "_spicyEntryStubEnd"
+)
+
+// entryStubRange returns where the entry stub of a linked wave lies, from
+// the symbols of the linked object, if it has them.
+func entryStubRange(symbols map[string]uint64) (AddressRange, bool) {
+	start, ok := symbols[entryStubStartSymbol]
+	if !ok {
+		return AddressRange{}, false
+	}
+	end, ok := symbols[entryStubEndSymbol]
+	if !ok {
+		return AddressRange{}, false
+	}
+	return AddressRange{Name: "entry stub", Start: uint32(start), End: uint32(end)}, true
+}
+
+// cicEntryOffsets are how far below the header's initial PC the IPL3 of
+// each CIC jumps to. The 6103 and 6106 IPL3s subtract these, so their ROMs
+// give a PC above the code they start.
+var cicEntryOffsets = map[CIC]uint32{
+	CIC6103: 0x100000,
+	CIC6106: 0x200000,
+}
+
+// EntryTarget returns the address the IPL3 of cic jumps to for pc, the
+// initial PC in the ROM header.
+func EntryTarget(pc uint32, cic CIC) uint32 {
+	return pc - cicEntryOffsets[cic]
+}
+
+// CheckEntryPc returns an error unless target, the address IPL3 jumps to
+// as EntryTarget gives it, is within one of stubs, the entry stubs of the
+// linked waves, or the loaded part of one of the OBJECT segments of waves
+// in layout; anywhere else holds no code once IPL3 has loaded the ROM.
+func CheckEntryPc(target uint32, stubs []AddressRange, waves []*Wave, layout []SegmentLayout) error {
+	for _, stub := range stubs {
+		if target >= stub.Start && target < stub.End {
+			return nil
+		}
+	}
+	code := map[string]bool{}
+	for _, w := range waves {
+		for _, seg := range w.ObjectSegments {
+			code[w.Name+"\x00"+seg.Name] = !seg.Flags.NoLoad
+		}
+	}
+	for _, l := range layout {
+		if code[l.Wave+"\x00"+l.Name] && uint64(target) >= l.VramStart && uint64(target) < l.VramStart+(l.RomEnd-l.RomStart) {
+			return nil
+		}
+	}
+	return fmt.Errorf("entry PC 0x%08x in the ROM header is outside the entry stub and every loaded code segment", target)
+}
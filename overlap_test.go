@@ -0,0 +1,122 @@
+package spicy
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPhysicalAddr(t *testing.T) {
+	assert := assert.New(t)
+	assert.Equal(uint32(0x00000400), PhysicalAddr(0x80000400))
+	assert.Equal(uint32(0x00000400), PhysicalAddr(0xA0000400))
+	assert.Equal(uint32(0x01000000), PhysicalAddr(0x01000000))
+}
+
+func TestCheckOverlapsAcrossKsegs(t *testing.T) {
+	assert := assert.New(t)
+	err := CheckOverlaps([]AddressRange{
+		{Name: "cached", Start: 0x80100000, End: 0x80102000},
+		{Name: "uncached", Start: 0xA0101000, End: 0xA0103000},
+	})
+	assert.NotNil(err)
+	assert.Contains(err.Error(), "cached and uncached")
+
+	assert.Nil(CheckOverlaps([]AddressRange{
+		{Name: "cached", Start: 0x80100000, End: 0x80102000},
+		{Name: "uncached", Start: 0xA0102000, End: 0xA0103000},
+		{Name: "mapped", Start: 0x00100000, End: 0x00102000},
+	}))
+}
+
+func TestCheckOverlapsIncludesRawSegments(t *testing.T) {
+	assert := assert.New(t)
+	w := &Wave{
+		ObjectSegments: []*Segment{{Name: "code"}},
+		RawSegments:    []*Segment{{Name: "data"}, {Name: "copy"}},
+		rawAliases:     map[string]string{"copy": "data"},
+	}
+	layout := []SegmentLayout{
+		{Name: "code", VramStart: 0x80000450, VramEnd: 0x80002000},
+		{Name: "data", VramStart: 0x80002000, VramEnd: 0x80003000},
+		{Name: "copy", VramStart: 0x80002000, VramEnd: 0x80003000},
+	}
+	assert.Nil(CheckOverlaps(memoryAddressRanges(w, layout)))
+
+	layout[1].VramStart, layout[1].VramEnd = 0xA0001000, 0xA0003000
+	layout[2].VramStart, layout[2].VramEnd = 0xA0001000, 0xA0003000
+	err := CheckOverlaps(memoryAddressRanges(w, layout))
+	assert.NotNil(err)
+	assert.Contains(err.Error(), "segments code and data overlap in physical memory")
+}
+
+func TestCheckRomOverlaps(t *testing.T) {
+	assert := assert.New(t)
+	w := &Wave{RawSegments: []*Segment{{Name: "copy"}}, rawAliases: map[string]string{"copy": "data"}}
+	layout := []SegmentLayout{
+		{Name: "code", RomStart: 0x1000, RomEnd: 0x3000},
+		{Name: "data", RomStart: 0x3000, RomEnd: 0x4000},
+		{Name: "copy", RomStart: 0x3000, RomEnd: 0x4000},
+		{Name: "empty", RomStart: 0x2000, RomEnd: 0x2000},
+	}
+	assert.Nil(CheckRomOverlaps(romAddressRanges(w, layout)))
+
+	layout = append(layout, SegmentLayout{Name: "forced", RomStart: 0x2800, RomEnd: 0x2900})
+	err := CheckRomOverlaps(romAddressRanges(w, layout))
+	assert.NotNil(err)
+	assert.Contains(err.Error(), "code and forced overlap in the ROM")
+}
+
+func TestCheckCodeAlignment(t *testing.T) {
+	assert := assert.New(t)
+	w := &Wave{
+		ObjectSegments: []*Segment{{Name: "code"}, {Name: "overlay"}},
+		RawSegments:    []*Segment{{Name: "data"}},
+	}
+	layout := []SegmentLayout{
+		{Name: "code", VramStart: 0x80000450},
+		{Name: "overlay", VramStart: 0x80100008},
+		{Name: "data", VramStart: 0x80200004},
+	}
+	err := CheckCodeAlignment(w, layout, 0x10)
+	assert.NotNil(err)
+	assert.Contains(err.Error(), "code segment overlay starts at 0x80100008")
+	assert.Nil(CheckCodeAlignment(w, layout, 0x8))
+	assert.Nil(CheckCodeAlignment(w, layout, 0))
+}
+
+func TestCheckHeaderOverlap(t *testing.T) {
+	assert := assert.New(t)
+	assert.Nil(CheckHeaderOverlap([]SegmentLayout{{Name: "code", RomStart: 0x1000, RomEnd: 0x2000}}))
+	err := CheckHeaderOverlap([]SegmentLayout{{Name: "dma", RomStart: 0x800, RomEnd: 0x900}})
+	assert.NotNil(err)
+	assert.Contains(err.Error(), "segment dma at 0x800-0x900 overlaps the header")
+}
+
+func TestCheckEntryPc(t *testing.T) {
+	assert := assert.New(t)
+	w := &Wave{Name: "game", ObjectSegments: []*Segment{
+		{Name: "code", Flags: Flags{Boot: true, Object: true}, Entries: []EntryPoint{{Entry: "boot"}}},
+		{Name: "bss", Flags: Flags{Object: true, NoLoad: true}},
+	}}
+	layout := []SegmentLayout{
+		{Wave: "game", Name: "code", RomStart: 0x1000, RomEnd: 0x2000, VramStart: 0x80000450, VramEnd: 0x80001800},
+		{Wave: "game", Name: "bss", RomStart: 0x2000, RomEnd: 0x2000, VramStart: 0x80001800, VramEnd: 0x80002000},
+	}
+	stubs := []AddressRange{{Name: "entry stub", Start: 0x80000400, End: 0x80000440}}
+	for _, pc := range []uint32{0x80000400, 0x8000043c, 0x80000450, 0x8000144f} {
+		assert.Nil(CheckEntryPc(pc, stubs, []*Wave{w}, layout), "0x%x", pc)
+	}
+	for _, pc := range []uint32{0x80000440, 0x80001450, 0x80001900, 0x00000400} {
+		assert.NotNil(CheckEntryPc(pc, stubs, []*Wave{w}, layout), "0x%x", pc)
+	}
+	assert.EqualError(CheckEntryPc(0x80200000, stubs, []*Wave{w}, layout), "entry PC 0x80200000 in the ROM header is outside the entry stub and every loaded code segment")
+	// A larger stub, such as one compiled from C, is taken as it was linked.
+	assert.Nil(CheckEntryPc(0x80000440, []AddressRange{{Start: 0x80000400, End: 0x80000480}}, []*Wave{w}, layout))
+
+	// The 6103 and 6106 IPL3s jump below the header's PC.
+	assert.Equal(uint32(0x80000400), EntryTarget(0x80000400, CIC6102))
+	assert.Equal(uint32(0x80000400), EntryTarget(0x80100400, CIC6103))
+	assert.Equal(uint32(0x80000400), EntryTarget(0x80200400, CIC6106))
+	assert.Nil(CheckEntryPc(EntryTarget(0x80100450, CIC6103), stubs, []*Wave{w}, layout))
+}
@@ -0,0 +1,92 @@
+package spicy
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	"github.com/trhodeos/n64rom"
+)
+
+// PaddingGap is a run of ROM bytes, from Start up to End, left between two
+// segments by alignment or placement, which only hold fill.
+type PaddingGap struct {
+	Start  uint64
+	End    uint64
+	After  string
+	Before string
+}
+
+// Size returns the number of bytes in the gap.
+func (g PaddingGap) Size() uint64 {
+	return g.End - g.Start
+}
+
+// PaddingGaps returns the gaps between the segments of layout, in ROM
+// order. Segments of every wave are considered together, as they share the
+// ROM.
+func PaddingGaps(layout []SegmentLayout) []PaddingGap {
+	sorted := append([]SegmentLayout{}, layout...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].RomStart < sorted[j].RomStart
+	})
+	var gaps []PaddingGap
+	var end uint64
+	var last string
+	for _, seg := range sorted {
+		if last != "" && seg.RomStart > end {
+			gaps = append(gaps, PaddingGap{Start: end, End: seg.RomStart, After: last, Before: seg.Name})
+		}
+		if last == "" || seg.RomEnd >= end {
+			end = seg.RomEnd
+			last = seg.Name
+		}
+	}
+	return gaps
+}
+
+// CheckNoGaps returns an error listing every gap between the segments of
+// layout, for ROMs that must be packed tightly. Space between stubEnd, where
+// the entry stub ends in the ROM, and the first segment is a gap too; the
+// header and bootcode before n64rom.CodeStart are not.
+func CheckNoGaps(layout []SegmentLayout, stubEnd uint64) error {
+	gaps := PaddingGaps(layout)
+	if len(layout) > 0 {
+		first := layout[0]
+		for _, l := range layout[1:] {
+			if l.RomStart < first.RomStart {
+				first = l
+			}
+		}
+		after := "the entry stub"
+		if stubEnd <= n64rom.CodeStart {
+			stubEnd, after = n64rom.CodeStart, "the header"
+		}
+		if first.RomStart > stubEnd {
+			gaps = append([]PaddingGap{{Start: stubEnd, End: first.RomStart, After: after, Before: first.Name}}, gaps...)
+		}
+	}
+	if len(gaps) == 0 {
+		return nil
+	}
+	lines := make([]string, len(gaps))
+	for i, gap := range gaps {
+		lines[i] = fmt.Sprintf("0x%08x-0x%08x, 0x%x bytes between %s and %s", gap.Start, gap.End, gap.Size(), gap.After, gap.Before)
+	}
+	return fmt.Errorf("gaps were left between segments in the ROM:\n  %s", strings.Join(lines, "\n  "))
+}
+
+// WritePadReport writes each gap between the segments of layout and the
+// total number of bytes they waste.
+func WritePadReport(w io.Writer, layout []SegmentLayout) error {
+	var total uint64
+	for _, gap := range PaddingGaps(layout) {
+		if _, err := fmt.Fprintf(w, "0x%08x-0x%08x\t%d bytes\tbetween %s and %s\n", gap.Start, gap.End, gap.Size(), gap.After, gap.Before); err != nil {
+			return err
+		}
+		total += gap.Size()
+	}
+	_, err := fmt.Fprintf(w, "total\t%d bytes\n", total)
+	return err
+}
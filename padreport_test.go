@@ -0,0 +1,115 @@
+package spicy
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPaddingGapsBetweenSegments(t *testing.T) {
+	assert := assert.New(t)
+	layout := []SegmentLayout{
+		{Name: "code", RomStart: 0x1050, RomEnd: 0x1190},
+		{Name: "blob", RomStart: 0x40000, RomEnd: 0x40200},
+		{Name: "overlay", RomStart: 0x1200, RomEnd: 0x1290},
+		{Name: "buffers", RomStart: 0x1290, RomEnd: 0x1290},
+	}
+	assert.Equal([]PaddingGap{
+		{Start: 0x1190, End: 0x1200, After: "code", Before: "overlay"},
+		{Start: 0x1290, End: 0x40000, After: "buffers", Before: "blob"},
+	}, PaddingGaps(layout))
+
+	b := &bytes.Buffer{}
+	assert.Nil(WritePadReport(b, layout))
+	lines := strings.Split(strings.TrimSpace(b.String()), "\n")
+	assert.Equal(3, len(lines))
+	assert.Equal("0x00001190-0x00001200\t112 bytes\tbetween code and overlay", lines[0])
+	assert.Equal("total\t257504 bytes", lines[2])
+}
+
+func TestPadReportTotalsSpecGaps(t *testing.T) {
+	assert := assert.New(t)
+	spec, err := ParseSpec(strings.NewReader(mixedPlacementSpec))
+	assert.Nil(err)
+	layout, err := ComputeLayout(spec, LayoutOptions{
+		ReadSections: func(include string) ([]InputSection, error) {
+			return []InputSection{{Name: ".text", Size: 0x84, Align: 4}}, nil
+		},
+		RawSize: func(include string) (uint64, error) { return 0x100, nil },
+	})
+	assert.Nil(err)
+	var sum uint64
+	for _, gap := range PaddingGaps(layout) {
+		sum += gap.Size()
+	}
+	// code ends at 0x10e0, overlay is aligned to 0x1100 and ends at 0x1190,
+	// and fixed is placed at 0x40000.
+	assert.Equal(uint64((0x1100-0x10e0)+(0x40000-0x1190)), sum)
+
+	b := &bytes.Buffer{}
+	assert.Nil(WritePadReport(b, layout))
+	assert.True(strings.HasSuffix(b.String(), "total\t257680 bytes\n"), b.String())
+}
+
+func TestNoGapsFailsOnAlignmentGap(t *testing.T) {
+	assert := assert.New(t)
+	spec, err := ParseSpec(strings.NewReader(`
+beginseg
+  name "code"
+  flags BOOT OBJECT
+  entry boot
+  stack bootStack
+  include "code.o"
+endseg
+beginseg
+  name "overlay"
+  flags OBJECT
+  after "code"
+  align 0x100
+  include "overlay.o"
+endseg
+beginwave
+  name "game"
+  include "code"
+  include "overlay"
+endwave
+`))
+	assert.Nil(err)
+	layout, err := ComputeLayout(spec, LayoutOptions{
+		ReadSections: func(include string) ([]InputSection, error) {
+			return []InputSection{{Name: ".text", Size: 0x84, Align: 4}}, nil
+		},
+	})
+	assert.Nil(err)
+	// code follows a 0x50-byte entry stub, ends at 0x10e0, and overlay is
+	// aligned to 0x1100.
+	stubs := []AddressRange{{Name: "entry stub", Start: 0x80000400, End: 0x80000450}}
+	err = CheckNoGaps(layout, 0x1050)
+	assert.EqualError(err, "gaps were left between segments in the ROM:\n  0x000010e0-0x00001100, 0x20 bytes between code and overlay")
+
+	err = checkNoGaps(layout, stubs, BuildOptions{NoGaps: true})
+	var stageErr *StageError
+	assert.True(errors.As(err, &stageErr))
+	assert.Equal("gaps", stageErr.Stage)
+
+	// Without the alignment the segments are packed, and the space before
+	// the entry stub for the header does not count.
+	layout[1].RomStart, layout[1].RomEnd = layout[0].RomEnd, layout[0].RomEnd+0x90
+	assert.Nil(CheckNoGaps(layout, 0x1050))
+	assert.Nil(checkNoGaps(layout, stubs, BuildOptions{NoGaps: true}))
+}
+
+func TestNoGapsFailsOnGapBeforeFirstSegment(t *testing.T) {
+	assert := assert.New(t)
+	layout := []SegmentLayout{
+		{Name: "tail", RomStart: 0x3000, RomEnd: 0x3100},
+		{Name: "blob", RomStart: 0x2000, RomEnd: 0x3000},
+	}
+	assert.EqualError(CheckNoGaps(layout, 0), "gaps were left between segments in the ROM:\n  0x00001000-0x00002000, 0x1000 bytes between the header and blob")
+	assert.EqualError(CheckNoGaps(layout, 0x1040), "gaps were left between segments in the ROM:\n  0x00001040-0x00002000, 0xfc0 bytes between the entry stub and blob")
+	layout[1].RomStart = 0x1040
+	assert.Nil(CheckNoGaps(layout, 0x1040))
+}
@@ -0,0 +1,262 @@
+package spicy
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Pipeline holds everything needed to turn a spec into a ROM, so that a
+// build can be configured once and run without going through the CLI.
+type Pipeline struct {
+	Cpp     Runner
+	Ld      Runner
+	As      Runner
+	Objcopy Runner
+
+	IncludeFlags  []string
+	DefineFlags   []string
+	UndefineFlags []string
+	// QuoteIncludeFlags are searched for quoted includes only, before
+	// IncludeFlags, and SystemIncludeFlags as system header directories,
+	// after them.
+	QuoteIncludeFlags  []string
+	SystemIncludeFlags []string
+	// CppArgs are passed to Cpp after every other argument, for flags such
+	// as -nostdinc that spicy has no option of its own for.
+	CppArgs      []string
+	ParseOptions []ParseOption
+	BuildOptions BuildOptions
+	// NoPreprocess parses specs as they are, without running them through
+	// Cpp, for quick checks of specs that use no macros or includes.
+	NoPreprocess bool
+	// CanonicalOrder builds the spec a second time, starting its waves in
+	// the opposite order, and fails the build if the two ROMs differ.
+	CanonicalOrder bool
+}
+
+// BuildResult is the outcome of a successful Pipeline.Run.
+type BuildResult struct {
+	Spec    *Spec
+	Rom     *Rom
+	Layout  []SegmentLayout
+	Objects []WaveObject
+	// SegmentTables holds the table of each wave's RAW segments, in the
+	// order of the spec's waves.
+	SegmentTables []WaveSegmentTable
+	Timings       []StageTiming
+}
+
+// RomReader returns a reader of the ROM image as the build would save it.
+// Each call starts a new reader at the beginning of the image, so that
+// several consumers, such as a file and a hash, can each read all of it.
+func (r *BuildResult) RomReader() io.Reader {
+	return bytes.NewReader(r.Rom.Bytes())
+}
+
+// cppFlags returns the flags p preprocesses a spec with. For the spec at
+// path, if it is set, its directory is searched after p.IncludeFlags.
+func (p *Pipeline) cppFlags(path string) []string {
+	includeFlags := p.IncludeFlags
+	if path != "" {
+		includeFlags = append(append([]string{}, p.IncludeFlags...), filepath.Dir(path))
+	}
+	return cppFlags(includeFlags, p.QuoteIncludeFlags, p.SystemIncludeFlags, p.DefineFlags, p.UndefineFlags, p.BuildOptions.Sysroot, p.CppArgs)
+}
+
+// cpp returns p.Cpp, recording the commands it runs in p's tracer.
+func (p *Pipeline) cpp() Runner {
+	return WithTrace(p.BuildOptions.Tracer, "cpp")(p.Cpp)
+}
+
+func (p *Pipeline) parse(spec io.Reader, timer *stageTimer) (*Spec, error) {
+	if p.NoPreprocess {
+		return p.parsePreprocessed(spec, timer)
+	}
+	start := time.Now()
+	preprocessed, err := preprocessSpec(spec, p.cpp(), p.cppFlags(""))
+	if err != nil {
+		return nil, &PipelineError{Code: ExitParse, Err: fmt.Errorf("could not preprocess spec: %w", err)}
+	}
+	timer.track("preprocess", "", start)
+	return p.parsePreprocessed(preprocessed, timer)
+}
+
+func (p *Pipeline) parsePreprocessed(preprocessed io.Reader, timer *stageTimer) (*Spec, error) {
+	start := time.Now()
+	options := p.ParseOptions
+	if p.NoPreprocess {
+		options = append(append([]ParseOption{}, options...), NotPreprocessed(HashLinesError))
+	}
+	parsed, err := ParseSpec(preprocessed, options...)
+	if err != nil {
+		return nil, &PipelineError{Code: ExitParse, Err: fmt.Errorf("could not parse spec: %w", err)}
+	}
+	timer.track("parse", "", start)
+	return parsed, nil
+}
+
+// preprocessFile preprocesses the spec at path, unless p.NoPreprocess is
+// set, looking up quoted includes next to it. The output is labelled with
+// path so errors point back at it.
+func (p *Pipeline) preprocessFile(path string, timer *stageTimer) ([]byte, error) {
+	start := time.Now()
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("could not open spec: %w", err)
+	}
+	defer f.Close()
+	var preprocessed io.Reader = f
+	if !p.NoPreprocess {
+		preprocessed, err = preprocessSpec(f, p.cpp(), p.cppFlags(path))
+		if err != nil {
+			return nil, fmt.Errorf("could not preprocess spec %s: %w", path, err)
+		}
+	}
+	b, err := ioutil.ReadAll(preprocessed)
+	if err != nil {
+		return nil, fmt.Errorf("could not preprocess spec %s: %w", path, err)
+	}
+	if !p.NoPreprocess {
+		timer.track("preprocess", "", start)
+	}
+	out := []byte(fmt.Sprintf("# 1 %q\n", path))
+	out = append(out, relabelStdin(b, path)...)
+	if len(b) > 0 && b[len(b)-1] != '\n' {
+		out = append(out, '\n')
+	}
+	return out, nil
+}
+
+// ParseFiles preprocesses each of paths and parses them as a single spec,
+// so segments and waves can be split across files. A segment name may only
+// be defined once across all of them.
+func (p *Pipeline) ParseFiles(paths ...string) (*Spec, error) {
+	timer := &stageTimer{tracer: p.BuildOptions.Tracer}
+	combined := &bytes.Buffer{}
+	for _, path := range paths {
+		b, err := p.preprocessFile(path, timer)
+		if err != nil {
+			return nil, &PipelineError{Code: ExitParse, Err: err}
+		}
+		combined.Write(b)
+	}
+	return p.parsePreprocessed(combined, timer)
+}
+
+// Parse preprocesses and parses spec without building it.
+func (p *Pipeline) Parse(spec io.Reader) (*Spec, error) {
+	return p.parse(spec, &stageTimer{tracer: p.BuildOptions.Tracer})
+}
+
+// Run preprocesses, parses and builds spec.
+func (p *Pipeline) Run(spec io.Reader) (*BuildResult, error) {
+	timer := &stageTimer{tracer: p.BuildOptions.Tracer}
+	parsed, err := p.parse(spec, timer)
+	if err != nil {
+		return nil, err
+	}
+	return p.build(parsed, timer)
+}
+
+// Build builds an already parsed spec.
+func (p *Pipeline) Build(spec *Spec) (*BuildResult, error) {
+	return p.build(spec, &stageTimer{tracer: p.BuildOptions.Tracer})
+}
+
+func (p *Pipeline) build(parsed *Spec, timer *stageTimer) (*BuildResult, error) {
+	result, err := p.buildRom(parsed, timer)
+	if err != nil {
+		return nil, &PipelineError{Code: ExitBuild, Err: err}
+	}
+	return result, nil
+}
+
+// buildOptions returns p.BuildOptions, compiling a C entry stub with Cpp,
+// which is gcc, unless another compiler is given.
+func (p *Pipeline) buildOptions() BuildOptions {
+	opts := p.BuildOptions
+	if opts.EntryLang == "c" && opts.EntryCc == nil {
+		opts.EntryCc = p.Cpp
+	}
+	return opts
+}
+
+// LayoutOptions returns the options ComputeLayout needs to lay out a spec as
+// p would build it, taking the size of each wave's entry stub from the stub
+// p builds for it.
+func (p *Pipeline) LayoutOptions() LayoutOptions {
+	opts := p.buildOptions()
+	return LayoutOptions{
+		EntryStubSize: func(w *Wave) (uint64, error) {
+			return MeasureEntryStub(w, p.As, opts)
+		},
+	}
+}
+
+func (p *Pipeline) buildRom(parsed *Spec, timer *stageTimer) (*BuildResult, error) {
+	opts := p.buildOptions()
+	ld, as, objcopy := p.Ld, p.As, p.Objcopy
+	traceRunners(opts.Tracer, &ld, &as, &objcopy)
+	defer trackTempFiles(&opts, &ld, &as, &objcopy)()
+	if err := checkLoadable(parsed.Waves, opts); err != nil {
+		return nil, err
+	}
+	if err := checkRawSizes(parsed.Waves, opts); err != nil {
+		return nil, err
+	}
+	base, err := readBaseRom(opts)
+	if err != nil {
+		return nil, err
+	}
+	builds, err := buildWaves(parsed.Waves, ld, as, objcopy, opts, timer, false)
+	if err != nil {
+		return nil, err
+	}
+	rom, layout, err := assembleRom(base, parsed.Waves, builds, opts)
+	if err != nil {
+		return nil, err
+	}
+	if p.CanonicalOrder {
+		if err := p.checkCanonicalOrder(parsed, base, rom, layout, opts); err != nil {
+			return nil, err
+		}
+	}
+	result := &BuildResult{Spec: parsed, Rom: rom, Layout: layout}
+	for i, w := range parsed.Waves {
+		result.Objects = append(result.Objects, WaveObject{Wave: w.Name, Linked: builds[i].linked})
+		result.SegmentTables = append(result.SegmentTables, WaveSegmentTable{Wave: w.Name, Table: builds[i].segments})
+	}
+	result.Timings = timer.timings
+	return result, nil
+}
+
+// checkCanonicalOrder builds parsed again with opts, starting its waves from
+// the last, and returns an error if the ROM differs from rom.
+func (p *Pipeline) checkCanonicalOrder(parsed *Spec, base []byte, rom *Rom, layout []SegmentLayout, opts BuildOptions) error {
+	ld, as, objcopy := p.Ld, p.As, p.Objcopy
+	traceRunners(opts.Tracer, &ld, &as, &objcopy)
+	trackTempFiles(&opts, &ld, &as, &objcopy)
+	builds, err := buildWaves(parsed.Waves, ld, as, objcopy, opts, nil, true)
+	if err != nil {
+		return fmt.Errorf("could not rebuild spec to check its order: %w", err)
+	}
+	again, _, err := assembleRom(base, parsed.Waves, builds, opts)
+	if err != nil {
+		return fmt.Errorf("could not rebuild spec to check its order: %w", err)
+	}
+	ranges, err := DiffROMs(bytes.NewReader(rom.Bytes()), bytes.NewReader(again.Bytes()))
+	if err != nil {
+		return err
+	}
+	if len(ranges) > 0 {
+		r := ranges[0]
+		return &StageError{Stage: "canonical", Err: fmt.Errorf("two builds of the spec differ in %d places, first at 0x%x-0x%x (%s)", len(ranges), r.Start, r.End, strings.Join(DiffRegions(r, layout), ", "))}
+	}
+	return nil
+}
@@ -0,0 +1,332 @@
+package spicy
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/trhodeos/n64rom"
+)
+
+const pipelineTestSpec = `
+beginseg
+  name "code"
+  flags BOOT OBJECT
+  entry boot
+  stack bootStack
+  include "code.o"
+endseg
+beginwave
+  name "game"
+  include "code"
+endwave
+`
+
+func TestPipelineRun(t *testing.T) {
+	assert := assert.New(t)
+	chdirTemp(t)
+	p := newTestPipeline()
+	result, err := p.Run(strings.NewReader(pipelineTestSpec))
+	assert.Nil(err)
+	assert.Equal("game", result.Spec.Waves[0].Name)
+	assert.Equal([]SegmentLayout{
+		{Wave: "game", Name: "code", RomStart: 0x1000, RomEnd: 0x1008, VramStart: 0x80000450, VramEnd: 0x80000458},
+	}, result.Layout)
+	var stages []string
+	for _, timing := range result.Timings {
+		stages = append(stages, timing.Stage)
+	}
+	assert.Equal([]string{"preprocess", "parse", "raw", "entry", "link", "binarize"}, stages)
+	b, err := ioutil.ReadAll(result.RomReader())
+	assert.Nil(err)
+	assert.Equal([]byte{1, 2, 3, 4, 5, 6, 7, 8}, b[n64rom.CodeStart:])
+	again, err := ioutil.ReadAll(result.RomReader())
+	assert.Nil(err)
+	assert.Equal(b, again)
+}
+
+func TestBuildResultHoldsSegmentTables(t *testing.T) {
+	assert := assert.New(t)
+	chdirTemp(t)
+	assert.Nil(ioutil.WriteFile("data.bin", []byte{1, 2, 3, 4, 5, 6, 7, 8}, 0644))
+	symbols := segmentSymbols(map[string]uint64{}, "code", 0x1000, 0x80000450, 8)
+	symbols = segmentSymbols(symbols, "data_0", 0x1008, 0, 4)
+	symbols = segmentSymbols(symbols, "data_1", 0x100c, 0, 4)
+	p := newFakePipeline(symbols, make([]byte, 16))
+	p.BuildOptions.AutoSplit = true
+	result, err := p.Run(strings.NewReader(`
+beginseg
+  name "code"
+  flags BOOT OBJECT
+  entry boot
+  stack bootStack
+  include "code.o"
+endseg
+beginseg
+  name "data"
+  flags RAW
+  maxsize 4
+  include "data.bin"
+endseg
+beginwave
+  name "game"
+  include "code"
+  include "data"
+endwave
+`))
+	assert.Nil(err)
+	assert.Equal([]WaveSegmentTable{{Wave: "game", Table: SegmentTable{
+		{Name: "data_0", Source: "data", Offset: 0, Size: 4},
+		{Name: "data_1", Source: "data", Offset: 4, Size: 4},
+	}}}, result.SegmentTables)
+}
+
+func TestSpecRomSizeDirectivePadsRom(t *testing.T) {
+	assert := assert.New(t)
+	chdirTemp(t)
+	p := newTestPipeline()
+	spec, err := p.Parse(strings.NewReader("romsize 8\nfill 0xff\n" + pipelineTestSpec))
+	assert.Nil(err)
+	assert.Equal(8, spec.RomSize)
+	assert.Equal(byte(0xff), *spec.Fill)
+
+	p.BuildOptions.RomSize = MbitBytes(spec.RomSize)
+	p.BuildOptions.FillByte = *spec.Fill
+	result, err := p.Build(spec)
+	assert.Nil(err)
+	b := readRom(t, result.Rom)
+	assert.Equal(0x100000, len(b))
+	assert.Equal(int64(0x100000), result.Rom.Size())
+	assert.Equal(int64(result.Layout[len(result.Layout)-1].RomEnd), result.Rom.UsedSize())
+	assert.Equal([]byte{1, 2, 3, 4, 5, 6, 7, 8, 0xff}, b[n64rom.CodeStart:n64rom.CodeStart+9])
+	assert.Equal(byte(0xff), b[len(b)-1])
+}
+
+func TestRomBytesPadsToExactSize(t *testing.T) {
+	assert := assert.New(t)
+	chdirTemp(t)
+	p := newTestPipeline()
+	size, err := ParseNumber("8M")
+	assert.Nil(err)
+	p.BuildOptions.RomSize = size
+	result, err := p.Run(strings.NewReader(pipelineTestSpec))
+	assert.Nil(err)
+	assert.Equal(8<<20, len(readRom(t, result.Rom)))
+}
+
+func TestMaxRomSizeStopsOversizedBuild(t *testing.T) {
+	assert := assert.New(t)
+	chdirTemp(t)
+	p := newTestPipeline()
+	p.BuildOptions.MaxRomSize = 0x1000
+	_, err := p.Run(strings.NewReader(pipelineTestSpec))
+	assert.NotNil(err)
+	assert.Contains(err.Error(), "over the limit of 0x1000 bytes")
+
+	p.BuildOptions.MaxRomSize = 4 << 20
+	p.BuildOptions.RomSize = 8 << 20
+	_, err = p.Run(strings.NewReader(pipelineTestSpec))
+	assert.NotNil(err)
+	assert.Contains(err.Error(), "padded to 0x800000 bytes")
+}
+
+func TestExternalEntryPcIsRejected(t *testing.T) {
+	assert := assert.New(t)
+	chdirTemp(t)
+	header := make([]byte, HeaderSize)
+	binary.BigEndian.PutUint32(header, DefaultPiConfig)
+	binary.BigEndian.PutUint32(header[8:], 0x80300000)
+	p := newTestPipeline()
+	p.BuildOptions.Header = header
+	_, err := p.Run(strings.NewReader(pipelineTestSpec))
+	assert.NotNil(err)
+	assert.Contains(err.Error(), "entry PC 0x80300000 in the ROM header is outside")
+	assert.Equal("entry", errorStage(err))
+
+	p.BuildOptions.AllowExternalEntry = true
+	result, err := p.Run(strings.NewReader(pipelineTestSpec))
+	assert.Nil(err)
+	assert.Equal(uint32(0x80300000), result.Rom.EntryPc())
+}
+
+func TestParseFilesMergesSpecs(t *testing.T) {
+	assert := assert.New(t)
+	dir := chdirTemp(t)
+	codeSpec := filepath.Join(dir, "code.spec")
+	gameSpec := filepath.Join(dir, "game.spec")
+	assert.Nil(ioutil.WriteFile(codeSpec, []byte(`
+beginseg
+  name "code"
+  flags BOOT OBJECT
+  entry boot
+  stack bootStack
+  include "code.o"
+endseg
+`), 0644))
+	assert.Nil(ioutil.WriteFile(gameSpec, []byte(`
+beginseg
+  name "data"
+  flags OBJECT
+  after "code"
+  include "data.o"
+endseg
+beginwave
+  name "game"
+  include "code"
+  include "data"
+endwave
+`), 0644))
+	symbols := segmentSymbols(map[string]uint64{}, "code", 0x1000, 0x80000450, 4)
+	symbols = segmentSymbols(symbols, "data", 0x1004, 0x80000454, 4)
+	p := newFakePipeline(symbols, []byte{1, 2, 3, 4, 5, 6, 7, 8})
+
+	spec, err := p.ParseFiles(codeSpec, gameSpec)
+	assert.Nil(err)
+	assert.Equal(gameSpec, spec.Waves[0].ObjectSegments[1].Span.Filename)
+	result, err := p.Build(spec)
+	assert.Nil(err)
+	assert.Equal([]SegmentLayout{
+		{Wave: "game", Name: "code", RomStart: 0x1000, RomEnd: 0x1004, VramStart: 0x80000450, VramEnd: 0x80000454},
+		{Wave: "game", Name: "data", RomStart: 0x1004, RomEnd: 0x1008, VramStart: 0x80000454, VramEnd: 0x80000458},
+	}, result.Layout)
+
+	_, err = p.ParseFiles(codeSpec, codeSpec, gameSpec)
+	assert.NotNil(err)
+	assert.Contains(err.Error(), codeSpec+":2:1: Segment code was already defined at "+codeSpec+":2.")
+}
+
+func TestNoPreprocessSkipsCpp(t *testing.T) {
+	assert := assert.New(t)
+	cpp := &echoRunner{}
+	p := &Pipeline{Cpp: cpp, NoPreprocess: true}
+	spec, err := p.Parse(strings.NewReader(pipelineTestSpec))
+	assert.Nil(err)
+	assert.Equal("game", spec.Waves[0].Name)
+	assert.Empty(cpp.calls)
+
+	_, err = p.Parse(strings.NewReader("#include \"segments.spec\"\n" + pipelineTestSpec))
+	var specErr *SpecError
+	assert.True(errors.As(err, &specErr))
+	assert.Equal(1, specErr.Line)
+	assert.Contains(specErr.Message, "needs the spec to be preprocessed")
+
+	spec, err = ParseSpec(strings.NewReader("# segments\n"+pipelineTestSpec), NotPreprocessed(HashLinesComment))
+	assert.Nil(err)
+	assert.Equal(3, spec.Waves[0].ObjectSegments[0].Span.StartLine)
+}
+
+func TestSysrootReachesCppAndLd(t *testing.T) {
+	assert := assert.New(t)
+	chdirTemp(t)
+	p := newTestPipeline()
+	p.BuildOptions.Sysroot = "/opt/mips-sysroot"
+	_, err := p.Run(strings.NewReader(pipelineTestSpec))
+	assert.Nil(err)
+	assert.Contains(p.Cpp.(*echoRunner).calls[0], "--sysroot=/opt/mips-sysroot")
+	assert.Contains(p.Ld.(*fakeRunner).calls[0], "--sysroot=/opt/mips-sysroot")
+}
+
+func TestCppArgsReachCpp(t *testing.T) {
+	assert := assert.New(t)
+	p := newTestPipeline()
+	p.IncludeFlags = []string{"include"}
+	p.CppArgs = []string{"-nostdinc", "-ffreestanding"}
+	_, err := p.Parse(strings.NewReader(pipelineTestSpec))
+	assert.Nil(err)
+	args := p.Cpp.(*echoRunner).calls[0]
+	assert.Equal([]string{"-Iinclude", "-nostdinc", "-ffreestanding"}, args[len(args)-3:])
+}
+
+func TestQuoteAndSystemIncludesReachCpp(t *testing.T) {
+	assert := assert.New(t)
+	p := newTestPipeline()
+	p.IncludeFlags = []string{"include"}
+	p.QuoteIncludeFlags = []string{"quote/one", "quote/two"}
+	p.SystemIncludeFlags = []string{"sys"}
+	p.DefineFlags = []string{"DEBUG"}
+	_, err := p.Parse(strings.NewReader(pipelineTestSpec))
+	assert.Nil(err)
+	args := p.Cpp.(*echoRunner).calls[0]
+	assert.Equal([]string{"-Iinclude", "-iquote", "quote/one", "-iquote", "quote/two", "-isystem", "sys", "-DDEBUG"}, args[len(args)-8:])
+}
+
+func TestBootcodeAndCodeAreBothWritten(t *testing.T) {
+	assert := assert.New(t)
+	chdirTemp(t)
+	p := newTestPipeline()
+	p.BuildOptions.Bootcode = bytes.Repeat([]byte{0xb0}, BootcodeSize)
+	result, err := p.Run(strings.NewReader(pipelineTestSpec))
+	assert.Nil(err)
+	b := readRom(t, result.Rom)
+	assert.Equal(p.BuildOptions.Bootcode, b[HeaderSize:n64rom.CodeStart])
+	assert.Equal([]byte{1, 2, 3, 4, 5, 6, 7, 8}, b[n64rom.CodeStart:])
+}
+
+// waveLinker stands in for ld, writing the object given for the wave whose
+// output it is asked for.
+type waveLinker map[string][]byte
+
+func (l waveLinker) Run(r io.Reader, args []string) (io.Reader, error) {
+	path := args[len(args)-1]
+	return &bytes.Buffer{}, ioutil.WriteFile(path, l[strings.TrimSuffix(path, ".out")], 0644)
+}
+
+// hashingObjcopy stands in for objcopy -O binary, taking a moment to do so,
+// and writes the first bytes of the SHA-256 of its input, so each wave's
+// image differs.
+type hashingObjcopy struct{}
+
+func (hashingObjcopy) Run(r io.Reader, args []string) (io.Reader, error) {
+	time.Sleep(time.Duration(rand.Intn(5)) * time.Millisecond)
+	b, err := ioutil.ReadFile(args[len(args)-2])
+	if err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256(b)
+	return &bytes.Buffer{}, ioutil.WriteFile(args[len(args)-1], sum[:8], 0644)
+}
+
+func TestParallelBuildsAreIdentical(t *testing.T) {
+	assert := assert.New(t)
+	chdirTemp(t)
+	spec := &strings.Builder{}
+	objects := waveLinker{}
+	for i := 0; i < 8; i++ {
+		fmt.Fprintf(spec, "beginseg\n name \"code%d\"\n flags BOOT OBJECT\n entry boot\n stack bootStack\n include \"code.o\"\nendseg\n", i)
+		fmt.Fprintf(spec, "beginwave\n name \"wave%d\"\n include \"code%d\"\nendwave\n", i, i)
+		// Every wave is placed at the same ROM address, so the image is
+		// that of whichever wave is written last.
+		objects[fmt.Sprintf("wave%d", i)] = testElf(entrySymbols(segmentSymbols(map[string]uint64{}, fmt.Sprintf("code%d", i), 0x1000, 0x80000450+uint64(i)*0x10, 8)))
+	}
+	p := newTestPipeline()
+	p.Ld = objects
+	p.Objcopy = hashingObjcopy{}
+	p.BuildOptions.Jobs = 4
+	p.CanonicalOrder = true
+	first, err := p.Run(strings.NewReader(spec.String()))
+	if !assert.Nil(err) {
+		return
+	}
+	second, err := p.Run(strings.NewReader(spec.String()))
+	if !assert.Nil(err) {
+		return
+	}
+	assert.Equal(first.Rom.Bytes(), second.Rom.Bytes())
+	var names []string
+	for _, l := range first.Layout {
+		names = append(names, l.Wave)
+	}
+	assert.Equal([]string{"wave0", "wave1", "wave2", "wave3", "wave4", "wave5", "wave6", "wave7"}, names)
+	sum := sha256.Sum256(objects["wave7"])
+	assert.Equal(sum[:8], readRom(t, first.Rom)[n64rom.CodeStart:])
+}
@@ -0,0 +1,57 @@
+package spicy
+
+import (
+	"fmt"
+	"os"
+	"runtime"
+	"runtime/pprof"
+)
+
+// Profiler writes pprof CPU and heap profiles of a run of spicy.
+type Profiler struct {
+	cpu     *os.File
+	memPath string
+}
+
+// StartProfiling starts a CPU profile written to cpuPath, and arranges for
+// Stop to write a heap profile to memPath. Either path may be empty.
+func StartProfiling(cpuPath string, memPath string) (*Profiler, error) {
+	p := &Profiler{memPath: memPath}
+	if cpuPath != "" {
+		f, err := os.Create(cpuPath)
+		if err != nil {
+			return nil, fmt.Errorf("could not create CPU profile: %v", err)
+		}
+		if err := pprof.StartCPUProfile(f); err != nil {
+			f.Close()
+			return nil, fmt.Errorf("could not start CPU profile: %v", err)
+		}
+		p.cpu = f
+	}
+	return p, nil
+}
+
+// Stop finishes the CPU profile and writes the heap profile.
+func (p *Profiler) Stop() error {
+	if p.cpu != nil {
+		pprof.StopCPUProfile()
+		if err := p.cpu.Close(); err != nil {
+			return fmt.Errorf("could not write CPU profile: %v", err)
+		}
+		p.cpu = nil
+	}
+	if p.memPath == "" {
+		return nil
+	}
+	f, err := os.Create(p.memPath)
+	if err != nil {
+		return fmt.Errorf("could not create memory profile: %v", err)
+	}
+	// Collect garbage first so the profile shows what is still live.
+	runtime.GC()
+	if err := pprof.WriteHeapProfile(f); err != nil {
+		f.Close()
+		return fmt.Errorf("could not write memory profile: %v", err)
+	}
+	return f.Close()
+}
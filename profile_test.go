@@ -0,0 +1,28 @@
+package spicy
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestProfilesAreWritten(t *testing.T) {
+	assert := assert.New(t)
+	dir := chdirTemp(t)
+	cpuPath := filepath.Join(dir, "cpu.pprof")
+	memPath := filepath.Join(dir, "mem.pprof")
+	profiler, err := StartProfiling(cpuPath, memPath)
+	assert.Nil(err)
+	_, err = newTestPipeline().Run(strings.NewReader(pipelineTestSpec))
+	assert.Nil(err)
+	assert.Nil(profiler.Stop())
+
+	for _, path := range []string{cpuPath, memPath} {
+		info, err := os.Stat(path)
+		assert.Nil(err)
+		assert.NotZero(info.Size(), path)
+	}
+}
@@ -0,0 +1,249 @@
+package spicy
+
+import (
+	"bytes"
+	"debug/elf"
+	"encoding/binary"
+	"fmt"
+)
+
+// Sections of an overlay a relocation table entry can fall in, as the top
+// two bits of the entry give them.
+const (
+	relocText   = 1
+	relocData   = 2
+	relocRodata = 3
+)
+
+// relocTypes are the MIPS relocations an overlay loader can apply again once
+// the overlay is moved. Relocations against symbols outside the segment are
+// resolved by the link and never need redoing.
+var relocTypes = map[elf.R_MIPS]bool{
+	elf.R_MIPS_32:   true,
+	elf.R_MIPS_26:   true,
+	elf.R_MIPS_HI16: true,
+	elf.R_MIPS_LO16: true,
+}
+
+// RelocTable is the relocation table of a RELOC segment. libultra itself
+// defines no overlay format, so the table is laid out as the Zelda 64
+// overlays lay theirs out, which is what most N64 overlay loaders expect:
+// the sizes of the segment's text, data, rodata and BSS, the number of
+// relocations, one word for each of them, and padding to 16 bytes, the last
+// word of which gives the size of the table, so that a loader can find it
+// from the end of the segment.
+//
+// Each relocation is the section it is in, shifted left by 30, the MIPS
+// relocation type, shifted left by 24, and its offset within the section.
+// The data of every .data input comes first, then every .rodata and .sdata
+// input, which are counted as rodata.
+type RelocTable struct {
+	TextSize   uint32
+	DataSize   uint32
+	RodataSize uint32
+	BssSize    uint32
+	Relocs     []uint32
+}
+
+// Bytes returns the table as it is stored in the ROM, big-endian.
+func (t *RelocTable) Bytes() []byte {
+	words := []uint32{t.TextSize, t.DataSize, t.RodataSize, t.BssSize, uint32(len(t.Relocs))}
+	words = append(words, t.Relocs...)
+	size := alignUp(uint64(len(words)+1)*4, 0x10)
+	for uint64(len(words)+1)*4 < size {
+		words = append(words, 0)
+	}
+	words = append(words, uint32(size))
+	b := &bytes.Buffer{}
+	binary.Write(b, binary.BigEndian, words)
+	return b.Bytes()
+}
+
+// relocTableName returns the name of the object holding seg's relocation
+// table, which the linker script places after the segment's data.
+func relocTableName(seg *Segment) string {
+	return fmt.Sprintf("%s.reloc.o", seg.LinkName())
+}
+
+// relocSectionKinds gives the section of a relocation table that the input
+// sections each of objectTextSections and objectDataSections matches are
+// counted in.
+var relocSectionKinds = map[string]uint32{
+	".text":   relocText,
+	".data":   relocData,
+	".rodata": relocRodata,
+	".sdata":  relocRodata,
+}
+
+// ComputeRelocTable builds the relocation table of seg from the relocation
+// sections of its includes, placing their sections as the linker script
+// does. Relocations in sections the script does not load, such as debug
+// information, are left out.
+func ComputeRelocTable(seg *Segment) (*RelocTable, error) {
+	return computeRelocTable(seg, nil)
+}
+
+// computeRelocTable is ComputeRelocTable, placing the sections of each
+// include given in sections, as LayoutOptions.ReadSections returns them,
+// which the relocation sections refer to by InputSection.Index. The
+// sections of includes missing from it are read from the object, which is
+// parsed only once for them, its symbols and its relocations.
+func computeRelocTable(seg *Segment, sections map[string][]InputSection) (*RelocTable, error) {
+	files := make([]*elf.File, len(seg.Includes))
+	symbols := make([][]elf.Symbol, len(seg.Includes))
+	placed := map[string][]InputSection{}
+	defined := map[string]bool{}
+	for i, include := range seg.Includes {
+		f, err := elf.Open(include)
+		if err != nil {
+			return nil, fmt.Errorf("could not read relocations of %s: %v", include, err)
+		}
+		defer f.Close()
+		if f.Class != elf.ELFCLASS32 {
+			return nil, fmt.Errorf("could not read relocations of %s: only 32-bit objects are supported", include)
+		}
+		files[i] = f
+		if s, ok := sections[include]; ok {
+			placed[include] = s
+		} else if placed[include], err = objectSections(f); err != nil {
+			return nil, fmt.Errorf("could not read sections of %s: %v", include, err)
+		}
+		syms, err := f.Symbols()
+		if err != nil && err != elf.ErrNoSymbols {
+			return nil, fmt.Errorf("could not read symbols of %s: %v", include, err)
+		}
+		symbols[i] = syms
+		for _, sym := range syms {
+			if elf.ST_BIND(sym.Info) != elf.STB_LOCAL && sym.Section != elf.SHN_UNDEF {
+				defined[sym.Name] = true
+			}
+		}
+	}
+
+	// offsets holds where each placed section of each include starts, from
+	// the segment's text start, kinds which section of the table it is
+	// counted in, and ends where the last section of each kind ends.
+	table := &RelocTable{}
+	offsets := map[int]map[int]uint64{}
+	kinds := map[int]map[int]uint32{}
+	ends := map[uint32]uint64{}
+	place := func(name string, include int, s InputSection, start uint64) {
+		if offsets[include] == nil {
+			offsets[include] = map[int]uint64{}
+			kinds[include] = map[int]uint32{}
+		}
+		kind := relocSectionKinds[name]
+		offsets[include][s.Index] = start
+		kinds[include][s.Index] = kind
+		ends[kind] = start + s.Size
+	}
+	p := &sectionPlacer{includes: seg.Includes, sections: placed}
+	p.place(place, objectTextSections...)
+	table.TextSize = uint32(p.dot)
+	p.place(place, objectDataSections...)
+	if end, ok := ends[relocData]; ok {
+		table.DataSize = uint32(end) - table.TextSize
+	}
+	p.dot = alignUp(p.dot, 0x10)
+	table.RodataSize = uint32(p.dot) - table.TextSize - table.DataSize
+	starts := map[uint32]uint64{relocText: 0, relocData: uint64(table.TextSize), relocRodata: uint64(table.TextSize + table.DataSize)}
+
+	bssStart := p.dot
+	p.place(nil, objectBssSections...)
+	table.BssSize = uint32(alignUp(p.dot-bssStart+seg.Reserve, 0x10))
+
+	for i, f := range files {
+		include := seg.Includes[i]
+		for _, s := range f.Sections {
+			if s.Type != elf.SHT_REL && s.Type != elf.SHT_RELA {
+				continue
+			}
+			start, ok := offsets[i][int(s.Info)]
+			if !ok {
+				continue
+			}
+			kind := kinds[i][int(s.Info)]
+			data, err := s.Data()
+			if err != nil {
+				return nil, fmt.Errorf("could not read %s of %s: %v", s.Name, include, err)
+			}
+			entrySize := 8
+			if s.Type == elf.SHT_RELA {
+				entrySize = 12
+			}
+			for off := 0; off+entrySize <= len(data); off += entrySize {
+				offset := f.ByteOrder.Uint32(data[off:])
+				info := f.ByteOrder.Uint32(data[off+4:])
+				typ := elf.R_MIPS(elf.R_TYPE32(info))
+				if typ == elf.R_MIPS_NONE {
+					continue
+				}
+				if index := int(elf.R_SYM32(info)); index > 0 && index <= len(symbols[i]) {
+					sym := symbols[i][index-1]
+					if sym.Section == elf.SHN_UNDEF && !defined[sym.Name] || sym.Section == elf.SHN_ABS {
+						continue
+					}
+				}
+				if !relocTypes[typ] {
+					return nil, fmt.Errorf("relocation %v at 0x%x in %s of %s cannot be applied by an overlay loader", typ, offset, s.Name, include)
+				}
+				sectionOffset := start + uint64(offset) - starts[kind]
+				if sectionOffset >= 1<<24 {
+					return nil, fmt.Errorf("relocation at 0x%x in %s of %s is too far into its section for a relocation table", offset, s.Name, include)
+				}
+				table.Relocs = append(table.Relocs, kind<<30|uint32(typ)<<24|uint32(sectionOffset))
+			}
+		}
+	}
+	return table, nil
+}
+
+// RelocTables holds the relocation table of each RELOC segment of a wave,
+// by segment name.
+type RelocTables map[string]*RelocTable
+
+// PrepareRelocTables writes the relocation table of each of w's RELOC
+// segments to an object the linker script can place, and returns the
+// tables for CheckRelocTables.
+func PrepareRelocTables(w *Wave, ld Runner, opts BuildOptions) (RelocTables, error) {
+	tables := RelocTables{}
+	for _, seg := range w.ObjectSegments {
+		if !seg.Flags.Reloc {
+			continue
+		}
+		table, err := ComputeRelocTable(seg)
+		if err != nil {
+			return nil, fmt.Errorf("segment %s: %w", seg.Name, err)
+		}
+		stageDebugf("raw", "Segment %s has %d relocations", seg.Name, len(table.Relocs))
+		if _, err := createRawObjectWrapper(bytes.NewReader(table.Bytes()), relocTableName(seg), ld, 0); err != nil {
+			return nil, err
+		}
+		opts.Tracer.File(relocTableName(seg))
+		tables[seg.Name] = table
+	}
+	return tables, nil
+}
+
+// CheckRelocTables returns an error if the sizes in tables, the relocation
+// tables PrepareRelocTables wrote for w's RELOC segments, disagree with
+// where the linker really placed their sections, which would leave a table
+// pointing at the wrong words.
+func CheckRelocTables(w *Wave, tables RelocTables, symbols map[string]uint64) error {
+	for _, seg := range w.ObjectSegments {
+		if !seg.Flags.Reloc {
+			continue
+		}
+		table, ok := tables[seg.Name]
+		if !ok {
+			return fmt.Errorf("segment %s has no relocation table", seg.Name)
+		}
+		text := symbols[seg.BoundarySymbol("TextEnd")] - symbols[seg.BoundarySymbol("TextStart")]
+		data := symbols[seg.BoundarySymbol("RelocStart")] - symbols[seg.BoundarySymbol("DataStart")]
+		bss := symbols[seg.BoundarySymbol("BssSize")]
+		if text != uint64(table.TextSize) || data != uint64(table.DataSize+table.RodataSize) || bss != uint64(table.BssSize) {
+			return fmt.Errorf("relocation table of segment %s gives 0x%x bytes of text, 0x%x of data and 0x%x of BSS, but the segment was linked with 0x%x, 0x%x and 0x%x", seg.Name, table.TextSize, table.DataSize+table.RodataSize, table.BssSize, text, data, bss)
+		}
+	}
+	return nil
+}
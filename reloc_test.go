@@ -0,0 +1,196 @@
+package spicy
+
+import (
+	"bytes"
+	"debug/elf"
+	"encoding/binary"
+	"io/ioutil"
+	"os/exec"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// relocTestObject returns a big-endian MIPS ELF32 object with 16 bytes of
+// text and 8 of data, and relocations against its own sections, against an
+// undefined symbol and from its debug information.
+func relocTestObject() []byte {
+	rel := func(relocs ...[3]uint32) []byte {
+		b := &bytes.Buffer{}
+		for _, r := range relocs {
+			binary.Write(b, binary.BigEndian, elf.Rel32{Off: r[0], Info: elf.R_INFO32(r[1], r[2])})
+		}
+		return b.Bytes()
+	}
+	names := []string{"", ".shstrtab", ".strtab", ".symtab", ".text", ".data", ".rel.text", ".rel.data", ".debug_info", ".rel.debug_info"}
+	shstrtab := []byte{0}
+	nameOffsets := map[string]uint32{}
+	for _, name := range names[1:] {
+		nameOffsets[name] = uint32(len(shstrtab))
+		shstrtab = append(append(shstrtab, name...), 0)
+	}
+	strtab := []byte("\x00osPiStartDma\x00")
+	symtab := &bytes.Buffer{}
+	binary.Write(symtab, binary.BigEndian, []elf.Sym32{
+		{},
+		{Info: elf.ST_INFO(elf.STB_LOCAL, elf.STT_SECTION), Shndx: 4},
+		{Info: elf.ST_INFO(elf.STB_LOCAL, elf.STT_SECTION), Shndx: 5},
+		{Name: 1, Info: elf.ST_INFO(elf.STB_GLOBAL, elf.STT_NOTYPE), Shndx: uint16(elf.SHN_UNDEF)},
+	})
+	contents := [][]byte{
+		nil,
+		shstrtab,
+		strtab,
+		symtab.Bytes(),
+		make([]byte, 16),
+		make([]byte, 8),
+		rel(
+			[3]uint32{0, 2, uint32(elf.R_MIPS_HI16)},
+			[3]uint32{4, 2, uint32(elf.R_MIPS_LO16)},
+			[3]uint32{8, 3, uint32(elf.R_MIPS_26)},
+			[3]uint32{12, 1, uint32(elf.R_MIPS_26)},
+		),
+		rel([3]uint32{4, 1, uint32(elf.R_MIPS_32)}),
+		make([]byte, 4),
+		rel([3]uint32{0, 1, uint32(elf.R_MIPS_32)}),
+	}
+	headers := []elf.Section32{
+		{},
+		{Type: uint32(elf.SHT_STRTAB), Addralign: 1},
+		{Type: uint32(elf.SHT_STRTAB), Addralign: 1},
+		{Type: uint32(elf.SHT_SYMTAB), Link: 2, Info: 3, Addralign: 4, Entsize: 16},
+		{Type: uint32(elf.SHT_PROGBITS), Flags: uint32(elf.SHF_ALLOC | elf.SHF_EXECINSTR), Addralign: 4},
+		{Type: uint32(elf.SHT_PROGBITS), Flags: uint32(elf.SHF_ALLOC | elf.SHF_WRITE), Addralign: 4},
+		{Type: uint32(elf.SHT_REL), Link: 3, Info: 4, Addralign: 4, Entsize: 8},
+		{Type: uint32(elf.SHT_REL), Link: 3, Info: 5, Addralign: 4, Entsize: 8},
+		{Type: uint32(elf.SHT_PROGBITS), Addralign: 1},
+		{Type: uint32(elf.SHT_REL), Link: 3, Info: 8, Addralign: 4, Entsize: 8},
+	}
+
+	const headerSize = 52
+	body := &bytes.Buffer{}
+	for i, c := range contents {
+		if i == 0 {
+			continue
+		}
+		headers[i].Name = nameOffsets[names[i]]
+		headers[i].Off = uint32(headerSize + body.Len())
+		headers[i].Size = uint32(len(c))
+		body.Write(c)
+	}
+	header := elf.Header32{
+		Type:      uint16(elf.ET_REL),
+		Machine:   uint16(elf.EM_MIPS),
+		Version:   uint32(elf.EV_CURRENT),
+		Shoff:     uint32(headerSize + body.Len()),
+		Ehsize:    headerSize,
+		Shentsize: 40,
+		Shnum:     uint16(len(headers)),
+		Shstrndx:  1,
+	}
+	copy(header.Ident[:], elf.ELFMAG)
+	header.Ident[elf.EI_CLASS] = byte(elf.ELFCLASS32)
+	header.Ident[elf.EI_DATA] = byte(elf.ELFDATA2MSB)
+	header.Ident[elf.EI_VERSION] = byte(elf.EV_CURRENT)
+	out := &bytes.Buffer{}
+	binary.Write(out, binary.BigEndian, header)
+	out.Write(body.Bytes())
+	binary.Write(out, binary.BigEndian, headers)
+	return out.Bytes()
+}
+
+func TestRelocTableMatchesObjectRelocations(t *testing.T) {
+	assert := assert.New(t)
+	chdirTemp(t)
+	assert.Nil(ioutil.WriteFile("a.o", relocTestObject(), 0644))
+	assert.Nil(ioutil.WriteFile("b.o", relocTestObject(), 0644))
+	spec, err := ParseSpec(strings.NewReader(`
+beginseg
+  name "ovl"
+  flags OBJECT RELOC
+  include "a.o"
+  include "b.o"
+endseg
+beginwave
+  name "game"
+  include "ovl"
+endwave
+`))
+	assert.Nil(err)
+	seg := spec.Waves[0].ObjectSegments[0]
+	assert.True(seg.Flags.Reloc)
+
+	table, err := ComputeRelocTable(seg)
+	assert.Nil(err)
+	assert.Equal(uint32(32), table.TextSize)
+	assert.Equal(uint32(16), table.DataSize)
+	assert.Equal(uint32(0), table.RodataSize)
+	assert.Equal(uint32(0), table.BssSize)
+	// The call to osPiStartDma and the debug information are left out, and
+	// b.o's sections follow a.o's.
+	assert.Equal([]uint32{
+		relocText<<30 | uint32(elf.R_MIPS_HI16)<<24 | 0,
+		relocText<<30 | uint32(elf.R_MIPS_LO16)<<24 | 4,
+		relocText<<30 | uint32(elf.R_MIPS_26)<<24 | 12,
+		relocData<<30 | uint32(elf.R_MIPS_32)<<24 | 4,
+		relocText<<30 | uint32(elf.R_MIPS_HI16)<<24 | 16,
+		relocText<<30 | uint32(elf.R_MIPS_LO16)<<24 | 20,
+		relocText<<30 | uint32(elf.R_MIPS_26)<<24 | 28,
+		relocData<<30 | uint32(elf.R_MIPS_32)<<24 | 12,
+	}, table.Relocs)
+
+	b := table.Bytes()
+	assert.Equal(64, len(b))
+	assert.Equal(uint32(8), binary.BigEndian.Uint32(b[16:]))
+	assert.Equal(uint32(64), binary.BigEndian.Uint32(b[60:]))
+
+	script, err := createLdScript(spec.Waves[0])
+	assert.Nil(err)
+	text, err := ioutil.ReadAll(script)
+	assert.Nil(err)
+	assert.Contains(string(text), `"ovl.reloc.o" (.data)`)
+
+	symbols := segmentSymbols(map[string]uint64{}, "ovl", 0x1000, 0x80400000, 0x30)
+	symbols["_ovlSegmentTextStart"] = 0x80400000
+	symbols["_ovlSegmentTextEnd"] = 0x80400020
+	symbols["_ovlSegmentDataStart"] = 0x80400020
+	symbols["_ovlSegmentRelocStart"] = 0x80400030
+	symbols["_ovlSegmentBssSize"] = 0
+	tables := RelocTables{"ovl": table}
+	assert.Nil(CheckRelocTables(spec.Waves[0], tables, symbols))
+	symbols["_ovlSegmentRelocStart"] += 0x10
+	assert.NotNil(CheckRelocTables(spec.Waves[0], tables, symbols))
+	assert.NotNil(CheckRelocTables(spec.Waves[0], RelocTables{}, symbols))
+
+	if _, err := exec.LookPath("ld"); err != nil {
+		t.Skip("ld not available")
+	}
+	prepared, err := PrepareRelocTables(spec.Waves[0], NewRunner("ld"), BuildOptions{})
+	assert.Nil(err)
+	assert.Equal(tables, prepared)
+	f, err := elf.Open(relocTableName(seg))
+	assert.Nil(err)
+	defer f.Close()
+	data, err := f.Section(".data").Data()
+	assert.Nil(err)
+	assert.Equal(b, data)
+}
+
+func TestRelocTablePlacesSectionsFromReadSections(t *testing.T) {
+	assert := assert.New(t)
+	chdirTemp(t)
+	assert.Nil(ioutil.WriteFile("a.o", relocTestObject(), 0644))
+	seg := &Segment{Name: "ovl", Includes: []string{"a.o"}, Flags: Flags{Object: true, Reloc: true}}
+	// The sections as a ReadSections hook gives them, with the text grown
+	// since the object was written; the relocations still refer to them by
+	// index.
+	table, err := computeRelocTable(seg, map[string][]InputSection{"a.o": {
+		{Name: ".text", Size: 0x40, Align: 4, Index: 4},
+		{Name: ".data", Size: 8, Align: 4, Index: 5},
+	}})
+	assert.Nil(err)
+	assert.Equal(uint32(0x40), table.TextSize)
+	assert.Equal(uint32(8), table.DataSize)
+	assert.Equal(relocData<<30|uint32(elf.R_MIPS_32)<<24|4, table.Relocs[len(table.Relocs)-1])
+}
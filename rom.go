@@ -0,0 +1,272 @@
+package spicy
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/trhodeos/n64rom"
+)
+
+// Rom is an in-memory ROM image: the header and bootcode region, followed by
+// the code written at n64rom.CodeStart and onwards.
+type Rom struct {
+	data []byte
+	fill byte
+	// used is the end of the highest write, or of the base image.
+	used int64
+	// allowHeader permits writes before n64rom.CodeStart.
+	allowHeader bool
+	// footer, if non-zero, is where the footer set by SetFooter starts.
+	footer int64
+}
+
+// NewBlankRom returns a ROM with a default header and nothing else.
+func NewBlankRom(fill byte) (*Rom, error) {
+	header := &bytes.Buffer{}
+	if err := binary.Write(header, binary.BigEndian, n64rom.GetBlankHeader()); err != nil {
+		return nil, err
+	}
+	data := bytes.Repeat([]byte{fill}, n64rom.CodeStart)
+	copy(data, header.Bytes())
+	return &Rom{data: data, fill: fill, used: n64rom.CodeStart}, nil
+}
+
+// LoadRom returns a ROM initialized from an existing image, so that new
+// segments can be written over it.
+func LoadRom(r io.Reader, fill byte) (*Rom, error) {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < n64rom.CodeStart {
+		return nil, fmt.Errorf("base ROM is too small: 0x%x bytes", len(data))
+	}
+	return &Rom{data: data, fill: fill, used: int64(len(data))}, nil
+}
+
+func (r *Rom) grow(size int) {
+	if size > len(r.data) {
+		r.data = append(r.data, bytes.Repeat([]byte{r.fill}, size-len(r.data))...)
+	}
+}
+
+// entryPcOffset is where the header holds the initial PC.
+const entryPcOffset = 0x08
+
+// HeaderSize is the size of the ROM header, as opposed to the bootcode that
+// follows it.
+const HeaderSize = 0x40
+
+// SetHeader replaces the ROM header with header, which must be exactly
+// HeaderSize bytes.
+func (r *Rom) SetHeader(header []byte) error {
+	if len(header) != HeaderSize {
+		return fmt.Errorf("header must be exactly %d bytes, got %d", HeaderSize, len(header))
+	}
+	copy(r.data, header)
+	return nil
+}
+
+// BootcodeSize is the most bootcode the region between the header and
+// n64rom.CodeStart holds.
+const BootcodeSize = n64rom.CodeStart - HeaderSize
+
+// SetBootcode writes bootcode into the region following the header, which
+// code is written after, from n64rom.CodeStart.
+func (r *Rom) SetBootcode(bootcode []byte) error {
+	if len(bootcode) > BootcodeSize {
+		return fmt.Errorf("bootcode must be at most %d bytes, got %d", BootcodeSize, len(bootcode))
+	}
+	copy(r.data[HeaderSize:], bootcode)
+	return nil
+}
+
+// DefaultPiConfig is the first header word of most cartridges, holding the
+// PI BSD domain 1 timings the PIF uses to read the rest of the ROM.
+const DefaultPiConfig = 0x80371240
+
+// SetPiConfig replaces the PI BSD domain configuration word at the start of
+// the header.
+func (r *Rom) SetPiConfig(word uint32) {
+	binary.BigEndian.PutUint32(r.data, word)
+}
+
+// EntryPc returns the initial PC from the header, where IPL3 jumps once it
+// has loaded the start of the ROM.
+func (r *Rom) EntryPc() uint32 {
+	return binary.BigEndian.Uint32(r.data[entryPcOffset:])
+}
+
+// AllowHeaderWrites sets whether WriteAt may write over the header and
+// bootcode before n64rom.CodeStart.
+func (r *Rom) AllowHeaderWrites(allow bool) {
+	r.allowHeader = allow
+}
+
+// WriteAt writes p at offset i, growing the ROM with the fill byte as needed.
+func (r *Rom) WriteAt(p []byte, i int64) error {
+	if i < n64rom.CodeStart && !r.allowHeader {
+		return fmt.Errorf("Cannot write at %d: This would overwrite bootloader before %d", i, n64rom.CodeStart)
+	}
+	r.grow(int(i) + len(p))
+	copy(r.data[i:], p)
+	if end := i + int64(len(p)); end > r.used {
+		r.used = end
+	}
+	return nil
+}
+
+// Pad grows the ROM with the fill byte until it is at least size bytes.
+func (r *Rom) Pad(size int64) {
+	r.grow(int(size))
+}
+
+// EmbedString writes s, NUL-terminated, at offset. An offset of zero places
+// it after the current end of the ROM, aligned to 16 bytes. The offset used
+// is returned.
+func (r *Rom) EmbedString(s string, offset int64) (int64, error) {
+	if offset == 0 {
+		offset = (r.Size() + 0xf) &^ 0xf
+	}
+	if err := r.WriteAt(append([]byte(s), 0), offset); err != nil {
+		return 0, err
+	}
+	return offset, nil
+}
+
+// UsedSize returns the offset just past the last byte written to the ROM,
+// ignoring any padding.
+func (r *Rom) UsedSize() int64 {
+	return r.used
+}
+
+// MbitBytes returns the number of bytes in a ROM of the given size in Mbit.
+// An Mbit is 2^20 bits, as cartridge sizes are given, so that a power-of-two
+// number of Mbit is a power-of-two number of bytes and a 256 Mbit ROM fills a
+// 256 Mbit cartridge.
+func MbitBytes(mbits int) int64 {
+	return int64(mbits) * 1024 * 1024 / 8
+}
+
+// PowerOfTwoMbitSize returns the smallest power-of-two number of Mbit, at
+// least 1, whose size in bytes holds size, as cartridges come in those sizes.
+func PowerOfTwoMbitSize(size int64) int {
+	mbits := 1
+	for MbitBytes(mbits) < size {
+		mbits *= 2
+	}
+	return mbits
+}
+
+// Size returns the current size of the ROM in bytes.
+func (r *Rom) Size() int64 {
+	return int64(len(r.data))
+}
+
+// CheckSha256 returns a MismatchError if the SHA-256 of image is not
+// expected, given in hex.
+func CheckSha256(image []byte, expected string) error {
+	sum := sha256.Sum256(image)
+	actual := hex.EncodeToString(sum[:])
+	if !strings.EqualFold(actual, expected) {
+		return &MismatchError{Expected: strings.ToLower(expected), Actual: actual, Size: len(image)}
+	}
+	return nil
+}
+
+// UpdateChecksum recomputes the header checksum words over the current data,
+// and then the CRC of any footer.
+func (r *Rom) UpdateChecksum() {
+	crc1, crc2 := ComputeChecksum(r.data)
+	binary.BigEndian.PutUint32(r.data[ChecksumOffset:], crc1)
+	binary.BigEndian.PutUint32(r.data[ChecksumOffset+4:], crc2)
+	if r.footer != 0 {
+		binary.BigEndian.PutUint32(r.data[len(r.data)-4:], crc32.ChecksumIEEE(r.data[:r.footer]))
+	}
+}
+
+// SetFooter writes magic at offset, followed by a big-endian CRC32 (IEEE) of
+// every byte before offset, which is kept up to date along with the header
+// checksum. The footer must end the ROM, and must come after the bytes the
+// header checksum covers, since each checksum would otherwise change the
+// other.
+func (r *Rom) SetFooter(magic []byte, offset int64) error {
+	if offset < checksumStart+checksumLength {
+		return fmt.Errorf("footer at 0x%x would be covered by the header checksum, which runs to 0x%x; pad the ROM past it", offset, checksumStart+checksumLength)
+	}
+	if end := offset + int64(len(magic)) + 4; end < r.Size() {
+		return fmt.Errorf("footer at 0x%x-0x%x does not end the ROM, which is 0x%x bytes", offset, end, r.Size())
+	}
+	if err := r.WriteAt(append(append([]byte{}, magic...), 0, 0, 0, 0), offset); err != nil {
+		return err
+	}
+	r.footer = offset
+	return nil
+}
+
+// Save updates the checksum and writes the ROM image to w.
+func (r *Rom) Save(w io.Writer) (int, error) {
+	r.UpdateChecksum()
+	return w.Write(r.data)
+}
+
+// Bytes returns a copy of the image as Save would write it, with any
+// padding and its checksum up to date, for consumers such as an in-process
+// emulator that have no need for a file.
+func (r *Rom) Bytes() []byte {
+	r.UpdateChecksum()
+	return append([]byte{}, r.data...)
+}
+
+// WriteGzip writes data to w gzip-compressed. No modification time is
+// recorded, so the output only depends on data and name.
+func WriteGzip(w io.Writer, data []byte, name string) error {
+	zw, err := gzip.NewWriterLevel(w, gzip.BestCompression)
+	if err != nil {
+		return err
+	}
+	zw.Name = name
+	if _, err := zw.Write(data); err != nil {
+		zw.Close()
+		return err
+	}
+	return zw.Close()
+}
+
+// CheckOutputPath makes sure a ROM can be written to path before any work is
+// done: path must not be a directory, and its parent must be a writable
+// directory. With mkdir, a missing parent is created.
+func CheckOutputPath(path string, mkdir bool) error {
+	if info, err := os.Stat(path); err == nil && info.IsDir() {
+		return fmt.Errorf("output path %s is a directory", path)
+	}
+	dir := filepath.Dir(path)
+	info, err := os.Stat(dir)
+	if os.IsNotExist(err) && mkdir {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return fmt.Errorf("could not create output directory: %v", err)
+		}
+	} else if os.IsNotExist(err) {
+		return fmt.Errorf("output directory %s does not exist (use --mkdir to create it)", dir)
+	} else if err != nil {
+		return err
+	} else if !info.IsDir() {
+		return fmt.Errorf("output directory %s is not a directory", dir)
+	}
+	f, err := ioutil.TempFile(dir, ".spicy-")
+	if err != nil {
+		return fmt.Errorf("output directory %s is not writable: %v", dir, err)
+	}
+	f.Close()
+	return os.Remove(f.Name())
+}
@@ -0,0 +1,255 @@
+package spicy
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/trhodeos/n64rom"
+)
+
+func TestOverlaySegmentOntoBaseRom(t *testing.T) {
+	assert := assert.New(t)
+	base := make([]byte, 0x3000)
+	for i := range base {
+		base[i] = byte(i * 7)
+	}
+	rom, err := LoadRom(bytes.NewReader(base), 0xff)
+	assert.Nil(err)
+	assert.Nil(rom.WriteAt([]byte{1, 2, 3, 4}, 0x2000))
+	assert.NotNil(rom.WriteAt([]byte{1}, 0x800))
+
+	out := &bytes.Buffer{}
+	_, err = rom.Save(out)
+	assert.Nil(err)
+	saved := out.Bytes()
+	assert.Equal(len(base), len(saved))
+	assert.Equal([]byte{1, 2, 3, 4}, saved[0x2000:0x2004])
+	// Everything but the checksum words and the overlaid segment is untouched.
+	assert.Equal(base[:ChecksumOffset], saved[:ChecksumOffset])
+	assert.Equal(base[ChecksumOffset+8:0x2000], saved[ChecksumOffset+8:0x2000])
+	assert.Equal(base[0x2004:], saved[0x2004:])
+	crc1, crc2 := ComputeChecksum(saved)
+	assert.Equal([]byte{byte(crc1 >> 24), byte(crc1 >> 16), byte(crc1 >> 8), byte(crc1),
+		byte(crc2 >> 24), byte(crc2 >> 16), byte(crc2 >> 8), byte(crc2)}, saved[ChecksumOffset:ChecksumOffset+8])
+}
+
+func TestBlankRomFillsUpToCode(t *testing.T) {
+	assert := assert.New(t)
+	rom, err := NewBlankRom(0xaa)
+	assert.Nil(err)
+	assert.Nil(rom.WriteAt([]byte{1}, n64rom.CodeStart+4))
+	out := &bytes.Buffer{}
+	_, err = rom.Save(out)
+	assert.Nil(err)
+	assert.Equal(n64rom.CodeStart+5, out.Len())
+	assert.Equal([]byte{0x80, 0x37, 0x12, 0x40}, out.Bytes()[:4])
+	assert.Equal([]byte{0xaa, 0xaa, 0xaa, 0xaa, 1}, out.Bytes()[n64rom.CodeStart:])
+}
+
+func TestEmbedVersionAtOffset(t *testing.T) {
+	assert := assert.New(t)
+	rom, err := NewBlankRom(0)
+	assert.Nil(err)
+	assert.Nil(rom.WriteAt([]byte{1, 2, 3, 4}, n64rom.CodeStart))
+	layout := []SegmentLayout{{Name: "code", RomStart: n64rom.CodeStart, RomEnd: n64rom.CodeStart + 4}}
+
+	assert.Nil(embedVersion(rom, layout, BuildOptions{Version: "v1.2", VersionOffset: 0x2000}))
+	b := &bytes.Buffer{}
+	_, err = rom.Save(b)
+	assert.Nil(err)
+	assert.Equal([]byte("v1.2\x00"), b.Bytes()[0x2000:0x2005])
+
+	offset, err := rom.EmbedString("next", 0)
+	assert.Nil(err)
+	assert.Equal(int64(0x2010), offset)
+
+	assert.NotNil(embedVersion(rom, layout, BuildOptions{Version: "v1.2", VersionOffset: n64rom.CodeStart + 2}))
+}
+
+func TestCheckOutputPath(t *testing.T) {
+	assert := assert.New(t)
+	dir := t.TempDir()
+	assert.Nil(CheckOutputPath(filepath.Join(dir, "rom.n64"), false))
+
+	err := CheckOutputPath(dir, false)
+	assert.NotNil(err)
+	assert.Contains(err.Error(), "is a directory")
+
+	missing := filepath.Join(dir, "missing", "rom.n64")
+	err = CheckOutputPath(missing, false)
+	assert.NotNil(err)
+	assert.Contains(err.Error(), "does not exist")
+	assert.Nil(CheckOutputPath(missing, true))
+	info, err := os.Stat(filepath.Dir(missing))
+	assert.Nil(err)
+	assert.True(info.IsDir())
+}
+
+func TestUsedSizeIgnoresPadding(t *testing.T) {
+	assert := assert.New(t)
+	rom, err := NewBlankRom(0)
+	assert.Nil(err)
+	assert.Nil(rom.WriteAt([]byte{1, 2, 3, 4}, 0x2000))
+	assert.Nil(rom.WriteAt([]byte{1, 2}, 0x1000))
+	rom.Pad(0x8000)
+	assert.Equal(int64(0x2004), rom.UsedSize())
+	assert.Equal(int64(0x8000), rom.Size())
+}
+
+func TestHeaderTemplate(t *testing.T) {
+	assert := assert.New(t)
+	header := make([]byte, HeaderSize)
+	for i := range header {
+		header[i] = byte(0x80 + i)
+	}
+	rom, err := newRom(nil, BuildOptions{Header: header})
+	assert.Nil(err)
+	assert.Nil(rom.WriteAt([]byte{1, 2, 3, 4}, n64rom.CodeStart))
+	b := &bytes.Buffer{}
+	_, err = rom.Save(b)
+	assert.Nil(err)
+	saved := b.Bytes()
+	assert.Equal(header[:ChecksumOffset], saved[:ChecksumOffset])
+	assert.Equal(header[ChecksumOffset+8:], saved[ChecksumOffset+8:HeaderSize])
+	crc1, crc2 := ComputeChecksum(saved)
+	assert.Equal(crc1, binary.BigEndian.Uint32(saved[ChecksumOffset:]))
+	assert.Equal(crc2, binary.BigEndian.Uint32(saved[ChecksumOffset+4:]))
+
+	_, err = newRom(nil, BuildOptions{Header: header[:32]})
+	assert.NotNil(err)
+}
+
+func TestHeaderWritesRejectedByDefault(t *testing.T) {
+	assert := assert.New(t)
+	rom, err := newRom(nil, BuildOptions{})
+	assert.Nil(err)
+	assert.NotNil(rom.WriteAt([]byte{1}, 0x800))
+
+	rom, err = newRom(nil, BuildOptions{AllowHeaderOverlap: true})
+	assert.Nil(err)
+	assert.Nil(rom.WriteAt([]byte{1}, 0x800))
+	assert.Equal(byte(1), readRom(t, rom)[0x800])
+}
+
+func TestBootcodeIsLayeredBetweenHeaderAndCode(t *testing.T) {
+	assert := assert.New(t)
+	bootcode := bytes.Repeat([]byte{0xb0}, BootcodeSize)
+	rom, err := newRom(nil, BuildOptions{Bootcode: bootcode})
+	assert.Nil(err)
+	assert.Nil(rom.WriteAt([]byte{1, 2, 3, 4}, n64rom.CodeStart))
+	b := readRom(t, rom)
+	assert.Equal(uint32(0x80000400), binary.BigEndian.Uint32(b[8:]))
+	assert.Equal(bootcode, b[HeaderSize:n64rom.CodeStart])
+	assert.Equal([]byte{1, 2, 3, 4}, b[n64rom.CodeStart:])
+
+	_, err = newRom(nil, BuildOptions{Bootcode: make([]byte, BootcodeSize+1)})
+	assert.NotNil(err)
+}
+
+func TestSegmentsMayNotOverlapBootcode(t *testing.T) {
+	assert := assert.New(t)
+	layout := []SegmentLayout{{Name: "low", RomStart: 0x800, RomEnd: 0x900}}
+	assert.Nil(CheckBootcodeOverlap(layout, 0x400))
+	err := CheckBootcodeOverlap(layout, BootcodeSize)
+	assert.NotNil(err)
+	assert.Contains(err.Error(), "segment low at 0x800-0x900 overlaps")
+}
+
+func TestWriteGzipRoundTrips(t *testing.T) {
+	assert := assert.New(t)
+	rom, err := NewBlankRom(0xff)
+	assert.Nil(err)
+	assert.Nil(rom.WriteAt(bytes.Repeat([]byte{1, 2, 3, 4}, 0x100), n64rom.CodeStart))
+	compressed := &bytes.Buffer{}
+	assert.Nil(WriteGzip(compressed, rom.Bytes(), "rom.z64"))
+
+	zr, err := gzip.NewReader(compressed)
+	assert.Nil(err)
+	assert.Equal("rom.z64", zr.Name)
+	b, err := ioutil.ReadAll(zr)
+	assert.Nil(err)
+	assert.Equal(readRom(t, rom), b)
+	crc1, _ := ComputeChecksum(b)
+	assert.Equal(crc1, binary.BigEndian.Uint32(b[ChecksumOffset:]))
+}
+
+func TestBytesMatchesSave(t *testing.T) {
+	assert := assert.New(t)
+	rom, err := NewBlankRom(0xff)
+	assert.Nil(err)
+	assert.Nil(rom.WriteAt(bytes.Repeat([]byte{1, 2, 3, 4}, 0x100), n64rom.CodeStart))
+	rom.Pad(MbitBytes(1))
+
+	b := rom.Bytes()
+	saved := &bytes.Buffer{}
+	_, err = rom.Save(saved)
+	assert.Nil(err)
+	assert.Equal(saved.Bytes(), b)
+	assert.Equal(int(MbitBytes(1)), len(b))
+	crc1, crc2 := ComputeChecksum(b)
+	assert.Equal(crc1, binary.BigEndian.Uint32(b[ChecksumOffset:]))
+	assert.Equal(crc2, binary.BigEndian.Uint32(b[ChecksumOffset+4:]))
+
+	b[n64rom.CodeStart] = 0
+	assert.Equal(byte(1), rom.Bytes()[n64rom.CodeStart])
+}
+
+func TestMbitBytesCountsBinaryMegabits(t *testing.T) {
+	assert := assert.New(t)
+	assert.Equal(int64(0x20000), MbitBytes(1))
+	assert.Equal(int64(0x2000000), MbitBytes(256))
+}
+
+func TestRoundPow2PadsToNextMbitSize(t *testing.T) {
+	assert := assert.New(t)
+	assert.Equal(1, PowerOfTwoMbitSize(0x1000))
+	assert.Equal(8, PowerOfTwoMbitSize(MbitBytes(8)))
+
+	rom, err := NewBlankRom(0xff)
+	assert.Nil(err)
+	assert.Nil(rom.WriteAt(make([]byte, MbitBytes(5)-n64rom.CodeStart), n64rom.CodeStart))
+	assert.Nil(finishRom(rom, nil, BuildOptions{RoundPow2: true}))
+	b := readRom(t, rom)
+	assert.Equal(int(MbitBytes(8)), len(b))
+	assert.Equal(0x100000, len(b))
+	assert.Equal(byte(0xff), b[len(b)-1])
+}
+
+func TestPiConfigSetsFirstHeaderWord(t *testing.T) {
+	assert := assert.New(t)
+	rom, err := newRom(nil, BuildOptions{})
+	assert.Nil(err)
+	assert.Equal(uint32(DefaultPiConfig), binary.BigEndian.Uint32(readRom(t, rom)))
+
+	piConfig := uint32(0x80371241)
+	rom, err = newRom(nil, BuildOptions{PiConfig: &piConfig})
+	assert.Nil(err)
+	assert.Equal(piConfig, binary.BigEndian.Uint32(readRom(t, rom)))
+}
+
+func TestCheckSha256(t *testing.T) {
+	assert := assert.New(t)
+	rom, err := NewBlankRom(0)
+	assert.Nil(err)
+	assert.Nil(rom.WriteAt([]byte{1, 2, 3, 4}, n64rom.CodeStart))
+	image := readRom(t, rom)
+	sum := sha256.Sum256(image)
+	golden := hex.EncodeToString(sum[:])
+
+	assert.Equal(0, ExitCode(CheckSha256(image, golden)))
+	assert.Equal(0, ExitCode(CheckSha256(image, strings.ToUpper(golden))))
+
+	image[n64rom.CodeStart] = 9
+	err = CheckSha256(image, golden)
+	assert.Equal(ExitMismatch, ExitCode(err))
+	assert.Contains(err.Error(), "expected "+golden)
+}
@@ -0,0 +1,63 @@
+package spicy
+
+import (
+	"fmt"
+
+	"github.com/trhodeos/n64rom"
+)
+
+// CheckRomSize returns an error if the segments of layout would make an
+// image larger than max bytes, naming the largest segment or gap behind
+// it. A max of zero disables the check.
+func CheckRomSize(layout []SegmentLayout, max int64) error {
+	if max <= 0 {
+		return nil
+	}
+	var end uint64
+	for _, l := range layout {
+		if l.RomEnd > end {
+			end = l.RomEnd
+		}
+	}
+	if end <= uint64(max) {
+		return nil
+	}
+	return fmt.Errorf("ROM would be 0x%x bytes, over the limit of 0x%x bytes; the largest part of it is %s", end, max, largestRomContributor(layout))
+}
+
+// CheckPaddedRomSize returns an error if padding the ROM to size would take
+// it over max bytes. A max of zero disables the check.
+func CheckPaddedRomSize(size int64, max int64) error {
+	if max > 0 && size > max {
+		return fmt.Errorf("ROM would be padded to 0x%x bytes, over the limit of 0x%x bytes", size, max)
+	}
+	return nil
+}
+
+// largestRomContributor describes whichever of the segments of layout, the
+// gaps between them and the gap before the first is the largest.
+func largestRomContributor(layout []SegmentLayout) string {
+	var largest string
+	var size uint64
+	first := SegmentLayout{RomStart: ^uint64(0)}
+	for _, l := range layout {
+		if l.RomEnd-l.RomStart > size {
+			size = l.RomEnd - l.RomStart
+			largest = fmt.Sprintf("segment %s, 0x%x bytes at 0x%x", l.Name, size, l.RomStart)
+		}
+		if l.RomStart < first.RomStart {
+			first = l
+		}
+	}
+	if first.RomStart > n64rom.CodeStart && first.RomStart-n64rom.CodeStart > size {
+		size = first.RomStart - n64rom.CodeStart
+		largest = fmt.Sprintf("the 0x%x-byte gap before segment %s at 0x%x", size, first.Name, first.RomStart)
+	}
+	for _, gap := range PaddingGaps(layout) {
+		if gap.Size() > size {
+			size = gap.Size()
+			largest = fmt.Sprintf("the 0x%x-byte gap between segments %s and %s at 0x%x", size, gap.After, gap.Before, gap.Start)
+		}
+	}
+	return largest
+}
@@ -0,0 +1,32 @@
+package spicy
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCheckRomSizeNamesLargestGap(t *testing.T) {
+	assert := assert.New(t)
+	layout := []SegmentLayout{
+		{Name: "code", RomStart: 0x1000, RomEnd: 0x3000},
+		{Name: "data", RomStart: 0x3000, RomEnd: 0x4000},
+		{Name: "level", RomStart: 0x8000000, RomEnd: 0x8001000},
+	}
+	assert.Nil(CheckRomSize(layout, 0))
+	assert.Nil(CheckRomSize(layout, 0x8001000))
+	assert.EqualError(CheckRomSize(layout, 64<<20), "ROM would be 0x8001000 bytes, over the limit of 0x4000000 bytes; the largest part of it is the 0x7ffc000-byte gap between segments data and level at 0x4000")
+
+	layout = []SegmentLayout{{Name: "huge", RomStart: 0x1000, RomEnd: 0x5000000}}
+	assert.EqualError(CheckRomSize(layout, 64<<20), "ROM would be 0x5000000 bytes, over the limit of 0x4000000 bytes; the largest part of it is segment huge, 0x4fff000 bytes at 0x1000")
+
+	layout = []SegmentLayout{{Name: "far", RomStart: 0x6000000, RomEnd: 0x6000010}}
+	assert.EqualError(CheckRomSize(layout, 64<<20), "ROM would be 0x6000010 bytes, over the limit of 0x4000000 bytes; the largest part of it is the 0x5fff000-byte gap before segment far at 0x6000000")
+}
+
+func TestCheckPaddedRomSize(t *testing.T) {
+	assert := assert.New(t)
+	assert.Nil(CheckPaddedRomSize(64<<20, 0))
+	assert.Nil(CheckPaddedRomSize(64<<20, 64<<20))
+	assert.EqualError(CheckPaddedRomSize(128<<20, 64<<20), "ROM would be padded to 0x8000000 bytes, over the limit of 0x4000000 bytes")
+}
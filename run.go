@@ -8,16 +8,32 @@ import (
 	"os"
 	"os/exec"
 	"path/filepath"
+	"strings"
+	"sync"
 
 	"github.com/depp/shellquote"
 	log "github.com/sirupsen/logrus"
 )
 
+var showCommands bool
+
+// ShowCommands makes ExecRunner log each command line it runs at info level,
+// even when the standard logger is quieter than that.
+func ShowCommands(show bool) {
+	showCommands = show
+}
+
 func logCommand(command string, args []string) {
 	text, err := shellquote.Command(append([]string{command}, args...))
 	if err != nil {
 		log.Panic("shellquote.Command:", err)
 	}
+	if showCommands && !log.IsLevelEnabled(log.InfoLevel) {
+		std := log.StandardLogger()
+		logger := &log.Logger{Out: std.Out, Formatter: std.Formatter, Hooks: make(log.LevelHooks), Level: log.InfoLevel}
+		logger.Infoln("Running", text)
+		return
+	}
 	log.Infoln("Running", text)
 }
 
@@ -26,13 +42,68 @@ type Runner interface {
 }
 
 type ExecRunner struct {
-	command string
+	command          string
+	warningsAsErrors bool
 }
 
 func NewRunner(cmd string) ExecRunner {
 	return ExecRunner{command: cmd}
 }
 
+// NewWarningsAsErrorsRunner is like NewRunner, but Run fails a command that
+// succeeds but prints to stderr, rather than logging what it printed as a
+// warning.
+func NewWarningsAsErrorsRunner(cmd string) ExecRunner {
+	return ExecRunner{command: cmd, warningsAsErrors: true}
+}
+
+// ProcessLimit bounds how many calls run at once across every runner that
+// shares it. A nil ProcessLimit allows any number.
+type ProcessLimit struct {
+	slots chan struct{}
+}
+
+// NewProcessLimit returns a limit of n concurrent calls, or nil if n is not
+// positive.
+func NewProcessLimit(n int) *ProcessLimit {
+	if n <= 0 {
+		return nil
+	}
+	return &ProcessLimit{slots: make(chan struct{}, n)}
+}
+
+func (l *ProcessLimit) acquire() {
+	if l != nil {
+		l.slots <- struct{}{}
+	}
+}
+
+func (l *ProcessLimit) release() {
+	if l != nil {
+		<-l.slots
+	}
+}
+
+// LimitedRunner runs the wrapped runner within a ProcessLimit.
+type LimitedRunner struct {
+	runner Runner
+	limit  *ProcessLimit
+}
+
+// WithProcessLimit returns middleware that waits for a slot in limit before
+// each call.
+func WithProcessLimit(limit *ProcessLimit) RunnerMiddleware {
+	return func(r Runner) Runner {
+		return LimitedRunner{runner: r, limit: limit}
+	}
+}
+
+func (e LimitedRunner) Run(r io.Reader, args []string) (io.Reader, error) {
+	e.limit.acquire()
+	defer e.limit.release()
+	return e.runner.Run(r, args)
+}
+
 func (e ExecRunner) Run(r io.Reader, args []string) (io.Reader, error) {
 	logCommand(e.command, args)
 	cmd := exec.Command(e.command, args...)
@@ -44,7 +115,13 @@ func (e ExecRunner) Run(r io.Reader, args []string) (io.Reader, error) {
 	err := cmd.Run()
 	log.Debug("stdout: ", out.String())
 	if err != nil {
-		return nil, fmt.Errorf("Error running '%s': %v: %s", e.command, err, errout.String())
+		return nil, fmt.Errorf("Error running '%s': %w: %s", e.command, err, errout.String())
+	}
+	if warnings := strings.TrimSpace(errout.String()); warnings != "" {
+		if e.warningsAsErrors {
+			return nil, fmt.Errorf("'%s' succeeded but printed warnings: %s", e.command, warnings)
+		}
+		log.Warnf("%s: %s", e.command, warnings)
 	}
 	return &out, nil
 }
@@ -52,18 +129,36 @@ func (e ExecRunner) Run(r io.Reader, args []string) (io.Reader, error) {
 type OutputFileRunner struct {
 	runner             Runner
 	expectedOutputFile string
+	removeOutput       bool
 }
 
 func NewOutputFileRunner(r Runner, outputFile string) OutputFileRunner {
 	return OutputFileRunner{runner: r, expectedOutputFile: outputFile}
 }
 
+// NewTempOutputFileRunner is like NewOutputFileRunner, but Run reads the
+// output into memory and removes the file, whether or not the command
+// succeeds, for outputs nothing else needs to find on disk.
+func NewTempOutputFileRunner(r Runner, outputFile string) OutputFileRunner {
+	return OutputFileRunner{runner: r, expectedOutputFile: outputFile, removeOutput: true}
+}
+
 func (e OutputFileRunner) Run(r io.Reader, args []string) (io.Reader, error) {
+	if e.removeOutput {
+		defer removeTempFiles(nil, []string{e.expectedOutputFile})
+	}
 	_, err := e.runner.Run(r, args)
 	if err != nil {
 		return nil, err
 	}
-	return os.Open(e.expectedOutputFile)
+	if !e.removeOutput {
+		return os.Open(e.expectedOutputFile)
+	}
+	b, err := ioutil.ReadFile(e.expectedOutputFile)
+	if err != nil {
+		return nil, err
+	}
+	return bytes.NewBuffer(b), nil
 }
 
 type MappedFileRunner struct {
@@ -76,34 +171,96 @@ func NewMappedFileRunner(r Runner, inputFileArgs map[string]io.Reader, outputFil
 	return MappedFileRunner{runner: r, inputFileArgs: inputFileArgs, outputFileArg: outputFileArg}
 }
 
-func writeTempFile(r io.Reader, prefix string) (string, error) {
+// TempFileRunner passes calls on to the wrapped runner. A MappedFileRunner
+// around it tracks the temporary files it writes in the runner's Cleanup for
+// as long as they exist, so that they can be removed if a build is
+// interrupted.
+type TempFileRunner struct {
+	runner Runner
+	temps  *Cleanup
+}
+
+// WithTempFiles returns middleware tracking temporary files in c. It must
+// be the outermost middleware for MappedFileRunner to find it.
+func WithTempFiles(c *Cleanup) RunnerMiddleware {
+	return func(r Runner) Runner {
+		return TempFileRunner{runner: r, temps: c}
+	}
+}
+
+func (e TempFileRunner) Run(r io.Reader, args []string) (io.Reader, error) {
+	return e.runner.Run(r, args)
+}
+
+// tempFilesOf returns the Cleanup r tracks temporary files in, if it is a
+// TempFileRunner, or nil.
+func tempFilesOf(r Runner) *Cleanup {
+	if t, ok := r.(TempFileRunner); ok {
+		return t.temps
+	}
+	return nil
+}
+
+// writeTempFile writes r to a new temporary file, which is tracked in temps
+// from when it is created.
+func writeTempFile(r io.Reader, prefix string, temps *Cleanup) (string, error) {
 	tmpfile, err := ioutil.TempFile("", prefix)
 	if err != nil {
 		return "", err
 	}
 	path, err := filepath.Abs(tmpfile.Name())
 	if err != nil {
+		tmpfile.Close()
+		os.Remove(tmpfile.Name())
 		return "", err
 	}
-	log.Debugf("Writing file for prefix %s to %s", prefix, path)
-	_, err = io.Copy(tmpfile, r)
-	if err != nil {
-		return "", err
+	temps.Add(path)
+	n, err := io.Copy(tmpfile, r)
+	if err == nil {
+		err = tmpfile.Close()
+	} else {
+		tmpfile.Close()
 	}
-	if err := tmpfile.Close(); err != nil {
+	if err != nil {
+		removeTempFiles(temps, []string{path})
 		return "", err
 	}
+	log.Debugf("Wrote %d bytes for prefix %s to %s", n, prefix, path)
 	return path, nil
 }
 
+// tempFileObserver is implemented by runners that are told of each input
+// file a MappedFileRunner around them writes, so tests can follow the order
+// they are made in.
+type tempFileObserver interface {
+	tempFileWritten(arg, path string)
+}
+
+// Run writes each mapped input to a temporary file and substitutes it for its
+// argument. Files are written in the order their arguments appear in args,
+// and an argument repeated in args reuses the first file written for it.
+// The files are removed once the command has run.
 func (e MappedFileRunner) Run(r io.Reader, args []string) (io.Reader, error) {
 	var newArgs []string = make([]string, len(args))
+	written := map[string]string{}
+	temps := tempFilesOf(e.runner)
+	observer, _ := e.runner.(tempFileObserver)
+	var paths []string
+	defer func() { removeTempFiles(temps, paths) }()
 	for i, arg := range args {
-		if _, ok := e.inputFileArgs[arg]; ok {
-			tempFile, err := writeTempFile(e.inputFileArgs[arg], arg)
+		if tempFile, ok := written[arg]; ok {
+			newArgs[i] = tempFile
+		} else if _, ok := e.inputFileArgs[arg]; ok {
+			tempFile, err := writeTempFile(e.inputFileArgs[arg], arg, temps)
 			if err != nil {
 				return nil, err
 			}
+			paths = append(paths, tempFile)
+			if observer != nil {
+				observer.tempFileWritten(arg, tempFile)
+			}
+			log.Debugf("Substituting %s for argument %s", tempFile, arg)
+			written[arg] = tempFile
 			newArgs[i] = tempFile
 		} else {
 			newArgs[i] = args[i]
@@ -119,3 +276,130 @@ func (e MappedFileRunner) Run(r io.Reader, args []string) (io.Reader, error) {
 	}
 	return bytes.NewBuffer(b), nil
 }
+
+// RunnerMiddleware wraps a Runner with some extra behaviour.
+type RunnerMiddleware func(Runner) Runner
+
+// Chain wraps base with each middleware in turn. The first middleware is the
+// outermost, so it sees each call first and the final result last.
+func Chain(base Runner, mw ...RunnerMiddleware) Runner {
+	r := base
+	for i := len(mw) - 1; i >= 0; i-- {
+		r = mw[i](r)
+	}
+	return r
+}
+
+// LoggingRunner logs each call it passes on, and any error it returns.
+type LoggingRunner struct {
+	runner Runner
+	name   string
+}
+
+// WithLogging returns middleware logging calls under name at debug level.
+func WithLogging(name string) RunnerMiddleware {
+	return func(r Runner) Runner {
+		return LoggingRunner{runner: r, name: name}
+	}
+}
+
+func (e LoggingRunner) Run(r io.Reader, args []string) (io.Reader, error) {
+	log.Debugf("Calling %s with %v", e.name, args)
+	out, err := e.runner.Run(r, args)
+	if err != nil {
+		log.Debugf("%s failed: %v", e.name, err)
+	}
+	return out, err
+}
+
+// RetryRunner reruns a failing call up to a fixed number of attempts. Stdin
+// is buffered so that each attempt sees all of it.
+type RetryRunner struct {
+	runner   Runner
+	attempts int
+}
+
+// WithRetry returns middleware making up to attempts calls before failing.
+func WithRetry(attempts int) RunnerMiddleware {
+	return func(r Runner) Runner {
+		return RetryRunner{runner: r, attempts: attempts}
+	}
+}
+
+func (e RetryRunner) Run(r io.Reader, args []string) (io.Reader, error) {
+	var stdin []byte
+	if r != nil {
+		b, err := ioutil.ReadAll(r)
+		if err != nil {
+			return nil, err
+		}
+		stdin = b
+	}
+	var err error
+	for attempt := 1; ; attempt++ {
+		var in io.Reader
+		if r != nil {
+			in = bytes.NewReader(stdin)
+		}
+		var out io.Reader
+		out, err = e.runner.Run(in, args)
+		if err == nil || attempt >= e.attempts {
+			return out, err
+		}
+		log.Debugf("Attempt %d of %d failed, retrying: %v", attempt, e.attempts, err)
+	}
+}
+
+// DryRunner logs each call at info level without running anything, and
+// returns empty output.
+type DryRunner struct {
+	name string
+}
+
+// DryRun returns middleware that replaces the wrapped runner entirely.
+func DryRun(name string) RunnerMiddleware {
+	return func(Runner) Runner {
+		return DryRunner{name: name}
+	}
+}
+
+func (e DryRunner) Run(r io.Reader, args []string) (io.Reader, error) {
+	logCommand(e.name, args)
+	return &bytes.Buffer{}, nil
+}
+
+// RecordingRunner keeps the arguments of every call, so tests can check the
+// exact command lines spicy builds. Calls are passed on to the wrapped
+// runner, or answered with empty output if there is none.
+type RecordingRunner struct {
+	runner Runner
+	mu     sync.Mutex
+	calls  [][]string
+}
+
+// NewRecordingRunner returns a RecordingRunner passing calls on to r, which
+// may be nil.
+func NewRecordingRunner(r Runner) *RecordingRunner {
+	return &RecordingRunner{runner: r}
+}
+
+func (e *RecordingRunner) Run(r io.Reader, args []string) (io.Reader, error) {
+	e.mu.Lock()
+	e.calls = append(e.calls, append([]string{}, args...))
+	e.mu.Unlock()
+	if e.runner == nil {
+		return &bytes.Buffer{}, nil
+	}
+	return e.runner.Run(r, args)
+}
+
+// Calls returns the arguments of each call made so far, in order.
+func (e *RecordingRunner) Calls() [][]string {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	calls := make([][]string, len(e.calls))
+	for i, args := range e.calls {
+		calls[i] = append([]string{}, args...)
+	}
+	return calls
+}
@@ -0,0 +1,242 @@
+package spicy
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+func captureLogs(t *testing.T, level log.Level) *bytes.Buffer {
+	b := &bytes.Buffer{}
+	oldLevel := log.GetLevel()
+	log.SetOutput(b)
+	log.SetLevel(level)
+	t.Cleanup(func() {
+		log.SetOutput(os.Stderr)
+		log.SetLevel(oldLevel)
+	})
+	return b
+}
+
+func TestMappedFileRunnerLogsTempFileSizes(t *testing.T) {
+	assert := assert.New(t)
+	logs := captureLogs(t, log.DebugLevel)
+	inputs := map[string]io.Reader{
+		"input": strings.NewReader("twelve bytes"),
+	}
+	_, err := NewMappedFileRunner(&fakeRunner{}, inputs, "").Run(nil, []string{"input"})
+	assert.NotNil(err) // No output file is produced.
+	assert.Contains(logs.String(), "Wrote 12 bytes for prefix input")
+	assert.Contains(logs.String(), "for argument input")
+}
+
+func TestShowCommandsWithoutStdout(t *testing.T) {
+	if _, err := exec.LookPath("echo"); err != nil {
+		t.Skip("echo not available")
+	}
+	assert := assert.New(t)
+	logs := captureLogs(t, log.WarnLevel)
+	ShowCommands(true)
+	defer ShowCommands(false)
+	_, err := NewRunner("echo").Run(nil, []string{"some-output"})
+	assert.Nil(err)
+	assert.Contains(logs.String(), "Running echo some-output")
+	assert.NotContains(logs.String(), "stdout")
+}
+
+// flakyRunner fails the first failures calls, then echoes its stdin.
+type flakyRunner struct {
+	failures int
+	calls    int
+}
+
+func (f *flakyRunner) Run(r io.Reader, args []string) (io.Reader, error) {
+	f.calls++
+	if f.calls <= f.failures {
+		return nil, errors.New("flaky failure")
+	}
+	b := &bytes.Buffer{}
+	_, err := io.Copy(b, r)
+	return b, err
+}
+
+func TestChainAppliesLoggingAndRetry(t *testing.T) {
+	assert := assert.New(t)
+	logs := captureLogs(t, log.DebugLevel)
+	base := &flakyRunner{failures: 2}
+	r := Chain(base, WithLogging("flaky"), WithRetry(3))
+
+	out, err := r.Run(strings.NewReader("stdin"), []string{"arg"})
+	assert.Nil(err)
+	assert.Equal(3, base.calls)
+	b, err := ioutil.ReadAll(out)
+	assert.Nil(err)
+	assert.Equal("stdin", string(b))
+	assert.Contains(logs.String(), "Calling flaky with [arg]")
+	assert.Equal(2, strings.Count(logs.String(), "retrying"))
+
+	base = &flakyRunner{failures: 5}
+	_, err = Chain(base, WithLogging("flaky"), WithRetry(3)).Run(nil, nil)
+	assert.NotNil(err)
+	assert.Equal(3, base.calls)
+	assert.Contains(logs.String(), "flaky failed: flaky failure")
+}
+
+// orderRunner is a fakeRunner that keeps the arguments of the input files a
+// MappedFileRunner around it writes, in the order they are written.
+type orderRunner struct {
+	*fakeRunner
+	order []string
+}
+
+func (e *orderRunner) tempFileWritten(arg, path string) {
+	e.order = append(e.order, arg)
+}
+
+func TestMappedFileRunnerWritesInputsInArgumentOrder(t *testing.T) {
+	assert := assert.New(t)
+	output := filepath.Join(t.TempDir(), "out")
+	fake := &fakeRunner{output: []byte{}, outputFile: output}
+	r := &orderRunner{fakeRunner: fake}
+	for i := 0; i < 3; i++ {
+		r.order = nil
+		inputs := map[string]io.Reader{
+			"zeta":  strings.NewReader("z"),
+			"alpha": strings.NewReader("a"),
+			"mid":   strings.NewReader("m"),
+		}
+		_, err := NewMappedFileRunner(r, inputs, output).Run(nil, []string{"mid", "-x", "zeta", "alpha", "mid"})
+		assert.Nil(err)
+		assert.Equal([]string{"mid", "zeta", "alpha"}, r.order)
+	}
+	args := fake.calls[0]
+	assert.Equal(args[0], args[4])
+	assert.Equal("-x", args[1])
+}
+
+func TestTempOutputFileRunnerRemovesOutput(t *testing.T) {
+	assert := assert.New(t)
+	output := filepath.Join(t.TempDir(), "out.bin")
+	r, err := NewTempOutputFileRunner(&fakeRunner{output: []byte("converted"), outputFile: output}, output).Run(nil, []string{"in.bin"})
+	assert.Nil(err)
+	b, err := ioutil.ReadAll(r)
+	assert.Nil(err)
+	assert.Equal("converted", string(b))
+	_, err = os.Stat(output)
+	assert.True(os.IsNotExist(err))
+
+	// A partial output of a failed command is removed too.
+	failing := runnerFunc(func(r io.Reader, args []string) (io.Reader, error) {
+		ioutil.WriteFile(output, []byte("partial"), 0644)
+		return nil, errors.New("objcopy failed")
+	})
+	_, err = NewTempOutputFileRunner(failing, output).Run(nil, []string{"in.bin"})
+	assert.NotNil(err)
+	_, err = os.Stat(output)
+	assert.True(os.IsNotExist(err))
+}
+
+// countingRunner tracks how many of its calls are running at once.
+type countingRunner struct {
+	mu      sync.Mutex
+	current int
+	max     int
+}
+
+func (c *countingRunner) Run(r io.Reader, args []string) (io.Reader, error) {
+	c.mu.Lock()
+	c.current++
+	if c.current > c.max {
+		c.max = c.current
+	}
+	c.mu.Unlock()
+	time.Sleep(5 * time.Millisecond)
+	c.mu.Lock()
+	c.current--
+	c.mu.Unlock()
+	return &bytes.Buffer{}, nil
+}
+
+func TestProcessLimitBoundsConcurrentCalls(t *testing.T) {
+	assert := assert.New(t)
+	counter := &countingRunner{}
+	limit := NewProcessLimit(3)
+	// Separate runners sharing one limit, as each wave's toolchain would.
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		runner := Chain(counter, WithProcessLimit(limit))
+		for j := 0; j < 5; j++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				_, err := runner.Run(nil, []string{"-o", "out"})
+				assert.Nil(err)
+			}()
+		}
+	}
+	wg.Wait()
+	assert.LessOrEqual(counter.max, 3)
+	assert.Equal(0, counter.current)
+}
+
+func TestRecordingRunnerRecordsLdCommandLine(t *testing.T) {
+	assert := assert.New(t)
+	chdirTemp(t)
+	p := newTestPipeline()
+	ld := NewRecordingRunner(p.Ld)
+	p.Ld = ld
+	_, err := p.Run(strings.NewReader(pipelineTestSpec))
+	assert.Nil(err)
+
+	calls := ld.Calls()
+	assert.Equal(1, len(calls))
+	args := calls[0]
+	// The linker script is written to a temporary file.
+	assert.Equal("-dT", args[len(args)-4])
+	assert.True(strings.HasPrefix(filepath.Base(args[len(args)-3]), "ld-script"), args[len(args)-3])
+	args[len(args)-3] = "ld-script"
+	assert.Equal([]string{"-G 0", "-S", "-nostartfiles", "-nodefaultlibs", "-nostdinc", "-M", "-dT", "ld-script", "-o", "game.out"}, args)
+
+	calls[0][0] = "changed"
+	assert.Equal("-G 0", ld.Calls()[0][0])
+
+	stub := NewRecordingRunner(nil)
+	out, err := stub.Run(nil, []string{"-v"})
+	assert.Nil(err)
+	b, err := ioutil.ReadAll(out)
+	assert.Nil(err)
+	assert.Empty(b)
+	assert.Equal([][]string{{"-v"}}, stub.Calls())
+}
+
+func TestStderrOfSuccessfulCommandIsAWarning(t *testing.T) {
+	if _, err := exec.LookPath("sh"); err != nil {
+		t.Skip("sh not available")
+	}
+	assert := assert.New(t)
+	dir := t.TempDir()
+	ld := filepath.Join(dir, "fake-ld")
+	assert.Nil(ioutil.WriteFile(ld, []byte("#!/bin/sh\necho 'fake-ld: warning: section .data overlaps .bss' >&2\necho linked\n"), 0755))
+	logs := captureLogs(t, log.WarnLevel)
+	out, err := NewRunner(ld).Run(nil, nil)
+	assert.Nil(err)
+	b, err := ioutil.ReadAll(out)
+	assert.Nil(err)
+	assert.Equal("linked\n", string(b))
+	assert.Contains(logs.String(), "level=warning")
+	assert.Contains(logs.String(), "fake-ld: warning: section .data overlaps .bss")
+
+	_, err = NewWarningsAsErrorsRunner(ld).Run(nil, nil)
+	assert.EqualError(err, "'"+ld+"' succeeded but printed warnings: fake-ld: warning: section .data overlaps .bss")
+}
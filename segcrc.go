@@ -0,0 +1,64 @@
+package spicy
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+)
+
+// SegmentCrcMagic starts the table of segment CRCs that --segment-crc
+// embeds in the ROM, so that runtime code can find it.
+const SegmentCrcMagic = "SCRC"
+
+// SegmentCrc is one entry of the segment CRC table: the segment's ROM range
+// and the CRC32 (IEEE) of its bytes there.
+type SegmentCrc struct {
+	RomStart uint32
+	RomEnd   uint32
+	Crc      uint32
+}
+
+// SegmentCrcs computes the CRC of every segment in layout, in layout order.
+func SegmentCrcs(rom *Rom, layout []SegmentLayout) ([]SegmentCrc, error) {
+	var crcs []SegmentCrc
+	for _, l := range layout {
+		if l.RomEnd > uint64(rom.Size()) || l.RomStart > l.RomEnd {
+			return nil, fmt.Errorf("segment %s at 0x%x-0x%x is outside the ROM", l.Name, l.RomStart, l.RomEnd)
+		}
+		crcs = append(crcs, SegmentCrc{
+			RomStart: uint32(l.RomStart),
+			RomEnd:   uint32(l.RomEnd),
+			Crc:      crc32.ChecksumIEEE(rom.data[l.RomStart:l.RomEnd]),
+		})
+	}
+	return crcs, nil
+}
+
+// EncodeSegmentCrcTable lays out crcs as the magic, a 32-bit entry count and
+// then each entry's fields, all big-endian as the N64 reads them.
+func EncodeSegmentCrcTable(crcs []SegmentCrc) []byte {
+	b := &bytes.Buffer{}
+	b.WriteString(SegmentCrcMagic)
+	binary.Write(b, binary.BigEndian, uint32(len(crcs)))
+	binary.Write(b, binary.BigEndian, crcs)
+	return b.Bytes()
+}
+
+// DecodeSegmentCrcTable reads a table written by EncodeSegmentCrcTable from
+// the start of b.
+func DecodeSegmentCrcTable(b []byte) ([]SegmentCrc, error) {
+	if len(b) < 8 || string(b[:4]) != SegmentCrcMagic {
+		return nil, errors.New("missing segment CRC table magic")
+	}
+	n := binary.BigEndian.Uint32(b[4:8])
+	if uint64(len(b)-8) < uint64(n)*12 {
+		return nil, fmt.Errorf("segment CRC table has %d entries but only %d bytes", n, len(b)-8)
+	}
+	crcs := make([]SegmentCrc, n)
+	if err := binary.Read(bytes.NewReader(b[8:]), binary.BigEndian, crcs); err != nil {
+		return nil, err
+	}
+	return crcs, nil
+}
@@ -0,0 +1,31 @@
+package spicy
+
+import (
+	"hash/crc32"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSegmentCrcTableMatchesSegments(t *testing.T) {
+	assert := assert.New(t)
+	chdirTemp(t)
+	p := newTestPipeline()
+	p.BuildOptions.SegmentCrc = true
+	result, err := p.Run(strings.NewReader(pipelineTestSpec))
+	assert.Nil(err)
+	b := readRom(t, result.Rom)
+
+	crcs, err := DecodeSegmentCrcTable(b[0x1010:])
+	assert.Nil(err)
+	assert.Equal(len(result.Layout), len(crcs))
+	for i, l := range result.Layout {
+		assert.Equal(uint32(l.RomStart), crcs[i].RomStart)
+		assert.Equal(uint32(l.RomEnd), crcs[i].RomEnd)
+		assert.Equal(crc32.ChecksumIEEE(b[l.RomStart:l.RomEnd]), crcs[i].Crc)
+	}
+
+	_, err = DecodeSegmentCrcTable(b[0x1000:])
+	assert.NotNil(err)
+}
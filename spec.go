@@ -5,49 +5,56 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
+	"text/scanner"
 
 	"github.com/alecthomas/participle"
+	"github.com/alecthomas/participle/lexer"
 	log "github.com/sirupsen/logrus"
+	"github.com/trhodeos/n64rom"
 )
 
 type Constant struct {
-	Symbol string `  @Ident`
-	Int    uint64 `| @Int`
+	Symbol string `parser:"  @Ident"`
+	Int    uint64 `parser:"| @Int"`
 }
 
 type FlagAst struct {
-	Boot   bool `  @"BOOT"`
-	Object bool `| @"OBJECT"`
-	Raw    bool `| @"RAW"`
+	Boot   bool `parser:"  @'BOOT'"`
+	Object bool `parser:"| @'OBJECT'"`
+	Raw    bool `parser:"| @'RAW'"`
+	NoLoad bool `parser:"| @('NOLOAD' | 'BSS')"`
+	Reloc  bool `parser:"| @'RELOC'"`
 }
 
 type Summand struct {
-	Lhs *Constant ` @@`
-	Op  string    `[ @("+" | "-")`
-	Rhs *Constant ` @@ ]`
+	Lhs *Constant `parser:" @@"`
+	Op  string    `parser:"[ @('+' | '-')"`
+	Rhs *Constant `parser:" @@ ]"`
 }
 
 type MaxSegment struct {
-	First  string `"max[" @String ","`
-	Second string `    @String "]"`
+	First  string `parser:"'max[' @String ','"`
+	Second string `parser:"    @String ']'"`
 }
 
 type MinSegment struct {
-	First  string `"min[" @String ","`
-	Second string `       @String "]"`
+	First  string `parser:"'min[' @String ','"`
+	Second string `parser:"       @String ']'"`
 }
 
 // Only one of these values will be set.
 type Value struct {
-	String        string      `  @String`
-	Int           uint64      `| @Int`
-	Flags         []*FlagAst  `| @@ { @@ }`
-	ConstantValue *Summand    `| @@`
-	MaxSegment    *MaxSegment `| @@`
-	MinSegment    *MinSegment `| @@`
+	String        string      `parser:"  @String"`
+	Int           uint64      `parser:"| @Int"`
+	Flags         []*FlagAst  `parser:"| @@ { @@ }"`
+	ConstantValue *Summand    `parser:"| @@"`
+	MaxSegment    *MaxSegment `parser:"| @@"`
+	MinSegment    *MinSegment `parser:"| @@"`
 }
 
 type StatementAst struct {
@@ -57,37 +64,162 @@ type StatementAst struct {
 	   |after <segmentName>
 	   |after max[<segmentName>,<segmentName>]
 	   |after min[<segmentName>,<segmentName>]
-	   |include <filename>
+	   |include <filename> [align <constant>]
 	   |maxsize <constant>
 	   |align <constant>
 	   |flags <flagList>
 	   |number <constant>
 	   |entry <symbol>
 	   |stack <stackValue>
+	   |romoffset <constant>
+	   |alignshift <constant>
+	   |prefix <symbol>
+	   |fill <constant> (waves only)
 	*/
 	// I tried using @Ident here, but the parser was greedily taking 'endseg' as name.
 	// By explicitly listing all known names here, we limit the search space.
-	Name  string `@("name" | "address" | "after" | "include" | "maxsize" | "align" | "flags" | "number" | "entry" | "stack")`
-	Value Value  `@@`
+	Pos          lexer.Position
+	Name         string           `parser:"@('name' | 'address' | 'after' | 'include' | 'maxsize' | 'align' | 'flags' | 'number' | 'entry' | 'stack' | 'romoffset' | 'alignshift' | 'prefix' | 'fill')"`
+	Value        Value            `parser:"@@"`
+	IncludeAlign *IncludeAlignAst `parser:"[ @@ ]"`
+}
+
+// IncludeAlignAst is the 'align <constant>' of 'include <filename> align
+// <constant>'. Whitespace is not significant to the rest of the grammar, so
+// it only matches on the line of the include it follows; an align on a
+// later line is the segment's own align statement.
+type IncludeAlignAst struct {
+	Pos   lexer.Position
+	Value uint64
+}
+
+// Parse implements participle.Parseable.
+func (a *IncludeAlignAst) Parse(lex *lexer.PeekingLexer) error {
+	if lex.Cursor() < 2 {
+		return participle.NextMatch
+	}
+	name, _ := lex.Peek(-2)
+	filename, _ := lex.Peek(-1)
+	keyword, _ := lex.Peek(0)
+	if name.Type != scanner.Ident || name.Value != "include" || keyword.Value != "align" || keyword.Pos.Line != filename.Pos.Line {
+		return participle.NextMatch
+	}
+	lex.Next()
+	value, _ := lex.Next()
+	v, err := strconv.ParseUint(value.Value, 0, 64)
+	if err != nil {
+		return lexer.ErrorWithTokenf(value, "unexpected %q (expected <int>)", value.Value)
+	}
+	a.Pos, a.Value = keyword.Pos, v
+	return nil
+}
+
+// EndSegAst and EndWaveAst exist to record where a block ends.
+type EndSegAst struct {
+	Pos     lexer.Position
+	Keyword string `parser:"@'endseg'"`
+}
+
+type EndWaveAst struct {
+	Pos     lexer.Position
+	Keyword string `parser:"@'endwave'"`
 }
 
 type SegmentAst struct {
-	Statements []*StatementAst `"beginseg" { @@ } "endseg"`
+	Pos        lexer.Position
+	Statements []*StatementAst `parser:"'beginseg' { @@ }"`
+	End        *EndSegAst      `parser:"@@"`
 }
 
 type WaveAst struct {
-	Statements []*StatementAst `"beginwave" { @@ } "endwave"`
+	Pos        lexer.Position
+	Statements []*StatementAst `parser:"'beginwave' { @@ }"`
+	End        *EndWaveAst     `parser:"@@"`
+}
+
+// DirectiveAst is a top-level build parameter.
+type DirectiveAst struct {
+	/*
+	   :romsize <constant>
+	   |fill <constant>
+	*/
+	Pos   lexer.Position
+	Name  string `parser:"@('romsize' | 'fill')"`
+	Value uint64 `parser:"@Int"`
+}
+
+// SpecItemAst is one top-level block. Blocks may come in any order, so that
+// several specs can be concatenated.
+type SpecItemAst struct {
+	Directive *DirectiveAst `parser:"  @@"`
+	Segment   *SegmentAst   `parser:"| @@"`
+	Wave      *WaveAst      `parser:"| @@"`
 }
 
 type SpecAst struct {
-	Segments []*SegmentAst `{ @@ }`
-	Waves    []*WaveAst    `{ @@ }`
+	Items []*SpecItemAst `parser:"{ @@ }"`
 }
 
 type Flags struct {
 	Object bool
 	Boot   bool
 	Raw    bool
+	// NoLoad segments reserve VRAM but take up no space in the ROM.
+	NoLoad bool
+	// Reloc segments carry a relocation table after their data, so that
+	// they can be loaded at an address other than the one they were linked
+	// at.
+	Reloc bool
+}
+
+// String returns the flags as they are written in a spec.
+func (f Flags) String() string {
+	var names []string
+	if f.Boot {
+		names = append(names, "BOOT")
+	}
+	if f.Object {
+		names = append(names, "OBJECT")
+	}
+	if f.Raw {
+		names = append(names, "RAW")
+	}
+	if f.NoLoad {
+		names = append(names, "NOLOAD")
+	}
+	if f.Reloc {
+		names = append(names, "RELOC")
+	}
+	return strings.Join(names, " ")
+}
+
+// checkFlags rejects a flags statement combining flags that contradict each
+// other. BOOT, NOLOAD and RELOC only apply to object segments, so they imply
+// OBJECT, and cannot be combined with RAW.
+func checkFlags(seg *Segment) error {
+	f := &seg.Flags
+	var reason string
+	switch {
+	case f.Raw && f.Object:
+		reason = "a segment cannot be both RAW and OBJECT"
+	case f.Raw && f.Boot:
+		reason = "a RAW segment cannot be BOOT"
+	case f.Raw && f.NoLoad:
+		reason = "a RAW segment cannot be NOLOAD"
+	case f.Raw && f.Reloc:
+		reason = "a RAW segment cannot be RELOC"
+	case f.Boot && f.NoLoad:
+		reason = "a BOOT segment must be loaded"
+	case f.NoLoad && f.Reloc:
+		reason = "a NOLOAD segment has no data in the ROM to relocate"
+	}
+	if reason != "" {
+		return errors.New(fmt.Sprintf("Flags %s of segment %s are not a valid combination: %s.", seg.Flags, seg.Name, reason))
+	}
+	if !f.Raw {
+		f.Object = true
+	}
+	return nil
 }
 
 type Positioning struct {
@@ -102,7 +234,25 @@ type StackInfo struct {
 	Offset uint64
 }
 
+// EntryPoint pairs an entry symbol with the stack it starts on. The nth
+// entry line of a segment is paired with its nth stack line.
+type EntryPoint struct {
+	Entry string
+	Stack *StackInfo
+}
+
+// Span is the region of the original spec that a segment or wave was parsed
+// from, from the start of its begin keyword to the end of its end keyword.
+type Span struct {
+	Filename  string
+	StartLine int
+	StartCol  int
+	EndLine   int
+	EndCol    int
+}
+
 type Segment struct {
+	Span        Span
 	Name        string
 	Includes    []string
 	StackInfo   *StackInfo
@@ -111,20 +261,151 @@ type Segment struct {
 	MaxSize     uint64
 	Align       uint64
 	Flags       Flags
+	// RomOffset, if set, fixes where the segment is placed in the ROM
+	// rather than following on from the previous segment.
+	RomOffset uint64
+	// Entries holds every entry point of the segment, the first of which is
+	// also given by Entry and StackInfo.
+	Entries []EntryPoint
+	// IncludeAlign holds the alignment of each include of a RAW segment
+	// that was given one, within the object wrapping it.
+	IncludeAlign map[string]uint64
+	// SymbolPrefix is prepended to the segment's name in the boundary
+	// symbols generated for it, such as _<prefix><name>SegmentRomStart.
+	SymbolPrefix string
+	// SymbolFormat, if set, is how the segment's boundary symbols are
+	// named, as CheckSymbolFormat describes, rather than DefaultSymbolFormat.
+	SymbolFormat string
+	// MangledName, if set, stands in for a name that is not ASCII in the
+	// linker script. Name is still used everywhere else.
+	MangledName string
+	// Reserve is a number of bytes reserved at the end of the segment's BSS,
+	// for segments spicy creates itself, such as default stacks.
+	Reserve uint64
+	// Split, for a piece of a RAW segment split under --auto-split, says
+	// which segment it was split from and which piece it is.
+	Split *SegmentSplit
+}
+
+// SegmentSplit places a piece among the pieces of a split RAW segment. The
+// linker script defines the boundary symbols of Source around them all, so
+// that code naming the segment still finds the whole of its data.
+type SegmentSplit struct {
+	Source *Segment
+	Index  int
+	Count  int
+}
+
+// First reports whether the piece is the first of its segment.
+func (s *SegmentSplit) First() bool {
+	return s.Index == 0
+}
+
+// Last reports whether the piece is the last of its segment.
+func (s *SegmentSplit) Last() bool {
+	return s.Index == s.Count-1
+}
+
+// LinkName returns the name of the segment in the linker script.
+func (s *Segment) LinkName() string {
+	if s.MangledName != "" {
+		return s.MangledName
+	}
+	return s.Name
+}
+
+// SymbolName returns the name the segment's boundary symbols are built on.
+func (s *Segment) SymbolName() string {
+	return s.SymbolPrefix + s.LinkName()
+}
+
+// MangleSymbol turns name into a valid C identifier. ASCII letters, digits
+// and underscores are kept, and every other character is replaced by _u
+// and its code point in hex, so the same name always gives the same symbol.
+func MangleSymbol(name string) string {
+	var b strings.Builder
+	for i, r := range name {
+		switch {
+		case r >= '0' && r <= '9':
+			if i == 0 {
+				b.WriteByte('_')
+			}
+			b.WriteRune(r)
+		case r == '_' || (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z'):
+			b.WriteRune(r)
+		default:
+			fmt.Fprintf(&b, "_u%04x", r)
+		}
+	}
+	return b.String()
+}
+
+func isASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] >= 0x80 {
+			return false
+		}
+	}
+	return true
 }
 
 type Wave struct {
+	Span           Span
 	Name           string
 	ObjectSegments []*Segment
 	RawSegments    []*Segment
+	// Fill, if set, is the fill byte for gaps within the wave, in place of
+	// the ROM's.
+	Fill *byte
+	// rawAliases names, for each RAW segment PrepareRawSegments found to be
+	// identical to an earlier one, the segment whose data it shares. It is
+	// kept on the wave, as other waves may include the same segment without
+	// the one it is identical to.
+	rawAliases map[string]string
+}
+
+// aliasOf returns the name of the RAW segment whose data the segment name
+// shares in w, or "" if it has its own.
+func (w *Wave) aliasOf(name string) string {
+	return w.rawAliases[name]
 }
 
 type Spec struct {
 	Waves []*Wave
+	// RomSize is the ROM size in Mbit from a romsize directive, or zero.
+	RomSize int
+	// Fill is the fill byte from a fill directive, if there was one.
+	Fill *byte
+	// Sources lists the spec files and headers the spec was read from, as
+	// recorded in cpp's linemarkers.
+	Sources []string
+}
+
+// expandPath expands environment variables in path, accepting both the
+// $(VAR) makefile style and the usual $VAR and ${VAR} forms. Under strict,
+// referencing an unset variable is an error.
+func expandPath(path string, strict bool) (string, error) {
+	// Hacky way of moving $(var) -> $var
+	replaced := strings.Replace(path, "$(", "$", -1)
+	replaced = strings.Replace(replaced, ")", "", -1)
+	var missing []string
+	replaced = os.Expand(replaced, func(name string) string {
+		value, ok := os.LookupEnv(name)
+		if !ok {
+			missing = append(missing, name)
+		}
+		return value
+	})
+	if strict && len(missing) > 0 {
+		return "", fmt.Errorf("Environment variable %s referenced by %q is not set.", missing[0], path)
+	}
+	return filepath.Clean(replaced), nil
 }
 
-func convertSegmentAst(s *SegmentAst) (*Segment, error) {
-	seg := &Segment{}
+func convertSegmentAst(s *SegmentAst, opts parseOptions) (*Segment, error) {
+	seg := &Segment{SymbolFormat: opts.symbolFormat}
+	entries, stacks := 0, 0
+	hasFlags := false
 	for _, statement := range s.Statements {
 		switch statement.Name {
 		case "name":
@@ -141,23 +422,51 @@ func convertSegmentAst(s *SegmentAst) (*Segment, error) {
 			} else if statement.Value.MaxSegment != nil {
 				seg.Positioning.AfterMaxSegment = [2]string{statement.Value.MaxSegment.First, statement.Value.MaxSegment.Second}
 			} else {
-				return nil, errors.New("No value found in 'after' statement")
+				return seg, errors.New("No value found in 'after' statement")
 			}
 			break
 		case "include":
-			// Hacky way of moving $(var) -> $var
-			replaced := strings.Replace(statement.Value.String, "$(", "$", -1)
-			replaced = strings.Replace(replaced, ")", "", -1)
-			replaced = filepath.Clean(os.ExpandEnv(replaced))
+			replaced, err := expandPath(statement.Value.String, opts.strictEnv)
+			if err != nil {
+				return seg, err
+			}
 			seg.Includes = append(seg.Includes, replaced)
+			if err := setIncludeAlign(seg, replaced, statement.IncludeAlign); err != nil {
+				return seg, err
+			}
 			break
 		case "maxsize":
 			seg.MaxSize = statement.Value.Int
 			break
 		case "align":
-			seg.Align = statement.Value.Int
+			if err := setAlign(seg, statement.Value.Int); err != nil {
+				return seg, err
+			}
+			break
+		case "alignshift":
+			if statement.Value.Int >= 32 {
+				return seg, errors.New(fmt.Sprintf("Alignment shift %d of segment %s is too large.", statement.Value.Int, seg.Name))
+			}
+			seg.Align = 1 << statement.Value.Int
+			break
+		case "romoffset":
+			if statement.Value.Int < n64rom.CodeStart && !opts.allowHeaderOverlap {
+				return seg, errors.New(fmt.Sprintf("ROM offset 0x%x of segment %s would overwrite the header and bootcode.", statement.Value.Int, seg.Name))
+			}
+			seg.RomOffset = statement.Value.Int
+			break
+		case "prefix":
+			prefix := statement.Value.String
+			if c := statement.Value.ConstantValue; c != nil && c.Rhs == nil {
+				prefix = c.Lhs.Symbol
+			}
+			if !isSymbolPrefix(prefix) {
+				return seg, errors.New(fmt.Sprintf("Prefix of segment %s must be a symbol, such as foo_.", seg.Name))
+			}
+			seg.SymbolPrefix = prefix
 			break
 		case "flags":
+			hasFlags = true
 			for _, f := range statement.Value.Flags {
 				if f.Boot {
 					seg.Flags.Boot = true
@@ -165,6 +474,10 @@ func convertSegmentAst(s *SegmentAst) (*Segment, error) {
 					seg.Flags.Object = true
 				} else if f.Raw {
 					seg.Flags.Raw = true
+				} else if f.NoLoad {
+					seg.Flags.NoLoad = true
+				} else if f.Reloc {
+					seg.Flags.Reloc = true
 				}
 			}
 			break
@@ -174,46 +487,140 @@ func convertSegmentAst(s *SegmentAst) (*Segment, error) {
 			// All that matters for code is the rom address.
 			break
 		case "entry":
-			seg.Entry = &statement.Value.ConstantValue.Lhs.Symbol
+			// A number is parsed as Value.Int, leaving no ConstantValue.
+			c := statement.Value.ConstantValue
+			if c == nil || c.Rhs != nil || c.Lhs.Symbol == "" {
+				return seg, errors.New(fmt.Sprintf("Entry point of segment %s must be a symbol, such as boot.", seg.Name))
+			}
+			entry := c.Lhs.Symbol
+			if seg.Entry == nil {
+				seg.Entry = &entry
+			}
+			entryPointAt(seg, entries).Entry = entry
+			entries++
 			break
 		case "stack":
-			seg.StackInfo = &StackInfo{}
-			if statement.Value.ConstantValue.Lhs.Symbol != "" {
-				seg.StackInfo.Start = statement.Value.ConstantValue.Lhs.Symbol
+			stack := &StackInfo{}
+			if c := statement.Value.ConstantValue; c != nil {
+				if c.Lhs.Symbol != "" {
+					stack.Start = c.Lhs.Symbol
+				} else {
+					stack.Start = fmt.Sprintf("0x%x", c.Lhs.Int)
+				}
+				if c.Rhs != nil && c.Rhs.Int != 0 {
+					stack.Offset = c.Rhs.Int
+				}
+			} else if statement.Value.String == "" && statement.Value.Flags == nil && statement.Value.MaxSegment == nil && statement.Value.MinSegment == nil {
+				// A number on its own is parsed as Value.Int.
+				stack.Start = fmt.Sprintf("0x%x", statement.Value.Int)
 			} else {
-				seg.StackInfo.Start = string(statement.Value.ConstantValue.Lhs.Int)
+				return seg, errors.New(fmt.Sprintf("Stack of segment %s must be a symbol or an address.", seg.Name))
 			}
-			if statement.Value.ConstantValue.Rhs.Int != 0 {
-				seg.StackInfo.Offset = statement.Value.ConstantValue.Rhs.Int
+			if seg.StackInfo == nil {
+				seg.StackInfo = stack
 			}
+			entryPointAt(seg, stacks).Stack = stack
+			stacks++
 			break
 		default:
-			return nil, errors.New(fmt.Sprintf("Unknown name %s", statement.Name))
+			return seg, errors.New(fmt.Sprintf("Unknown name %s", statement.Name))
+		}
+	}
+	if !isASCII(seg.Name) {
+		seg.MangledName = MangleSymbol(seg.Name)
+		log.Warnf("Segment name %s is not ASCII; it is called %s in the linker script.", seg.Name, seg.MangledName)
+	}
+	if len(seg.IncludeAlign) > 0 && !seg.Flags.Raw {
+		return seg, errors.New(fmt.Sprintf("Include alignment in segment %s is only supported for RAW segments.", seg.Name))
+	}
+	if hasFlags {
+		if err := checkFlags(seg); err != nil {
+			return seg, err
 		}
 	}
 	return seg, nil
 }
 
-func convertWaveAst(s *WaveAst, segments map[string]*Segment) (*Wave, error) {
+// isSymbolPrefix reports whether s can start a C symbol name.
+func isSymbolPrefix(s string) bool {
+	if s == "" || (s[0] >= '0' && s[0] <= '9') {
+		return false
+	}
+	for _, c := range s {
+		if !(c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9')) {
+			return false
+		}
+	}
+	return true
+}
+
+// setAlign sets the ROM alignment of seg, which must be a power of two.
+func setAlign(seg *Segment, align uint64) error {
+	if align == 0 || align&(align-1) != 0 {
+		return errors.New(fmt.Sprintf("Alignment 0x%x of segment %s is not a power of two.", align, seg.Name))
+	}
+	seg.Align = align
+	return nil
+}
+
+// setIncludeAlign records the alignment a gives include within seg, if a
+// is set.
+func setIncludeAlign(seg *Segment, include string, a *IncludeAlignAst) error {
+	if a == nil {
+		return nil
+	}
+	if a.Value == 0 || a.Value&(a.Value-1) != 0 {
+		return errors.New(fmt.Sprintf("Alignment 0x%x of include %s is not a power of two.", a.Value, include))
+	}
+	if seg.IncludeAlign == nil {
+		seg.IncludeAlign = map[string]uint64{}
+	}
+	seg.IncludeAlign[include] = a.Value
+	return nil
+}
+
+// entryPointAt returns seg's ith entry point, adding it if needed.
+func entryPointAt(seg *Segment, i int) *EntryPoint {
+	for len(seg.Entries) <= i {
+		seg.Entries = append(seg.Entries, EntryPoint{})
+	}
+	return &seg.Entries[i]
+}
+
+func convertWaveAst(s *WaveAst, segments map[string]*Segment) (*Wave, []error) {
 	out := &Wave{}
+	var errs []error
 	for _, statement := range s.Statements {
+		if statement.IncludeAlign != nil {
+			return nil, []error{fmt.Errorf("Segment %s is included in a wave with an alignment, which only includes in RAW segments can have.", statement.Value.String)}
+		}
 		switch statement.Name {
 		case "name":
 			out.Name = statement.Value.String
 			break
+		case "fill":
+			if statement.Value.Int > 0xff {
+				errs = append(errs, fmt.Errorf("Fill byte 0x%x of wave %s does not fit in a byte.", statement.Value.Int, out.Name))
+				break
+			}
+			fill := byte(statement.Value.Int)
+			out.Fill = &fill
+			break
 		case "include":
-			seg := segments[statement.Value.String]
-			if seg.Flags.Object {
+			seg, ok := segments[statement.Value.String]
+			if !ok {
+				errs = append(errs, fmt.Errorf("Unknown segment %s included in wave.", statement.Value.String))
+			} else if seg.Flags.Object {
 				out.ObjectSegments = append(out.ObjectSegments, seg)
 			} else if seg.Flags.Raw {
 				out.RawSegments = append(out.RawSegments, seg)
 			}
 			break
 		default:
-			return nil, errors.New(fmt.Sprintf("Unknown name %s", statement.Name))
+			return nil, []error{errors.New(fmt.Sprintf("Unknown name %s", statement.Name))}
 		}
 	}
-	return out, nil
+	return out, errs
 }
 
 func (w *Wave) updateWithConstants() {
@@ -224,101 +631,729 @@ func (w *Wave) updateWithConstants() {
 	}
 }
 
-func convertAstToSpec(s SpecAst) (*Spec, error) {
+// allocateStack gives the entry points of w's boot segment that have no
+// stack a NOLOAD segment of size bytes to use as one, placed after the
+// wave's other object segments. Nothing is done if size is zero.
+func (w *Wave) allocateStack(size uint64) error {
+	boot := w.GetBootSegment()
+	if boot == nil || size == 0 {
+		return nil
+	}
+	var missing []*EntryPoint
+	for i := range boot.Entries {
+		if boot.Entries[i].Entry != "" && boot.Entries[i].Stack == nil {
+			missing = append(missing, &boot.Entries[i])
+		}
+	}
+	if len(missing) == 0 {
+		return nil
+	}
+	name := boot.Name + "Stack"
+	for _, seg := range append(append([]*Segment{}, w.ObjectSegments...), w.RawSegments...) {
+		if seg.Name == name {
+			return errors.New(fmt.Sprintf("Segment %s is already defined, so cannot be used as the default stack of wave %s.", name, w.Name))
+		}
+	}
+	stackSeg := &Segment{
+		Span:         boot.Span,
+		Name:         name,
+		Flags:        Flags{Object: true, NoLoad: true},
+		Positioning:  Positioning{AfterSegment: w.ObjectSegments[len(w.ObjectSegments)-1].Name},
+		Reserve:      size,
+		SymbolFormat: boot.SymbolFormat,
+	}
+	// The stack grows down from the end of the segment.
+	stack := &StackInfo{Start: stackSeg.BoundarySymbol("BssEnd")}
+	for _, e := range missing {
+		e.Stack = stack
+	}
+	if boot.StackInfo == nil {
+		boot.StackInfo = stack
+	}
+	log.Infof("Allocated a 0x%x byte stack for wave %s in segment %s.", size, w.Name, name)
+	w.ObjectSegments = append(w.ObjectSegments, stackSeg)
+	return nil
+}
+
+// convertAstToSpec converts the AST, collecting every error found along the
+// way. The returned list is ordered as the errors appear in the spec, each
+// error located at the start of the directive, segment or wave it is in.
+func convertAstToSpec(s SpecAst, sources []sourceLine, opts parseOptions) (*Spec, ParseErrorList) {
 	out := &Spec{}
+	var errs ParseErrorList
+	add := func(pos lexer.Position, found ...error) {
+		for _, err := range found {
+			errs = append(errs, locateError(err, pos, sources))
+		}
+	}
+	var directives []*DirectiveAst
+	var segmentAsts []*SegmentAst
+	var waveAsts []*WaveAst
+	for _, item := range s.Items {
+		switch {
+		case item.Directive != nil:
+			directives = append(directives, item.Directive)
+		case item.Segment != nil:
+			segmentAsts = append(segmentAsts, item.Segment)
+		case item.Wave != nil:
+			waveAsts = append(waveAsts, item.Wave)
+		}
+	}
+	for _, d := range directives {
+		switch d.Name {
+		case "romsize":
+			if out.RomSize != 0 && out.RomSize != int(d.Value) {
+				add(d.Pos, fmt.Errorf("romsize is set to both %d and %d.", out.RomSize, d.Value))
+				continue
+			}
+			out.RomSize = int(d.Value)
+		case "fill":
+			if d.Value > 0xff {
+				add(d.Pos, fmt.Errorf("Fill byte 0x%x does not fit in a byte.", d.Value))
+				continue
+			}
+			if out.Fill != nil && *out.Fill != byte(d.Value) {
+				add(d.Pos, fmt.Errorf("fill is set to both 0x%x and 0x%x.", *out.Fill, d.Value))
+				continue
+			}
+			fill := byte(d.Value)
+			out.Fill = &fill
+		}
+	}
 	segments := map[string]*Segment{}
-	for _, segAst := range s.Segments {
-		seg, err := convertSegmentAst(segAst)
+	var ordered []*Segment
+	for _, segAst := range segmentAsts {
+		seg, err := convertSegmentAst(segAst, opts)
 		if err != nil {
-			return nil, err
+			add(segAst.Pos, err)
+		}
+		seg.Span = originalSpan(segAst.Pos, segAst.End.Pos, segAst.End.Keyword, sources)
+		if first, ok := segments[seg.Name]; ok {
+			add(segAst.Pos, fmt.Errorf("Segment %s was already defined at %s:%d.", seg.Name, first.Span.Filename, first.Span.StartLine))
+			continue
 		}
 		segments[seg.Name] = seg
+		ordered = append(ordered, seg)
 	}
-	for _, waveAst := range s.Waves {
-		wave, err := convertWaveAst(waveAst, segments)
-		if err != nil {
-			return nil, err
+	for _, waveAst := range waveAsts {
+		wave, waveErrs := convertWaveAst(waveAst, segments)
+		add(waveAst.Pos, waveErrs...)
+		if wave == nil {
+			continue
 		}
+		wave.Span = originalSpan(waveAst.Pos, waveAst.End.Pos, waveAst.End.Keyword, sources)
+		add(waveAst.Pos, checkDuplicateIncludes(wave, opts.strict)...)
 		wave.updateWithConstants()
-		err = wave.checkValidity()
-		if err != nil {
-			return nil, err
+		if err := wave.allocateStack(opts.defaultStackSize); err != nil {
+			add(waveAst.Pos, err)
 		}
+		add(waveAst.Pos, wave.checkValidity()...)
 		out.Waves = append(out.Waves, wave)
 	}
 
-	return out, nil
+	return out, errs
+}
+
+// checkDuplicateIncludes warns about every object included by more than one
+// OBJECT segment of w, whose symbols would then be defined more than once
+// when w is linked. Segments of other waves are linked apart and may share
+// objects freely. Under strict, each is an error instead.
+func checkDuplicateIncludes(w *Wave, strict bool) []error {
+	var objects []string
+	includedBy := map[string][]string{}
+	for _, seg := range w.ObjectSegments {
+		seen := map[string]bool{}
+		for _, include := range seg.Includes {
+			path := filepath.Clean(include)
+			if seen[path] {
+				continue
+			}
+			seen[path] = true
+			if includedBy[path] == nil {
+				objects = append(objects, path)
+			}
+			includedBy[path] = append(includedBy[path], seg.Name)
+		}
+	}
+	var errs []error
+	for _, path := range objects {
+		names := includedBy[path]
+		if len(names) < 2 {
+			continue
+		}
+		if strict {
+			errs = append(errs, fmt.Errorf("Object %s is included by more than one segment of wave %s: %s.", path, w.Name, strings.Join(names, ", ")))
+			continue
+		}
+		log.Warnf("Object %s is included by more than one segment of wave %s, %s; its symbols will be defined more than once.", path, w.Name, strings.Join(names, ", "))
+	}
+	return errs
 }
 
 func PreprocessSpec(file io.Reader, gcc Runner, includeFlags []string, defineFlags []string, undefineFlags []string) (io.Reader, error) {
-	args := []string{"-P", "-E", "-U_LANGUAGE_C", "-D_LANGUAGE_MAKEROM", "-"}
+	return preprocessSpec(file, gcc, cppFlags(includeFlags, nil, nil, defineFlags, undefineFlags, "", nil))
+}
+
+// cppFlags returns the flags that find a spec's headers and define its
+// macros: includeFlags as -I, quoteIncludes for quoted includes only, as
+// -iquote does, systemIncludes as system directories, as -isystem does,
+// the defines and undefines, sysroot if it is set and then extraArgs as
+// they are.
+func cppFlags(includeFlags []string, quoteIncludes []string, systemIncludes []string, defineFlags []string, undefineFlags []string, sysroot string, extraArgs []string) []string {
+	var args []string
 	for _, include := range includeFlags {
 		args = append(args, fmt.Sprintf("-I%s", include))
 	}
+	for _, include := range quoteIncludes {
+		args = append(args, "-iquote", include)
+	}
+	for _, include := range systemIncludes {
+		args = append(args, "-isystem", include)
+	}
 	for _, define := range defineFlags {
 		args = append(args, fmt.Sprintf("-D%s", define))
 	}
 	for _, undefine := range undefineFlags {
 		args = append(args, fmt.Sprintf("-U%s", undefine))
 	}
+	if sysroot != "" {
+		args = append(args, "--sysroot="+sysroot)
+	}
+	return append(args, extraArgs...)
+}
+
+// preprocessSpec runs file through cpp with flags, as cppFlags gives them.
+func preprocessSpec(file io.Reader, gcc Runner, flags []string) (io.Reader, error) {
+	// Linemarkers are kept so that ParseSpec can report errors against the
+	// original files, including any #included fragments.
+	args := append([]string{"-E", "-U_LANGUAGE_C", "-D_LANGUAGE_MAKEROM", "-"}, flags...)
 
+	stageDebugf("preprocess", "Preprocessing spec with %v", args)
 	return gcc.Run(file, args)
 }
 
-func ParseSpec(r io.Reader) (*Spec, error) {
+// Dependencies returns every file spec #includes, directly or not, as cpp
+// finds them. System headers are left out.
+func Dependencies(spec io.Reader, gcc Runner, includeFlags []string, defineFlags []string) ([]string, error) {
+	return dependencies(spec, gcc, cppFlags(includeFlags, nil, nil, defineFlags, nil, "", nil))
+}
+
+// dependencies is Dependencies with every cpp flag, as cppFlags gives them,
+// so that headers are found as preprocessSpec finds them.
+func dependencies(spec io.Reader, gcc Runner, flags []string) ([]string, error) {
+	args := append([]string{"-E", "-MM", "-U_LANGUAGE_C", "-D_LANGUAGE_MAKEROM", "-"}, flags...)
+	out, err := gcc.Run(spec, args)
+	if err != nil {
+		return nil, err
+	}
+	b, err := ioutil.ReadAll(out)
+	if err != nil {
+		return nil, err
+	}
+	return parseMakeRule(string(b)), nil
+}
+
+// parseMakeRule returns the prerequisites of the make rule cpp -M writes.
+func parseMakeRule(rule string) []string {
+	rule = strings.Replace(rule, "\\\n", " ", -1)
+	if i := strings.Index(rule, ": "); i >= 0 {
+		rule = rule[i+2:]
+	}
+	// Spaces in paths are escaped with a backslash.
+	rule = strings.Replace(rule, "\\ ", "\x00", -1)
+	var deps []string
+	for _, field := range strings.Fields(rule) {
+		deps = append(deps, strings.Replace(field, "\x00", " ", -1))
+	}
+	return deps
+}
+
+// SpecError is an error at a location in the original, unpreprocessed spec.
+type SpecError struct {
+	Filename string
+	Line     int
+	Column   int
+	Message  string
+	// Explanation, if set, shows the line of the original spec next to what
+	// cpp expanded it to.
+	Explanation string
+}
+
+func (e *SpecError) Error() string {
+	msg := fmt.Sprintf("%s:%d:%d: %s", e.Filename, e.Line, e.Column, e.Message)
+	if e.Explanation != "" {
+		msg += "\n" + e.Explanation
+	}
+	return msg
+}
+
+// sourceLine is the original location of a line of preprocessed spec.
+type sourceLine struct {
+	filename string
+	line     int
+}
+
+// stripLinemarkers blanks out the linemarkers cpp leaves in its output, so
+// line numbers in the result are unchanged, and returns the original
+// location of every line. Lines before any marker are attributed to filename.
+func stripLinemarkers(b []byte, filename string) ([]byte, []sourceLine) {
+	lines := strings.Split(string(b), "\n")
+	sources := make([]sourceLine, len(lines))
+	current := sourceLine{filename: filename, line: 1}
+	for i, line := range lines {
+		sources[i] = current
+		current.line++
+		trimmed := strings.TrimSpace(line)
+		if !strings.HasPrefix(trimmed, "#") {
+			continue
+		}
+		fields := strings.Fields(strings.TrimPrefix(strings.TrimPrefix(trimmed, "#"), "line"))
+		if len(fields) == 0 {
+			continue
+		}
+		n, err := strconv.Atoi(fields[0])
+		if err != nil {
+			continue
+		}
+		current.line = n
+		if len(fields) > 1 {
+			name, err := strconv.Unquote(fields[1])
+			if err == nil {
+				if name == "<stdin>" {
+					name = filename
+				}
+				current.filename = name
+			}
+		}
+		lines[i] = ""
+	}
+	return []byte(strings.Join(lines, "\n")), sources
+}
+
+// sourceFiles returns each distinct file in sources, in the order first seen.
+// cpp's pseudo-files, like <built-in>, are left out.
+func sourceFiles(sources []sourceLine) []string {
+	var files []string
+	seen := map[string]bool{}
+	for _, source := range sources {
+		if seen[source.filename] || strings.HasPrefix(source.filename, "<") {
+			continue
+		}
+		seen[source.filename] = true
+		files = append(files, source.filename)
+	}
+	return files
+}
+
+// relabelStdin rewrites the linemarkers cpp emits for a spec read from
+// standard input to name filename instead.
+func relabelStdin(b []byte, filename string) []byte {
+	lines := strings.Split(string(b), "\n")
+	for i, line := range lines {
+		if strings.HasPrefix(strings.TrimSpace(line), "#") {
+			lines[i] = strings.Replace(line, `"<stdin>"`, strconv.Quote(filename), 1)
+		}
+	}
+	return []byte(strings.Join(lines, "\n"))
+}
+
+// originalSpan maps the positions of a block's first and last keywords back
+// to the original spec.
+func originalSpan(start lexer.Position, end lexer.Position, endKeyword string, sources []sourceLine) Span {
+	lookup := func(line int) sourceLine {
+		if line < 1 || line > len(sources) {
+			return sourceLine{line: line}
+		}
+		return sources[line-1]
+	}
+	startSource := lookup(start.Line)
+	return Span{
+		Filename:  startSource.filename,
+		StartLine: startSource.line,
+		StartCol:  start.Column,
+		EndLine:   lookup(end.Line).line,
+		EndCol:    end.Column + len(endKeyword),
+	}
+}
+
+// specKeywords lists every keyword the grammar accepts, for suggestions.
+var specKeywords = []string{
+	"beginseg", "endseg", "beginwave", "endwave",
+	"name", "address", "after", "include", "maxsize", "align", "flags", "number", "entry", "stack", "romoffset", "alignshift",
+	"prefix", "romsize", "fill",
+}
+
+func levenshtein(a, b string) int {
+	prev := make([]int, len(b)+1)
+	cur := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = prev[j] + 1
+			if cur[j-1]+1 < cur[j] {
+				cur[j] = cur[j-1] + 1
+			}
+			if prev[j-1]+cost < cur[j] {
+				cur[j] = prev[j-1] + cost
+			}
+		}
+		prev, cur = cur, prev
+	}
+	return prev[len(b)]
+}
+
+// suggestKeyword returns the known keyword closest to word, if any is close
+// enough to plausibly be what was meant.
+func suggestKeyword(word string) string {
+	return closestKeyword(word, specKeywords)
+}
+
+// topLevelKeywords are the keywords a top-level item of a spec begins with.
+var topLevelKeywords = []string{"beginseg", "beginwave", "romsize", "fill"}
+
+// closestKeyword returns the one of keywords closest to word, if any is
+// close enough to plausibly be what was meant.
+func closestKeyword(word string, keywords []string) string {
+	best, bestDistance := "", len(word)/2+1
+	for _, keyword := range keywords {
+		if d := levenshtein(word, keyword); d < bestDistance {
+			best, bestDistance = keyword, d
+		}
+	}
+	return best
+}
+
+// explainLine shows the line source refers to, read from the original file,
+// above the line of preprocessed spec it became.
+func explainLine(source sourceLine, expanded string) string {
+	original := "(not available)"
+	if b, err := ioutil.ReadFile(source.filename); err == nil {
+		if lines := strings.Split(string(b), "\n"); source.line >= 1 && source.line <= len(lines) {
+			original = strings.TrimRight(lines[source.line-1], "\r")
+		}
+	}
+	return fmt.Sprintf("  original: %s\n  expanded: %s", original, expanded)
+}
+
+// toSpecError maps the position of a parser error back to the original spec.
+// Under strict, an unexpected identifier is reported as an unknown keyword.
+// With explain, the failing line is shown before and after preprocessing,
+// expanded being the spec the parser was given.
+func toSpecError(err error, sources []sourceLine, strict bool, explain bool, expanded []byte) error {
+	perr, ok := err.(participle.Error)
+	if !ok {
+		return err
+	}
+	pos := perr.Token().Pos
+	if pos.Line < 1 || pos.Line > len(sources) {
+		return err
+	}
+	source := sources[pos.Line-1]
+	message := perr.Message()
+	if tok := perr.Token(); strict && tok.Type == scanner.Ident {
+		message = fmt.Sprintf("unknown keyword '%s' at line %d", tok.Value, source.line)
+		if suggestion := suggestKeyword(tok.Value); suggestion != "" {
+			message += fmt.Sprintf("; did you mean '%s'?", suggestion)
+		}
+	}
+	specErr := &SpecError{Filename: source.filename, Line: source.line, Column: pos.Column, Message: message}
+	if lines := strings.Split(string(expanded), "\n"); explain && pos.Line <= len(lines) {
+		specErr.Explanation = explainLine(source, lines[pos.Line-1])
+	}
+	return specErr
+}
+
+// locateError reports err, found in the item of the spec starting at pos,
+// as a SpecError at that item's location in the original files. Errors that
+// are already located are returned as they are.
+func locateError(err error, pos lexer.Position, sources []sourceLine) error {
+	if _, ok := err.(*SpecError); ok || pos.Line < 1 || pos.Line > len(sources) {
+		return err
+	}
+	source := sources[pos.Line-1]
+	return &SpecError{Filename: source.filename, Line: source.line, Column: pos.Column, Message: err.Error()}
+}
+
+// trailingContentError returns a parse error for the token err stopped at
+// if everything before it parses as a spec and the token cannot begin
+// another top-level item, nor is a misspelling of a keyword that would, so
+// that stray content between or after items is reported as such rather than
+// as the start of a bad segment or wave. It returns nil for any other parse
+// error, which is left to toSpecError.
+func trailingContentError(parser *participle.Parser, b []byte, err error, sources []sourceLine) error {
+	perr, ok := err.(participle.Error)
+	if !ok {
+		return nil
+	}
+	tok := perr.Token()
+	pos := tok.Pos
+	if tok.EOF() || pos.Offset <= 0 || pos.Offset > len(b) || pos.Line < 1 || pos.Line > len(sources) {
+		return nil
+	}
+	if tok.Type == scanner.Ident && closestKeyword(tok.Value, topLevelKeywords) != "" {
+		return nil
+	}
+	prefix := &SpecAst{}
+	if parser.ParseBytes(b[:pos.Offset], prefix) != nil || len(prefix.Items) == 0 {
+		return nil
+	}
+	var after string
+	var end lexer.Position
+	switch last := prefix.Items[len(prefix.Items)-1]; {
+	case last.Segment != nil:
+		after, end = "endseg", last.Segment.End.Pos
+	case last.Wave != nil:
+		after, end = "endwave", last.Wave.End.Pos
+	default:
+		after, end = last.Directive.Name+" directive", last.Directive.Pos
+	}
+	if end.Line >= 1 && end.Line <= len(sources) {
+		after += fmt.Sprintf(" on line %d", sources[end.Line-1].line)
+	}
+	return lexer.ErrorWithTokenf(tok, "unexpected %q after the %s; only beginseg, beginwave, romsize, fill or comments may follow it", tok.Value, after)
+}
+
+// ParseErrorList holds every error found in the segments and waves of a
+// spec in aggregate mode.
+type ParseErrorList []error
+
+func (l ParseErrorList) Error() string {
+	msgs := make([]string, len(l))
+	for i, err := range l {
+		msgs[i] = err.Error()
+	}
+	return strings.Join(msgs, "\n")
+}
+
+type parseOptions struct {
+	aggregateErrors    bool
+	strictEnv          bool
+	filename           string
+	strict             bool
+	notPreprocessed    bool
+	hashLines          HashLines
+	defaultStackSize   uint64
+	explainPreprocess  bool
+	symbolFormat       string
+	allowHeaderOverlap bool
+}
+
+// HashLines selects what ParseSpec does with lines starting with '#', other
+// than linemarkers, in a spec that was not preprocessed.
+type HashLines int
+
+const (
+	// HashLinesError reports them, as they are most likely cpp directives.
+	HashLinesError HashLines = iota
+	// HashLinesComment ignores them.
+	HashLinesComment
+)
+
+// ParseOption configures the behaviour of ParseSpec.
+type ParseOption func(*parseOptions)
+
+// AggregateErrors makes ParseSpec report every error in the segments and
+// waves of a spec as a ParseErrorList, rather than stopping at the first
+// one. A syntax error still stops parsing on its own, as nothing after it
+// can be read.
+func AggregateErrors() ParseOption {
+	return func(o *parseOptions) {
+		o.aggregateErrors = true
+	}
+}
+
+// StrictEnv makes ParseSpec fail when an include path references an unset
+// environment variable, instead of expanding it to the empty string.
+func StrictEnv() ParseOption {
+	return func(o *parseOptions) {
+		o.strictEnv = true
+	}
+}
+
+// Strict reports unexpected words in the spec as unknown keywords, with a
+// suggestion of the keyword that was probably meant.
+func Strict() ParseOption {
+	return func(o *parseOptions) {
+		o.strict = true
+	}
+}
+
+// DefaultStackSize gives boot segment entry points declared without a stack
+// one of size bytes, in a NOLOAD segment named after the boot segment with
+// a Stack suffix.
+func DefaultStackSize(size uint64) ParseOption {
+	return func(o *parseOptions) {
+		o.defaultStackSize = size
+	}
+}
+
+// AllowHeaderOverlap accepts a romoffset within the header and bootcode,
+// for builds run with BuildOptions.AllowHeaderOverlap.
+func AllowHeaderOverlap() ParseOption {
+	return func(o *parseOptions) {
+		o.allowHeaderOverlap = true
+	}
+}
+
+// ExplainPreprocess makes a syntax error in the spec show the line it is on
+// as written, read from the file a linemarker names, and as cpp expanded
+// it, for finding macros that expand to something unexpected.
+func ExplainPreprocess() ParseOption {
+	return func(o *parseOptions) {
+		o.explainPreprocess = true
+	}
+}
+
+// SymbolFormat names the boundary symbols of every segment after format,
+// which must pass CheckSymbolFormat.
+func SymbolFormat(format string) ParseOption {
+	return func(o *parseOptions) {
+		o.symbolFormat = format
+	}
+}
+
+// Filename names the spec being parsed in error messages. Input read by cpp
+// from stdin is attributed to this name as well.
+func Filename(name string) ParseOption {
+	return func(o *parseOptions) {
+		o.filename = name
+	}
+}
+
+// NotPreprocessed tells ParseSpec that the spec has not been through cpp,
+// so any '#' lines in it are handled according to mode.
+func NotPreprocessed(mode HashLines) ParseOption {
+	return func(o *parseOptions) {
+		o.notPreprocessed = true
+		o.hashLines = mode
+	}
+}
+
+// checkHashLines applies mode to the '#' lines stripLinemarkers left in b.
+func checkHashLines(b []byte, sources []sourceLine, mode HashLines) ([]byte, error) {
+	lines := strings.Split(string(b), "\n")
+	for i, line := range lines {
+		trimmed := strings.TrimSpace(line)
+		if !strings.HasPrefix(trimmed, "#") {
+			continue
+		}
+		if mode == HashLinesError {
+			return nil, &SpecError{
+				Filename: sources[i].filename,
+				Line:     sources[i].line,
+				Column:   strings.Index(line, "#") + 1,
+				Message:  fmt.Sprintf("%q needs the spec to be preprocessed", trimmed),
+			}
+		}
+		lines[i] = ""
+	}
+	return []byte(strings.Join(lines, "\n")), nil
+}
+
+func ParseSpec(r io.Reader, options ...ParseOption) (*Spec, error) {
+	opts := parseOptions{filename: "<spec>"}
+	for _, option := range options {
+		option(&opts)
+	}
 	log.Infof("Parsing spec")
+	if opts.symbolFormat != "" {
+		if err := CheckSymbolFormat(opts.symbolFormat); err != nil {
+			return nil, err
+		}
+	}
 	parser, err := participle.Build(&SpecAst{})
 	if err != nil {
 		return nil, err
 	}
 
-	specAst := &SpecAst{}
-	err = parser.Parse(r, specAst)
+	b, err := ioutil.ReadAll(r)
 	if err != nil {
 		return nil, err
 	}
-	out, err := convertAstToSpec(*specAst)
+	b, sources := stripLinemarkers(b, opts.filename)
+	if opts.notPreprocessed {
+		if b, err = checkHashLines(b, sources, opts.hashLines); err != nil {
+			return nil, err
+		}
+	}
+	specAst := &SpecAst{}
+	err = parser.ParseBytes(b, specAst)
 	if err != nil {
-		return nil, err
+		if trailing := trailingContentError(parser, b, err, sources); trailing != nil {
+			err = trailing
+		}
+		return nil, toSpecError(err, sources, opts.strict, opts.explainPreprocess, b)
 	}
-	log.Debugf("Parsed: %v", out)
+	out, errs := convertAstToSpec(*specAst, sources, opts)
+	if len(errs) > 0 {
+		if opts.aggregateErrors {
+			return nil, errs
+		}
+		return nil, errs[0]
+	}
+	out.Sources = sourceFiles(sources)
+	stageDebugf("parse", "Parsed: %v", out)
 	for _, w := range out.Waves {
 		w.correctOrdering()
 	}
-	return out, err
+	return out, nil
 }
 
-func (w *Wave) checkValidity() error {
-	for _, seg := range w.ObjectSegments {
-		numSet := 0
-		if seg.Name == "" {
-			return errors.New("Name must be non-empty.")
-		}
-		if seg.Flags.Boot && seg.StackInfo == nil {
-			return errors.New("Boot segments must have stack info specified.")
-		}
-		if seg.Flags.Boot && seg.Entry == nil {
-			return errors.New("Boot segments must have entry point specified.")
-		}
-		if seg.Positioning.Address > 0 {
-			numSet++
-		}
-		if seg.Positioning.AfterSegment != "" {
-			numSet++
-		}
-		if seg.Positioning.AfterMinSegment[0] != "" {
-			numSet++
+func checkSegmentValidity(seg *Segment) error {
+	numSet := 0
+	if seg.Name == "" {
+		return errors.New("Name must be non-empty.")
+	}
+	if seg.Flags.Boot && seg.StackInfo == nil {
+		return errors.New("Boot segments must have stack info specified.")
+	}
+	if seg.Flags.Boot && seg.Entry == nil {
+		return errors.New("Boot segments must have entry point specified.")
+	}
+	for _, e := range seg.Entries {
+		if e.Entry == "" {
+			return errors.New(fmt.Sprintf("Stack at %s in segment %s has no entry point.", e.Stack.Start, seg.Name))
 		}
-		if seg.Positioning.AfterMaxSegment[0] != "" {
-			numSet++
+		if e.Stack == nil {
+			return errors.New(fmt.Sprintf("Entry point %s in segment %s has no stack.", e.Entry, seg.Name))
 		}
-		if numSet > 1 {
-			return errors.New(fmt.Sprintf("Too many addressing sections specified in segment %s.", seg.Name))
+	}
+	if seg.Positioning.Address > 0 {
+		numSet++
+	}
+	if seg.Positioning.AfterSegment != "" {
+		numSet++
+	}
+	if seg.Positioning.AfterMinSegment[0] != "" {
+		numSet++
+	}
+	if seg.Positioning.AfterMaxSegment[0] != "" {
+		numSet++
+	}
+	if numSet > 1 {
+		return errors.New(fmt.Sprintf("Too many addressing sections specified in segment %s.", seg.Name))
+	}
+	return nil
+}
+
+// checkValidity returns every problem found in the wave, one per segment.
+func (w *Wave) checkValidity() []error {
+	var errs []error
+	for _, seg := range w.ObjectSegments {
+		if err := checkSegmentValidity(seg); err != nil {
+			errs = append(errs, err)
 		}
 	}
 	// Per-spec checks
 	// Wave checks
-	return nil
+	return errs
 }
 
 func findElement(l *list.List, name string) *list.Element {
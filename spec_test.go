@@ -1,10 +1,15 @@
 package spicy
 
 import (
+	"errors"
+	"io/ioutil"
 	"os"
+	"os/exec"
+	"path/filepath"
 	"strings"
 	"testing"
 
+	log "github.com/sirupsen/logrus"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -64,3 +69,497 @@ endwave
 	assert.Equal("some/file", spec.Waves[0].ObjectSegments[0].Includes[0])
 	assert.Equal("parent/some/file", spec.Waves[0].ObjectSegments[0].Includes[1])
 }
+
+func TestParsingAggregatesErrors(t *testing.T) {
+	assert := assert.New(t)
+	specStr := `
+beginseg
+  name "boot"
+  flags BOOT OBJECT
+  entry boot
+endseg
+beginseg
+  name "obj"
+  flags OBJECT
+  address 0x80000400
+  after "boot"
+endseg
+beginwave
+  name "wave"
+  include "boot"
+  include "obj"
+  include "missing"
+endwave
+`
+	_, err := ParseSpec(strings.NewReader(specStr))
+	assert.NotNil(err)
+	_, isList := err.(ParseErrorList)
+	assert.False(isList)
+
+	_, err = ParseSpec(strings.NewReader(specStr), AggregateErrors())
+	errs, isList := err.(ParseErrorList)
+	assert.True(isList)
+	assert.Equal(3, len(errs))
+	assert.Contains(err.Error(), "Unknown segment missing")
+	assert.Contains(err.Error(), "stack info")
+	assert.Contains(err.Error(), "Too many addressing sections specified in segment obj")
+}
+
+func TestParsingIncludesWithEnvironmentVariable(t *testing.T) {
+	assert := assert.New(t)
+	dir := t.TempDir()
+	assert.Nil(ioutil.WriteFile(filepath.Join(dir, "level1.bin"), []byte{1, 2, 3, 4}, 0644))
+	os.Setenv("ASSET_DIR", dir)
+	os.Unsetenv("UNSET_ASSET_DIR")
+	specStr := `
+beginseg
+  name "level1"
+  flags RAW
+  include "$ASSET_DIR/level1.bin"
+endseg
+beginwave
+  name "wave"
+  include "level1"
+endwave
+`
+	spec, err := ParseSpec(strings.NewReader(specStr), StrictEnv())
+	assert.Nil(err)
+	include := spec.Waves[0].RawSegments[0].Includes[0]
+	assert.Equal(filepath.Join(dir, "level1.bin"), include)
+	_, err = os.Stat(include)
+	assert.Nil(err)
+
+	unset := strings.Replace(specStr, "$ASSET_DIR", "$UNSET_ASSET_DIR", 1)
+	_, err = ParseSpec(strings.NewReader(unset))
+	assert.Nil(err)
+	_, err = ParseSpec(strings.NewReader(unset), StrictEnv())
+	assert.NotNil(err)
+	assert.Contains(err.Error(), "UNSET_ASSET_DIR")
+}
+
+func TestParsingReportsLinemarkerLocations(t *testing.T) {
+	assert := assert.New(t)
+	specStr := `# 1 "<stdin>"
+beginseg
+# 1 "segments.spec" 1
+  name "obj"
+  flags OBJECT
+  adress 0x80000400
+# 3 "<stdin>" 2
+endseg
+`
+	_, err := ParseSpec(strings.NewReader(specStr), Filename("game.spec"))
+	specErr, ok := err.(*SpecError)
+	assert.True(ok)
+	assert.Equal("segments.spec", specErr.Filename)
+	assert.Equal(3, specErr.Line)
+
+	// Errors found once the spec is parsed are located at the start of the
+	// segment or wave they are in.
+	specStr = `# 1 "<stdin>"
+beginwave
+  name "game"
+  include "obj"
+endwave
+# 1 "segments.spec" 1
+
+beginseg
+  name "obj"
+  flags RAW OBJECT
+endseg
+# 6 "<stdin>" 2
+`
+	_, err = ParseSpec(strings.NewReader(specStr), Filename("game.spec"), AggregateErrors())
+	list, ok := err.(ParseErrorList)
+	assert.True(ok)
+	assert.NotEmpty(list)
+	specErr, ok = list[0].(*SpecError)
+	assert.True(ok)
+	assert.Equal("segments.spec", specErr.Filename)
+	assert.Equal(2, specErr.Line)
+	assert.Contains(specErr.Message, "not a valid combination")
+}
+
+func TestParsingIncludedFragments(t *testing.T) {
+	if _, err := exec.LookPath("gcc"); err != nil {
+		t.Skip("gcc not available")
+	}
+	assert := assert.New(t)
+	dir := t.TempDir()
+	fragments := map[string]string{
+		"code.spec": "beginseg\n  name \"code\"\n  flags OBJECT\n  address 0x80000400\nendseg\n",
+		"data.spec": "beginseg\n  name \"data\"\n  flags RAW\n  include \"data.bin\"\nendseg\n",
+		"wave.spec": "beginwave\n  name \"wave\"\n  include \"code\"\n  include \"data\"\nendwave\n",
+	}
+	for name, contents := range fragments {
+		assert.Nil(ioutil.WriteFile(filepath.Join(dir, name), []byte(contents), 0644))
+	}
+	gcc := NewRunner("gcc")
+	preprocess := func(specStr string) (*Spec, error) {
+		preprocessed, err := PreprocessSpec(strings.NewReader(specStr), gcc, []string{dir}, nil, nil)
+		assert.Nil(err)
+		return ParseSpec(preprocessed, Filename("game.spec"))
+	}
+
+	combined, err := preprocess(fragments["code.spec"] + fragments["data.spec"] + fragments["wave.spec"])
+	assert.Nil(err)
+	split, err := preprocess("#include \"code.spec\"\n#include \"data.spec\"\n#include \"wave.spec\"\n")
+	assert.Nil(err)
+	// Spans and sources legitimately differ, as they point into the fragments.
+	assert.Equal(filepath.Join(dir, "data.spec"), split.Waves[0].RawSegments[0].Span.Filename)
+	assert.Contains(split.Sources, filepath.Join(dir, "data.spec"))
+	for _, spec := range []*Spec{combined, split} {
+		spec.Sources = nil
+		for _, w := range spec.Waves {
+			w.Span = Span{}
+			for _, seg := range append(w.ObjectSegments, w.RawSegments...) {
+				seg.Span = Span{}
+			}
+		}
+	}
+	assert.Equal(combined, split)
+
+	broken := strings.Replace(fragments["data.spec"], "include", "inclde", 1)
+	assert.Nil(ioutil.WriteFile(filepath.Join(dir, "data.spec"), []byte(broken), 0644))
+	_, err = preprocess("#include \"code.spec\"\n#include \"data.spec\"\n#include \"wave.spec\"\n")
+	specErr, ok := err.(*SpecError)
+	assert.True(ok)
+	assert.Equal(filepath.Join(dir, "data.spec"), specErr.Filename)
+	assert.Equal(4, specErr.Line)
+}
+
+func TestExplainPreprocessShowsOriginalAndExpandedLines(t *testing.T) {
+	if _, err := exec.LookPath("gcc"); err != nil {
+		t.Skip("gcc not available")
+	}
+	assert := assert.New(t)
+	path := filepath.Join(t.TempDir(), "game.spec")
+	assert.Nil(ioutil.WriteFile(path, []byte(`#define PLACE(addr) adress addr
+beginseg
+  name "code"
+  flags OBJECT
+  PLACE(0x80000400)
+endseg
+`), 0644))
+	p := &Pipeline{Cpp: NewRunner("gcc"), ParseOptions: []ParseOption{ExplainPreprocess()}}
+	_, err := p.ParseFiles(path)
+	var specErr *SpecError
+	assert.True(errors.As(err, &specErr))
+	assert.Equal(path, specErr.Filename)
+	assert.Equal(5, specErr.Line)
+	assert.Equal("  original:   PLACE(0x80000400)\n  expanded:   adress 0x80000400", specErr.Explanation)
+	assert.Contains(err.Error(), specErr.Explanation)
+
+	p.ParseOptions = nil
+	_, err = p.ParseFiles(path)
+	assert.True(errors.As(err, &specErr))
+	assert.Equal("", specErr.Explanation)
+}
+
+func TestParsingRecordsSpans(t *testing.T) {
+	assert := assert.New(t)
+	specStr := `# 1 "<stdin>"
+beginseg
+  name "obj"
+  flags OBJECT
+endseg
+  beginwave
+    name "wave"
+    include "obj"
+  endwave
+`
+	spec, err := ParseSpec(strings.NewReader(specStr), Filename("game.spec"))
+	assert.Nil(err)
+	assert.Equal(Span{Filename: "game.spec", StartLine: 1, StartCol: 1, EndLine: 4, EndCol: 7}, spec.Waves[0].ObjectSegments[0].Span)
+	assert.Equal(Span{Filename: "game.spec", StartLine: 5, StartCol: 3, EndLine: 8, EndCol: 10}, spec.Waves[0].Span)
+}
+
+func TestStrictParsingSuggestsKeywords(t *testing.T) {
+	assert := assert.New(t)
+	specStr := `
+beginseg
+  name "obj"
+  adress 0x80000400
+endseg
+`
+	_, err := ParseSpec(strings.NewReader(specStr))
+	assert.NotContains(err.Error(), "did you mean")
+
+	_, err = ParseSpec(strings.NewReader(specStr), Strict())
+	assert.NotNil(err)
+	assert.Contains(err.Error(), "unknown keyword 'adress' at line 4; did you mean 'address'?")
+	assert.Equal("", suggestKeyword("frobnicate"))
+}
+
+func TestParsingNumericStackAndEntry(t *testing.T) {
+	assert := assert.New(t)
+	segment := func(entry, stack string) string {
+		return "beginseg\n  name \"code\"\n  flags BOOT OBJECT\n  entry " + entry + "\n  stack " + stack + "\n  include \"code.o\"\nendseg\nbeginwave\n  name \"game\"\n  include \"code\"\nendwave\n"
+	}
+	spec, err := ParseSpec(strings.NewReader(segment("boot", "0x80400000")))
+	assert.Nil(err)
+	seg := spec.Waves[0].ObjectSegments[0]
+	assert.Equal("0x80400000", seg.StackInfo.Start)
+	assert.Equal(uint64(0), seg.StackInfo.Offset)
+
+	_, err = ParseSpec(strings.NewReader(segment("0x80000400", "bootStack")))
+	assert.EqualError(err, "<spec>:1:1: Entry point of segment code must be a symbol, such as boot.")
+	_, err = ParseSpec(strings.NewReader(segment("\"boot\"", "bootStack")))
+	assert.NotNil(err)
+	_, err = ParseSpec(strings.NewReader(segment("boot", "\"bootStack\"")))
+	assert.EqualError(err, "<spec>:1:1: Stack of segment code must be a symbol or an address.")
+}
+
+func TestParsingRejectsContradictoryFlags(t *testing.T) {
+	assert := assert.New(t)
+	segment := func(flags string) string {
+		stack := ""
+		if strings.Contains(flags, "BOOT") {
+			stack = "  entry boot\n  stack bootStack\n"
+		}
+		return "beginseg\n  name \"seg\"\n  flags " + flags + "\n" + stack + "  include \"seg.o\"\nendseg\n"
+	}
+	for _, flags := range []string{"RAW OBJECT", "BOOT RAW", "RAW NOLOAD", "RAW RELOC", "BOOT NOLOAD", "NOLOAD RELOC"} {
+		_, err := ParseSpec(strings.NewReader(segment(flags)))
+		assert.NotNil(err, flags)
+		assert.Contains(err.Error(), "of segment seg are not a valid combination", flags)
+	}
+	_, err := ParseSpec(strings.NewReader(segment("BOOT NOLOAD")))
+	assert.Contains(err.Error(), "Flags BOOT NOLOAD of segment seg are not a valid combination: a BOOT segment must be loaded.")
+
+	// Flags that only apply to object segments make one without OBJECT.
+	for flags, want := range map[string]Flags{
+		"OBJECT NOLOAD": {Object: true, NoLoad: true},
+		"BOOT":          {Boot: true, Object: true},
+		"NOLOAD":        {Object: true, NoLoad: true},
+		"BOOT RELOC":    {Boot: true, Object: true, Reloc: true},
+	} {
+		spec, err := ParseSpec(strings.NewReader(segment(flags) + "beginwave\n  name \"wave\"\n  include \"seg\"\nendwave\n"))
+		if assert.Nil(err, flags) {
+			assert.Equal(want, spec.Waves[0].ObjectSegments[0].Flags, flags)
+		}
+	}
+}
+
+func TestDependenciesListsIncludedHeaders(t *testing.T) {
+	if _, err := exec.LookPath("gcc"); err != nil {
+		t.Skip("gcc not available")
+	}
+	assert := assert.New(t)
+	dir := t.TempDir()
+	header := filepath.Join(dir, "segments.h")
+	assert.Nil(ioutil.WriteFile(header, []byte("#define CODE_INCLUDE \"code.o\"\n"), 0644))
+	deps, err := Dependencies(strings.NewReader("#include \"segments.h\"\nbeginseg\n  name \"code\"\nendseg\n"), NewRunner("gcc"), []string{dir}, nil)
+	assert.Nil(err)
+	assert.Equal([]string{header}, deps)
+
+	assert.Equal([]string{"a.h", "dir with space/b.h"}, parseMakeRule("-: a.h \\\n dir\\ with\\ space/b.h\n"))
+}
+
+func TestParsingRejectsInvalidPrefix(t *testing.T) {
+	assert := assert.New(t)
+	_, err := ParseSpec(strings.NewReader(`
+beginseg
+  name "code"
+  flags OBJECT
+  prefix "1st-"
+endseg
+`))
+	assert.NotNil(err)
+	assert.Contains(err.Error(), "Prefix of segment code must be a symbol")
+}
+
+func TestMangleSymbol(t *testing.T) {
+	assert := assert.New(t)
+	assert.Equal("code", MangleSymbol("code"))
+	assert.Equal("_u30b3_u30fc_u30c9", MangleSymbol("コード"))
+	assert.Equal("caf_u00e9_u0020menu", MangleSymbol("café menu"))
+	assert.Equal("_2d", MangleSymbol("2d"))
+	assert.Equal(MangleSymbol("ステージ1"), MangleSymbol("ステージ1"))
+}
+
+func TestParsingNonAsciiSegmentNames(t *testing.T) {
+	assert := assert.New(t)
+	spec := `
+beginseg
+  name "コード"
+  flags BOOT OBJECT
+  entry boot
+  stack bootStack
+  include "code.o"
+endseg
+beginwave
+  name "game"
+  include "コード"
+endwave
+`
+	parsed, err := ParseSpec(strings.NewReader(spec))
+	assert.Nil(err)
+	seg := parsed.Waves[0].ObjectSegments[0]
+	assert.Equal("コード", seg.Name)
+	assert.Equal("_u30b3_u30fc_u30c9", seg.SymbolName())
+}
+
+func TestParsingRequiresStackWithoutDefaultStackSize(t *testing.T) {
+	assert := assert.New(t)
+	spec := `
+beginseg
+  name "code"
+  flags BOOT OBJECT
+  entry boot
+  include "code.o"
+endseg
+beginseg
+  name "codeStack"
+  flags OBJECT
+  include "stack.o"
+endseg
+beginwave
+  name "game"
+  include "code"
+  include "codeStack"
+endwave
+`
+	_, err := ParseSpec(strings.NewReader(spec))
+	assert.NotNil(err)
+	assert.Contains(err.Error(), "must have stack info")
+
+	_, err = ParseSpec(strings.NewReader(spec), DefaultStackSize(0x1000))
+	assert.NotNil(err)
+	assert.Contains(err.Error(), "Segment codeStack is already defined")
+}
+
+const sharedIncludeSpec = `
+beginseg
+  name "code"
+  flags BOOT OBJECT
+  entry boot
+  stack bootStack
+  include "code.o"
+  include "lib/util.o"
+endseg
+beginseg
+  name "overlay"
+  flags OBJECT
+  include "overlay.o"
+  include "lib/../lib/util.o"
+endseg
+beginseg
+  name "blob"
+  flags RAW
+  include "code.o"
+endseg
+beginwave
+  name "game"
+  include "code"
+  include "overlay"
+  include "blob"
+endwave
+`
+
+func TestSharedObjectIncludeIsWarnedAbout(t *testing.T) {
+	assert := assert.New(t)
+	logs := captureLogs(t, log.WarnLevel)
+	_, err := ParseSpec(strings.NewReader(sharedIncludeSpec))
+	assert.Nil(err)
+	assert.Contains(logs.String(), "Object lib/util.o is included by more than one segment of wave game, code, overlay; its symbols will be defined more than once.")
+	// A RAW segment including an object's file does not link its symbols.
+	assert.NotContains(logs.String(), "Object code.o")
+
+	_, err = ParseSpec(strings.NewReader(sharedIncludeSpec), Strict())
+	assert.EqualError(err, "<spec>:21:1: Object lib/util.o is included by more than one segment of wave game: code, overlay.")
+}
+
+func TestObjectSharedAcrossWavesIsNotWarnedAbout(t *testing.T) {
+	assert := assert.New(t)
+	logs := captureLogs(t, log.WarnLevel)
+	_, err := ParseSpec(strings.NewReader(`
+beginseg
+  name "code"
+  flags BOOT OBJECT
+  entry boot
+  stack bootStack
+  include "code.o"
+  include "lib/util.o"
+endseg
+beginseg
+  name "code2"
+  flags BOOT OBJECT
+  entry boot
+  stack bootStack
+  include "code2.o"
+  include "lib/util.o"
+endseg
+beginseg
+  name "unused"
+  flags OBJECT
+  include "lib/util.o"
+endseg
+beginwave
+  name "game"
+  include "code"
+endwave
+beginwave
+  name "demo"
+  include "code2"
+endwave
+`), Strict())
+	assert.Nil(err)
+	assert.NotContains(logs.String(), "lib/util.o")
+}
+
+func TestTrailingContentAfterLastWaveIsReported(t *testing.T) {
+	assert := assert.New(t)
+	_, err := ParseSpec(strings.NewReader(pipelineTestSpec+"/* done */\nendwave junk\n"), Filename("game.spec"))
+	specErr, ok := err.(*SpecError)
+	assert.True(ok)
+	assert.Equal(14, specErr.Line)
+	assert.EqualError(err, `game.spec:14:1: unexpected "endwave" after the endwave on line 12; only beginseg, beginwave, romsize, fill or comments may follow it`)
+
+	// Comments and blank lines may still follow the last wave.
+	_, err = ParseSpec(strings.NewReader(pipelineTestSpec + "\n// end of spec\n/* really */\n\n"))
+	assert.Nil(err)
+	// A wave left unfinished is still reported as such.
+	_, err = ParseSpec(strings.NewReader(pipelineTestSpec + "beginwave\n  name \"extra\"\n"))
+	assert.NotNil(err)
+	assert.NotContains(err.Error(), "may follow it")
+
+	// Segments may follow waves, so a misspelt one is not stray content,
+	// and under strict gets its suggestion.
+	_, err = ParseSpec(strings.NewReader(pipelineTestSpec+"begnseg\n  name \"extra\"\nendseg\n"), Strict())
+	assert.NotNil(err)
+	assert.NotContains(err.Error(), "may follow it")
+	assert.Contains(err.Error(), "did you mean 'beginseg'?")
+	// Stray content between two segments is reported after the first.
+	_, err = ParseSpec(strings.NewReader("beginseg\n  name \"a\"\n  flags OBJECT\nendseg\n42\nbeginseg\n  name \"b\"\n  flags OBJECT\nendseg\n"))
+	assert.EqualError(err, `<spec>:5:1: unexpected "42" after the endseg on line 4; only beginseg, beginwave, romsize, fill or comments may follow it`)
+}
+
+func TestIncludeAlignOnlyFollowsIncludeOnItsLine(t *testing.T) {
+	assert := assert.New(t)
+	spec, err := ParseSpec(strings.NewReader(`
+beginseg
+  name "data"
+  flags RAW
+  include "a.bin" align 16
+  include "b.bin"
+  align 32
+  include "c.bin"   align   0x40
+endseg
+beginwave
+  name "game"
+  include "data"
+endwave
+`))
+	assert.Nil(err)
+	seg := spec.Waves[0].RawSegments[0]
+	assert.Equal(map[string]uint64{"a.bin": 16, "c.bin": 0x40}, seg.IncludeAlign)
+	assert.Equal(uint64(32), seg.Align)
+
+	_, err = ParseSpec(strings.NewReader("beginseg\n  name \"data\"\n  flags RAW\n  include \"a.bin\" align 12\nendseg\n"))
+	assert.EqualError(err, "<spec>:1:1: Alignment 0xc of include a.bin is not a power of two.")
+	_, err = ParseSpec(strings.NewReader("beginseg\n  name \"data\"\n  flags RAW\n  include \"a.bin\" align x\nendseg\n"))
+	assert.NotNil(err)
+	_, err = ParseSpec(strings.NewReader("beginseg\n  name \"data\"\n  flags RAW\n  include \"a.bin\"\nendseg\nbeginwave\n  name \"game\"\n  include \"data\" align 16\nendwave\n"))
+	assert.EqualError(err, "<spec>:6:1: Segment data is included in a wave with an alignment, which only includes in RAW segments can have.")
+}
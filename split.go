@@ -0,0 +1,107 @@
+package spicy
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/trhodeos/n64rom"
+)
+
+// dataRomStartSymbol is defined by the linker script as the ROM offset the
+// data image starts at. The boundary symbols of RAW segments still give
+// offsets into the whole ROM, so code finds a segment in the data image by
+// subtracting it.
+const dataRomStartSymbol = "_DataRomStart"
+
+// CodeDataSplit is a built ROM split into a code image and a data image,
+// for loaders that DMA the two from separate files.
+type CodeDataSplit struct {
+	// Code is a ROM of the header, bootcode and OBJECT segments, which stay
+	// at the offsets they were linked at, padded as the whole ROM was.
+	Code       *Rom
+	CodeLayout []SegmentLayout
+	// Data holds the RAW segments, from DataBase on. DataLayout gives where
+	// each is within it.
+	Data       []byte
+	DataLayout []SegmentLayout
+	// DataBase is the ROM offset the data image starts at, as
+	// _DataRomStart gives it to code.
+	DataBase uint64
+}
+
+// SplitCodeData splits the ROM of result, built with opts, into its code
+// and its data. The data image starts where _DataRomStart, defined by the
+// linker script after the last OBJECT segment, says, so every RAW segment
+// must come after all the code, as it does unless a romoffset places one
+// among the OBJECT segments. Bytes after the last segment are left out of
+// the data image; the code image is padded to opts.RomSize and given the
+// footer as the whole ROM was.
+func SplitCodeData(result *BuildResult, opts BuildOptions) (*CodeDataSplit, error) {
+	raw := map[string]bool{}
+	for _, w := range result.Spec.Waves {
+		for _, seg := range w.RawSegments {
+			raw[w.Name+"\x00"+seg.Name] = true
+		}
+	}
+	split := &CodeDataSplit{}
+	codeEnd := uint64(n64rom.CodeStart)
+	var dataEnd uint64
+	var lastCode SegmentLayout
+	for _, l := range result.Layout {
+		if raw[l.Wave+"\x00"+l.Name] {
+			if l.RomEnd > dataEnd {
+				dataEnd = l.RomEnd
+			}
+			split.DataLayout = append(split.DataLayout, l)
+			continue
+		}
+		if l.RomEnd > codeEnd {
+			codeEnd = l.RomEnd
+			lastCode = l
+		}
+		split.CodeLayout = append(split.CodeLayout, l)
+	}
+	for i, object := range result.Objects {
+		symbols, err := readSymbols(object.Linked)
+		if err != nil {
+			return nil, fmt.Errorf("could not read symbols of wave %s: %v", object.Wave, err)
+		}
+		base, ok := symbols[dataRomStartSymbol]
+		if !ok {
+			return nil, fmt.Errorf("wave %s does not define %s", object.Wave, dataRomStartSymbol)
+		}
+		if i > 0 && base != split.DataBase {
+			return nil, fmt.Errorf("wave %s starts its data at 0x%x but wave %s at 0x%x, so code and data cannot be split", object.Wave, base, result.Objects[0].Wave, split.DataBase)
+		}
+		split.DataBase = base
+	}
+	if len(result.Objects) == 0 {
+		split.DataBase = codeEnd
+	}
+	for _, l := range split.DataLayout {
+		if l.RomEnd > l.RomStart && (l.RomStart < codeEnd || l.RomStart < split.DataBase) {
+			return nil, fmt.Errorf("RAW segment %s at 0x%x comes before the end of OBJECT segment %s at 0x%x, so code and data cannot be split", l.Name, l.RomStart, lastCode.Name, codeEnd)
+		}
+	}
+	if split.DataBase < codeEnd {
+		return nil, fmt.Errorf("OBJECT segment %s ends at 0x%x, after the data image starts at 0x%x, so code and data cannot be split", lastCode.Name, codeEnd, split.DataBase)
+	}
+	if dataEnd < split.DataBase {
+		dataEnd = split.DataBase
+	}
+	image := result.Rom.Bytes()
+	code, err := LoadRom(bytes.NewReader(image[:codeEnd]), result.Rom.fill)
+	if err != nil {
+		return nil, err
+	}
+	if err := padRom(code, opts); err != nil {
+		return nil, err
+	}
+	split.Code = code
+	split.Data = append([]byte{}, image[split.DataBase:dataEnd]...)
+	for i := range split.DataLayout {
+		split.DataLayout[i].RomStart -= split.DataBase
+		split.DataLayout[i].RomEnd -= split.DataBase
+	}
+	return split, nil
+}
@@ -0,0 +1,89 @@
+package spicy
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/trhodeos/n64rom"
+)
+
+const splitTestSpec = `
+beginseg
+  name "code"
+  flags BOOT OBJECT
+  entry boot
+  stack bootStack
+  include "code.o"
+endseg
+beginseg
+  name "level"
+  flags RAW
+  include "level.bin"
+endseg
+beginwave
+  name "game"
+  include "code"
+  include "level"
+endwave
+`
+
+func buildSplitTestRom(t *testing.T, levelStart uint64, opts BuildOptions) *BuildResult {
+	assert := assert.New(t)
+	chdirTemp(t)
+	assert.Nil(ioutil.WriteFile("level.bin", bytes.Repeat([]byte{0xda}, 8), 0644))
+	symbols := segmentSymbols(map[string]uint64{}, "code", 0x1000, 0x80000450, 8)
+	symbols = segmentSymbols(symbols, "level", levelStart, 0, 8)
+	symbols[dataRomStartSymbol] = 0x1008
+	image := append(bytes.Repeat([]byte{0xc0}, 8), make([]byte, levelStart-0x1008)...)
+	image = append(image, bytes.Repeat([]byte{0xda}, 8)...)
+	p := newFakePipeline(symbols, image)
+	p.BuildOptions = opts
+	result, err := p.Run(strings.NewReader(splitTestSpec))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return result
+}
+
+func TestSplitCodeDataSeparatesSegments(t *testing.T) {
+	assert := assert.New(t)
+	result := buildSplitTestRom(t, 0x1010, BuildOptions{})
+	split, err := SplitCodeData(result, BuildOptions{})
+	assert.Nil(err)
+
+	assert.Equal([]SegmentLayout{{Wave: "game", Name: "code", RomStart: 0x1000, RomEnd: 0x1008, VramStart: 0x80000450, VramEnd: 0x80000458}}, split.CodeLayout)
+	code := split.Code.Bytes()
+	assert.Equal(0x1008, len(code))
+	assert.Equal(bytes.Repeat([]byte{0xc0}, 8), code[n64rom.CodeStart:])
+	assert.NotContains(string(code), string([]byte{0xda}))
+	crc1, _ := ComputeChecksum(code)
+	assert.Equal(crc1, binary.BigEndian.Uint32(code[ChecksumOffset:]))
+
+	// The data image starts at _DataRomStart, right after the code, so
+	// the gap before the level is kept.
+	assert.Equal(uint64(0x1008), split.DataBase)
+	assert.Equal([]SegmentLayout{{Wave: "game", Name: "level", RomStart: 8, RomEnd: 0x10}}, split.DataLayout)
+	assert.Equal(append(make([]byte, 8), bytes.Repeat([]byte{0xda}, 8)...), split.Data)
+}
+
+func TestSplitCodeDataKeepsRomPadding(t *testing.T) {
+	assert := assert.New(t)
+	opts := BuildOptions{RomSize: 0x2000}
+	result := buildSplitTestRom(t, 0x1008, opts)
+	split, err := SplitCodeData(result, opts)
+	assert.Nil(err)
+	assert.Equal(0x2000, len(split.Code.Bytes()))
+	assert.Equal(bytes.Repeat([]byte{0xda}, 8), split.Data)
+}
+
+func TestSplitCodeDataRejectsDataAmongCode(t *testing.T) {
+	assert := assert.New(t)
+	result := buildSplitTestRom(t, 0x1010, BuildOptions{})
+	result.Layout[1].RomStart, result.Layout[1].RomEnd = 0x1004, 0x100c
+	_, err := SplitCodeData(result, BuildOptions{})
+	assert.EqualError(err, "RAW segment level at 0x1004 comes before the end of OBJECT segment code at 0x1008, so code and data cannot be split")
+}
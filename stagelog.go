@@ -0,0 +1,45 @@
+package spicy
+
+import (
+	"fmt"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// PipelineStages lists the stages of a build, in the order they run.
+var PipelineStages = []string{"preprocess", "parse", "raw", "entry", "link", "binarize"}
+
+var logStages = map[string]bool{}
+
+// LogStages enables debug logging for just the named stages, even when the
+// standard logger is quieter than that.
+func LogStages(stages []string) error {
+	enabled := map[string]bool{}
+	for _, stage := range stages {
+		known := false
+		for _, s := range PipelineStages {
+			known = known || s == stage
+		}
+		if !known {
+			return NewUsageError("unknown stage %q; stages are %s", stage, strings.Join(PipelineStages, ", "))
+		}
+		enabled[stage] = true
+	}
+	logStages = enabled
+	return nil
+}
+
+// stageDebugf logs a debug message from stage, if debug logging is enabled
+// for it or for everything.
+func stageDebugf(stage string, format string, args ...interface{}) {
+	if log.IsLevelEnabled(log.DebugLevel) {
+		log.Debugf(format, args...)
+		return
+	}
+	if logStages[stage] {
+		std := log.StandardLogger()
+		logger := &log.Logger{Out: std.Out, Formatter: std.Formatter, Hooks: make(log.LevelHooks), Level: log.DebugLevel}
+		logger.WithField("stage", stage).Debug(fmt.Sprintf(format, args...))
+	}
+}
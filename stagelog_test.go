@@ -0,0 +1,37 @@
+package spicy
+
+import (
+	"strings"
+	"testing"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLogStagesOnlyLogsSelectedStages(t *testing.T) {
+	assert := assert.New(t)
+	logs := captureLogs(t, log.WarnLevel)
+	assert.Nil(LogStages([]string{"link"}))
+	t.Cleanup(func() { LogStages(nil) })
+
+	spec, err := ParseSpec(strings.NewReader(pipelineTestSpec))
+	assert.Nil(err)
+	w := spec.Waves[0]
+	_, err = createLdScript(w)
+	assert.Nil(err)
+	_, err = createEntrySource(w.GetBootSegment())
+	assert.Nil(err)
+
+	assert.Contains(logs.String(), "Ld script generated")
+	assert.Contains(logs.String(), "stage=link")
+	assert.NotContains(logs.String(), "Created entry script")
+	assert.NotContains(logs.String(), "Parsed:")
+}
+
+func TestLogStagesRejectsUnknownStages(t *testing.T) {
+	assert := assert.New(t)
+	err := LogStages([]string{"link", "lnk"})
+	assert.NotNil(err)
+	assert.Contains(err.Error(), `unknown stage "lnk"`)
+	assert.False(logStages["link"])
+}
@@ -0,0 +1,35 @@
+package spicy
+
+import (
+	"github.com/trhodeos/n64rom"
+)
+
+// stubLoop is a MIPS branch to itself, followed by the nop in its delay slot.
+var stubLoop = []byte{0x10, 0x00, 0xff, 0xff, 0x00, 0x00, 0x00, 0x00}
+
+// NewStubRom returns a ROM whose only code is a loop at the boot address,
+// for checking that a cartridge or emulator boots without building a spec.
+// bootcode, if given, is written to the bootcode region; otherwise the
+// region holds the same loop. The ROM covers the whole range the header
+// checksum is computed over.
+//
+// The loop does none of the setup real hardware needs: without an IPL3 in
+// bootcode the console never reaches it, and even with one nothing sets up
+// a stack, interrupts or the other hardware a game's entry point would.
+func NewStubRom(bootcode []byte, fill byte) (*Rom, error) {
+	if len(bootcode) == 0 {
+		bootcode = stubLoop
+	}
+	rom, err := NewBlankRom(fill)
+	if err != nil {
+		return nil, err
+	}
+	if err := rom.SetBootcode(bootcode); err != nil {
+		return nil, err
+	}
+	if err := rom.WriteAt(stubLoop, n64rom.CodeStart); err != nil {
+		return nil, err
+	}
+	rom.Pad(checksumStart + checksumLength)
+	return rom, nil
+}
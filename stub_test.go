@@ -0,0 +1,40 @@
+package spicy
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/trhodeos/n64rom"
+)
+
+func TestStubRomHasValidHeaderAndBootcode(t *testing.T) {
+	assert := assert.New(t)
+	rom, err := NewStubRom(nil, 0)
+	assert.Nil(err)
+	b := readRom(t, rom)
+	assert.Equal(checksumStart+checksumLength, len(b))
+
+	header, err := n64rom.ParseHeader(bytes.NewReader(b), binary.BigEndian)
+	assert.Nil(err)
+	assert.Equal(uint32(0x80000400), header.BootAddress)
+	crc1, crc2 := ComputeChecksum(b)
+	assert.Equal(crc1, binary.BigEndian.Uint32(b[ChecksumOffset:]))
+	assert.Equal(crc2, binary.BigEndian.Uint32(b[ChecksumOffset+4:]))
+
+	assert.NotEqual(make([]byte, checksumStart-bootcodeStart), b[bootcodeStart:checksumStart])
+	assert.Equal(stubLoop, b[n64rom.CodeStart:n64rom.CodeStart+len(stubLoop)])
+}
+
+func TestStubRomUsesGivenBootcode(t *testing.T) {
+	assert := assert.New(t)
+	bootcode := bytes.Repeat([]byte{0xab}, checksumStart-bootcodeStart)
+	rom, err := NewStubRom(bootcode, 0)
+	assert.Nil(err)
+	b := readRom(t, rom)
+	assert.Equal(bootcode, b[bootcodeStart:checksumStart])
+
+	_, err = NewStubRom(make([]byte, checksumStart), 0)
+	assert.NotNil(err)
+}
@@ -0,0 +1,73 @@
+package spicy
+
+import (
+	"fmt"
+	"strings"
+)
+
+// DefaultSymbolFormat is the libultra naming of segment boundary symbols,
+// as in _codeSegmentRomStart.
+const DefaultSymbolFormat = "_%sSegmentRomStart"
+
+// symbolFormatMarkers are the spellings of the ROM start symbol a symbol
+// format may use, each with how the other boundary symbols are spelled in
+// its place.
+var symbolFormatMarkers = []struct {
+	marker string
+	style  func(kind string) string
+}{
+	{"RomStart", func(kind string) string { return kind }},
+	{"ROM_START", func(kind string) string { return snakeCase(kind) }},
+	{"rom_start", func(kind string) string { return strings.ToLower(snakeCase(kind)) }},
+}
+
+// snakeCase turns a boundary symbol kind such as RomStart into ROM_START.
+func snakeCase(kind string) string {
+	var b strings.Builder
+	for i, r := range kind {
+		if i > 0 && r >= 'A' && r <= 'Z' {
+			b.WriteByte('_')
+		}
+		b.WriteRune(r)
+	}
+	return strings.ToUpper(b.String())
+}
+
+// CheckSymbolFormat returns an error unless format can name boundary
+// symbols. It must contain %s exactly once, standing for the segment's
+// symbol name, and spell out the ROM start symbol as RomStart, ROM_START or
+// rom_start; the other symbols are named by replacing it, in the same
+// style, so "%s_ROM_START" names the BSS size symbol of segment code
+// code_BSS_SIZE.
+func CheckSymbolFormat(format string) error {
+	if strings.Count(format, "%s") != 1 || strings.Count(format, "%") != 1 {
+		return fmt.Errorf("symbol format %q must contain %%s exactly once, and no other %%", format)
+	}
+	for _, r := range strings.Replace(format, "%s", "", 1) {
+		if r != '_' && (r < '0' || r > '9') && (r < 'a' || r > 'z') && (r < 'A' || r > 'Z') {
+			return fmt.Errorf("symbol format %q may only contain letters, digits and underscores besides %%s", format)
+		}
+	}
+	for _, m := range symbolFormatMarkers {
+		if strings.Contains(format, m.marker) {
+			return nil
+		}
+	}
+	return fmt.Errorf("symbol format %q must name the ROM start symbol, as RomStart, ROM_START or rom_start", format)
+}
+
+// BoundarySymbol returns the name of the segment's boundary symbol of the
+// given kind, such as RomStart or BssSize, following its SymbolFormat.
+func (s *Segment) BoundarySymbol(kind string) string {
+	format := s.SymbolFormat
+	if format == "" {
+		format = DefaultSymbolFormat
+	}
+	for _, m := range symbolFormatMarkers {
+		if strings.Contains(format, m.marker) {
+			format = strings.Replace(format, m.marker, m.style(kind), 1)
+			break
+		}
+	}
+	return strings.Replace(format, "%s", s.SymbolName(), 1)
+}
@@ -0,0 +1,30 @@
+package spicy
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCheckSymbolFormat(t *testing.T) {
+	assert := assert.New(t)
+	for _, format := range []string{DefaultSymbolFormat, "%s_ROM_START", "__%s_rom_start", "seg_%s_RomStart"} {
+		assert.Nil(CheckSymbolFormat(format), format)
+	}
+	for _, format := range []string{"", "ROM_START", "%s_%s_ROM_START", "%d_ROM_START", "%s_ROM_START%%", "%s.ROM_START", "%s_START"} {
+		assert.NotNil(CheckSymbolFormat(format), format)
+	}
+}
+
+func TestBoundarySymbolFollowsFormat(t *testing.T) {
+	assert := assert.New(t)
+	seg := &Segment{Name: "code", SymbolPrefix: "game_"}
+	assert.Equal("_game_codeSegmentRomStart", seg.BoundarySymbol("RomStart"))
+	assert.Equal("_game_codeSegmentBssSize", seg.BoundarySymbol("BssSize"))
+	seg.SymbolFormat = "%s_ROM_START"
+	assert.Equal("game_code_ROM_START", seg.BoundarySymbol("RomStart"))
+	assert.Equal("game_code_BSS_SIZE", seg.BoundarySymbol("BssSize"))
+	assert.Equal("game_code_END", seg.BoundarySymbol("End"))
+	seg.SymbolFormat = "__%s_rom_start"
+	assert.Equal("__game_code_text_start", seg.BoundarySymbol("TextStart"))
+}
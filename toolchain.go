@@ -0,0 +1,69 @@
+package spicy
+
+import (
+	"fmt"
+	"io"
+	"os/exec"
+	"strings"
+)
+
+// Toolchain names the command run for each tool spicy uses.
+type Toolchain struct {
+	Cpp     string
+	Ld      string
+	As      string
+	Objcopy string
+}
+
+// NewToolchain returns the toolchain whose commands all share prefix, such
+// as "mips64-elf-". cpp is run through gcc.
+func NewToolchain(prefix string) Toolchain {
+	return Toolchain{
+		Cpp:     prefix + "gcc",
+		Ld:      prefix + "ld",
+		As:      prefix + "as",
+		Objcopy: prefix + "objcopy",
+	}
+}
+
+// Identity describes the toolchain as exactly as it can be told apart from
+// another: the full path of each command and what it prints for --version.
+// Caches mix it into their keys, so that outputs of one toolchain are never
+// reused by another.
+func (t Toolchain) Identity() string {
+	var b strings.Builder
+	for _, command := range []string{t.Cpp, t.Ld, t.As, t.Objcopy} {
+		path, err := exec.LookPath(command)
+		if err != nil {
+			path = command
+		}
+		version, _ := exec.Command(path, "--version").Output()
+		fmt.Fprintf(&b, "%s\x00%s\x00", path, version)
+	}
+	return b.String()
+}
+
+// Print writes the full path of each tool's command to w, one per line. It
+// returns an error naming the first command that could not be found, after
+// printing the rest.
+func (t Toolchain) Print(w io.Writer) error {
+	var missing error
+	for _, tool := range []struct{ name, command string }{
+		{"cpp", t.Cpp},
+		{"ld", t.Ld},
+		{"as", t.As},
+		{"objcopy", t.Objcopy},
+	} {
+		path, err := exec.LookPath(tool.command)
+		if err != nil {
+			if missing == nil {
+				missing = fmt.Errorf("could not find %s: %w", tool.name, err)
+			}
+			path = "not found"
+		}
+		if _, err := fmt.Fprintf(w, "%s\t%s\t%s\n", tool.name, tool.command, path); err != nil {
+			return err
+		}
+	}
+	return missing
+}
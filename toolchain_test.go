@@ -0,0 +1,54 @@
+package spicy
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPrintToolchainResolvesPaths(t *testing.T) {
+	assert := assert.New(t)
+	dir := t.TempDir()
+	for _, tool := range []string{"gcc", "ld", "as", "objcopy"} {
+		assert.Nil(ioutil.WriteFile(filepath.Join(dir, "test-"+tool), []byte("#!/bin/sh\n"), 0755))
+	}
+	oldPath := os.Getenv("PATH")
+	os.Setenv("PATH", dir)
+	defer os.Setenv("PATH", oldPath)
+
+	out := &bytes.Buffer{}
+	assert.Nil(NewToolchain("test-").Print(out))
+	assert.Equal("cpp\ttest-gcc\t"+filepath.Join(dir, "test-gcc")+"\n"+
+		"ld\ttest-ld\t"+filepath.Join(dir, "test-ld")+"\n"+
+		"as\ttest-as\t"+filepath.Join(dir, "test-as")+"\n"+
+		"objcopy\ttest-objcopy\t"+filepath.Join(dir, "test-objcopy")+"\n", out.String())
+
+	tc := NewToolchain("test-")
+	tc.Ld = "missing-ld"
+	out.Reset()
+	err := tc.Print(out)
+	assert.True(errors.Is(err, exec.ErrNotFound))
+	assert.Contains(out.String(), "ld\tmissing-ld\tnot found\n")
+	assert.Contains(out.String(), "objcopy\ttest-objcopy\t")
+}
+
+func TestToolchainIdentityChangesWithVersion(t *testing.T) {
+	assert := assert.New(t)
+	dir := t.TempDir()
+	ld := filepath.Join(dir, "ld")
+	assert.Nil(ioutil.WriteFile(ld, []byte("#!/bin/sh\necho 'GNU ld 2.34'\n"), 0755))
+	tc := Toolchain{Cpp: ld, Ld: ld, As: ld, Objcopy: ld}
+	before := tc.Identity()
+	assert.Contains(before, "GNU ld 2.34")
+
+	assert.Nil(ioutil.WriteFile(ld, []byte("#!/bin/sh\necho 'GNU ld 2.40'\n"), 0755))
+	assert.NotEqual(before, tc.Identity())
+	tc.Ld = filepath.Join(dir, "missing-ld")
+	assert.Contains(tc.Identity(), tc.Ld)
+}
@@ -0,0 +1,93 @@
+package spicy
+
+import (
+	"encoding/json"
+	"io"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// TraceEvent is one entry of a build trace: a stage finishing, a command
+// being run or a file being written. The command of a command event is the
+// tool the build ran, as ld, as, objcopy, cc or cpp, followed by its
+// arguments.
+type TraceEvent struct {
+	Time     time.Time     `json:"time"`
+	Event    string        `json:"event"`
+	Stage    string        `json:"stage,omitempty"`
+	Wave     string        `json:"wave,omitempty"`
+	Command  []string      `json:"command,omitempty"`
+	Path     string        `json:"path,omitempty"`
+	Duration time.Duration `json:"duration_ns,omitempty"`
+}
+
+// Tracer writes a TraceEvent for every stage, command and file of the
+// builds it is given to in BuildOptions.Tracer. A nil Tracer traces
+// nothing.
+type Tracer struct {
+	mu  sync.Mutex
+	enc *json.Encoder
+}
+
+// NewTracer returns a Tracer writing each event to w as a line of JSON.
+func NewTracer(w io.Writer) *Tracer {
+	return &Tracer{enc: json.NewEncoder(w)}
+}
+
+func (t *Tracer) event(e TraceEvent) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.enc == nil {
+		return
+	}
+	e.Time = time.Now()
+	if err := t.enc.Encode(e); err != nil {
+		log.Warnf("Could not write trace event: %v", err)
+		t.enc = nil
+	}
+}
+
+// Stop stops t writing events, so that what it writes to can be closed
+// while builds may still be running.
+func (t *Tracer) Stop() {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.enc = nil
+}
+
+// File records that path was written, for outputs written by callers of the
+// library rather than the library itself.
+func (t *Tracer) File(path string) {
+	t.event(TraceEvent{Event: "file", Path: path})
+}
+
+// TracingRunner records each call it passes on as a command event.
+type TracingRunner struct {
+	runner Runner
+	tracer *Tracer
+	tool   string
+}
+
+// WithTrace returns middleware recording each call in t as a run of tool.
+// With a nil t, it leaves the runner as it is.
+func WithTrace(t *Tracer, tool string) RunnerMiddleware {
+	return func(r Runner) Runner {
+		if t == nil {
+			return r
+		}
+		return TracingRunner{runner: r, tracer: t, tool: tool}
+	}
+}
+
+func (e TracingRunner) Run(r io.Reader, args []string) (io.Reader, error) {
+	e.tracer.event(TraceEvent{Event: "command", Command: append([]string{e.tool}, args...)})
+	return e.runner.Run(r, args)
+}
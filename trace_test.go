@@ -0,0 +1,69 @@
+package spicy
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTraceRecordsBuildInOrder(t *testing.T) {
+	assert := assert.New(t)
+	chdirTemp(t)
+	trace := &bytes.Buffer{}
+	p := newTestPipeline()
+	cpp, ld, as, objcopy := NewRecordingRunner(p.Cpp), NewRecordingRunner(p.Ld), NewRecordingRunner(p.As), NewRecordingRunner(p.Objcopy)
+	p.Cpp, p.Ld, p.As, p.Objcopy = cpp, ld, as, objcopy
+	p.BuildOptions.SaveEntryAsm = "entry.s"
+	p.BuildOptions.Tracer = NewTracer(trace)
+	_, err := p.Run(strings.NewReader(pipelineTestSpec))
+	assert.Nil(err)
+	var untraced *Tracer
+	untraced.File("ignored")
+	untraced.Stop()
+
+	var events []TraceEvent
+	for _, line := range strings.Split(strings.TrimSpace(trace.String()), "\n") {
+		var e TraceEvent
+		assert.Nil(json.Unmarshal([]byte(line), &e), line)
+		events = append(events, e)
+	}
+	var timeline []string
+	commands := map[string][][]string{}
+	for i, e := range events {
+		switch {
+		case e.Event == "stage":
+			timeline = append(timeline, e.Stage)
+		case e.Event == "file" && e.Path == "entry.s":
+			timeline = append(timeline, "entry.s")
+		case e.Event == "command":
+			commands[e.Command[0]] = append(commands[e.Command[0]], e.Command[1:])
+		}
+		if i > 0 {
+			assert.False(e.Time.Before(events[i-1].Time))
+		}
+	}
+	assert.Equal([]string{"preprocess", "parse", "raw", "entry.s", "entry", "link", "binarize"}, timeline)
+	// Every command the build ran is traced, as the tool it ran it as.
+	assert.Equal(map[string][][]string{
+		"cpp":     cpp.Calls(),
+		"ld":      ld.Calls(),
+		"as":      as.Calls(),
+		"objcopy": objcopy.Calls(),
+	}, commands)
+	assert.NotEmpty(ld.Calls())
+	assert.NotEmpty(objcopy.Calls())
+}
+
+func TestStoppedTracerWritesNothing(t *testing.T) {
+	assert := assert.New(t)
+	trace := &bytes.Buffer{}
+	tracer := NewTracer(trace)
+	tracer.File("before")
+	tracer.Stop()
+	tracer.File("after")
+	assert.Equal(1, strings.Count(trace.String(), "\n"))
+	assert.Contains(trace.String(), "before")
+}
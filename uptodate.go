@@ -0,0 +1,48 @@
+package spicy
+
+import (
+	"os"
+)
+
+// InputFiles returns every file the spec's ROM is built from: the spec
+// sources themselves and each segment's includes, or the archives they are
+// members of.
+func (s *Spec) InputFiles() []string {
+	files := append([]string{}, s.Sources...)
+	seen := map[string]bool{}
+	for _, file := range files {
+		seen[file] = true
+	}
+	for _, w := range s.Waves {
+		for _, seg := range append(append([]*Segment{}, w.ObjectSegments...), w.RawSegments...) {
+			for _, include := range seg.Includes {
+				include = includeFile(include)
+				if !seen[include] {
+					seen[include] = true
+					files = append(files, include)
+				}
+			}
+		}
+	}
+	return files
+}
+
+// UpToDate reports whether output exists and is newer than every one of
+// inputs, as make would decide. A missing input is never up to date, so the
+// build runs and reports it.
+func UpToDate(output string, inputs []string) (bool, error) {
+	info, err := os.Stat(output)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	for _, input := range inputs {
+		inputInfo, err := os.Stat(input)
+		if err != nil || inputInfo.ModTime().After(info.ModTime()) {
+			return false, nil
+		}
+	}
+	return true, nil
+}
@@ -0,0 +1,54 @@
+package spicy
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUpToDateFollowsSpecInputs(t *testing.T) {
+	assert := assert.New(t)
+	dir := t.TempDir()
+	include := filepath.Join(dir, "data.bin")
+	specPath := filepath.Join(dir, "game.spec")
+	rom := filepath.Join(dir, "rom.n64")
+	assert.Nil(ioutil.WriteFile(include, []byte{1, 2, 3, 4}, 0644))
+	assert.Nil(ioutil.WriteFile(specPath, []byte(`
+beginseg
+  name "data"
+  flags RAW
+  include "`+include+`"
+endseg
+beginwave
+  name "game"
+  include "data"
+endwave
+`), 0644))
+	p := &Pipeline{Cpp: &echoRunner{}}
+	spec, err := p.ParseFiles(specPath)
+	assert.Nil(err)
+	inputs := spec.InputFiles()
+	assert.Equal([]string{specPath, include}, inputs)
+
+	upToDate, err := UpToDate(rom, inputs)
+	assert.Nil(err)
+	assert.False(upToDate)
+
+	past := time.Now().Add(-time.Hour)
+	assert.Nil(os.Chtimes(specPath, past, past))
+	assert.Nil(os.Chtimes(include, past, past))
+	assert.Nil(ioutil.WriteFile(rom, nil, 0644))
+	upToDate, err = UpToDate(rom, inputs)
+	assert.Nil(err)
+	assert.True(upToDate)
+
+	future := time.Now().Add(time.Hour)
+	assert.Nil(os.Chtimes(include, future, future))
+	upToDate, err = UpToDate(rom, inputs)
+	assert.Nil(err)
+	assert.False(upToDate)
+}